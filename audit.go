@@ -0,0 +1,313 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package membersys
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Actions recorded in the audit log.
+const (
+	AuditActionApply           = "apply"
+	AuditActionUploadAgreement = "upload_agreement"
+	AuditActionAccept          = "accept"
+	AuditActionReject          = "reject"
+	AuditActionCancel          = "cancel"
+	AuditActionCreateAccount   = "create_account"
+	AuditActionGoodbye         = "goodbye"
+	AuditActionArchive         = "archive"
+	AuditActionRestore         = "restore"
+	AuditActionEdit            = "edit"
+	AuditActionImport          = "import"
+	AuditActionMerge           = "merge"
+	AuditActionFeeReduction    = "fee_reduction"
+	AuditActionVerifyEmail     = "verify_email"
+	AuditActionConflict        = "conflict"
+)
+
+// The user who makes a change, and the address the request came from.
+// Both are recorded in the audit log.
+type Actor struct {
+	User     string
+	SourceIP string
+}
+
+// Create an audit log entry for "action", performed by "actor" on the
+// record "id" of the member with the e-mail address "subject".
+func newAuditEntry(actor *Actor, subject, id, action string,
+	now time.Time) *AuditLogEntry {
+	var entry = &AuditLogEntry{
+		Subject:   proto.String(subject),
+		Timestamp: proto.Uint64(uint64(now.Unix())),
+		Action:    proto.String(action),
+		RecordId:  proto.String(id),
+	}
+
+	if actor != nil {
+		entry.Initiator = proto.String(actor.User)
+		if len(actor.SourceIP) > 0 {
+			entry.SourceIp = proto.String(actor.SourceIP)
+		}
+	}
+
+	return entry
+}
+
+// Create an audit log entry for a record of "agreement" moving from the
+// table "src_table" to "dst_table".
+func newAuditMove(actor *Actor, agreement *MembershipAgreement,
+	id, action, src_table, dst_table string, now time.Time) *AuditLogEntry {
+	var entry = newAuditEntry(actor, agreement.GetMemberData().GetEmail(), id,
+		action, now)
+
+	if len(src_table) > 0 {
+		entry.OldValue = proto.String(src_table)
+	}
+	entry.NewValue = proto.String(dst_table)
+	return entry
+}
+
+// Create the audit log entries for merging the application "duplicate_id"
+// holding "duplicate" into the application "id" holding "agreement". The
+// merge is recorded for both subjects, unless they are the same.
+func newAuditMerge(actor *Actor, agreement, duplicate *MembershipAgreement,
+	id, duplicate_id string, now time.Time) []*AuditLogEntry {
+	var entry *AuditLogEntry
+	var entries []*AuditLogEntry
+
+	entry = newAuditMove(actor, duplicate, duplicate_id, AuditActionMerge,
+		"application", "membership_archive", now)
+	entry.Comment = proto.String("Merged into application " + id)
+	entries = append(entries, entry)
+
+	if agreement.GetMemberData().GetEmail() !=
+		duplicate.GetMemberData().GetEmail() {
+		entry = newAuditEntry(actor, agreement.GetMemberData().GetEmail(),
+			id, AuditActionMerge, now)
+		entry.Comment = proto.String("Merged application " +
+			duplicate_id + " of " + duplicate.GetMemberData().GetEmail())
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// Create an audit log entry for the upload of a membership agreement scan
+// replacing the one in "agreement". Only the hashes of the scans are
+// recorded.
+func newAuditAgreementUpload(actor *Actor, agreement *MembershipAgreement,
+	id string, agreement_data []byte, now time.Time) *AuditLogEntry {
+	var entry = newAuditEntry(actor, agreement.GetMemberData().GetEmail(), id,
+		AuditActionUploadAgreement, now)
+
+	if agreementPdfHash(agreement) != "" {
+		entry.OldValue = proto.String(agreementPdfHash(agreement))
+	}
+	entry.NewValue = proto.String(blobHash(agreement_data))
+	return entry
+}
+
+// Create an audit log entry for the decision about the fee reduction
+// requested along with "agreement", which has already been recorded in it.
+// The state of the request before the decision is given in "old_status".
+func newAuditFeeReduction(actor *Actor, agreement *MembershipAgreement,
+	id, old_status string, now time.Time) *AuditLogEntry {
+	var reduction *FeeReduction = agreement.GetFeeReduction()
+	var entry = newAuditEntry(actor, agreement.GetMemberData().GetEmail(), id,
+		AuditActionFeeReduction, now)
+	var comment string
+
+	entry.OldValue = proto.String(old_status)
+	entry.NewValue = proto.String(reduction.GetStatus())
+
+	if reduction.ValidUntil != nil {
+		comment = "Valid until " + time.Unix(
+			int64(reduction.GetValidUntil()), 0).UTC().Format("2006-01-02")
+	}
+	if reduction.GetDecisionComment() != "" {
+		if comment != "" {
+			comment += ": "
+		}
+		comment += reduction.GetDecisionComment()
+	}
+	if comment != "" {
+		entry.Comment = proto.String(comment)
+	}
+	return entry
+}
+
+// Create audit log entries for all of "fields" which differ between the
+// member data "before" and "after" of the member "id".
+func newAuditEdits(actor *Actor, id string, before, after *Member,
+	fields []string, now time.Time) []*AuditLogEntry {
+	var entries []*AuditLogEntry
+	var field string
+
+	for _, field = range fields {
+		var old_value = fmt.Sprint(memberColumnValue(before, field))
+		var new_value = fmt.Sprint(memberColumnValue(after, field))
+		var entry *AuditLogEntry
+
+		if old_value == new_value {
+			continue
+		}
+
+		entry = newAuditEntry(actor, id, id, AuditActionEdit, now)
+		entry.Field = proto.String(field)
+		entry.OldValue = proto.String(old_value)
+		entry.NewValue = proto.String(new_value)
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// Create the audit log entries for the member with the e-mail address
+// "subject" recording that the changes logged as "entries" haven't been
+// applied, since the record had been modified concurrently.
+func newAuditConflict(actor *Actor, subject string,
+	entries []*AuditLogEntry, now time.Time) []*AuditLogEntry {
+	var entry *AuditLogEntry
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	entry = newAuditEntry(actor, subject, entries[0].GetRecordId(),
+		AuditActionConflict, now)
+	entry.Comment = proto.String(fmt.Sprintf("Entries %d to %d have not "+
+		"been applied, since the record had been modified concurrently",
+		entries[0].GetSequence(), entries[len(entries)-1].GetSequence()))
+	return []*AuditLogEntry{entry}
+}
+
+// Copy "entries" for the audit log of "subject". Changes of the e-mail
+// address of a member are recorded under both the old and the new
+// address, so the log can be followed across the change.
+func auditEntriesFor(subject string, entries []*AuditLogEntry) []*AuditLogEntry {
+	var rv []*AuditLogEntry
+	var entry *AuditLogEntry
+
+	for _, entry = range entries {
+		var copied = proto.Clone(entry).(*AuditLogEntry)
+
+		copied.Subject = proto.String(subject)
+		rv = append(rv, copied)
+	}
+
+	return rv
+}
+
+// Compute the hash of "entry", which covers all of its fields except the
+// hash itself.
+func AuditEntryHash(entry *AuditLogEntry) ([]byte, error) {
+	var unhashed = proto.Clone(entry).(*AuditLogEntry)
+	var sum [sha256.Size]byte
+	var data []byte
+	var err error
+
+	unhashed.Hash = nil
+	if data, err = proto.Marshal(unhashed); err != nil {
+		return nil, err
+	}
+
+	sum = sha256.Sum256(data)
+	return sum[:], nil
+}
+
+// Append "entries" to the audit log whose most recent entry is "last",
+// or which is empty if "last" is nil, by filling in their sequence numbers
+// and hashes.
+func chainAuditEntries(last *AuditLogEntry, entries []*AuditLogEntry) error {
+	var sequence uint64 = last.GetSequence()
+	var previous []byte = last.GetHash()
+	var entry *AuditLogEntry
+	var err error
+
+	for _, entry = range entries {
+		sequence++
+		entry.Sequence = proto.Uint64(sequence)
+		entry.PreviousHash = previous
+		if entry.Hash, err = AuditEntryHash(entry); err != nil {
+			return err
+		}
+		previous = entry.Hash
+	}
+
+	return nil
+}
+
+// Check that "entries", the complete audit log of a single member, has
+// not been tampered with: no entries may be missing, and every entry has
+// to match its hash and the hash recorded in the following entry.
+func VerifyAuditLog(entries []*AuditLogEntry) error {
+	var previous []byte
+	var entry *AuditLogEntry
+	var hash []byte
+	var i int
+	var err error
+
+	for i, entry = range entries {
+		if entry.GetSequence() != uint64(i+1) {
+			return fmt.Errorf("Entry %d of the audit log of %s is missing",
+				i+1, entry.GetSubject())
+		}
+		if !bytes.Equal(entry.PreviousHash, previous) {
+			return fmt.Errorf("Entry %d of the audit log of %s doesn't "+
+				"match the entry before it", i+1, entry.GetSubject())
+		}
+		if hash, err = AuditEntryHash(entry); err != nil {
+			return err
+		}
+		if !bytes.Equal(entry.Hash, hash) {
+			return fmt.Errorf("Entry %d of the audit log of %s has been "+
+				"modified", i+1, entry.GetSubject())
+		}
+		previous = entry.Hash
+	}
+
+	return nil
+}
+
+// The applicant filing the membership request "req", who is identified
+// by their e-mail address in the audit log.
+func applicantActor(req *FormInputData) *Actor {
+	return &Actor{
+		User:     req.MemberData.GetEmail(),
+		SourceIP: req.Metadata.GetRequestSourceIp(),
+	}
+}
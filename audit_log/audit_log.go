@@ -0,0 +1,136 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/membersys"
+	"github.com/starshipfactory/membersys/config"
+)
+
+func main() {
+	var db membersys.MembershipStore
+	var org *config.OrganisationConfig
+	var config config.MembersysConfig
+	var organisation string
+	var config_contents []byte
+	var config_path string
+	var email string
+	var entries []*membersys.AuditLogEntry
+	var entry *membersys.AuditLogEntry
+	var verify_only bool
+	var help bool
+	var err error
+
+	flag.BoolVar(&help, "help", false, "Display help")
+	flag.StringVar(&config_path, "config", "",
+		"Path to the membersys configuration file")
+	flag.StringVar(&organisation, "organisation", "",
+		"Name of the organisation to work on, if several are configured")
+	flag.StringVar(&email, "email", "",
+		"E-mail address of the member whose audit log should be displayed")
+	flag.BoolVar(&verify_only, "verify", false,
+		"Only verify the audit log, don't display it")
+	flag.Parse()
+
+	if help || config_path == "" || email == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	config_contents, err = ioutil.ReadFile(config_path)
+	if err != nil {
+		log.Fatal("Unable to read ", config_path, ": ", err)
+	}
+	err = proto.Unmarshal(config_contents, &config)
+	if err != nil {
+		err = proto.UnmarshalText(string(config_contents), &config)
+	}
+	if err != nil {
+		log.Fatal("Error parsing ", config_path, ": ", err)
+	}
+
+	org, err = membersys.FindOrganisation(&config, organisation)
+	if err != nil {
+		log.Fatal("Error selecting the organisation: ", err)
+	}
+
+	db, err = membersys.NewMembershipStore(org.DatabaseConfig,
+		time.Duration(org.DatabaseConfig.GetDatabaseTimeout())*time.Millisecond)
+	if err != nil {
+		log.Fatal("Unable to connect to the membership database ",
+			org.DatabaseConfig.GetDatabaseServer(), " at ",
+			org.DatabaseConfig.GetDatabaseName(), ": ", err)
+	}
+
+	entries, err = db.GetAuditLog(context.Background(), email)
+	if err != nil {
+		log.Fatal("Error fetching the audit log of ", email, ": ", err)
+	}
+
+	if !verify_only {
+		for _, entry = range entries {
+			fmt.Printf("%d\t%s\t%s (%s)\t%s %s\t%s\t%q -> %q",
+				entry.GetSequence(),
+				time.Unix(int64(entry.GetTimestamp()), 0).Format(time.RFC3339),
+				entry.GetInitiator(), entry.GetSourceIp(), entry.GetAction(),
+				entry.GetField(), entry.GetRecordId(), entry.GetOldValue(),
+				entry.GetNewValue())
+			if len(entry.GetComment()) > 0 {
+				fmt.Printf("\t%q", entry.GetComment())
+			}
+			fmt.Println()
+		}
+	}
+
+	if err = membersys.VerifyAuditLog(entries); err != nil {
+		log.Fatal("Verification failed: ", err)
+	}
+
+	// The hash of the last entry covers the entire log; it can be noted
+	// down to detect later rewrites of the whole log.
+	if len(entries) > 0 {
+		fmt.Printf("Audit log of %s verified, %d entries, head %s\n", email,
+			len(entries), hex.EncodeToString(entries[len(entries)-1].Hash))
+	} else {
+		fmt.Printf("Audit log of %s is empty\n", email)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package membersys
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Create a chained audit log of four entries.
+func newTestAuditLog(t *testing.T) []*AuditLogEntry {
+	var now = time.Unix(1500000000, 0)
+	var entries []*AuditLogEntry
+	var err error
+
+	entries = []*AuditLogEntry{
+		newAuditEntry(testActor, "ada@example.com", "1", AuditActionApply,
+			now),
+		newAuditEntry(testActor, "ada@example.com", "1",
+			AuditActionUploadAgreement, now),
+	}
+	if err = chainAuditEntries(nil, entries); err != nil {
+		t.Fatalf("Error chaining the entries: %s", err)
+	}
+
+	entries = append(entries, newAuditEntry(testActor, "ada@example.com",
+		"1", AuditActionAccept, now.Add(time.Hour)),
+		newAuditEntry(testActor, "ada@example.com", "1",
+			AuditActionCreateAccount, now.Add(2*time.Hour)))
+	if err = chainAuditEntries(entries[1], entries[2:]); err != nil {
+		t.Fatalf("Error chaining the entries: %s", err)
+	}
+
+	return entries
+}
+
+func TestVerifyAuditLog(t *testing.T) {
+	var tests = []struct {
+		name   string
+		tamper func(entries []*AuditLogEntry) []*AuditLogEntry
+		err    string
+	}{
+		{"intact", func(entries []*AuditLogEntry) []*AuditLogEntry {
+			return entries
+		}, ""},
+		{"empty", func(entries []*AuditLogEntry) []*AuditLogEntry {
+			return nil
+		}, ""},
+		{"truncated", func(entries []*AuditLogEntry) []*AuditLogEntry {
+			return entries[:3]
+		}, ""},
+		{"first entry missing", func(entries []*AuditLogEntry) []*AuditLogEntry {
+			return entries[1:]
+		}, "Entry 1 of the audit log of ada@example.com is missing"},
+		{"entry missing", func(entries []*AuditLogEntry) []*AuditLogEntry {
+			return append(entries[:1], entries[2:]...)
+		}, "Entry 2 of the audit log of ada@example.com is missing"},
+		{"modified", func(entries []*AuditLogEntry) []*AuditLogEntry {
+			entries[2].Initiator = proto.String("mallory")
+			return entries
+		}, "Entry 3 of the audit log of ada@example.com has been modified"},
+		{"rehashed", func(entries []*AuditLogEntry) []*AuditLogEntry {
+			entries[1].Comment = proto.String("nothing to see")
+			entries[1].Hash, _ = AuditEntryHash(entries[1])
+			return entries
+		}, "Entry 3 of the audit log of ada@example.com doesn't match " +
+			"the entry before it"},
+		{"replaced", func(entries []*AuditLogEntry) []*AuditLogEntry {
+			var forged = newAuditEntry(testActor, "ada@example.com", "1",
+				AuditActionReject, time.Unix(1500000000, 0))
+			chainAuditEntries(nil, []*AuditLogEntry{forged})
+			return append([]*AuditLogEntry{forged}, entries[1:]...)
+		}, "Entry 2 of the audit log of ada@example.com doesn't match " +
+			"the entry before it"},
+	}
+	var err error
+	var i int
+
+	for i = range tests {
+		var test = tests[i]
+
+		err = VerifyAuditLog(test.tamper(newTestAuditLog(t)))
+		if test.err == "" && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		} else if test.err != "" && (err == nil ||
+			!strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: expected the error %q, got %v", test.name,
+				test.err, err)
+		}
+	}
+}
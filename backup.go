@@ -0,0 +1,447 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package membersys
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Backups start with one of these markers, depending on whether they are
+// encrypted. Unencrypted backups may be gzip compressed, which is detected
+// from the gzip header; encrypted backups are compressed before they are
+// encrypted, so the marker is checked again after decryption. The records
+// are followed by an empty record and the number of records, so backups
+// which have been cut off are detected. Backups written by version 1 lack
+// this end marker and are refused.
+const backupMagic = "membersys backup v2\n"
+const oldBackupMagic = "membersys backup v1\n"
+const encryptedBackupMagic = "membersys encrypted backup v1\n"
+
+// Size of the chunks encrypted backups are sealed in.
+const backupChunkSize = 64 * 1024
+
+// Largest record which is written to or read from a backup. This leaves
+// plenty of room for scanned agreements, but keeps corrupted lengths from
+// exhausting the memory.
+const maxBackupRecordSize = 64 * 1048576
+
+// Read the key used for encrypting backups from "path". The file must
+// contain 32 bytes (for AES-256) in hexadecimal.
+func ReadKeyFile(path string) ([]byte, error) {
+	var contents []byte
+	var key []byte
+	var err error
+
+	if contents, err = ioutil.ReadFile(path); err != nil {
+		return nil, err
+	}
+	key, err = hex.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, errors.New("The key must be 32 bytes long")
+	}
+	return key, nil
+}
+
+// Writer encrypting everything written to it in chunks using AES-GCM.
+// Every chunk is preceded by a flag telling whether it's the last one and
+// its length; the flag is authenticated as well, so truncated backups are
+// detected.
+type backupEncrypter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint32
+	buf     []byte
+}
+
+func newBackupEncrypter(w io.Writer, key []byte) (*backupEncrypter, error) {
+	var block cipher.Block
+	var e = &backupEncrypter{w: w}
+	var err error
+
+	if block, err = aes.NewCipher(key); err != nil {
+		return nil, err
+	}
+	if e.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+
+	// The nonce consists of a random prefix and the chunk number.
+	e.nonce = make([]byte, e.aead.NonceSize())
+	if _, err = rand.Read(e.nonce[:len(e.nonce)-4]); err != nil {
+		return nil, err
+	}
+
+	if _, err = io.WriteString(w, encryptedBackupMagic); err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(e.nonce[:len(e.nonce)-4]); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Seal "data" as the next chunk.
+func (e *backupEncrypter) seal(data []byte, last bool) error {
+	var header = make([]byte, 5)
+	var sealed []byte
+	var err error
+
+	if last {
+		header[0] = 1
+	}
+	binary.BigEndian.PutUint32(e.nonce[len(e.nonce)-4:], e.counter)
+	e.counter++
+
+	sealed = e.aead.Seal(nil, e.nonce, data, header[:1])
+	binary.BigEndian.PutUint32(header[1:], uint32(len(sealed)))
+	if _, err = e.w.Write(header); err != nil {
+		return err
+	}
+	_, err = e.w.Write(sealed)
+	return err
+}
+
+func (e *backupEncrypter) Write(p []byte) (int, error) {
+	var n int = len(p)
+	var err error
+
+	e.buf = append(e.buf, p...)
+	for len(e.buf) > backupChunkSize {
+		if err = e.seal(e.buf[:backupChunkSize], false); err != nil {
+			return 0, err
+		}
+		e.buf = e.buf[backupChunkSize:]
+	}
+	return n, nil
+}
+
+// Write the remaining data as the last chunk.
+func (e *backupEncrypter) Close() error {
+	return e.seal(e.buf, true)
+}
+
+// Reader decrypting the chunks written by backupEncrypter.
+type backupDecrypter struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint32
+	buf     []byte
+	done    bool
+}
+
+func newBackupDecrypter(r io.Reader, key []byte) (*backupDecrypter, error) {
+	var block cipher.Block
+	var d = &backupDecrypter{r: r}
+	var err error
+
+	if block, err = aes.NewCipher(key); err != nil {
+		return nil, err
+	}
+	if d.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+
+	d.nonce = make([]byte, d.aead.NonceSize())
+	if _, err = io.ReadFull(r, d.nonce[:len(d.nonce)-4]); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *backupDecrypter) Read(p []byte) (int, error) {
+	var header = make([]byte, 5)
+	var sealed []byte
+	var n int
+	var err error
+
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+
+		if _, err = io.ReadFull(d.r, header); err != nil {
+			return 0, errors.New("The backup has been truncated")
+		}
+		if binary.BigEndian.Uint32(header[1:]) >
+			uint32(backupChunkSize+d.aead.Overhead()) {
+			return 0, errors.New("The backup is corrupted: chunk too large")
+		}
+		sealed = make([]byte, binary.BigEndian.Uint32(header[1:]))
+		if _, err = io.ReadFull(d.r, sealed); err != nil {
+			return 0, errors.New("The backup has been truncated")
+		}
+
+		binary.BigEndian.PutUint32(d.nonce[len(d.nonce)-4:], d.counter)
+		d.counter++
+
+		d.buf, err = d.aead.Open(nil, d.nonce, sealed, header[:1])
+		if err != nil {
+			return 0, errors.New(
+				"Unable to decrypt the backup: wrong key or corrupted data")
+		}
+		d.done = header[0] == 1
+	}
+
+	n = copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// Write all records of "db" to "w". If "compress" is set, the records are
+// gzip compressed; if "key" is given, they are encrypted using it. Returns
+// the number of records written.
+func WriteBackup(ctx context.Context, db MembershipStore, w io.Writer,
+	compress bool, key []byte) (int, error) {
+	var out io.Writer = w
+	var closers []io.Closer
+	var encrypter *backupEncrypter
+	var zw *gzip.Writer
+	var bw *bufio.Writer
+	var count int
+	var i int
+	var err error
+
+	if key != nil {
+		if encrypter, err = newBackupEncrypter(out, key); err != nil {
+			return 0, err
+		}
+		out = encrypter
+		closers = append(closers, encrypter)
+	}
+	if compress {
+		zw = gzip.NewWriter(out)
+		out = zw
+		closers = append(closers, zw)
+	}
+	bw = bufio.NewWriter(out)
+
+	if _, err = io.WriteString(bw, backupMagic); err != nil {
+		return 0, err
+	}
+
+	err = db.ExportRecords(ctx, func(record *BackupRecord) error {
+		var length = make([]byte, binary.MaxVarintLen64)
+		var value []byte
+		var err error
+
+		if value, err = proto.Marshal(record); err != nil {
+			return err
+		}
+		if len(value) > maxBackupRecordSize {
+			return fmt.Errorf("Record %s in %s is too large to be backed up",
+				record.GetKey(), record.GetTable())
+		}
+		length = length[:binary.PutUvarint(length, uint64(len(value)))]
+		if _, err = bw.Write(length); err != nil {
+			return err
+		}
+		if _, err = bw.Write(value); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+
+	if err = writeBackupTrailer(bw, count); err != nil {
+		return count, err
+	}
+	if err = bw.Flush(); err != nil {
+		return count, err
+	}
+	for i = len(closers) - 1; i >= 0; i-- {
+		if err = closers[i].Close(); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// Write the end marker of a backup containing "count" records.
+func writeBackupTrailer(w io.Writer, count int) error {
+	var trailer = make([]byte, 1+binary.MaxVarintLen64)
+	var err error
+
+	trailer = trailer[:1+binary.PutUvarint(trailer[1:], uint64(count))]
+	_, err = w.Write(trailer)
+	return err
+}
+
+// Call "fn" for every record of the backup read from "r", which is
+// decrypted using "key" if needed. Fails if the end marker is missing or
+// doesn't match the number of records read. Returns the number of records
+// read.
+func readBackup(r io.Reader, key []byte, fn func(*BackupRecord) error) (
+	int, error) {
+	var br *bufio.Reader = bufio.NewReader(r)
+	var zr *gzip.Reader
+	var magic []byte
+	var count int
+	var err error
+
+	magic, _ = br.Peek(len(encryptedBackupMagic))
+	if bytes.Equal(magic, []byte(encryptedBackupMagic)) {
+		var decrypter *backupDecrypter
+
+		if key == nil {
+			return 0, errors.New("The backup is encrypted, but no key " +
+				"has been given")
+		}
+		br.Discard(len(encryptedBackupMagic))
+		if decrypter, err = newBackupDecrypter(br, key); err != nil {
+			return 0, err
+		}
+		br = bufio.NewReader(decrypter)
+	}
+
+	magic, _ = br.Peek(2)
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		if zr, err = gzip.NewReader(br); err != nil {
+			return 0, err
+		}
+		br = bufio.NewReader(zr)
+	}
+
+	magic = make([]byte, len(backupMagic))
+	_, err = io.ReadFull(br, magic)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, errors.New("Not a membersys backup")
+	} else if err != nil {
+		return 0, err
+	} else if bytes.Equal(magic, []byte(oldBackupMagic)) {
+		return 0, errors.New("The backup has been written by an earlier " +
+			"version without an end marker, so it can't be verified")
+	} else if !bytes.Equal(magic, []byte(backupMagic)) {
+		return 0, errors.New("Not a membersys backup")
+	}
+
+	for {
+		var record = new(BackupRecord)
+		var length uint64
+		var value []byte
+
+		length, err = binary.ReadUvarint(br)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return count, fmt.Errorf("The backup has been truncated "+
+				"after %d records", count)
+		} else if err != nil {
+			return count, err
+		}
+
+		if length == 0 {
+			return count, readBackupTrailer(br, count)
+		} else if length > maxBackupRecordSize {
+			return count, fmt.Errorf("The backup is corrupted: record "+
+				"of %d bytes after %d records", length, count)
+		}
+
+		value = make([]byte, length)
+		if _, err = io.ReadFull(br, value); err != nil {
+			return count, fmt.Errorf("The backup has been truncated "+
+				"after %d records", count)
+		}
+		if err = proto.Unmarshal(value, record); err != nil {
+			return count, err
+		}
+
+		if err = fn(record); err != nil {
+			return count, err
+		}
+		count++
+	}
+}
+
+// Check the end marker read from "br" against the number of records read,
+// "count", and ensure nothing follows it.
+func readBackupTrailer(br *bufio.Reader, count int) error {
+	var expected uint64
+	var err error
+
+	expected, err = binary.ReadUvarint(br)
+	if err != nil {
+		return fmt.Errorf("The backup has been truncated after %d records",
+			count)
+	}
+	if expected != uint64(count) {
+		return fmt.Errorf("The backup is corrupted: it should contain %d "+
+			"records, but %d have been read", expected, count)
+	}
+	if _, err = br.ReadByte(); err == nil {
+		return errors.New("The backup is corrupted: data after the end " +
+			"marker")
+	} else if err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// Read the backup from "r" completely without loading it, to ensure it
+// is intact before it is restored. "key" is needed for encrypted backups.
+// Returns the number of records in the backup.
+func VerifyBackup(r io.Reader, key []byte) (int, error) {
+	return readBackup(r, key, func(record *BackupRecord) error {
+		return nil
+	})
+}
+
+// Load all records of the backup read from "r" into "db". "key" is needed
+// for encrypted backups. Returns the number of records loaded. Backups
+// which turn out to be incomplete are only detected at their end, so they
+// should be checked using VerifyBackup first.
+func RestoreBackup(ctx context.Context, db MembershipStore, r io.Reader,
+	key []byte) (int, error) {
+	return readBackup(r, key, func(record *BackupRecord) error {
+		return db.ImportRecord(ctx, record)
+	})
+}
@@ -0,0 +1,241 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package membersys
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Create an in-memory database holding records in all lifecycle states,
+// and an agreement scan large enough to span several encrypted chunks.
+func newTestBackupDB(t *testing.T) *InMemoryMembershipDB {
+	var ctx = context.Background()
+	var db = NewInMemoryMembershipDB()
+	var scan = make([]byte, 3*backupChunkSize)
+	var id string
+	var err error
+
+	db.retention = testRetention
+	rand.New(rand.NewSource(1)).Read(scan)
+
+	id = storeTestApplication(t, db, "Ada Lovelace", "ada@example.com",
+		false)
+	if err = db.StoreMembershipAgreement(ctx, id, scan, testActor); err != nil {
+		t.Fatalf("Error storing the agreement: %s", err)
+	}
+	if err = db.MoveApplicantToNewMember(ctx, id, testActor); err != nil {
+		t.Fatalf("Error accepting %s: %s", id, err)
+	}
+	createTestMember(t, db, id)
+
+	id = storeTestApplication(t, db, "Grace Hopper", "grace@example.com",
+		true)
+	if err = db.MoveApplicantToNewMember(ctx, id, testActor); err != nil {
+		t.Fatalf("Error accepting %s: %s", id, err)
+	}
+
+	id = storeTestApplication(t, db, "Charles Babbage",
+		"charles@example.com", false)
+	if err = db.MoveApplicantToTrash(ctx, id, testActor); err != nil {
+		t.Fatalf("Error rejecting %s: %s", id, err)
+	}
+
+	storeTestApplication(t, db, "Alan Turing", "alan@example.com", true)
+	return db
+}
+
+// Export all records of "db", except for their TTLs, which change over
+// time, keyed by their table and key.
+func exportTestRecords(t *testing.T, db MembershipStore) map[string]*BackupRecord {
+	var rv = make(map[string]*BackupRecord)
+	var err error
+
+	err = db.ExportRecords(context.Background(),
+		func(record *BackupRecord) error {
+			var copied = proto.Clone(record).(*BackupRecord)
+
+			copied.Ttl = nil
+			rv[record.GetTable()+"/"+record.GetKey()] = copied
+			return nil
+		})
+	if err != nil {
+		t.Fatalf("Error exporting the records: %s", err)
+	}
+	return rv
+}
+
+func TestBackupRoundTrip(t *testing.T) {
+	var ctx = context.Background()
+	var key = bytes.Repeat([]byte{0x42}, 32)
+	var tests = []struct {
+		name     string
+		compress bool
+		key      []byte
+	}{
+		{"plain", false, nil},
+		{"compressed", true, nil},
+		{"encrypted", false, key},
+		{"compressed and encrypted", true, key},
+	}
+	var db = newTestBackupDB(t)
+	var expected = exportTestRecords(t, db)
+	var i int
+
+	for i = range tests {
+		var test = tests[i]
+		var restored = NewInMemoryMembershipDB()
+		var records map[string]*BackupRecord
+		var record *BackupRecord
+		var buf bytes.Buffer
+		var name string
+		var count, n int
+		var err error
+
+		if count, err = WriteBackup(ctx, db, &buf, test.compress,
+			test.key); err != nil {
+			t.Fatalf("%s: error writing the backup: %s", test.name, err)
+		}
+		if count != len(expected) {
+			t.Errorf("%s: expected %d records to be written, got %d",
+				test.name, len(expected), count)
+		}
+
+		n, err = VerifyBackup(bytes.NewReader(buf.Bytes()), test.key)
+		if err != nil || n != count {
+			t.Errorf("%s: expected %d records to be verified, got %d (%v)",
+				test.name, count, n, err)
+		}
+
+		n, err = RestoreBackup(ctx, restored, bytes.NewReader(buf.Bytes()),
+			test.key)
+		if err != nil || n != count {
+			t.Fatalf("%s: expected %d records to be restored, got %d (%v)",
+				test.name, count, n, err)
+		}
+
+		records = exportTestRecords(t, restored)
+		if len(records) != len(expected) {
+			t.Errorf("%s: expected %d records after restoring, got %d",
+				test.name, len(expected), len(records))
+		}
+		for name, record = range expected {
+			if !proto.Equal(records[name], record) {
+				t.Errorf("%s: record %s differs after restoring", test.name,
+					name)
+			}
+		}
+
+		if test.key != nil {
+			if _, err = VerifyBackup(bytes.NewReader(buf.Bytes()),
+				nil); err == nil {
+				t.Errorf("%s: verified without a key", test.name)
+			}
+			if _, err = VerifyBackup(bytes.NewReader(buf.Bytes()),
+				bytes.Repeat([]byte{0x23}, 32)); err == nil {
+				t.Errorf("%s: verified with the wrong key", test.name)
+			}
+		}
+	}
+}
+
+// A backup which is expected to be refused.
+type damagedBackup struct {
+	name   string
+	backup []byte
+	key    []byte
+}
+
+// Backups which have been cut short or tampered with are refused.
+func TestBackupDamaged(t *testing.T) {
+	var ctx = context.Background()
+	var key = bytes.Repeat([]byte{0x42}, 32)
+	var db = newTestBackupDB(t)
+	var plain, encrypted bytes.Buffer
+	var tests []damagedBackup
+	var modified []byte
+	var count, size, i int
+	var err error
+
+	if count, err = WriteBackup(ctx, db, &plain, false, nil); err != nil {
+		t.Fatalf("Error writing the backup: %s", err)
+	}
+	if _, err = WriteBackup(ctx, db, &encrypted, true, key); err != nil {
+		t.Fatalf("Error writing the backup: %s", err)
+	}
+
+	for _, size = range []int{1, 2, 10, plain.Len() / 2,
+		plain.Len() - len(backupMagic), plain.Len()} {
+		tests = append(tests, damagedBackup{
+			fmt.Sprintf("plain without the last %d bytes", size),
+			plain.Bytes()[:plain.Len()-size], nil})
+	}
+
+	// The first chunk ends after the magic, the nonce prefix, and the
+	// chunk with its header and tag.
+	size = len(encryptedBackupMagic) + 8 + 5 + backupChunkSize + 16
+	for _, size = range []int{1, 16, encrypted.Len() - size,
+		encrypted.Len() / 2} {
+		tests = append(tests, damagedBackup{
+			fmt.Sprintf("encrypted without the last %d bytes", size),
+			encrypted.Bytes()[:encrypted.Len()-size], key})
+	}
+
+	modified = append([]byte(nil), encrypted.Bytes()...)
+	modified[len(modified)/2] ^= 1
+	tests = append(tests, damagedBackup{"encrypted and modified", modified,
+		key})
+
+	modified = append([]byte(nil), plain.Bytes()...)
+	modified[len(modified)-1] = byte(count + 1)
+	tests = append(tests, damagedBackup{"wrong record count", modified, nil})
+
+	tests = append(tests,
+		damagedBackup{"data after the end marker",
+			append(append([]byte(nil), plain.Bytes()...), 0), nil},
+		damagedBackup{"earlier version", append([]byte(oldBackupMagic),
+			plain.Bytes()[len(backupMagic):]...), nil},
+		damagedBackup{"not a backup", []byte("This is not a backup"), nil})
+
+	for i = range tests {
+		_, err = VerifyBackup(bytes.NewReader(tests[i].backup),
+			tests[i].key)
+		if err == nil {
+			t.Errorf("%s: the backup has been verified", tests[i].name)
+		}
+	}
+}
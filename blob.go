@@ -0,0 +1,559 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package membersys
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Content addressed storage for the scanned membership agreements, which
+// are too large to be decoded every time a record is listed. Blobs are
+// keyed by the SHA-256 hash of their contents, in hexadecimal.
+type BlobStore interface {
+	// Store "data" under "hash", replacing any blob stored under the
+	// same hash before.
+	PutBlob(ctx context.Context, hash string, data []byte) error
+
+	// Retrieve the blob stored under "hash".
+	GetBlob(ctx context.Context, hash string) ([]byte, error)
+
+	// Remove the blob stored under "hash". Removing a blob which doesn't
+	// exist is not an error.
+	DeleteBlob(ctx context.Context, hash string) error
+
+	// Call "fn" with the hash of every blob in the store and the time it
+	// has last been stored at. Stops at the first error.
+	EnumerateBlobs(ctx context.Context,
+		fn func(hash string, stored time.Time) error) error
+}
+
+// Time a blob is left alone by sweepBlobs after it has been stored. The
+// blob is stored before the record referring to it is written, which has
+// to happen within this period.
+const blobGracePeriod = time.Hour
+
+// Compute the key of "data" in a BlobStore.
+func blobHash(data []byte) string {
+	var sum [sha256.Size]byte = sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Ensure "hash" looks like a key produced by blobHash, so it can't be
+// used to access files outside of a FileBlobStore.
+func checkBlobHash(hash string) error {
+	var err error
+
+	if len(hash) != 2*sha256.Size {
+		return grpc.Errorf(codes.InvalidArgument, "Invalid blob hash %s",
+			hash)
+	}
+	if _, err = hex.DecodeString(hash); err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "Invalid blob hash %s",
+			hash)
+	}
+	return nil
+}
+
+// Hash of the agreement PDF of "agreement", which may still be embedded
+// in records written by earlier versions. Empty if no PDF has been
+// uploaded.
+func agreementPdfHash(agreement *MembershipAgreement) string {
+	if len(agreement.GetAgreementPdfHash()) > 0 {
+		return agreement.GetAgreementPdfHash()
+	}
+	if len(agreement.AgreementPdf) > 0 {
+		return blobHash(agreement.AgreementPdf)
+	}
+	return ""
+}
+
+// Count the blobs "agreement" refers to in "refs", which maps the hashes
+// to the number of records referring to them.
+func countBlobReferences(refs map[string]int, agreement *MembershipAgreement) {
+	if len(agreement.GetAgreementPdfHash()) > 0 {
+		refs[agreement.GetAgreementPdfHash()]++
+	}
+	if len(agreement.GetFeeReduction().GetDocumentHash()) > 0 {
+		refs[agreement.GetFeeReduction().GetDocumentHash()]++
+	}
+}
+
+// Delete the blobs of "blobs" which no record refers to any more, e.g.
+// because the record has expired from the archive. "references" counts
+// the references of all records, including revisions of current members.
+// Blobs stored less than blobGracePeriod before the sweep are left alone,
+// since the records referring to them may not have been written yet.
+// Returns the number of blobs which have been deleted.
+func sweepBlobs(ctx context.Context, blobs BlobStore,
+	references func(refs map[string]int) error) (int, error) {
+	var cutoff time.Time = time.Now().Add(-blobGracePeriod)
+	var refs = make(map[string]int)
+	var hashes []string
+	var hash string
+	var count int
+	var err error
+
+	err = blobs.EnumerateBlobs(ctx, func(hash string, stored time.Time) error {
+		if stored.Before(cutoff) {
+			hashes = append(hashes, hash)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err = references(refs); err != nil {
+		return 0, err
+	}
+
+	for _, hash = range hashes {
+		if refs[hash] > 0 {
+			continue
+		}
+		if err = blobs.DeleteBlob(ctx, hash); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Retrieve the agreement PDF of "agreement", either embedded into it by
+// an earlier version or from "blobs". Blobs are decrypted using "keys",
+// which may be nil.
+func readAgreementPdf(ctx context.Context, blobs BlobStore, keys *KeyRing,
+	agreement *MembershipAgreement) ([]byte, error) {
+	var data []byte
+	var err error
+
+	if len(agreement.AgreementPdf) > 0 {
+		return agreement.AgreementPdf, nil
+	}
+	if agreement.GetAgreementPdfHash() == "" {
+		return nil, grpc.Errorf(codes.NotFound,
+			"No membership agreement has been uploaded")
+	}
+
+	if data, err = blobs.GetBlob(ctx, agreement.GetAgreementPdfHash()); err != nil {
+		return nil, err
+	}
+	return keys.Open(data)
+}
+
+// Retrieve the document supporting the fee reduction request of
+// "agreement" from "blobs", decrypted using "keys", which may be nil.
+func readFeeReductionDocument(ctx context.Context, blobs BlobStore,
+	keys *KeyRing, agreement *MembershipAgreement) ([]byte, error) {
+	var data []byte
+	var err error
+
+	if agreement.GetFeeReduction().GetDocumentHash() == "" {
+		return nil, grpc.Errorf(codes.NotFound,
+			"No supporting document has been uploaded")
+	}
+
+	data, err = blobs.GetBlob(ctx, agreement.GetFeeReduction().GetDocumentHash())
+	if err != nil {
+		return nil, err
+	}
+	return keys.Open(data)
+}
+
+// Call "fn" with a backup record for every blob in "blobs", decrypted
+// using "keys", which may be nil.
+func exportBlobs(ctx context.Context, blobs BlobStore, keys *KeyRing,
+	fn func(*BackupRecord) error) error {
+	return blobs.EnumerateBlobs(ctx, func(hash string, stored time.Time) error {
+		var data []byte
+		var err error
+
+		if data, err = blobs.GetBlob(ctx, hash); err != nil {
+			return err
+		}
+		if data, err = keys.Open(data); err != nil {
+			return err
+		}
+		return fn(&BackupRecord{
+			Table:    proto.String("agreement_blobs"),
+			Key:      proto.String(hash),
+			BlobData: data,
+		})
+	})
+}
+
+// Blob store keeping every blob in a file of its own below a directory.
+// The files are spread over subdirectories named after the first two
+// digits of their hash.
+type FileBlobStore struct {
+	dir string
+}
+
+// Create a blob store in the directory "dir", which is created if it
+// doesn't exist yet.
+func NewFileBlobStore(dir string) (*FileBlobStore, error) {
+	var err error
+
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileBlobStore{dir: dir}, nil
+}
+
+func (f *FileBlobStore) path(hash string) string {
+	return filepath.Join(f.dir, hash[:2], hash)
+}
+
+// Store "data" under "hash". The blob is written to a temporary file
+// first, so readers never see partially written blobs.
+func (f *FileBlobStore) PutBlob(ctx context.Context, hash string,
+	data []byte) error {
+	var tmp *os.File
+	var err error
+
+	if err = checkBlobHash(hash); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(f.path(hash)), 0700); err != nil {
+		return err
+	}
+
+	tmp, err = ioutil.TempFile(filepath.Dir(f.path(hash)), "."+hash)
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), f.path(hash))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Retrieve the blob stored under "hash".
+func (f *FileBlobStore) GetBlob(ctx context.Context, hash string) (
+	[]byte, error) {
+	var data []byte
+	var err error
+
+	if err = checkBlobHash(hash); err != nil {
+		return nil, err
+	}
+
+	data, err = ioutil.ReadFile(f.path(hash))
+	if os.IsNotExist(err) {
+		return nil, grpc.Errorf(codes.NotFound, "Blob %s not found", hash)
+	}
+	return data, err
+}
+
+// Remove the blob stored under "hash".
+func (f *FileBlobStore) DeleteBlob(ctx context.Context, hash string) error {
+	var err error
+
+	if err = checkBlobHash(hash); err != nil {
+		return err
+	}
+	if err = os.Remove(f.path(hash)); os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Call "fn" with the hash of every blob in the store and the time it has
+// been written at.
+func (f *FileBlobStore) EnumerateBlobs(ctx context.Context,
+	fn func(hash string, stored time.Time) error) error {
+	var paths []string
+	var path string
+	var err error
+
+	if paths, err = filepath.Glob(filepath.Join(f.dir, "??", "*")); err != nil {
+		return err
+	}
+	sort.Strings(paths)
+
+	for _, path = range paths {
+		var hash string = filepath.Base(path)
+		var info os.FileInfo
+
+		// Skip temporary files of blobs being written.
+		if strings.HasPrefix(hash, ".") || checkBlobHash(hash) != nil {
+			continue
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if info, err = os.Stat(path); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err = fn(hash, info.ModTime()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Blob store keeping all blobs in memory, for the in-memory database.
+type memoryBlobStore struct {
+	mtx    sync.Mutex
+	blobs  map[string][]byte
+	stored map[string]time.Time
+}
+
+func newMemoryBlobStore() *memoryBlobStore {
+	return &memoryBlobStore{
+		blobs:  make(map[string][]byte),
+		stored: make(map[string]time.Time),
+	}
+}
+
+func (s *memoryBlobStore) PutBlob(ctx context.Context, hash string,
+	data []byte) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.blobs[hash] = append([]byte(nil), data...)
+	s.stored[hash] = time.Now()
+	return nil
+}
+
+func (s *memoryBlobStore) GetBlob(ctx context.Context, hash string) (
+	[]byte, error) {
+	var data []byte
+	var ok bool
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if data, ok = s.blobs[hash]; !ok {
+		return nil, grpc.Errorf(codes.NotFound, "Blob %s not found", hash)
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (s *memoryBlobStore) DeleteBlob(ctx context.Context, hash string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	delete(s.blobs, hash)
+	delete(s.stored, hash)
+	return nil
+}
+
+func (s *memoryBlobStore) EnumerateBlobs(ctx context.Context,
+	fn func(hash string, stored time.Time) error) error {
+	var stored = make(map[string]time.Time)
+	var hashes []string
+	var hash string
+	var err error
+
+	s.mtx.Lock()
+	for hash = range s.blobs {
+		hashes = append(hashes, hash)
+		stored[hash] = s.stored[hash]
+	}
+	s.mtx.Unlock()
+
+	sort.Strings(hashes)
+	for _, hash = range hashes {
+		if err = fn(hash, stored[hash]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Blob store keeping the blobs in the agreement_blobs table of the
+// Cassandra membership database.
+type cqlBlobStore struct {
+	sess *gocql.Session
+}
+
+func (s *cqlBlobStore) PutBlob(ctx context.Context, hash string,
+	data []byte) error {
+	return s.sess.Query("INSERT INTO agreement_blobs (hash, data) "+
+		"VALUES (?, ?)", hash, data).WithContext(ctx).Exec()
+}
+
+func (s *cqlBlobStore) GetBlob(ctx context.Context, hash string) (
+	[]byte, error) {
+	var data []byte
+	var err error
+
+	err = s.sess.Query("SELECT data FROM agreement_blobs WHERE hash = ?",
+		hash).WithContext(ctx).Scan(&data)
+	if err == gocql.ErrNotFound {
+		return nil, grpc.Errorf(codes.NotFound, "Blob %s not found", hash)
+	}
+	return data, err
+}
+
+func (s *cqlBlobStore) DeleteBlob(ctx context.Context, hash string) error {
+	return s.sess.Query("DELETE FROM agreement_blobs WHERE hash = ?",
+		hash).WithContext(ctx).Exec()
+}
+
+// The time a blob has been stored at is taken from the write time of its
+// data, in microseconds since the epoch.
+func (s *cqlBlobStore) EnumerateBlobs(ctx context.Context,
+	fn func(hash string, stored time.Time) error) error {
+	var iter *gocql.Iter
+	var hash string
+	var written int64
+	var err error
+
+	iter = s.sess.Query("SELECT hash, writetime(data) FROM agreement_blobs").
+		WithContext(ctx).Iter()
+	for iter.Scan(&hash, &written) {
+		if err = fn(hash, time.Unix(0, written*1000)); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+// Blob store keeping the blobs in the agreement_blobs table of the SQL
+// membership database.
+type sqlBlobStore struct {
+	db *sql.DB
+}
+
+func (s *sqlBlobStore) PutBlob(ctx context.Context, hash string,
+	data []byte) error {
+	var tx *sql.Tx
+	var err error
+
+	if tx, err = s.db.BeginTx(ctx, nil); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM agreement_blobs "+
+		"WHERE hash = $1", hash)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, "INSERT INTO agreement_blobs "+
+			"(hash, data, stored) VALUES ($1, $2, $3)", hash, data,
+			time.Now().Unix())
+	}
+	return sqlFinishTx(tx, err)
+}
+
+func (s *sqlBlobStore) GetBlob(ctx context.Context, hash string) (
+	[]byte, error) {
+	var data []byte
+	var err error
+
+	err = s.db.QueryRowContext(ctx, "SELECT data FROM agreement_blobs "+
+		"WHERE hash = $1", hash).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, grpc.Errorf(codes.NotFound, "Blob %s not found", hash)
+	}
+	return data, err
+}
+
+func (s *sqlBlobStore) DeleteBlob(ctx context.Context, hash string) error {
+	var err error
+
+	_, err = s.db.ExecContext(ctx, "DELETE FROM agreement_blobs "+
+		"WHERE hash = $1", hash)
+	return err
+}
+
+// Blobs stored by earlier versions have no time recorded, and count as
+// stored at the beginning of time.
+func (s *sqlBlobStore) EnumerateBlobs(ctx context.Context,
+	fn func(hash string, stored time.Time) error) error {
+	var rows *sql.Rows
+	var stored = make(map[string]time.Time)
+	var hashes []string
+	var hash string
+	var err error
+
+	// Collect the hashes first, so "fn" can access the database while
+	// SQLite only allows a single connection.
+	rows, err = s.db.QueryContext(ctx,
+		"SELECT hash, stored FROM agreement_blobs ORDER BY hash")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var ts sql.NullInt64
+
+		if err = rows.Scan(&hash, &ts); err != nil {
+			rows.Close()
+			return err
+		}
+		hashes = append(hashes, hash)
+		if ts.Valid {
+			stored[hash] = time.Unix(ts.Int64, 0)
+		}
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, hash = range hashes {
+		if err = fn(hash, stored[hash]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
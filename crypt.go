@@ -0,0 +1,257 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package membersys
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Set of master keys used for encrypting column values. The first key
+// read is used for encrypting new values, the others are kept for reading
+// values which have been encrypted before the keys were rotated.
+type KeyRing struct {
+	current string
+	keys    map[string][]byte
+}
+
+// Read the master keys from "path". Every line contains the name of a key
+// and the key itself as 64 hexadecimal digits, separated by whitespace.
+// Empty lines and lines starting with # are ignored.
+func ReadKeyRing(path string) (*KeyRing, error) {
+	var keys = &KeyRing{keys: make(map[string][]byte)}
+	var scanner *bufio.Scanner
+	var f *os.File
+	var lineno int
+	var err error
+
+	if f, err = os.Open(path); err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner = bufio.NewScanner(f)
+	for scanner.Scan() {
+		var fields []string = strings.Fields(scanner.Text())
+		var key []byte
+
+		lineno++
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: Expected a key name and a key",
+				path, lineno)
+		}
+		if key, err = hex.DecodeString(fields[1]); err != nil ||
+			len(key) != 32 {
+			return nil, fmt.Errorf("%s:%d: The key must be 64 hexadecimal "+
+				"digits", path, lineno)
+		}
+		if _, ok := keys.keys[fields[0]]; ok {
+			return nil, fmt.Errorf("%s:%d: Duplicate key %s", path, lineno,
+				fields[0])
+		}
+
+		if keys.current == "" {
+			keys.current = fields[0]
+		}
+		keys.keys[fields[0]] = key
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if keys.current == "" {
+		return nil, fmt.Errorf("%s: No keys found", path)
+	}
+	return keys, nil
+}
+
+// Encrypt "plaintext" using AES-GCM with "key". The random nonce is
+// prepended to the result.
+func sealAESGCM(key, plaintext []byte) ([]byte, error) {
+	var block cipher.Block
+	var aead cipher.AEAD
+	var nonce []byte
+	var err error
+
+	if block, err = aes.NewCipher(key); err != nil {
+		return nil, err
+	}
+	if aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+
+	nonce = make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Decrypt "ciphertext" as produced by sealAESGCM using "key".
+func openAESGCM(key, ciphertext []byte) ([]byte, error) {
+	var block cipher.Block
+	var aead cipher.AEAD
+	var err error
+
+	if block, err = aes.NewCipher(key); err != nil {
+		return nil, err
+	}
+	if aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, fmt.Errorf("Encrypted value is too short")
+	}
+	return aead.Open(nil, ciphertext[:aead.NonceSize()],
+		ciphertext[aead.NonceSize():], nil)
+}
+
+// Prefix of the values encrypted by Seal, followed by the version of the
+// format and the encoded EncryptedValue. Protocol buffers never start with
+// a zero byte, and the remainder tells encrypted values apart from blobs
+// such as scans which happen to.
+const encryptedMagic = "\x00MSENC"
+
+// Version of the format of encrypted values written by Seal.
+const encryptedVersion byte = 1
+
+// Length of the header preceding the EncryptedValue of a sealed value.
+const encryptedHeaderLen = len(encryptedMagic) + 1
+
+// Determine whether "value" has been encrypted by Seal.
+func isEncrypted(value []byte) bool {
+	return len(value) >= encryptedHeaderLen &&
+		string(value[:len(encryptedMagic)]) == encryptedMagic
+}
+
+// Encrypt "value" with a new data key, which is encrypted with the
+// current master key. Without a key ring, and for empty values, "value"
+// is returned as it is.
+func (k *KeyRing) Seal(value []byte) ([]byte, error) {
+	var ev *EncryptedValue
+	var dataKey = make([]byte, 32)
+	var encoded []byte
+	var err error
+
+	if k == nil || len(value) == 0 {
+		return value, nil
+	}
+
+	if _, err = rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+
+	ev = &EncryptedValue{KeyId: proto.String(k.current)}
+	if ev.WrappedKey, err = sealAESGCM(k.keys[k.current], dataKey); err != nil {
+		return nil, err
+	}
+	if ev.Ciphertext, err = sealAESGCM(dataKey, value); err != nil {
+		return nil, err
+	}
+
+	if encoded, err = proto.Marshal(ev); err != nil {
+		return nil, err
+	}
+	return append(append([]byte(encryptedMagic), encryptedVersion),
+		encoded...), nil
+}
+
+// Decrypt "value" as encrypted by Seal. Values which haven't been
+// encrypted are returned as they are, so data written before encryption
+// was enabled can still be read. Without a key ring, all values are
+// returned as they are, since the stores which never encrypt anything
+// don't have one; see checkEncrypted for the stores which do.
+func (k *KeyRing) Open(value []byte) ([]byte, error) {
+	var ev = new(EncryptedValue)
+	var dataKey, master []byte
+	var ok bool
+	var err error
+
+	if k == nil || !isEncrypted(value) {
+		return value, nil
+	}
+	if value[len(encryptedMagic)] != encryptedVersion {
+		return nil, fmt.Errorf("Value has been encrypted using the "+
+			"unknown format version %d", value[len(encryptedMagic)])
+	}
+
+	if err = proto.Unmarshal(value[encryptedHeaderLen:], ev); err != nil {
+		return nil, err
+	}
+	if master, ok = k.keys[ev.GetKeyId()]; !ok {
+		return nil, fmt.Errorf("Value has been encrypted with the unknown "+
+			"key %s", ev.GetKeyId())
+	}
+	if dataKey, err = openAESGCM(master, ev.GetWrappedKey()); err != nil {
+		return nil, err
+	}
+	return openAESGCM(dataKey, ev.GetCiphertext())
+}
+
+// Determine whether "value" has to be encrypted again, because it is not
+// encrypted with the current master key yet.
+func (k *KeyRing) NeedsReencryption(value []byte) bool {
+	var ev = new(EncryptedValue)
+
+	if k == nil || len(value) == 0 {
+		return false
+	}
+	if !isEncrypted(value) || value[len(encryptedMagic)] != encryptedVersion {
+		return true
+	}
+	if proto.Unmarshal(value[encryptedHeaderLen:], ev) != nil {
+		return true
+	}
+	return ev.GetKeyId() != k.current
+}
+
+// Report an error if "value" has been encrypted, but there is no key ring
+// "keys" to decrypt it with.
+func checkEncrypted(keys *KeyRing, value []byte) error {
+	if keys == nil && isEncrypted(value) {
+		return fmt.Errorf("Found an encrypted value, but no " +
+			"encryption_key_file has been configured")
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package membersys
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Write "contents" to a key file in a temporary directory and read it.
+func readTestKeyRing(t *testing.T, contents string) (*KeyRing, error) {
+	var path string = filepath.Join(t.TempDir(), "keys")
+	var err error
+
+	if err = ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("Error writing %s: %s", path, err)
+	}
+	return ReadKeyRing(path)
+}
+
+const testKeyA = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+const testKeyB = "202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f"
+
+func TestReadKeyRing(t *testing.T) {
+	var tests = []struct {
+		name     string
+		contents string
+		current  string
+		err      string
+	}{
+		{"single key", "a " + testKeyA + "\n", "a", ""},
+		{"comments", "# master keys\n\nb " + testKeyB + "\na " + testKeyA +
+			"\n", "b", ""},
+		{"empty", "# nothing here\n", "", "No keys found"},
+		{"short key", "a 0001\n", "", "64 hexadecimal digits"},
+		{"not hex", "a " + strings.Repeat("zz", 32) + "\n", "",
+			"64 hexadecimal digits"},
+		{"missing key", "a\n", "", "Expected a key name and a key"},
+		{"duplicate", "a " + testKeyA + "\na " + testKeyB + "\n", "",
+			"Duplicate key a"},
+	}
+	var keys *KeyRing
+	var i int
+	var err error
+
+	for i = range tests {
+		var test = tests[i]
+
+		keys, err = readTestKeyRing(t, test.contents)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected an error containing %q, got %v",
+					test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		} else if keys.current != test.current {
+			t.Errorf("%s: expected the current key %s, got %s", test.name,
+				test.current, keys.current)
+		}
+	}
+
+	if _, err = ReadKeyRing(filepath.Join(t.TempDir(),
+		"missing")); !os.IsNotExist(err) {
+		t.Errorf("Expected a missing key file to be reported, got %v", err)
+	}
+}
+
+func TestKeyRingSealOpen(t *testing.T) {
+	var old, rotated, other *KeyRing
+	var nilRing *KeyRing
+	var plaintext = []byte("Hauptstrasse 1")
+	var sealed, resealed, opened []byte
+	var err error
+
+	if old, err = readTestKeyRing(t, "a "+testKeyA+"\n"); err != nil {
+		t.Fatalf("Error reading the key ring: %s", err)
+	}
+	if rotated, err = readTestKeyRing(t, "b "+testKeyB+"\na "+testKeyA+
+		"\n"); err != nil {
+		t.Fatalf("Error reading the key ring: %s", err)
+	}
+	if other, err = readTestKeyRing(t, "b "+testKeyB+"\n"); err != nil {
+		t.Fatalf("Error reading the key ring: %s", err)
+	}
+
+	if sealed, err = old.Seal(plaintext); err != nil {
+		t.Fatalf("Error sealing: %s", err)
+	}
+	if !isEncrypted(sealed) || bytes.Contains(sealed, plaintext) {
+		t.Errorf("The sealed value isn't encrypted: %q", sealed)
+	}
+	if resealed, err = old.Seal(plaintext); err != nil {
+		t.Fatalf("Error sealing: %s", err)
+	}
+	if bytes.Equal(sealed, resealed) {
+		t.Errorf("Sealing the same value twice gave the same result")
+	}
+
+	if opened, err = old.Open(sealed); err != nil {
+		t.Errorf("Error opening with the same key ring: %s", err)
+	} else if !bytes.Equal(opened, plaintext) {
+		t.Errorf("Expected %q, got %q", plaintext, opened)
+	}
+
+	// Values sealed before the keys were rotated can still be opened, but
+	// need to be encrypted again.
+	if opened, err = rotated.Open(sealed); err != nil {
+		t.Errorf("Error opening after rotating the keys: %s", err)
+	} else if !bytes.Equal(opened, plaintext) {
+		t.Errorf("Expected %q, got %q", plaintext, opened)
+	}
+	if !rotated.NeedsReencryption(sealed) {
+		t.Errorf("A value sealed with an old key doesn't need to be " +
+			"encrypted again")
+	}
+	if old.NeedsReencryption(sealed) {
+		t.Errorf("A value sealed with the current key needs to be " +
+			"encrypted again")
+	}
+	if !old.NeedsReencryption(plaintext) {
+		t.Errorf("A plain text value doesn't need to be encrypted")
+	}
+
+	if _, err = other.Open(sealed); err == nil {
+		t.Errorf("Opened a value sealed with an unknown key")
+	}
+	if opened, err = nilRing.Open(sealed); err != nil ||
+		!bytes.Equal(opened, sealed) {
+		t.Errorf("Expected a value to be passed through without a key "+
+			"ring, got %q (%v)", opened, err)
+	}
+	if err = checkEncrypted(nilRing, sealed); err == nil {
+		t.Errorf("A sealed value without a key ring hasn't been reported")
+	}
+	if err = checkEncrypted(nilRing, plaintext); err != nil {
+		t.Errorf("A plain text value has been reported: %s", err)
+	}
+
+	// Scans such as MP4 or HEIC files start with a zero byte as well.
+	if isEncrypted([]byte("\x00\x00\x00\x18ftypheic")) {
+		t.Errorf("A HEIC scan is taken for an encrypted value")
+	}
+	if opened, err = old.Open([]byte("\x00\x00\x00\x18ftypmp42")); err != nil {
+		t.Errorf("Error passing through an MP4 scan: %s", err)
+	}
+	resealed = append([]byte(nil), sealed...)
+	resealed[len(encryptedMagic)] = encryptedVersion + 1
+	if _, err = old.Open(resealed); err == nil {
+		t.Errorf("Opened a value of an unknown format version")
+	}
+
+	sealed[len(sealed)-1] ^= 1
+	if _, err = old.Open(sealed); err == nil {
+		t.Errorf("Opened a value which has been tampered with")
+	}
+
+	// Without a key ring, and for values written before encryption was
+	// enabled, values are passed through.
+	if resealed, err = nilRing.Seal(plaintext); err != nil ||
+		!bytes.Equal(resealed, plaintext) {
+		t.Errorf("Expected a value to be kept without a key ring, got %q "+
+			"(%v)", resealed, err)
+	}
+	if opened, err = old.Open(plaintext); err != nil ||
+		!bytes.Equal(opened, plaintext) {
+		t.Errorf("Expected a plain text value to be passed through, got "+
+			"%q (%v)", opened, err)
+	}
+	if sealed, err = old.Seal(nil); err != nil || len(sealed) != 0 {
+		t.Errorf("Expected an empty value to be kept, got %q (%v)",
+			sealed, err)
+	}
+}
@@ -32,14 +32,16 @@
 package membersys
 
 import (
-	"database/cassandra"
-	"encoding/binary"
+	"context"
 	"encoding/hex"
 	"errors"
-	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/gocql/gocql"
 	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/membersys/config"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 )
@@ -52,1033 +54,2085 @@ type FormInputData struct {
 	Key        string
 	CommonErr  string
 	FieldErr   map[string]string
+
+	// Language the form is shown in, one of Languages.
+	Language string
+
+	// Fee reduction requested on the form, if any, and the document the
+	// applicant uploaded in support of it. The document is kept in the
+	// blob store.
+	FeeReduction         *FeeReduction
+	FeeReductionDocument []byte
 }
 
+// Membership database kept in Cassandra, accessed using the CQL native
+// protocol. Every lifecycle state has its own table; see cassandra-schema
+// for the table definitions. If "keys" is set, pb_data and the agreement
+// blobs are encrypted with it.
 type MembershipDB struct {
-	conn *cassandra.RetryCassandraClient
+	sess      *gocql.Session
+	retention *config.DatabaseConfig_RetentionConfig
+	keys      *KeyRing
+	blobs     BlobStore
 }
 
 type MemberWithKey struct {
 	Key string `json:"key"`
 	Member
-}
 
-var applicationPrefix string = "applicant:"
-var applicationEnd string = "applicant;"
-var queuePrefix string = "queue:"
-var queueEnd string = "queue;"
-var dequeuePrefix string = "dequeue:"
-var dequeueEnd string = "dequeue;"
-var archivePrefix string = "archive:"
-var archiveEnd string = "archive;"
-var memberPrefix string = "member:"
-var memberEnd string = "member;"
-
-// List of all relevant columns; used for a few copies here.
-var allColumns [][]byte = [][]byte{
-	[]byte("name"), []byte("street"), []byte("city"), []byte("zipcode"),
-	[]byte("country"), []byte("email"), []byte("email_verified"),
-	[]byte("phone"), []byte("fee"), []byte("username"), []byte("pwhash"),
-	[]byte("fee_yearly"), []byte("has_key"), []byte("payments_caught_up_to"),
-	[]byte("sourceip"), []byte("useragent"), []byte("metadata"),
-	[]byte("pb_data"), []byte("application_pdf"), []byte("agreement_pdf"),
-	[]byte("approval_ts"),
+	// Records which may belong to the same person, as found when the
+	// application was submitted. Only filled in for the applicant list.
+	PossibleDuplicates []*PossibleDuplicate `json:"possible_duplicates,omitempty"`
+
+	// Fee reduction requested along with the application, if any. Only
+	// filled in for the applicant list.
+	FeeReduction *FeeReduction `json:"fee_reduction,omitempty"`
 }
 
 // Create a new connection to the membership database on the given "host".
-// Will set the keyspace to "dbname".
+// "host" may be a comma separated list of Cassandra nodes to connect to.
+// Will set the keyspace to "dbname", which must be at the current schema
+// version.
 func NewMembershipDB(host, dbname string, timeout time.Duration) (*MembershipDB, error) {
-	var conn *cassandra.RetryCassandraClient
+	var cluster *gocql.ClusterConfig = gocql.NewCluster(
+		strings.Split(host, ",")...)
+	var sess *gocql.Session
 	var err error
-	conn, err = cassandra.NewRetryCassandraClientTimeout(host, timeout)
+
+	cluster.Keyspace = dbname
+	cluster.Consistency = gocql.Quorum
+	if timeout > 0 {
+		cluster.Timeout = timeout
+		cluster.ConnectTimeout = timeout
+	}
+
+	sess, err = cluster.CreateSession()
 	if err != nil {
 		return nil, err
 	}
-	err = conn.SetKeyspace(dbname)
-	if err != nil {
+
+	// Refuse to work with a schema we don't know how to handle.
+	if err = CheckSchemaVersion(sess, dbname); err != nil {
+		sess.Close()
 		return nil, err
 	}
+
 	return &MembershipDB{
-		conn: conn,
+		sess:  sess,
+		blobs: &cqlBlobStore{sess: sess},
 	}, nil
 }
 
-// Create a new mutation with the given name, value and time stamp.
-func newCassandraMutationBytes(name string, value []byte, now *time.Time, ttl int32) *cassandra.Mutation {
-	var ret = cassandra.NewMutation()
-	var col = cassandra.NewColumn()
-	var now_long = int64(now.UnixNano())
-
-	col.Timestamp = &now_long
-	col.Name = []byte(name)
-	col.Value = value
+// Connect to the Cassandra membership database described by "dbconfig",
+// applying its retention, encryption and blob store settings.
+func OpenMembershipDB(dbconfig *config.DatabaseConfig,
+	timeout time.Duration) (*MembershipDB, error) {
+	var db *MembershipDB
+	var blobs BlobStore
+	var err error
 
-	if ttl > 0 {
-		col.TTL = &ttl
+	if err = checkRetention(dbconfig.Retention); err != nil {
+		return nil, err
+	}
+	db, err = NewMembershipDB(dbconfig.GetDatabaseServer(),
+		dbconfig.GetDatabaseName(), timeout)
+	if err != nil {
+		return nil, err
 	}
 
-	ret.ColumnOrSupercolumn = cassandra.NewColumnOrSuperColumn()
-	ret.ColumnOrSupercolumn.Column = col
+	db.retention = dbconfig.Retention
+	if dbconfig.EncryptionKeyFile != nil {
+		db.keys, err = ReadKeyRing(dbconfig.GetEncryptionKeyFile())
+		if err != nil {
+			db.sess.Close()
+			return nil, err
+		}
+	}
+	if blobs, err = configuredBlobStore(dbconfig); err != nil {
+		db.sess.Close()
+		return nil, err
+	}
+	if blobs != nil {
+		db.blobs = blobs
+	}
 
-	return ret
+	return db, nil
 }
 
-// Create a new mutation with the given name, value and time stamp.
-func newCassandraMutationString(name, value string, now *time.Time) *cassandra.Mutation {
-	return newCassandraMutationBytes(name, []byte(value), now, 0)
-}
+// Encode "pb" for storing it in a pb_data column.
+func (m *MembershipDB) marshal(pb proto.Message) ([]byte, error) {
+	var value []byte
+	var err error
 
-// Funciton for lazy people to add a column to a membership request mutation map.
-func addMembershipRequestInfoBytes(mmap map[string][]*cassandra.Mutation, name string, value []byte, now *time.Time) {
-	mmap["application"] = append(mmap["application"],
-		newCassandraMutationBytes(name, value, now, 0))
+	if value, err = proto.Marshal(pb); err != nil {
+		return nil, err
+	}
+	return m.keys.Seal(value)
 }
 
-// Funciton for lazy people to add a column to a membership request mutation map.
-func addMembershipRequestInfoString(mmap map[string][]*cassandra.Mutation, name string, value *string, now *time.Time) {
-	if value != nil && len(*value) > 0 {
-		mmap["application"] = append(mmap["application"],
-			newCassandraMutationString(name, *value, now))
+// Decode the contents of a pb_data column into "pb".
+func (m *MembershipDB) unmarshal(value []byte, pb proto.Message) error {
+	var err error
+
+	if err = checkEncrypted(m.keys, value); err != nil {
+		return err
+	}
+	if value, err = m.keys.Open(value); err != nil {
+		return err
 	}
+	return proto.Unmarshal(value, pb)
 }
 
-// Store the given membership request in the database.
-func (m *MembershipDB) StoreMembershipRequest(req *FormInputData) (key string, err error) {
-	var bmods map[string]map[string][]*cassandra.Mutation
-	var pb *MembershipAgreement = new(MembershipAgreement)
-	var bdata []byte
-	var now = time.Now()
-	var uuid cassandra.UUID
-	var c_key string
+// Store "data", such as an agreement PDF, in the blob store, encrypted
+// like the records referring to it. Returns the hash to refer to it by.
+func (m *MembershipDB) putBlob(ctx context.Context, data []byte) (
+	string, error) {
+	var hash string = blobHash(data)
+	var value []byte
+	var err error
 
-	// First, let's generate an UUID for the new record.
-	uuid, err = cassandra.GenTimeUUID(&now)
-	if err != nil {
+	if value, err = m.keys.Seal(data); err != nil {
 		return "", err
 	}
+	if err = m.blobs.PutBlob(ctx, hash, value); err != nil {
+		return "", err
+	}
+	return hash, nil
+}
 
-	c_key = applicationPrefix + string(uuid)
-	key = hex.EncodeToString(uuid)
-
-	bmods = make(map[string]map[string][]*cassandra.Mutation)
-	bmods[c_key] = make(map[string][]*cassandra.Mutation)
-	bmods[c_key]["application"] = make([]*cassandra.Mutation, 0)
-
-	addMembershipRequestInfoString(bmods[c_key], "name", req.MemberData.Name, &now)
-	addMembershipRequestInfoString(bmods[c_key], "street", req.MemberData.Street, &now)
-	addMembershipRequestInfoString(bmods[c_key], "city", req.MemberData.City, &now)
-	addMembershipRequestInfoString(bmods[c_key], "zipcode", req.MemberData.Zipcode, &now)
-	addMembershipRequestInfoString(bmods[c_key], "country", req.MemberData.Country, &now)
-	addMembershipRequestInfoString(bmods[c_key], "email", req.MemberData.Email, &now)
-	addMembershipRequestInfoBytes(bmods[c_key], "email_verified", []byte{0}, &now)
-	addMembershipRequestInfoString(bmods[c_key], "phone", req.MemberData.Phone, &now)
-	bdata = make([]byte, 8)
-	binary.BigEndian.PutUint64(bdata, req.MemberData.GetFee())
-	addMembershipRequestInfoBytes(bmods[c_key], "fee", bdata, &now)
-	addMembershipRequestInfoString(bmods[c_key], "username", req.MemberData.Username, &now)
-	addMembershipRequestInfoString(bmods[c_key], "pwhash", req.MemberData.Pwhash, &now)
-	if req.MemberData.GetFeeYearly() {
-		addMembershipRequestInfoBytes(bmods[c_key], "fee_yearly", []byte{1}, &now)
-	} else {
-		addMembershipRequestInfoBytes(bmods[c_key], "fee_yearly", []byte{0}, &now)
+// Translate the lack of a result into a gRPC compatible error.
+func cqlError(err error) error {
+	if err == gocql.ErrNotFound {
+		return grpc.Errorf(codes.NotFound, "Not found")
 	}
+	return err
+}
 
-	// Set the IP explicitly.
-	addMembershipRequestInfoString(bmods[c_key], "sourceip",
-		req.Metadata.RequestSourceIp, &now)
-	addMembershipRequestInfoString(bmods[c_key], "useragent",
-		req.Metadata.UserAgent, &now)
+// Create a query for "stmt" which is cancelled along with "ctx".
+func (m *MembershipDB) query(ctx context.Context, stmt string,
+	values ...interface{}) *gocql.Query {
+	return m.sess.Query(stmt, values...).WithContext(ctx)
+}
 
-	// Add the membership metadata.
-	if req.Metadata.RequestTimestamp == nil {
-		req.Metadata.RequestTimestamp = new(uint64)
-		*req.Metadata.RequestTimestamp = uint64(now.Unix())
-	}
-	pb.MemberData = req.MemberData
-	pb.Metadata = req.Metadata
+// Statement for writing a member record; see memberRecordValues for the
+// values to pass along. Only the columns needed for listing and searching
+// members are kept outside of pb_data.
+const cqlInsertMemberRecord = "INSERT INTO member_records (id, email, " +
+	"pb_data, name, city, country, username, fee, fee_yearly, has_key, " +
+	"payments_caught_up_to, approval_ts, version, category) " +
+	"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+
+// Fields of the member data which are kept in columns of member_records
+// as well as in pb_data.
+var cqlMemberColumns = map[string]bool{
+	"email": true, "name": true, "city": true, "country": true,
+	"username": true, "fee": true, "fee_yearly": true, "has_key": true,
+	"payments_caught_up_to": true, "category": true,
+}
 
-	bdata, err = proto.Marshal(pb)
-	if err != nil {
-		return
+// Values of the columns written by cqlInsertMemberRecord for the member
+// "agreement", which is encoded as "value".
+func memberRecordValues(agreement *MembershipAgreement, value []byte,
+	version int64) []interface{} {
+	var md *Member = agreement.GetMemberData()
+	var payments *int64
+
+	if md.PaymentsCaughtUpTo != nil {
+		payments = proto.Int64(int64(md.GetPaymentsCaughtUpTo()))
 	}
-	addMembershipRequestInfoBytes(bmods[c_key], "pb_data", bdata, &now)
 
-	// Now execute the batch mutation.
-	err = m.conn.BatchMutate(bmods, cassandra.ConsistencyLevel_QUORUM)
-	if err != nil {
-		return
+	return []interface{}{
+		int64(md.GetId()), md.GetEmail(), value, md.GetName(),
+		md.GetCity(), md.GetCountry(), md.Username, int64(md.GetFee()),
+		md.GetFeeYearly(), md.GetHasKey(), payments,
+		int64(agreement.GetMetadata().GetApprovalTimestamp()), version,
+		md.Category,
 	}
-	return
 }
 
-// Retrieve a specific members detailed membership data, but fetch it by the
-// user name of the member.
-func (m *MembershipDB) GetMemberDetailByUsername(username string) (
-	*MembershipAgreement, error) {
-	var member *MembershipAgreement = new(MembershipAgreement)
-	var cp *cassandra.ColumnParent = cassandra.NewColumnParent()
-	var pred *cassandra.SlicePredicate = cassandra.NewSlicePredicate()
-	var kr *cassandra.KeyRange = cassandra.NewKeyRange()
-	var expr *cassandra.IndexExpression = cassandra.NewIndexExpression()
-
-	var r []*cassandra.KeySlice
-	var ks *cassandra.KeySlice
+// Number of times appending to an audit log is attempted while other
+// changes to the records of the same member get in first.
+const auditAttempts = 20
+
+// Append "entries" to the audit log of their subject. Conditional updates
+// can't be batched with writes to other tables, so every entry is written
+// by itself, before the change it records, and only if its sequence number
+// hasn't been claimed yet; otherwise the remaining entries are chained to
+// the entry which got in first. If the change fails afterwards, the log
+// shows a change which may not have been applied, but it never misses one.
+func (m *MembershipDB) audit(ctx context.Context,
+	entries ...*AuditLogEntry) error {
+	var subject string
+	var last *AuditLogEntry
+	var existing map[string]interface{}
+	var value []byte
+	var applied bool
+	var attempt int
 	var err error
 
-	expr.ColumnName = []byte("username")
-	expr.Op = cassandra.IndexOperator_EQ
-	expr.Value = []byte(username)
+	if len(entries) == 0 {
+		return nil
+	}
+	subject = entries[0].GetSubject()
+
+	err = m.query(ctx, "SELECT pb_data FROM audit_log WHERE subject = ? "+
+		"ORDER BY seq DESC LIMIT 1", subject).Scan(&value)
+	if err == nil {
+		last = new(AuditLogEntry)
+		if err = m.unmarshal(value, last); err != nil {
+			return err
+		}
+	} else if err != gocql.ErrNotFound {
+		return err
+	}
 
-	cp.ColumnFamily = "members"
-	pred.ColumnNames = [][]byte{[]byte("pb_data")}
-	kr.StartKey = []byte(memberPrefix)
-	kr.EndKey = []byte(memberEnd)
-	kr.RowFilter = []*cassandra.IndexExpression{expr}
+	for len(entries) > 0 {
+		if attempt >= auditAttempts {
+			return grpc.Errorf(codes.Aborted, "The audit log of %s is "+
+				"being written to concurrently, please try again", subject)
+		}
+		if err = chainAuditEntries(last, entries); err != nil {
+			return err
+		}
+		if value, err = m.marshal(entries[0]); err != nil {
+			return err
+		}
 
-	r, err = m.conn.GetRangeSlices(
-		cp, pred, kr, cassandra.ConsistencyLevel_ONE)
-	if err != nil {
-		return nil, grpc.Errorf(codes.Internal, err.Error())
-	}
+		existing = make(map[string]interface{})
+		applied, err = m.query(ctx, "INSERT INTO audit_log (subject, seq, "+
+			"pb_data) VALUES (?, ?, ?) IF NOT EXISTS", subject,
+			int64(entries[0].GetSequence()), value).MapScanCAS(existing)
+		if err != nil {
+			return err
+		}
 
-	for _, ks = range r {
-		var cos *cassandra.ColumnOrSuperColumn
+		if applied {
+			last = entries[0]
+			entries = entries[1:]
+			continue
+		}
 
-		for _, cos = range ks.Columns {
-			var col = cos.Column
-			if string(col.Name) == "pb_data" {
-				member = new(MembershipAgreement)
-				err = proto.Unmarshal(col.Value, member)
-				return member, err
-			} else {
-				return nil, grpc.Errorf(codes.DataLoss, "Unexpected column "+
-					string(col.Name))
-			}
+		// Another change got the sequence number first; follow it.
+		value, _ = existing["pb_data"].([]byte)
+		last = new(AuditLogEntry)
+		if err = m.unmarshal(value, last); err != nil {
+			return err
 		}
+		attempt++
 	}
 
-	return nil, grpc.Errorf(codes.NotFound, "Not found")
+	return nil
 }
 
-// Retrieve a specific members detailed membership data.
-func (m *MembershipDB) GetMemberDetail(id string) (*MembershipAgreement, error) {
+// Time after which a row of member_emails which doesn't belong to its
+// member is considered to have been left behind by a change which failed
+// halfway. Changes take much less time than this, so rows of changes still
+// in progress are never taken for stale ones.
+const staleEmailAge = 10 * time.Minute
+
+// Determine whether the row of member_emails claiming "email" for the
+// member "number" has been left behind, because there is no such member
+// or the member has another address by now.
+func (m *MembershipDB) staleEmail(ctx context.Context, email string,
+	number int64) (bool, error) {
 	var member *MembershipAgreement = new(MembershipAgreement)
-	var cp *cassandra.ColumnPath = cassandra.NewColumnPath()
-	var r *cassandra.ColumnOrSuperColumn
+	var written int64
+	var value []byte
 	var err error
 
-	cp.ColumnFamily = "members"
-	cp.Column = []byte("pb_data")
-
-	// Retrieve the protobuf with all data from Cassandra.
-	r, err = m.conn.Get(
-		append([]byte(memberPrefix), []byte(id)...),
-		cp, cassandra.ConsistencyLevel_ONE)
-	if err != nil {
-		return nil, err
+	err = m.query(ctx, "SELECT writetime(id) FROM member_emails "+
+		"WHERE email = ?", email).Scan(&written)
+	if err == gocql.ErrNotFound {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	if time.Since(time.Unix(0, written*1000)) < staleEmailAge {
+		return false, nil
 	}
 
-	// Decode the protobuf which was written to the column.
-	err = proto.Unmarshal(r.Column.Value, member)
-	return member, err
+	err = m.query(ctx, "SELECT pb_data FROM member_records WHERE id = ?",
+		number).Scan(&value)
+	if err == gocql.ErrNotFound {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	if err = m.unmarshal(value, member); err != nil {
+		return false, err
+	}
+	return member.GetMemberData().GetEmail() != email, nil
 }
 
-// Update the membership fee for the given member.
-func (m *MembershipDB) SetMemberFee(id string, fee uint64, yearly bool) error {
-	var now time.Time = time.Now()
-	var mmap map[string]map[string][]*cassandra.Mutation
-	var member *MembershipAgreement = new(MembershipAgreement)
-	var cp *cassandra.ColumnPath = cassandra.NewColumnPath()
-	var r *cassandra.ColumnOrSuperColumn
-
-	var mu *cassandra.Mutation = cassandra.NewMutation()
-	var ts int64 = now.UnixNano()
-	var bdata []byte
+// Claim the e-mail address "email" for the member "number". Claiming an
+// address the member holds already succeeds, and rows left behind by
+// changes which failed halfway are replaced.
+func (m *MembershipDB) claimEmail(ctx context.Context, email string,
+	number int64) error {
+	var existing map[string]interface{}
+	var owner int64
+	var applied, stale bool
 	var err error
 
-	cp.ColumnFamily = "members"
-	cp.Column = []byte("pb_data")
-
-	// Retrieve the protobuf with all data from Cassandra.
-	r, err = m.conn.Get(
-		append([]byte(memberPrefix), []byte(id)...),
-		cp, cassandra.ConsistencyLevel_ONE)
-	if err != nil {
+	existing = make(map[string]interface{})
+	applied, err = m.query(ctx, "INSERT INTO member_emails (email, id) "+
+		"VALUES (?, ?) IF NOT EXISTS", email, number).MapScanCAS(existing)
+	if err != nil || applied {
 		return err
 	}
 
-	// Decode the protobuf which was written to the column.
-	err = proto.Unmarshal(r.Column.Value, member)
-	if err != nil {
-		return err
+	owner, _ = existing["id"].(int64)
+	if owner == number {
+		return nil
 	}
-
-	member.MemberData.Fee = &fee
-	member.MemberData.FeeYearly = &yearly
-
-	r.Column.Value, err = proto.Marshal(member)
-	r.Column.Timestamp = &ts
-	if err != nil {
+	if stale, err = m.staleEmail(ctx, email, owner); err != nil {
 		return err
 	}
-
-	// Write pb_data back.
-	mmap = make(map[string]map[string][]*cassandra.Mutation)
-	mmap[memberPrefix+id] = make(map[string][]*cassandra.Mutation)
-	mmap[memberPrefix+id]["members"] = make([]*cassandra.Mutation, 0)
-	mmap[memberPrefix+id]["member_agreements"] = make([]*cassandra.Mutation, 0)
-
-	mu.ColumnOrSupercolumn = cassandra.NewColumnOrSuperColumn()
-	mu.ColumnOrSupercolumn.Column = r.Column
-	mmap[memberPrefix+id]["members"] = append(
-		mmap[memberPrefix+id]["members"], mu)
-	mmap[memberPrefix+id]["member_agreements"] = append(
-		mmap[memberPrefix+id]["member_agreements"], mu)
-
-	// Now update data columns.
-	bdata = make([]byte, 8)
-	binary.BigEndian.PutUint64(bdata, fee)
-	mu = newCassandraMutationBytes("fee", bdata, &now, 0)
-	mmap[memberPrefix+id]["members"] = append(
-		mmap[memberPrefix+id]["members"], mu)
-
-	bdata = make([]byte, 1)
-	if yearly {
-		bdata[0] = 1
-	} else {
-		bdata[0] = 0
+	if stale {
+		applied, err = m.query(ctx, "UPDATE member_emails SET id = ? "+
+			"WHERE email = ? IF id = ?", number, email, owner).MapScanCAS(
+			make(map[string]interface{}))
+		if err != nil || applied {
+			return err
+		}
 	}
-	mu = newCassandraMutationBytes("fee_yearly", bdata, &now, 0)
-	mmap[memberPrefix+id]["members"] = append(
-		mmap[memberPrefix+id]["members"], mu)
 
-	return m.conn.AtomicBatchMutate(
-		mmap, cassandra.ConsistencyLevel_QUORUM)
+	return grpc.Errorf(codes.AlreadyExists,
+		"There already is a member with the e-mail address %s", email)
 }
 
-// Update the specified long field for the given member.
-func (m *MembershipDB) SetLongValue(
-	id string, field string, value uint64) error {
-	var now time.Time = time.Now()
-	var mmap map[string]map[string][]*cassandra.Mutation
-	var member *MembershipAgreement = new(MembershipAgreement)
-	var cp *cassandra.ColumnPath = cassandra.NewColumnPath()
-	var r *cassandra.ColumnOrSuperColumn
+// Release the claim of the member "number" on the e-mail address "email",
+// e.g. after the change claiming it failed. This is done even if the
+// request has been cancelled in the meantime. Errors are ignored, since
+// claimEmail replaces rows which have been left behind.
+func (m *MembershipDB) releaseEmail(email string, number int64) {
+	m.query(context.Background(), "DELETE FROM member_emails "+
+		"WHERE email = ? IF id = ?", email, number).MapScanCAS(
+		make(map[string]interface{}))
+}
 
-	var mu *cassandra.Mutation = cassandra.NewMutation()
-	var ts int64 = now.UnixNano()
+// Clean up after the batch creating the record of the member "number" with
+// the e-mail address "email" failed with "err": the claim on the address
+// is released, unless the record has been written nonetheless, e.g. if
+// only the response timed out. Returns "err".
+func (m *MembershipDB) abandonMember(email string, number int64,
+	err error) error {
+	var id int64
+
+	if m.query(context.Background(), "SELECT id FROM member_records "+
+		"WHERE id = ?", number).Scan(&id) == gocql.ErrNotFound {
+		m.releaseEmail(email, number)
+	}
+	return err
+}
+
+// Store the given membership request in the database.
+func (m *MembershipDB) StoreMembershipRequest(ctx context.Context,
+	req *FormInputData) (key string, err error) {
+	var pb *MembershipAgreement = new(MembershipAgreement)
+	var now = time.Now()
+	var batch *gocql.Batch
+	var uuid gocql.UUID
 	var bdata []byte
-	var err error
 
-	cp.ColumnFamily = "members"
-	cp.Column = []byte("pb_data")
+	// First, let's generate an UUID for the new record.
+	uuid = gocql.UUIDFromTime(now)
+	key = hex.EncodeToString(uuid[:])
 
-	// Retrieve the protobuf with all data from Cassandra.
-	r, err = m.conn.Get(
-		append([]byte(memberPrefix), []byte(id)...),
-		cp, cassandra.ConsistencyLevel_ONE)
-	if err != nil {
-		return err
+	// Add the membership metadata.
+	if req.Metadata.RequestTimestamp == nil {
+		req.Metadata.RequestTimestamp = new(uint64)
+		*req.Metadata.RequestTimestamp = uint64(now.Unix())
 	}
+	pb.MemberData = req.MemberData
+	pb.Metadata = req.Metadata
+	pb.FeeReduction = req.FeeReduction
 
-	// Decode the protobuf which was written to the column.
-	err = proto.Unmarshal(r.Column.Value, member)
-	if err != nil {
-		return err
+	if pb.FeeReduction != nil && len(req.FeeReductionDocument) > 0 {
+		var hash string
+		if hash, err = m.putBlob(ctx, req.FeeReductionDocument); err != nil {
+			return
+		}
+		pb.FeeReduction.DocumentHash = proto.String(hash)
 	}
 
-	if field == "payments_caught_up_to" {
-		member.MemberData.PaymentsCaughtUpTo = proto.Uint64(value)
-	} else {
-		return fmt.Errorf("Unknown field specified: %s", field)
+	bdata, err = m.marshal(pb)
+	if err != nil {
+		return
 	}
 
-	r.Column.Value, err = proto.Marshal(member)
-	r.Column.Timestamp = &ts
+	batch = m.sess.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	addApplicationToBatch(batch, uuid, pb, bdata)
+
+	err = m.audit(ctx, newAuditMove(applicantActor(req), pb,
+		uuid.String(), AuditActionApply, "", "application", now))
 	if err != nil {
-		return err
+		return
 	}
 
-	// Write pb_data back.
-	mmap = make(map[string]map[string][]*cassandra.Mutation)
-	mmap[memberPrefix+id] = make(map[string][]*cassandra.Mutation)
-	mmap[memberPrefix+id]["members"] = make([]*cassandra.Mutation, 0)
-	mmap[memberPrefix+id]["member_agreements"] = make([]*cassandra.Mutation, 0)
+	err = m.sess.ExecuteBatch(batch)
+	return
+}
+
+// Retrieve a specific members detailed membership data, but fetch it by the
+// user name of the member.
+func (m *MembershipDB) GetMemberDetailByUsername(ctx context.Context,
+	username string) (*MembershipAgreement, error) {
+	var member *MembershipAgreement = new(MembershipAgreement)
+	var value []byte
+	var err error
+
+	err = m.query(ctx, "SELECT pb_data FROM member_records "+
+		"WHERE username = ?", username).Consistency(gocql.One).Scan(&value)
+	if err == gocql.ErrNotFound {
+		return nil, grpc.Errorf(codes.NotFound, "Not found")
+	} else if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	} else if err != nil {
+		return nil, grpc.Errorf(codes.Internal, err.Error())
+	}
 
-	mu.ColumnOrSupercolumn = cassandra.NewColumnOrSuperColumn()
-	mu.ColumnOrSupercolumn.Column = r.Column
-	mmap[memberPrefix+id]["members"] = append(
-		mmap[memberPrefix+id]["members"], mu)
-	mmap[memberPrefix+id]["member_agreements"] = append(
-		mmap[memberPrefix+id]["member_agreements"], mu)
+	err = m.unmarshal(value, member)
+	return member, err
+}
 
-	// Now update data columns.
-	bdata = make([]byte, 8)
-	binary.BigEndian.PutUint64(bdata, value)
-	mu = newCassandraMutationBytes(field, bdata, &now, 0)
-	mmap[memberPrefix+id]["members"] = append(
-		mmap[memberPrefix+id]["members"], mu)
+// Look up the membership number of the member with the e-mail address
+// "email".
+func (m *MembershipDB) memberNumber(ctx context.Context, email string) (
+	int64, error) {
+	var number int64
+	var err error
 
-	return m.conn.AtomicBatchMutate(
-		mmap, cassandra.ConsistencyLevel_QUORUM)
+	err = m.query(ctx, "SELECT id FROM member_emails WHERE email = ?",
+		email).Scan(&number)
+	if err != nil {
+		return 0, cqlError(err)
+	}
+	return number, nil
 }
 
-// Update the specified boolean field for the given member.
-func (m *MembershipDB) SetBoolValue(id string, field string, value bool) error {
-	var now time.Time = time.Now()
-	var mmap map[string]map[string][]*cassandra.Mutation
+// Fetch the record of the member with the e-mail address "email", along
+// with their membership number and the version of the record.
+func (m *MembershipDB) getMember(ctx context.Context, email string) (
+	*MembershipAgreement, int64, int64, error) {
 	var member *MembershipAgreement = new(MembershipAgreement)
-	var cp *cassandra.ColumnPath = cassandra.NewColumnPath()
-	var r *cassandra.ColumnOrSuperColumn
-
-	var mu *cassandra.Mutation = cassandra.NewMutation()
-	var ts int64 = now.UnixNano()
-	var bdata []byte
+	var number int64
+	var value []byte
+	var version *int64
 	var err error
 
-	cp.ColumnFamily = "members"
-	cp.Column = []byte("pb_data")
+	if number, err = m.memberNumber(ctx, email); err != nil {
+		return nil, 0, 0, err
+	}
 
 	// Retrieve the protobuf with all data from Cassandra.
-	r, err = m.conn.Get(
-		append([]byte(memberPrefix), []byte(id)...),
-		cp, cassandra.ConsistencyLevel_ONE)
+	err = m.query(ctx, "SELECT pb_data, version FROM member_records "+
+		"WHERE id = ?", number).Consistency(gocql.One).Scan(&value, &version)
 	if err != nil {
-		return err
+		return nil, 0, 0, cqlError(err)
 	}
 
 	// Decode the protobuf which was written to the column.
-	err = proto.Unmarshal(r.Column.Value, member)
-	if err != nil {
-		return err
+	if err = m.unmarshal(value, member); err != nil {
+		return nil, 0, 0, err
 	}
-
-	if field == "has_key" {
-		member.MemberData.HasKey = proto.Bool(value)
-	} else {
-		return fmt.Errorf("Unknown field specified: %s", field)
+	// The address may have been left behind by a change which failed
+	// halfway.
+	if member.GetMemberData().GetEmail() != email {
+		return nil, 0, 0, grpc.Errorf(codes.NotFound, "Not found")
 	}
-
-	r.Column.Value, err = proto.Marshal(member)
-	r.Column.Timestamp = &ts
-	if err != nil {
-		return err
+	if version == nil {
+		return member, number, 0, nil
 	}
+	return member, number, *version, nil
+}
 
-	// Write pb_data back.
-	mmap = make(map[string]map[string][]*cassandra.Mutation)
-	mmap[memberPrefix+id] = make(map[string][]*cassandra.Mutation)
-	mmap[memberPrefix+id]["members"] = make([]*cassandra.Mutation, 0)
-	mmap[memberPrefix+id]["member_agreements"] = make([]*cassandra.Mutation, 0)
-
-	mu.ColumnOrSupercolumn = cassandra.NewColumnOrSuperColumn()
-	mu.ColumnOrSupercolumn.Column = r.Column
-	mmap[memberPrefix+id]["members"] = append(
-		mmap[memberPrefix+id]["members"], mu)
-	mmap[memberPrefix+id]["member_agreements"] = append(
-		mmap[memberPrefix+id]["member_agreements"], mu)
-
-	// Now update data columns.
-	bdata = make([]byte, 1)
-	if value {
-		bdata[0] = 1
-	} else {
-		bdata[0] = 0
-	}
-	mu = newCassandraMutationBytes(field, bdata, &now, 0)
-	mmap[memberPrefix+id]["members"] = append(
-		mmap[memberPrefix+id]["members"], mu)
+// Retrieve a specific members detailed membership data, along with the
+// version of the record.
+func (m *MembershipDB) GetMemberDetail(ctx context.Context,
+	id string) (*MembershipAgreement, int64, error) {
+	var member *MembershipAgreement
+	var version int64
+	var err error
 
-	return m.conn.AtomicBatchMutate(
-		mmap, cassandra.ConsistencyLevel_QUORUM)
+	member, _, version, err = m.getMember(ctx, id)
+	return member, version, err
 }
 
-// Update the specified text column on the membership data.
-func (m *MembershipDB) SetTextValue(id string, field, value string) error {
-	var now time.Time = time.Now()
-	var mmap map[string]map[string][]*cassandra.Mutation
-	var member *MembershipAgreement = new(MembershipAgreement)
-	var cp *cassandra.ColumnPath = cassandra.NewColumnPath()
-	var r *cassandra.ColumnOrSuperColumn
-
-	var mu *cassandra.Mutation = cassandra.NewMutation()
-	var ts int64 = now.UnixNano()
+// Fetch the member "id", apply "modify" to the membership data and write
+// it back, along with the denormalised "columns" it changed. The update is
+// only applied if the record is still at "version", using a lightweight
+// transaction. Conditional updates can't span tables, so the previous
+// state is kept as a revision and changes to the columns are recorded in
+// the audit log before the record is updated; if the update turns out to
+// conflict with another one, this is recorded in the audit log as well.
+// If the e-mail address is changed, the new address is claimed for the
+// member first, and the old one released afterwards.
+func (m *MembershipDB) updateMember(ctx context.Context, id string,
+	version int64, columns []string, actor *Actor,
+	modify func(*MembershipAgreement) error) (int64, error) {
+	var before, member *MembershipAgreement
+	var entries, moved []*AuditLogEntry
+	var number, current int64
+	var args []interface{}
+	var query string = "UPDATE member_records SET pb_data = ?, version = ?"
+	var column, email string
+	var value, prev []byte
+	var applied bool
 	var err error
 
-	cp.ColumnFamily = "members"
-	cp.Column = []byte("pb_data")
+	if before, number, current, err = m.getMember(ctx, id); err != nil {
+		return 0, err
+	}
+	if current != version {
+		return 0, versionConflict(id)
+	}
 
-	// Retrieve the protobuf with all data from Cassandra.
-	r, err = m.conn.Get(
-		append([]byte(memberPrefix), []byte(id)...),
-		cp, cassandra.ConsistencyLevel_ONE)
-	if err != nil {
-		return err
+	member = proto.Clone(before).(*MembershipAgreement)
+	if err = modify(member); err != nil {
+		return 0, err
 	}
+	entries = newAuditEdits(actor, id, before.GetMemberData(),
+		member.GetMemberData(), columns, time.Now())
 
-	// Decode the protobuf which was written to the column.
-	err = proto.Unmarshal(r.Column.Value, member)
+	if value, err = m.marshal(member); err != nil {
+		return 0, err
+	}
+	if prev, err = m.marshal(before); err != nil {
+		return 0, err
+	}
+
+	email = member.GetMemberData().GetEmail()
+	if email != id {
+		if err = m.claimEmail(ctx, email, number); err != nil {
+			return 0, err
+		}
+		moved = auditEntriesFor(email, entries)
+	}
+
+	// The revision holds the state at "version", so writing it again if
+	// the update fails does no harm.
+	err = m.query(ctx, "INSERT INTO member_record_revisions (id, version, "+
+		"pb_data) VALUES (?, ?, ?)", number, version, prev).Exec()
+	if err == nil {
+		err = m.audit(ctx, moved...)
+	}
+	if err == nil {
+		err = m.audit(ctx, entries...)
+	}
 	if err != nil {
-		return err
+		if email != id {
+			m.releaseEmail(email, number)
+		}
+		return 0, err
 	}
 
-	if field == "name" {
-		member.MemberData.Name = proto.String(value)
-	} else if field == "street" {
-		member.MemberData.Street = proto.String(value)
-	} else if field == "city" {
-		member.MemberData.City = proto.String(value)
-	} else if field == "zipcode" {
-		member.MemberData.Zipcode = proto.String(value)
-	} else if field == "country" {
-		member.MemberData.Country = proto.String(value)
-	} else if field == "phone" {
-		member.MemberData.Phone = proto.String(value)
-	} else if field == "username" {
-		if member.MemberData.Username != nil && *member.MemberData.Username != "" {
-			return errors.New("Cannot modify user name")
-		}
-		member.MemberData.Username = proto.String(value)
-	} else {
-		return fmt.Errorf("Unknown field specified: %s", field)
+	current = nextVersion(version)
+	args = append(args, value, current)
+	for _, column = range columns {
+		if !cqlMemberColumns[column] {
+			continue
+		}
+		query += ", " + column + " = ?"
+		args = append(args, memberColumnValue(member.MemberData, column))
 	}
+	args = append(args, number, version)
 
-	r.Column.Value, err = proto.Marshal(member)
-	r.Column.Timestamp = &ts
+	applied, err = m.query(ctx, query+" WHERE id = ? IF version = ?",
+		args...).MapScanCAS(make(map[string]interface{}))
 	if err != nil {
-		return err
+		// The update may have been applied nonetheless, so the new
+		// address stays claimed.
+		return 0, err
+	}
+	if !applied {
+		m.audit(ctx, newAuditConflict(actor, id, entries, time.Now())...)
+		if email != id {
+			m.audit(ctx, newAuditConflict(actor, email, moved,
+				time.Now())...)
+			m.releaseEmail(email, number)
+		}
+		return 0, versionConflict(id)
+	}
+
+	if email != id {
+		m.releaseEmail(id, number)
 	}
+	return current, nil
+}
 
-	// Write pb_data back.
-	mmap = make(map[string]map[string][]*cassandra.Mutation)
-	mmap[memberPrefix+id] = make(map[string][]*cassandra.Mutation)
-	mmap[memberPrefix+id]["members"] = make([]*cassandra.Mutation, 0)
-	mmap[memberPrefix+id]["member_agreements"] = make([]*cassandra.Mutation, 0)
+// Update the membership fee for the given member.
+func (m *MembershipDB) SetMemberFee(ctx context.Context, id string, fee uint64,
+	yearly bool, version int64, actor *Actor) (int64, error) {
+	return m.updateMember(ctx, id, version, []string{"fee", "fee_yearly"}, actor,
+		func(member *MembershipAgreement) error {
+			member.MemberData.Fee = &fee
+			member.MemberData.FeeYearly = &yearly
+			return nil
+		})
+}
 
-	mu.ColumnOrSupercolumn = cassandra.NewColumnOrSuperColumn()
-	mu.ColumnOrSupercolumn.Column = r.Column
-	mmap[memberPrefix+id]["members"] = append(
-		mmap[memberPrefix+id]["members"], mu)
-	mmap[memberPrefix+id]["member_agreements"] = append(
-		mmap[memberPrefix+id]["member_agreements"], mu)
+// Update the specified long field for the given member.
+func (m *MembershipDB) SetLongValue(ctx context.Context, id string,
+	field string, value uint64, version int64, actor *Actor) (int64, error) {
+	return m.updateMember(ctx, id, version, []string{field}, actor,
+		func(member *MembershipAgreement) error {
+			return setMemberLongField(member, field, value)
+		})
+}
 
-	// Now update data columns.
-	mu = newCassandraMutationString(field, value, &now)
-	mmap[memberPrefix+id]["members"] = append(
-		mmap[memberPrefix+id]["members"], mu)
+// Update the specified boolean field for the given member.
+func (m *MembershipDB) SetBoolValue(ctx context.Context, id string,
+	field string, value bool, version int64, actor *Actor) (int64, error) {
+	return m.updateMember(ctx, id, version, []string{field}, actor,
+		func(member *MembershipAgreement) error {
+			return setMemberBoolField(member, field, value)
+		})
+}
 
-	return m.conn.AtomicBatchMutate(
-		mmap, cassandra.ConsistencyLevel_QUORUM)
+// Update the specified text column on the membership data.
+func (m *MembershipDB) SetTextValue(ctx context.Context, id string, field,
+	value string, version int64, actor *Actor) (int64, error) {
+	return m.updateMember(ctx, id, version, []string{field}, actor,
+		func(member *MembershipAgreement) error {
+			return setMemberTextField(member, field, value)
+		})
 }
 
-// Retrieve an individual applicants data.
-func (m *MembershipDB) GetMembershipRequest(id, table, prefix string) (*MembershipAgreement, int64, error) {
-	var uuid cassandra.UUID
+// Retrieve an individual applicants data. The prefix is not needed with
+// CQL, since every lifecycle state has its own table.
+func (m *MembershipDB) GetMembershipRequest(ctx context.Context, id, table,
+	prefix string) (*MembershipAgreement, int64, error) {
+	var uuid gocql.UUID
 	var member *MembershipAgreement = new(MembershipAgreement)
-	var cp *cassandra.ColumnPath = cassandra.NewColumnPath()
-	var r *cassandra.ColumnOrSuperColumn
+	var value []byte
+	var timestamp int64
 	var err error
 
-	if uuid, err = cassandra.ParseUUID(id); err != nil {
+	if err = checkRecordTable(table); err != nil {
 		return nil, 0, err
 	}
 
-	cp.ColumnFamily = table
-	cp.Column = []byte("pb_data")
+	if uuid, err = gocql.ParseUUID(id); err != nil {
+		return nil, 0, err
+	}
 
 	// Retrieve the protobuf with all data from Cassandra.
-	r, err = m.conn.Get(
-		append([]byte(prefix), []byte(uuid)...),
-		cp, cassandra.ConsistencyLevel_ONE)
+	err = m.query(ctx, "SELECT pb_data, WRITETIME(pb_data) FROM "+table+
+		" WHERE id = ?", uuid).Consistency(gocql.One).Scan(
+		&value, &timestamp)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, cqlError(err)
 	}
 
 	// Decode the protobuf which was written to the column.
-	err = proto.Unmarshal(r.Column.Value, member)
-	return member, *r.Column.Timestamp, err
+	err = m.unmarshal(value, member)
+	return member, timestamp, err
+}
+
+// Determine the condition for listing the rows of a table starting at the
+// partition key "prev". Rows are returned in token order, so paging has to
+// compare tokens rather than keys. If "prev" ends in a NUL byte, the list
+// starts after the key instead.
+func cqlPageStart(column, prev string) (string, string) {
+	if len(prev) == 0 {
+		return "", ""
+	}
+	if strings.HasSuffix(prev, "\000") {
+		return "token(" + column + ") > token(?)",
+			strings.TrimSuffix(prev, "\000")
+	}
+	return "token(" + column + ") >= token(?)", prev
+}
+
+// Build the query for listing the rows of a table starting at "prev".
+// Without a search criterion, Cassandra only needs to return "num" rows.
+// Otherwise the rows are filtered as they are read, so the query is left
+// open and the caller stops reading once it has found "num" matches.
+func (m *MembershipDB) pageQuery(ctx context.Context, query string,
+	args []interface{}, criterion string, num int32) *gocql.Query {
+	if len(criterion) == 0 {
+		query += " LIMIT ?"
+		args = append(args, num)
+	}
+	return m.query(ctx, query, args...).Consistency(gocql.One)
 }
 
 // Get a list of all members currently in the database. Returns a set of
-// "num" entries beginning after "prev".
-// Returns a filled-out member structure and the timestamp when the
-// membership was approved.
-func (m *MembershipDB) EnumerateMembers(prev string, num int32) (
-	[]*Member, error) {
-	var cp *cassandra.ColumnParent = cassandra.NewColumnParent()
-	var pred *cassandra.SlicePredicate = cassandra.NewSlicePredicate()
-	var r *cassandra.KeyRange = cassandra.NewKeyRange()
-	var kss []*cassandra.KeySlice
-	var ks *cassandra.KeySlice
+// "num" entries meeting "filter", beginning at "prev". Conditions on the
+// indexed columns are evaluated by Cassandra, the others are checked as
+// the rows are read.
+// Returns a filled-out member structure.
+func (m *MembershipDB) EnumerateMembers(ctx context.Context,
+	filter *MemberFilter, prev string, num int32) ([]*Member, error) {
+	var query string = "SELECT id, email, name, city, country, " +
+		"username, fee, fee_yearly, has_key, payments_caught_up_to, " +
+		"category, approval_ts FROM member_records"
+	var conds []string
+	var args []interface{}
+	var cond, start string
+	var indexed, scan bool
+	var iter *gocql.Iter
 	var rv []*Member
 	var err error
 
-	// Fetch all relevant non-protobuf columns of the members column family.
-	cp.ColumnFamily = "members"
-	pred.ColumnNames = [][]byte{
-		[]byte("name"), []byte("city"), []byte("country"), []byte("email"),
-		[]byte("phone"), []byte("username"), []byte("fee"),
-		[]byte("fee_yearly"), []byte("has_key"),
-		[]byte("payments_caught_up_to"),
+	var number, fee, approved int64
+	var name, city, country string
+	var email, username, category *string
+	var feeYearly bool
+	var hasKey *bool
+	var paymentsCaughtUpTo *int64
+
+	// Fetch all relevant non-protobuf columns of the members table.
+	if cond, start = cqlPageStart("id", prev); len(cond) > 0 {
+		if number, err = strconv.ParseInt(start, 10, 64); err != nil {
+			return nil, grpc.Errorf(codes.InvalidArgument,
+				"Invalid membership number %s", start)
+		}
+		conds = append(conds, cond)
+		args = append(args, number)
 	}
-	r.StartKey = []byte(memberPrefix + prev)
-	r.EndKey = []byte(memberEnd)
-	r.Count = num
 
-	kss, err = m.conn.GetRangeSlices(
-		cp, pred, r, cassandra.ConsistencyLevel_ONE)
-	if err != nil {
-		return rv, err
+	if filter != nil {
+		if len(filter.Country) > 0 {
+			conds = append(conds, "country = ?")
+			args = append(args, filter.Country)
+			indexed = true
+		}
+		if len(filter.Category) > 0 {
+			conds = append(conds, "category = ?")
+			args = append(args, filter.Category)
+			indexed = true
+		}
+		if filter.HasKey != nil {
+			conds = append(conds, "has_key = ?")
+			args = append(args, *filter.HasKey)
+			indexed = true
+		}
+		if filter.FeeYearly != nil {
+			conds = append(conds, "fee_yearly = ?")
+			args = append(args, *filter.FeeYearly)
+			indexed = true
+		}
+		if filter.MinFee != nil {
+			conds = append(conds, "fee >= ?")
+			args = append(args, int64(*filter.MinFee))
+			indexed = true
+		}
+		if filter.MaxFee != nil {
+			conds = append(conds, "fee <= ?")
+			args = append(args, int64(*filter.MaxFee))
+			indexed = true
+		}
+		if filter.ApprovedAfter != nil {
+			conds = append(conds, "approval_ts >= ?")
+			args = append(args, int64(*filter.ApprovedAfter))
+			indexed = true
+		}
+		if filter.ApprovedBefore != nil {
+			conds = append(conds, "approval_ts < ?")
+			args = append(args, int64(*filter.ApprovedBefore))
+			indexed = true
+		}
+
+		// Members who have never paid have no payments_caught_up_to
+		// value, so arrears can't be left to Cassandra.
+		scan = len(filter.Criterion) > 0 || filter.PaidBefore != nil
 	}
 
-	for _, ks = range kss {
-		var member *Member = new(Member)
-		var scol *cassandra.ColumnOrSuperColumn
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	if !scan {
+		query += " LIMIT ?"
+		args = append(args, num)
+	}
+	if indexed {
+		query += " ALLOW FILTERING"
+	}
 
-		if len(ks.Columns) == 0 {
-			continue
+	iter = m.query(ctx, query, args...).Consistency(gocql.One).Iter()
+	for iter.Scan(&number, &email, &name, &city, &country, &username,
+		&fee, &feeYearly, &hasKey, &paymentsCaughtUpTo, &category,
+		&approved) {
+		var member *Member = &Member{
+			Id:        proto.Uint64(uint64(number)),
+			Email:     email,
+			Name:      proto.String(name),
+			City:      proto.String(city),
+			Country:   proto.String(country),
+			Username:  username,
+			Fee:       proto.Uint64(uint64(fee)),
+			FeeYearly: proto.Bool(feeYearly),
+			HasKey:    hasKey,
+			Category:  category,
+		}
+		if paymentsCaughtUpTo != nil {
+			member.PaymentsCaughtUpTo =
+				proto.Uint64(uint64(*paymentsCaughtUpTo))
 		}
 
-		member.Email = proto.String(string(ks.Key[len(memberPrefix):]))
-
-		for _, scol = range ks.Columns {
-			var col *cassandra.Column = scol.Column
-			var colname string = string(col.Name)
-
-			if colname == "name" {
-				member.Name = proto.String(string(col.Value))
-			} else if colname == "street" {
-				member.Street = proto.String(string(col.Value))
-			} else if colname == "city" {
-				member.City = proto.String(string(col.Value))
-			} else if colname == "country" {
-				member.Country = proto.String(string(col.Value))
-			} else if colname == "email" {
-				member.Email = proto.String(string(col.Value))
-			} else if colname == "phone" {
-				member.Phone = proto.String(string(col.Value))
-			} else if colname == "username" {
-				member.Username = proto.String(string(col.Value))
-			} else if colname == "fee" {
-				member.Fee = proto.Uint64(binary.BigEndian.Uint64(col.Value))
-			} else if colname == "fee_yearly" {
-				member.FeeYearly = proto.Bool(col.Value[0] == 1)
-			} else if colname == "has_key" {
-				member.HasKey = proto.Bool(col.Value[0] == 1)
-			} else if colname == "payments_caught_up_to" {
-				member.PaymentsCaughtUpTo =
-					proto.Uint64(binary.BigEndian.Uint64(col.Value))
-			}
+		if !filter.matches(member, uint64(approved)) {
+			continue
 		}
 
 		rv = append(rv, member)
+		if int32(len(rv)) >= num {
+			break
+		}
 	}
 
-	return rv, nil
+	return rv, iter.Close()
 }
 
 // Get a list of all membership applications currently in the database.
-// Returns a set of "num" entries beginning after "prev". If "criterion" is
-// given, it will be compared against the name of the member.
-func (m *MembershipDB) EnumerateMembershipRequests(criterion, prev string, num int32) (
-	[]*MemberWithKey, error) {
-	var cp *cassandra.ColumnParent = cassandra.NewColumnParent()
-	var pred *cassandra.SlicePredicate = cassandra.NewSlicePredicate()
-	var r *cassandra.KeyRange = cassandra.NewKeyRange()
-	var kss []*cassandra.KeySlice
-	var ks *cassandra.KeySlice
+// Returns a set of "num" entries beginning at "prev". If "criterion" is
+// given, only applicants matching it are returned.
+func (m *MembershipDB) EnumerateMembershipRequests(ctx context.Context,
+	criterion, prev string, num int32) ([]*MemberWithKey, error) {
+	var query string = "SELECT id, name, city, email, username, " +
+		"fee, fee_yearly, category FROM application"
+	var args []interface{}
+	var iter *gocql.Iter
 	var rv []*MemberWithKey
+	var uuid gocql.UUID
 	var err error
 
-	// Fetch the name, street, city and fee columns of the application column family.
-	cp.ColumnFamily = "application"
-	pred.ColumnNames = [][]byte{
-		[]byte("name"), []byte("street"), []byte("city"), []byte("fee"),
-		[]byte("fee_yearly"),
-	}
+	var name, city, email, username, category *string
+	var fee int64
+	var feeYearly bool
+
+	// Fetch the name, city and fee columns of the application table.
 	if len(prev) > 0 {
-		var uuid cassandra.UUID
-		if uuid, err = cassandra.ParseUUID(prev); err != nil {
+		if uuid, err = gocql.ParseUUID(prev); err != nil {
 			return rv, err
 		}
-		r.StartKey = append([]byte(applicationPrefix), []byte(uuid)...)
-	} else {
-		r.StartKey = []byte(applicationPrefix)
+		query += " WHERE token(id) >= token(?)"
+		args = append(args, uuid)
 	}
-	r.EndKey = []byte(applicationEnd)
-	r.Count = num
 
-	kss, err = m.conn.GetRangeSlices(
-		cp, pred, r, cassandra.ConsistencyLevel_ONE)
-	if err != nil {
-		return rv, err
-	}
-
-	for _, ks = range kss {
+	iter = m.pageQuery(ctx, query, args, criterion, num).Iter()
+	for iter.Scan(&uuid, &name, &city, &email, &username, &fee,
+		&feeYearly, &category) {
 		var member *MemberWithKey = new(MemberWithKey)
-		var scol *cassandra.ColumnOrSuperColumn
-		var uuid cassandra.UUID = cassandra.UUIDFromBytes(
-			ks.Key[len(applicationPrefix):])
 
 		member.Key = uuid.String()
-
-		if len(ks.Columns) == 0 {
+		member.Name = name
+		member.City = city
+		member.Email = email
+		member.Username = username
+		member.Fee = proto.Uint64(uint64(fee))
+		member.FeeYearly = proto.Bool(feeYearly)
+		member.Category = category
+
+		if !matchesCriterion(&member.Member, criterion) {
 			continue
 		}
 
-		for _, scol = range ks.Columns {
-			var col *cassandra.Column = scol.Column
-
-			if string(col.Name) == "name" {
-				member.Name = proto.String(string(col.Value))
-			} else if string(col.Name) == "street" {
-				member.Street = proto.String(string(col.Value))
-			} else if string(col.Name) == "city" {
-				member.City = proto.String(string(col.Value))
-			} else if string(col.Name) == "fee" {
-				member.Fee = proto.Uint64(binary.BigEndian.Uint64(col.Value))
-			} else if string(col.Name) == "fee_yearly" {
-				member.FeeYearly = proto.Bool(col.Value[0] == 1)
-			}
+		rv = append(rv, member)
+		if int32(len(rv)) >= num {
+			break
 		}
+	}
 
-		rv = append(rv, member)
-	}
-
-	return rv, nil
+	return rv, iter.Close()
 }
 
 // Get a list of all future members which are currently in the queue.
-func (m *MembershipDB) EnumerateQueuedMembers(prev string, num int32) ([]*MemberWithKey, error) {
-	return m.enumerateQueuedMembersIn(
-		"membership_queue", queuePrefix, queueEnd, prev, num)
+func (m *MembershipDB) EnumerateQueuedMembers(ctx context.Context,
+	criterion, prev string, num int32) ([]*MemberWithKey, error) {
+	return m.enumerateQueuedMembersIn(ctx, "membership_queue", criterion, prev,
+		num)
 }
 
 // Get a list of all future members which are currently in the departing queue.
-func (m *MembershipDB) EnumerateDeQueuedMembers(prev string, num int32) ([]*MemberWithKey, error) {
-	return m.enumerateQueuedMembersIn(
-		"membership_dequeue", dequeuePrefix, dequeueEnd, prev, num)
-}
-
-func (m *MembershipDB) enumerateQueuedMembersIn(
-	cf, prefix, end, prev string, num int32) ([]*MemberWithKey, error) {
-	var cp *cassandra.ColumnParent = cassandra.NewColumnParent()
-	var pred *cassandra.SlicePredicate = cassandra.NewSlicePredicate()
-	var r *cassandra.KeyRange = cassandra.NewKeyRange()
-	var kss []*cassandra.KeySlice
-	var ks *cassandra.KeySlice
+func (m *MembershipDB) EnumerateDeQueuedMembers(ctx context.Context,
+	criterion, prev string, num int32) ([]*MemberWithKey, error) {
+	return m.enumerateQueuedMembersIn(ctx, "membership_dequeue", criterion, prev,
+		num)
+}
+
+// Get a list of all members which are currently in the trash.
+func (m *MembershipDB) EnumerateTrashedMembers(ctx context.Context,
+	criterion, prev string, num int32) ([]*MemberWithKey, error) {
+	return m.enumerateQueuedMembersIn(ctx, "membership_archive", criterion, prev,
+		num)
+}
+
+func (m *MembershipDB) enumerateQueuedMembersIn(ctx context.Context,
+	table, criterion, prev string, num int32) ([]*MemberWithKey, error) {
+	var query string = "SELECT id, pb_data FROM " + table
+	var args []interface{}
+	var iter *gocql.Iter
 	var rv []*MemberWithKey
+	var uuid gocql.UUID
+	var value []byte
 	var err error
 
-	// Fetch the protobuf column of the application column family.
-	cp.ColumnFamily = cf
-	pred.ColumnNames = [][]byte{
-		[]byte("pb_data"),
-	}
+	// Fetch the protobuf column of the table.
 	if len(prev) > 0 {
-		var uuid cassandra.UUID
-		if uuid, err = cassandra.ParseUUID(prev); err != nil {
+		if uuid, err = gocql.ParseUUID(prev); err != nil {
 			return rv, err
 		}
-		r.StartKey = append([]byte(prefix), []byte(uuid)...)
-	} else {
-		r.StartKey = []byte(prefix)
-	}
-	r.EndKey = []byte(end)
-	r.Count = num
-
-	kss, err = m.conn.GetRangeSlices(
-		cp, pred, r, cassandra.ConsistencyLevel_ONE)
-	if err != nil {
-		return rv, err
+		query += " WHERE token(id) >= token(?)"
+		args = append(args, uuid)
 	}
 
-	for _, ks = range kss {
-		var member *MemberWithKey
-		var scol *cassandra.ColumnOrSuperColumn
-		var uuid cassandra.UUID = cassandra.UUIDFromBytes(
-			ks.Key[len(prefix):])
+	iter = m.pageQuery(ctx, query, args, criterion, num).Iter()
+	for iter.Scan(&uuid, &value) {
+		var agreement = new(MembershipAgreement)
+		var member = new(MemberWithKey)
 
-		if len(ks.Columns) == 0 {
-			continue
+		if err = m.unmarshal(value, agreement); err != nil {
+			iter.Close()
+			return rv, err
 		}
+		proto.Merge(&member.Member, agreement.GetMemberData())
+		member.Key = uuid.String()
 
-		for _, scol = range ks.Columns {
-			var col *cassandra.Column = scol.Column
-
-			if string(col.Name) == "pb_data" {
-				var agreement = new(MembershipAgreement)
-				member = new(MemberWithKey)
-				err = proto.Unmarshal(col.Value, agreement)
-				proto.Merge(&member.Member, agreement.GetMemberData())
-				member.Key = uuid.String()
-			}
+		if !matchesCriterion(&member.Member, criterion) {
+			continue
 		}
 
-		if member != nil {
-			rv = append(rv, member)
+		rv = append(rv, member)
+		if int32(len(rv)) >= num {
+			break
 		}
 	}
 
-	return rv, nil
+	return rv, iter.Close()
 }
 
-// Get a list of all members which are currently in the trash.
-func (m *MembershipDB) EnumerateTrashedMembers(prev string, num int32) ([]*MemberWithKey, error) {
-	var cp *cassandra.ColumnParent = cassandra.NewColumnParent()
-	var pred *cassandra.SlicePredicate = cassandra.NewSlicePredicate()
-	var r *cassandra.KeyRange = cassandra.NewKeyRange()
-	var kss []*cassandra.KeySlice
-	var ks *cassandra.KeySlice
-	var rv []*MemberWithKey
+// Move a member record to the queue for getting their user account removed
+// (e.g. when they leave us). Once the account has been removed, the record
+// is kept in the archive for the retention period of former members.
+func (m *MembershipDB) MoveMemberToTrash(ctx context.Context, id string,
+	actor *Actor, reason string) error {
+	var now time.Time = time.Now()
+	var now_long uint64 = uint64(now.Unix())
+	var uuid gocql.UUID = gocql.UUIDFromTime(now)
+	var member *MembershipAgreement
+	var entry *AuditLogEntry
+	var batch *gocql.Batch
+	var number int64
+	var value []byte
 	var err error
 
-	// Fetch the protobuf column of the application column family.
-	cp.ColumnFamily = "membership_archive"
-	pred.ColumnNames = [][]byte{
-		[]byte("pb_data"),
-	}
-	if len(prev) > 0 {
-		var uuid cassandra.UUID
-		if uuid, err = cassandra.ParseUUID(prev); err != nil {
-			return rv, err
-		}
-		r.StartKey = append([]byte(archivePrefix), []byte(uuid)...)
-	} else {
-		r.StartKey = []byte(archivePrefix)
+	if member, number, _, err = m.getMember(ctx, id); err != nil {
+		return err
 	}
-	r.EndKey = []byte(archiveEnd)
-	r.Count = num
 
-	kss, err = m.conn.GetRangeSlices(cp, pred, r, cassandra.ConsistencyLevel_ONE)
-	if err != nil {
-		return rv, err
+	member.Metadata.GoodbyeInitiator = &actor.User
+	member.Metadata.GoodbyeTimestamp = &now_long
+	member.Metadata.GoodbyeReason = &reason
+
+	if value, err = m.marshal(member); err != nil {
+		return err
 	}
 
-	for _, ks = range kss {
-		var member *MemberWithKey
-		var scol *cassandra.ColumnOrSuperColumn
-		var uuid cassandra.UUID = cassandra.UUIDFromBytes(
-			ks.Key[len(archivePrefix):])
+	entry = newAuditMove(actor, member, id, AuditActionGoodbye, "members",
+		"membership_dequeue", now)
+	entry.Comment = proto.String(reason)
 
-		if len(ks.Columns) == 0 {
-			continue
-		}
+	batch = m.sess.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.Query("DELETE FROM member_records WHERE id = ?", number)
+	batch.Query("DELETE FROM member_emails WHERE email = ?", id)
+	batch.Query("INSERT INTO membership_dequeue (id, pb_data) VALUES (?, ?)",
+		uuid, value)
+	if err = m.audit(ctx, entry); err != nil {
+		return err
+	}
+	return m.sess.ExecuteBatch(batch)
+}
 
-		for _, scol = range ks.Columns {
-			var col *cassandra.Column = scol.Column
+// Move the record of the given applicant to the queue of new users to be
+// processed. The approver will be set to the user of "actor".
+func (m *MembershipDB) MoveApplicantToNewMember(ctx context.Context, id string,
+	actor *Actor) error {
+	return m.moveRecordToTable(ctx, id, actor, AuditActionAccept, "application",
+		"membership_queue", 0)
+}
 
-			if string(col.Name) == "pb_data" {
-				var agreement = new(MembershipAgreement)
-				member = new(MemberWithKey)
-				err = proto.Unmarshal(col.Value, agreement)
-				proto.Merge(&member.Member, agreement.GetMemberData())
-				member.Key = uuid.String()
-			}
-		}
+// Move the record of the given applicant to a temporary archive of deleted
+// applications. The deleter will be set to the user of "actor".
+func (m *MembershipDB) MoveApplicantToTrash(ctx context.Context, id string,
+	actor *Actor) error {
+	return m.moveRecordToTable(ctx, id, actor, AuditActionReject, "application",
+		"membership_archive",
+		retentionTTL(m.retention.GetRejectedApplicationDays()))
+}
 
-		if member != nil {
-			rv = append(rv, member)
-		}
+// Move a member from the queue to the trash (e.g. if they can't be processed).
+func (m *MembershipDB) MoveQueuedRecordToTrash(ctx context.Context, id string,
+	actor *Actor) error {
+	return m.moveRecordToTable(ctx, id, actor, AuditActionCancel,
+		"membership_queue", "membership_archive",
+		retentionTTL(m.retention.GetCancelledQueueDays()))
+}
+
+// Add a query writing "value" as the record "uuid" of "table" to "batch".
+// If "ttl" is positive, the record will expire after "ttl" seconds.
+func addRecordToBatch(batch *gocql.Batch, table string, uuid gocql.UUID,
+	value []byte, ttl int32) {
+	if ttl > 0 {
+		batch.Query("INSERT INTO "+table+" (id, pb_data) VALUES (?, ?) "+
+			"USING TTL ?", uuid, value, ttl)
+	} else {
+		batch.Query("INSERT INTO "+table+" (id, pb_data) VALUES (?, ?)",
+			uuid, value)
 	}
+}
 
-	return rv, nil
+// Add a query writing "agreement", encoded as "value", as the
+// record "uuid" of the application table to "batch". The application table
+// keeps the details shown in the list of applicants in separate columns as
+// well.
+func addApplicationToBatch(batch *gocql.Batch, uuid gocql.UUID,
+	agreement *MembershipAgreement, value []byte) {
+	var md *Member = agreement.GetMemberData()
+
+	// Unset optional fields are passed as nil pointers and end up as null.
+	batch.Query("INSERT INTO application (id, name, city, email, "+
+		"fee, username, fee_yearly, category, pb_data) "+
+		"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		uuid, md.Name, md.City, md.Email, int64(md.GetFee()),
+		md.Username, md.GetFeeYearly(), md.Category, value)
 }
 
-// Move a member record to the queue for getting their user account removed
-// (e.g. when they leave us). Set the retention to 2 years instead of just
-// 6 months, since they have been a member.
-func (m *MembershipDB) MoveMemberToTrash(id, initiator, reason string) error {
+// Move the record of the given applicant to a different table.
+func (m *MembershipDB) moveRecordToTable(ctx context.Context, id string,
+	actor *Actor, action, src_table, dst_table string, ttl int32) error {
+	var uuid gocql.UUID
+	var batch *gocql.Batch
 	var now time.Time = time.Now()
-	var now_long uint64 = uint64(now.Unix())
-	var uuid cassandra.UUID
-	var mmap map[string]map[string][]*cassandra.Mutation
 	var member *MembershipAgreement
-
-	var cp *cassandra.ColumnPath = cassandra.NewColumnPath()
-	var cos *cassandra.ColumnOrSuperColumn
-	var del *cassandra.Deletion = cassandra.NewDeletion()
-	var mu *cassandra.Mutation
-	var ts int64
-
+	var value []byte
 	var err error
 
-	cp.ColumnFamily = "members"
-	cp.Column = []byte("pb_data")
+	uuid, err = gocql.ParseUUID(id)
+	if err != nil {
+		return err
+	}
 
-	uuid, err = cassandra.GenTimeUUID(&now)
+	// First, retrieve the desired membership data.
+	member, _, err = m.GetMembershipRequest(ctx, id, src_table, "")
 	if err != nil {
 		return err
 	}
 
-	cos, err = m.conn.Get(
-		[]byte(memberPrefix+id), cp, cassandra.ConsistencyLevel_QUORUM)
+	if dst_table == "membership_queue" && agreementPdfHash(member) == "" {
+		return errors.New("No membership agreement scan has been uploaded")
+	}
+
+	// Fill in details concerning the approval.
+	member.Metadata.ApproverUid = proto.String(actor.User)
+	member.Metadata.ApprovalTimestamp = proto.Uint64(uint64(now.Unix()))
+
+	value, err = m.marshal(member)
 	if err != nil {
 		return err
 	}
 
-	member = new(MembershipAgreement)
-	err = proto.Unmarshal(cos.Column.Value, member)
+	// Add the application protobuf to the destination table and delete
+	// the original record.
+	batch = m.sess.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	addRecordToBatch(batch, dst_table, uuid, value, ttl)
+	batch.Query("DELETE FROM "+src_table+" WHERE id = ?", uuid)
+	err = m.audit(ctx, newAuditMove(actor, member, uuid.String(),
+		action, src_table, dst_table, now))
 	if err != nil {
 		return err
 	}
+	return m.sess.ExecuteBatch(batch)
+}
 
-	del.Predicate = cassandra.NewSlicePredicate()
-	del.Predicate.ColumnNames = allColumns
-	del.Timestamp = cos.Column.Timestamp
+// Add the membership agreement form scan to the given membership request
+// record. The scan itself is kept in the blob store.
+func (m *MembershipDB) StoreMembershipAgreement(ctx context.Context, id string,
+	agreement_data []byte, actor *Actor) error {
+	var agreement *MembershipAgreement
+	var entry *AuditLogEntry
+	var batch *gocql.Batch
+	var uuid gocql.UUID
+	var hash string
+	var value []byte
+	var err error
 
-	mu = cassandra.NewMutation()
-	mu.Deletion = del
+	uuid, err = gocql.ParseUUID(id)
+	if err != nil {
+		return err
+	}
 
-	mmap = make(map[string]map[string][]*cassandra.Mutation)
-	mmap[memberPrefix+id] = make(map[string][]*cassandra.Mutation)
-	mmap[memberPrefix+id]["members"] = []*cassandra.Mutation{mu}
+	agreement, _, err = m.GetMembershipRequest(ctx, id, "application", "")
+	if err != nil {
+		return err
+	}
 
-	member.Metadata.GoodbyeInitiator = &initiator
-	member.Metadata.GoodbyeTimestamp = &now_long
-	member.Metadata.GoodbyeReason = &reason
+	entry = newAuditAgreementUpload(actor, agreement, uuid.String(),
+		agreement_data, time.Now())
+
+	if hash, err = m.putBlob(ctx, agreement_data); err != nil {
+		return err
+	}
+	agreement.AgreementPdf = nil
+	agreement.AgreementPdfHash = proto.String(hash)
 
-	ts = now.UnixNano()
-	cos.Column = cassandra.NewColumn()
-	cos.Column.Name = []byte("pb_data")
-	cos.Column.Timestamp = &ts
-	cos.Column.Value, err = proto.Marshal(member)
+	value, err = m.marshal(agreement)
 	if err != nil {
 		return err
 	}
 
-	mu = cassandra.NewMutation()
-	mu.ColumnOrSupercolumn = cos
+	batch = m.sess.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.Query("UPDATE application SET pb_data = ? WHERE id = ?", value,
+		uuid)
+	if err = m.audit(ctx, entry); err != nil {
+		return err
+	}
+	return m.sess.ExecuteBatch(batch)
+}
 
-	mmap[dequeuePrefix+id] = make(map[string][]*cassandra.Mutation)
-	mmap[dequeuePrefix+string([]byte(uuid))] =
-		make(map[string][]*cassandra.Mutation)
-	mmap[dequeuePrefix+string([]byte(uuid))]["membership_dequeue"] =
-		[]*cassandra.Mutation{mu}
+// Record the decision about the fee reduction requested along with the
+// application "id". Approved reductions apply until "valid_until", or
+// indefinitely if it is 0.
+func (m *MembershipDB) DecideFeeReduction(ctx context.Context, id string,
+	approved bool, valid_until uint64, comment string, actor *Actor) error {
+	var agreement *MembershipAgreement
+	var now time.Time = time.Now()
+	var batch *gocql.Batch
+	var uuid gocql.UUID
+	var old_status string
+	var value []byte
+	var err error
 
-	err = m.conn.AtomicBatchMutate(
-		mmap, cassandra.ConsistencyLevel_QUORUM)
-	return err
-}
+	if uuid, err = gocql.ParseUUID(id); err != nil {
+		return err
+	}
 
-// Move the record of the given applicant to the queue of new users to be
-// processed. The approver will be set to "initiator".
-func (m *MembershipDB) MoveApplicantToNewMember(id, initiator string) error {
-	return m.moveRecordToTable(id, initiator, "application", applicationPrefix,
-		"membership_queue", queuePrefix, 0)
-}
+	agreement, _, err = m.GetMembershipRequest(ctx, id, "application", "")
+	if err != nil {
+		return err
+	}
 
-// Move the record of the given applicant to a temporary archive of deleted
-// applications. The deleter will be set to "initiator".
-func (m *MembershipDB) MoveApplicantToTrash(id, initiator string) error {
-	return m.moveRecordToTable(id, initiator, "application", applicationPrefix,
-		"membership_archive", archivePrefix, int32(6*30*24*60*60))
-}
+	old_status, err = decideFeeReduction(agreement, approved, valid_until,
+		comment, actor, now)
+	if err != nil {
+		return err
+	}
 
-// Move a member from the queue to the trash (e.g. if they can't be processed).
-func (m *MembershipDB) MoveQueuedRecordToTrash(id, initiator string) error {
-	return m.moveRecordToTable(id, initiator, "membership_queue", queuePrefix,
-		"membership_archive", archivePrefix, int32(6*30*24*60*60))
+	if value, err = m.marshal(agreement); err != nil {
+		return err
+	}
+
+	batch = m.sess.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.Query("UPDATE application SET pb_data = ? WHERE id = ?", value,
+		uuid)
+	err = m.audit(ctx, newAuditFeeReduction(actor, agreement,
+		uuid.String(), old_status, now))
+	if err != nil {
+		return err
+	}
+	return m.sess.ExecuteBatch(batch)
 }
 
-// Move the record of the given applicant to a different column family.
-func (m *MembershipDB) moveRecordToTable(
-	id, initiator, src_table, src_prefix, dst_table, dst_prefix string,
-	ttl int32) error {
-	var uuid cassandra.UUID
-	var bmods map[string]map[string][]*cassandra.Mutation
+// Mark the e-mail address of the application "id" as verified, provided
+// it is still "email".
+func (m *MembershipDB) VerifyApplicationEmail(ctx context.Context, id,
+	email string, actor *Actor) error {
+	var agreement *MembershipAgreement
 	var now time.Time = time.Now()
-	var member *MembershipAgreement
-	var mutation *cassandra.Mutation = cassandra.NewMutation()
+	var batch *gocql.Batch
+	var uuid gocql.UUID
 	var value []byte
-	var timestamp int64
 	var err error
 
-	uuid, err = cassandra.ParseUUID(id)
+	if uuid, err = gocql.ParseUUID(id); err != nil {
+		return err
+	}
+
+	agreement, _, err = m.GetMembershipRequest(ctx, id, "application", "")
 	if err != nil {
 		return err
 	}
 
-	// First, retrieve the desired membership data.
-	member, timestamp, err = m.GetMembershipRequest(id, src_table, src_prefix)
+	if err = verifyApplicationEmail(agreement, email, actor, now); err != nil {
+		return err
+	}
+
+	if value, err = m.marshal(agreement); err != nil {
+		return err
+	}
+
+	batch = m.sess.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.Query("UPDATE application SET pb_data = ? WHERE id = ?", value,
+		uuid)
+	err = m.audit(ctx, newAuditEntry(actor, email,
+		uuid.String(), AuditActionVerifyEmail, now))
 	if err != nil {
 		return err
 	}
+	return m.sess.ExecuteBatch(batch)
+}
 
-	if dst_table == "membership_queue" && len(member.AgreementPdf) == 0 {
-		return errors.New("No membership agreement scan has been uploaded")
+// Merge the application "duplicate" into the application "id". The
+// combined record is kept as "id", the duplicate is moved to the archive
+// like a rejected application.
+func (m *MembershipDB) MergeApplications(ctx context.Context, id,
+	duplicate string, actor *Actor) error {
+	var agreement, other *MembershipAgreement
+	var now time.Time = time.Now()
+	var uuid, other_uuid gocql.UUID
+	var entry *AuditLogEntry
+	var batch *gocql.Batch
+	var value, other_value []byte
+	var err error
+
+	if uuid, err = gocql.ParseUUID(id); err != nil {
+		return err
+	}
+	if other_uuid, err = gocql.ParseUUID(duplicate); err != nil {
+		return err
+	}
+	if uuid == other_uuid {
+		return grpc.Errorf(codes.InvalidArgument,
+			"Cannot merge application %s with itself", id)
 	}
 
-	// Fill in details concerning the approval.
-	member.Metadata.ApproverUid = proto.String(initiator)
-	member.Metadata.ApprovalTimestamp = proto.Uint64(uint64(now.Unix()))
+	agreement, _, err = m.GetMembershipRequest(ctx, id, "application", "")
+	if err != nil {
+		return err
+	}
+	other, _, err = m.GetMembershipRequest(ctx, duplicate, "application", "")
+	if err != nil {
+		return err
+	}
+
+	mergeAgreements(agreement, other, other_uuid.String())
+	other.Metadata.ApproverUid = proto.String(actor.User)
+	other.Metadata.ApprovalTimestamp = proto.Uint64(uint64(now.Unix()))
+
+	if value, err = m.marshal(agreement); err != nil {
+		return err
+	}
+	if other_value, err = m.marshal(other); err != nil {
+		return err
+	}
+
+	batch = m.sess.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	addApplicationToBatch(batch, uuid, agreement, value)
+	batch.Query("DELETE FROM application WHERE id = ?", other_uuid)
+	addRecordToBatch(batch, "membership_archive", other_uuid, other_value,
+		retentionTTL(m.retention.GetRejectedApplicationDays()))
+	for _, entry = range newAuditMerge(actor, agreement, other, uuid.String(),
+		other_uuid.String(), now) {
+		if err = m.audit(ctx, entry); err != nil {
+			return err
+		}
+	}
+	return m.sess.ExecuteBatch(batch)
+}
+
+// Assign the next membership number. The last number assigned is kept in
+// the member_numbers table and updated using a lightweight transaction, so
+// numbers are never handed out twice, even to members who have left. If
+// the number read is stale, the update fails and is retried.
+func (m *MembershipDB) allocateMemberNumber(ctx context.Context) (
+	int64, error) {
+	var last *int64
+	var number int64
+	var applied bool
+	var err error
+
+	for {
+		last = nil
+		err = m.query(ctx, "SELECT last_id FROM member_numbers "+
+			"WHERE name = 'members'").Scan(&last)
+		if err == gocql.ErrNotFound {
+			number = 1
+			applied, err = m.query(ctx, "INSERT INTO member_numbers "+
+				"(name, last_id) VALUES ('members', ?) IF NOT EXISTS",
+				number).MapScanCAS(make(map[string]interface{}))
+		} else if err == nil {
+			if last != nil {
+				number = *last + 1
+			} else {
+				number = 1
+			}
+			applied, err = m.query(ctx, "UPDATE member_numbers "+
+				"SET last_id = ? WHERE name = 'members' IF last_id = ?",
+				number, last).MapScanCAS(make(map[string]interface{}))
+		}
+		if err != nil {
+			return 0, err
+		}
+		if applied {
+			return number, nil
+		}
+	}
+}
 
-	bmods = make(map[string]map[string][]*cassandra.Mutation)
-	bmods[dst_prefix+string(uuid)] = make(map[string][]*cassandra.Mutation)
-	bmods[dst_prefix+string(uuid)][dst_table] = make([]*cassandra.Mutation, 0)
-	bmods[src_prefix+string(uuid)] = make(map[string][]*cassandra.Mutation)
-	bmods[src_prefix+string(uuid)][src_table] = make([]*cassandra.Mutation, 0)
+// Turn the queued record "id" into a member record. "agreement" is the
+// record as it has been completed when creating the members account; the
+// membership number is assigned here and filled into it.
+func (m *MembershipDB) MoveQueuedRecordToMember(ctx context.Context,
+	id string, agreement *MembershipAgreement, actor *Actor) error {
+	var batch *gocql.Batch
+	var md *Member = agreement.GetMemberData()
+	var uuid gocql.UUID
+	var number int64
+	var value []byte
+	var err error
+
+	if uuid, err = gocql.ParseUUID(id); err != nil {
+		return err
+	}
 
-	value, err = proto.Marshal(member)
+	// Make sure the queue entry still exists.
+	_, _, err = m.GetMembershipRequest(ctx, id, "membership_queue", "")
 	if err != nil {
 		return err
 	}
 
-	// Add the application protobuf to the membership data.
-	bmods[dst_prefix+string(uuid)][dst_table] = append(
-		bmods[dst_prefix+string(uuid)][dst_table],
-		newCassandraMutationBytes("pb_data", value, &now, ttl))
+	if number, err = m.allocateMemberNumber(ctx); err != nil {
+		return err
+	}
+	md.Id = proto.Uint64(uint64(number))
+
+	if value, err = m.marshal(agreement); err != nil {
+		return err
+	}
+	if err = m.claimEmail(ctx, md.GetEmail(), number); err != nil {
+		return err
+	}
+
+	batch = m.sess.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.Query(cqlInsertMemberRecord,
+		memberRecordValues(agreement, value, nextVersion(0))...)
+	batch.Query("DELETE FROM membership_queue WHERE id = ?", uuid)
+	err = m.audit(ctx, newAuditMove(actor, agreement,
+		uuid.String(), AuditActionCreateAccount, "membership_queue",
+		"members", time.Now()))
+	if err == nil {
+		err = m.sess.ExecuteBatch(batch)
+	}
+	if err != nil {
+		return m.abandonMember(md.GetEmail(), number, err)
+	}
+	return nil
+}
 
-	// Delete the application data.
-	mutation.Deletion = cassandra.NewDeletion()
-	mutation.Deletion.Predicate = cassandra.NewSlicePredicate()
-	mutation.Deletion.Predicate.ColumnNames = allColumns
-	mutation.Deletion.Timestamp = &timestamp
-	bmods[src_prefix+string(uuid)][src_table] = append(
-		bmods[src_prefix+string(uuid)][src_table], mutation)
+// Add "agreement", imported from another system, as a member record and
+// assign the next membership number to it.
+func (m *MembershipDB) AddImportedMember(ctx context.Context,
+	agreement *MembershipAgreement, actor *Actor) error {
+	var batch *gocql.Batch
+	var md *Member = agreement.GetMemberData()
+	var number int64
+	var value []byte
+	var err error
+
+	if number, err = m.allocateMemberNumber(ctx); err != nil {
+		return err
+	}
+	md.Id = proto.Uint64(uint64(number))
+
+	if value, err = m.marshal(agreement); err != nil {
+		return err
+	}
+	if err = m.claimEmail(ctx, md.GetEmail(), number); err != nil {
+		return err
+	}
 
-	return m.conn.AtomicBatchMutate(bmods, cassandra.ConsistencyLevel_QUORUM)
+	batch = m.sess.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.Query(cqlInsertMemberRecord,
+		memberRecordValues(agreement, value, nextVersion(0))...)
+	err = m.audit(ctx, newAuditMove(actor, agreement,
+		strconv.FormatInt(number, 10), AuditActionImport, "", "members",
+		time.Now()))
+	if err == nil {
+		err = m.sess.ExecuteBatch(batch)
+	}
+	if err != nil {
+		return m.abandonMember(md.GetEmail(), number, err)
+	}
+	return nil
 }
 
-// Add the membership agreement form scan to the given membership request
-// record.
-func (m *MembershipDB) StoreMembershipAgreement(id string, agreement_data []byte) error {
+// Move the record "id" of a departed member from the departing queue to
+// the archive once their account has been removed.
+func (m *MembershipDB) MoveDeQueuedRecordToArchive(ctx context.Context,
+	id string, actor *Actor) error {
+	var batch *gocql.Batch
 	var agreement *MembershipAgreement
-	var bmods map[string]map[string][]*cassandra.Mutation
-	var now = time.Now()
-	var uuid cassandra.UUID
-	var buuid []byte
+	var uuid gocql.UUID
 	var value []byte
 	var err error
 
-	uuid, err = cassandra.ParseUUID(id)
+	if uuid, err = gocql.ParseUUID(id); err != nil {
+		return err
+	}
+
+	agreement, _, err = m.GetMembershipRequest(ctx,
+		id, "membership_dequeue", "")
 	if err != nil {
 		return err
 	}
-	buuid = append([]byte(applicationPrefix), []byte(uuid)...)
 
-	agreement, _, err = m.GetMembershipRequest(id, "application",
-		applicationPrefix)
+	if value, err = m.marshal(agreement); err != nil {
+		return err
+	}
+
+	batch = m.sess.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	batch.Query("DELETE FROM membership_dequeue WHERE id = ?", uuid)
+	addRecordToBatch(batch, "membership_archive", uuid, value,
+		retentionTTL(m.retention.GetFormerMemberDays()))
+	err = m.audit(ctx, newAuditMove(actor, agreement, uuid.String(),
+		AuditActionArchive, "membership_dequeue", "membership_archive",
+		time.Now()))
 	if err != nil {
 		return err
 	}
+	return m.sess.ExecuteBatch(batch)
+}
 
-	agreement.AgreementPdf = agreement_data
+// Move the record "id" from the archive back to the application table, or
+// for former members, back to the members.
+func (m *MembershipDB) RestoreArchivedRecord(ctx context.Context, id string,
+	actor *Actor) error {
+	var agreement *MembershipAgreement
+	var batch *gocql.Batch
+	var uuid gocql.UUID
+	var dst_table string
+	var number int64
+	var value []byte
+	var err error
 
-	bmods = make(map[string]map[string][]*cassandra.Mutation)
-	bmods[string(buuid)] = make(map[string][]*cassandra.Mutation)
-	bmods[string(buuid)]["application"] = make([]*cassandra.Mutation, 0)
+	if uuid, err = gocql.ParseUUID(id); err != nil {
+		return err
+	}
 
-	value, err = proto.Marshal(agreement)
+	agreement, _, err = m.GetMembershipRequest(ctx,
+		id, "membership_archive", "")
 	if err != nil {
 		return err
 	}
 
-	addMembershipRequestInfoBytes(bmods[string(buuid)],
-		"pb_data", value, &now)
-	addMembershipRequestInfoBytes(bmods[string(buuid)],
-		"application_pdf", agreement_data, &now)
+	dst_table = restoreArchivedAgreement(agreement)
+	if dst_table == "members" {
+		// Members who left before membership numbers were introduced
+		// get a new one.
+		number = int64(agreement.GetMemberData().GetId())
+		if number == 0 {
+			if number, err = m.allocateMemberNumber(ctx); err != nil {
+				return err
+			}
+			agreement.MemberData.Id = proto.Uint64(uint64(number))
+		}
+	}
+
+	if value, err = m.marshal(agreement); err != nil {
+		return err
+	}
+	if dst_table == "members" {
+		err = m.claimEmail(ctx, agreement.GetMemberData().GetEmail(),
+			number)
+		if err != nil {
+			return err
+		}
+	}
+
+	batch = m.sess.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	if dst_table == "members" {
+		batch.Query(cqlInsertMemberRecord,
+			memberRecordValues(agreement, value, nextVersion(0))...)
+	} else {
+		addApplicationToBatch(batch, uuid, agreement, value)
+	}
+	batch.Query("DELETE FROM membership_archive WHERE id = ?", uuid)
+	err = m.audit(ctx, newAuditMove(actor, agreement,
+		uuid.String(), AuditActionRestore, "membership_archive", dst_table,
+		time.Now()))
+	if err == nil {
+		err = m.sess.ExecuteBatch(batch)
+	}
+	if err != nil && dst_table == "members" {
+		return m.abandonMember(agreement.GetMemberData().GetEmail(), number,
+			err)
+	}
+	return err
+}
+
+// Retrieve the audit log of the member with the e-mail address "subject",
+// oldest entry first.
+func (m *MembershipDB) GetAuditLog(ctx context.Context,
+	subject string) ([]*AuditLogEntry, error) {
+	var iter *gocql.Iter
+	var rv []*AuditLogEntry
+	var value []byte
+	var err error
+
+	iter = m.query(ctx, "SELECT pb_data FROM audit_log WHERE subject = ? "+
+		"ORDER BY seq", subject).Iter()
+	for iter.Scan(&value) {
+		var entry *AuditLogEntry = new(AuditLogEntry)
+
+		if err = m.unmarshal(value, entry); err != nil {
+			iter.Close()
+			return rv, err
+		}
+
+		rv = append(rv, entry)
+	}
+
+	return rv, iter.Close()
+}
+
+// Retrieve the previous states of the record of the member "id", newest
+// first.
+func (m *MembershipDB) GetMemberRevisions(ctx context.Context,
+	id string) ([]*MemberRevision, error) {
+	var iter *gocql.Iter
+	var rv []*MemberRevision
+	var number, version int64
+	var value []byte
+	var err error
+
+	if _, number, _, err = m.getMember(ctx, id); err != nil {
+		return nil, err
+	}
+
+	iter = m.query(ctx, "SELECT version, pb_data "+
+		"FROM member_record_revisions WHERE id = ?", number).Iter()
+	for iter.Scan(&version, &value) {
+		var revision = &MemberRevision{
+			Version:   version,
+			Agreement: new(MembershipAgreement),
+		}
+
+		if err = m.unmarshal(value, revision.Agreement); err != nil {
+			iter.Close()
+			return rv, err
+		}
+
+		rv = append(rv, revision)
+	}
+
+	return rv, iter.Close()
+}
+
+// List the records which will be deleted before "before" because their
+// retention period is over, the earliest first. The tables are scanned
+// completely, since Cassandra can't filter by TTL.
+func (m *MembershipDB) EnumerateExpiringRecords(ctx context.Context,
+	before time.Time) ([]*ExpiringRecord, error) {
+	var now time.Time = time.Now()
+	var rv []*ExpiringRecord
+	var table string
+	var err error
+
+	for _, table = range recordTables {
+		var iter *gocql.Iter
+		var uuid gocql.UUID
+		var value []byte
+		var ttl int
+
+		iter = m.query(ctx, "SELECT id, pb_data, TTL(pb_data) FROM "+
+			table).Iter()
+		for iter.Scan(&uuid, &value, &ttl) {
+			var record *ExpiringRecord
+
+			// Records without a TTL are kept forever.
+			if ttl <= 0 {
+				continue
+			}
+
+			record = &ExpiringRecord{
+				Key:       uuid.String(),
+				Table:     table,
+				Expires:   now.Add(time.Duration(ttl) * time.Second),
+				Agreement: new(MembershipAgreement),
+			}
+			if !record.Expires.Before(before) {
+				continue
+			}
+			if err = m.unmarshal(value, record.Agreement); err != nil {
+				iter.Close()
+				return rv, err
+			}
+
+			rv = append(rv, record)
+		}
+
+		if err = iter.Close(); err != nil {
+			return rv, err
+		}
+	}
+
+	sortByExpiry(rv)
+	return rv, nil
+}
+
+// Delete the blobs no record refers to any more. Cassandra removes the
+// records by themselves once their TTL runs out, but the blobs are shared
+// between records and kept without one.
+func (m *MembershipDB) PurgeExpiredRecords(ctx context.Context) error {
+	var err error
+
+	_, err = sweepBlobs(ctx, m.blobs, func(refs map[string]int) error {
+		return m.countBlobReferences(ctx, refs)
+	})
+	return err
+}
+
+// Count the references of all records to blobs in "refs". Revisions only
+// count as long as the member is still around. The records are read at
+// quorum, so none written before the scan is missed.
+func (m *MembershipDB) countBlobReferences(ctx context.Context,
+	refs map[string]int) error {
+	var members = make(map[int64]bool)
+	var iter *gocql.Iter
+	var table string
+	var number int64
+	var value []byte
+	var err error
+
+	for _, table = range recordTables {
+		iter = m.query(ctx, "SELECT pb_data FROM "+table).Consistency(
+			gocql.Quorum).Iter()
+		for iter.Scan(&value) {
+			var agreement = new(MembershipAgreement)
+
+			if err = m.unmarshal(value, agreement); err != nil {
+				iter.Close()
+				return err
+			}
+			countBlobReferences(refs, agreement)
+		}
+		if err = iter.Close(); err != nil {
+			return err
+		}
+	}
+
+	iter = m.query(ctx, "SELECT id, pb_data FROM member_records").Consistency(
+		gocql.Quorum).Iter()
+	for iter.Scan(&number, &value) {
+		var agreement = new(MembershipAgreement)
+
+		if err = m.unmarshal(value, agreement); err != nil {
+			iter.Close()
+			return err
+		}
+		members[number] = true
+		countBlobReferences(refs, agreement)
+	}
+	if err = iter.Close(); err != nil {
+		return err
+	}
+
+	iter = m.query(ctx, "SELECT id, pb_data FROM member_record_revisions").
+		Consistency(gocql.Quorum).Iter()
+	for iter.Scan(&number, &value) {
+		var agreement = new(MembershipAgreement)
+
+		if !members[number] {
+			continue
+		}
+		if err = m.unmarshal(value, agreement); err != nil {
+			iter.Close()
+			return err
+		}
+		countBlobReferences(refs, agreement)
+	}
+	return iter.Close()
+}
+
+// Call "fn" for every record of every lifecycle state, and for the last
+// membership number assigned. Stops at the first error.
+func (m *MembershipDB) ExportRecords(ctx context.Context,
+	fn func(*BackupRecord) error) error {
+	var iter *gocql.Iter
+	var table string
+	var number int64
+	var value []byte
+	var last *int64
+	var err error
+
+	// Blobs come first, so they are there once the records referring to
+	// them have been restored.
+	if err = exportBlobs(ctx, m.blobs, m.keys, fn); err != nil {
+		return err
+	}
+
+	for _, table = range recordTables {
+		var uuid gocql.UUID
+		var ttl int
+
+		iter = m.query(ctx, "SELECT id, pb_data, TTL(pb_data) FROM "+
+			table).Iter()
+		for iter.Scan(&uuid, &value, &ttl) {
+			var record = &BackupRecord{
+				Table:     proto.String(table),
+				Key:       proto.String(uuid.String()),
+				Agreement: new(MembershipAgreement),
+			}
+
+			if ttl > 0 {
+				record.Ttl = proto.Int32(int32(ttl))
+			}
+			if err = m.unmarshal(value, record.Agreement); err != nil {
+				iter.Close()
+				return err
+			}
+			if err = fn(record); err != nil {
+				iter.Close()
+				return err
+			}
+		}
+		if err = iter.Close(); err != nil {
+			return err
+		}
+	}
+
+	iter = m.query(ctx, "SELECT id, pb_data FROM member_records").Iter()
+	for iter.Scan(&number, &value) {
+		var record = &BackupRecord{
+			Table:     proto.String("members"),
+			Key:       proto.String(strconv.FormatInt(number, 10)),
+			Agreement: new(MembershipAgreement),
+		}
+
+		if err = m.unmarshal(value, record.Agreement); err != nil {
+			iter.Close()
+			return err
+		}
+		if err = fn(record); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	if err = iter.Close(); err != nil {
+		return err
+	}
+
+	err = m.query(ctx, "SELECT last_id FROM member_numbers "+
+		"WHERE name = 'members'").Scan(&last)
+	if err == gocql.ErrNotFound || (err == nil && last == nil) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return fn(&BackupRecord{
+		Table:            proto.String("member_numbers"),
+		Key:              proto.String("members"),
+		LastMemberNumber: proto.Uint64(uint64(*last)),
+	})
+}
+
+// Ensure the last membership number assigned is at least "number", so
+// numbers of imported members aren't handed out again.
+func (m *MembershipDB) raiseMemberNumber(ctx context.Context,
+	number int64) error {
+	var last *int64
+	var applied bool
+	var err error
+
+	for {
+		last = nil
+		err = m.query(ctx, "SELECT last_id FROM member_numbers "+
+			"WHERE name = 'members'").Scan(&last)
+		if err == gocql.ErrNotFound {
+			applied, err = m.query(ctx, "INSERT INTO member_numbers "+
+				"(name, last_id) VALUES ('members', ?) IF NOT EXISTS",
+				number).MapScanCAS(make(map[string]interface{}))
+		} else if err == nil && last != nil && *last >= number {
+			return nil
+		} else if err == nil {
+			applied, err = m.query(ctx, "UPDATE member_numbers "+
+				"SET last_id = ? WHERE name = 'members' IF last_id = ?",
+				number, last).MapScanCAS(make(map[string]interface{}))
+		}
+		if err != nil {
+			return err
+		}
+		if applied {
+			return nil
+		}
+	}
+}
+
+// Write "record" as it has been exported from a database. Records with the
+// same key are replaced, so an import can be repeated.
+func (m *MembershipDB) ImportRecord(ctx context.Context,
+	record *BackupRecord) error {
+	var agreement *MembershipAgreement = record.GetAgreement()
+	var batch *gocql.Batch
+	var uuid gocql.UUID
+	var number int64
+	var value, prev []byte
+	var err error
+
+	if err = checkBackupRecord(record); err != nil {
+		return err
+	}
+	if record.GetTable() == "member_numbers" {
+		return m.raiseMemberNumber(ctx, int64(record.GetLastMemberNumber()))
+	}
+	if record.GetTable() == "agreement_blobs" {
+		_, err = m.putBlob(ctx, record.BlobData)
+		return err
+	}
+
+	if record.GetTable() == "members" {
+		var md *Member = agreement.GetMemberData()
+		var previous *MembershipAgreement = new(MembershipAgreement)
+
+		number, err = strconv.ParseInt(record.GetKey(), 10, 64)
+		if err != nil {
+			return err
+		}
+		md.Id = proto.Uint64(uint64(number))
+
+		if err = m.raiseMemberNumber(ctx, number); err != nil {
+			return err
+		}
+		if value, err = m.marshal(agreement); err != nil {
+			return err
+		}
+
+		// A record imported before may have had another address, which
+		// is released once the record has been replaced.
+		err = m.query(ctx, "SELECT pb_data FROM member_records "+
+			"WHERE id = ?", number).Scan(&prev)
+		if err == nil {
+			err = m.unmarshal(prev, previous)
+		} else if err == gocql.ErrNotFound {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// The e-mail address may only be claimed by the same member
+		// again.
+		if err = m.claimEmail(ctx, md.GetEmail(), number); err != nil {
+			return err
+		}
+
+		err = m.query(ctx, cqlInsertMemberRecord,
+			memberRecordValues(agreement, value, nextVersion(0))...).Exec()
+		if err != nil {
+			return m.abandonMember(md.GetEmail(), number, err)
+		}
+		if previous.MemberData != nil &&
+			previous.GetMemberData().GetEmail() != md.GetEmail() {
+			m.releaseEmail(previous.GetMemberData().GetEmail(), number)
+		}
+		return nil
+	}
+
+	if uuid, err = gocql.ParseUUID(record.GetKey()); err != nil {
+		return err
+	}
+	if value, err = m.marshal(agreement); err != nil {
+		return err
+	}
+
+	batch = m.sess.NewBatch(gocql.LoggedBatch).WithContext(ctx)
+	if record.GetTable() == "application" {
+		addApplicationToBatch(batch, uuid, agreement, value)
+	} else {
+		addRecordToBatch(batch, record.GetTable(), uuid, value,
+			record.GetTtl())
+	}
+	return m.sess.ExecuteBatch(batch)
+}
+
+// Tables holding pb_data columns, along with their key columns. All but
+// the audit log contain MembershipAgreement records.
+var cqlPbDataTables = []struct {
+	table string
+	keys  []string
+}{
+	{"application", []string{"id"}},
+	{"membership_queue", []string{"id"}},
+	{"membership_dequeue", []string{"id"}},
+	{"membership_archive", []string{"id"}},
+	{"member_records", []string{"id"}},
+	{"member_record_revisions", []string{"id", "version"}},
+	{"audit_log", []string{"subject", "seq"}},
+}
+
+// Replace the pb_data column of every row of "table" by the value returned
+// by "rewrite", or leave it alone if nil is returned. The rows keep the
+// time they have left before they expire. Rows which are modified
+// concurrently are skipped. Returns the number of rows which have been
+// rewritten.
+func (m *MembershipDB) rewritePbData(ctx context.Context, table string,
+	keys []string, rewrite func(value []byte) ([]byte, error)) (int, error) {
+	var iter *gocql.Iter
+	var count int
+	var err error
+
+	iter = m.query(ctx, "SELECT "+strings.Join(keys, ", ")+", pb_data, "+
+		"TTL(pb_data) AS ttl FROM "+table).Iter()
+	for {
+		var row = make(map[string]interface{})
+		var conds []string
+		var args []interface{}
+		var value, old []byte
+		var column string
+		var applied bool
+		var ttl int
+
+		if !iter.MapScan(row) {
+			break
+		}
+
+		old, _ = row["pb_data"].([]byte)
+		if value, err = rewrite(old); err != nil {
+			iter.Close()
+			return count, err
+		}
+		if value == nil {
+			continue
+		}
+
+		// Rows without a TTL are written without one again.
+		ttl, _ = row["ttl"].(int)
+		args = append(args, ttl, value)
+		for _, column = range keys {
+			conds = append(conds, column+" = ?")
+			args = append(args, row[column])
+		}
+		args = append(args, old)
+
+		applied, err = m.query(ctx, "UPDATE "+table+" USING TTL ? "+
+			"SET pb_data = ? WHERE "+strings.Join(conds, " AND ")+
+			" IF pb_data = ?", args...).MapScanCAS(
+			make(map[string]interface{}))
+		if err != nil {
+			iter.Close()
+			return count, err
+		}
+		if applied {
+			count++
+		}
+	}
+
+	return count, iter.Close()
+}
+
+// Encrypt all values which haven't been encrypted with the current master
+// key yet, e.g. after a new key has been added or encryption has been
+// enabled. The records keep the time they have left before they expire.
+// Records which are modified concurrently are skipped, since they are
+// encrypted with the current key anyway. Returns the number of records
+// and blobs which have been rewritten.
+func (m *MembershipDB) ReencryptRecords(ctx context.Context) (int, error) {
+	var count, n int
+	var i int
+	var err error
+
+	if m.keys == nil {
+		return 0, errors.New("No encryption_key_file has been configured")
+	}
+
+	for i = range cqlPbDataTables {
+		n, err = m.rewritePbData(ctx, cqlPbDataTables[i].table,
+			cqlPbDataTables[i].keys, func(value []byte) ([]byte, error) {
+				var err error
+
+				if !m.keys.NeedsReencryption(value) {
+					return nil, nil
+				}
+				if value, err = m.keys.Open(value); err != nil {
+					return nil, err
+				}
+				return m.keys.Seal(value)
+			})
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
+
+	err = m.blobs.EnumerateBlobs(ctx, func(hash string, stored time.Time) error {
+		var data []byte
+		var err error
+
+		if data, err = m.blobs.GetBlob(ctx, hash); err != nil {
+			return err
+		}
+		if !m.keys.NeedsReencryption(data) {
+			return nil
+		}
+		if data, err = m.keys.Open(data); err != nil {
+			return err
+		}
+		if _, err = m.putBlob(ctx, data); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+
+	return count, err
+}
+
+// Retrieve the scanned membership agreement of "agreement" from the blob
+// store.
+func (m *MembershipDB) GetAgreementPdf(ctx context.Context,
+	agreement *MembershipAgreement) ([]byte, error) {
+	return readAgreementPdf(ctx, m.blobs, m.keys, agreement)
+}
+
+// Retrieve the document supporting the fee reduction request of
+// "agreement" from the blob store.
+func (m *MembershipDB) GetFeeReductionDocument(ctx context.Context,
+	agreement *MembershipAgreement) ([]byte, error) {
+	return readFeeReductionDocument(ctx, m.blobs, m.keys, agreement)
+}
+
+// Move the agreements embedded in records written by earlier versions to
+// the blob store. Records which are modified concurrently are skipped, so
+// the migration may have to be run again. Returns the number of records
+// which have been rewritten.
+func (m *MembershipDB) MoveAgreementsToBlobStore(ctx context.Context) (
+	int, error) {
+	var count, n int
+	var i int
+	var err error
+
+	for i = range cqlPbDataTables {
+		if cqlPbDataTables[i].table == "audit_log" {
+			continue
+		}
+
+		n, err = m.rewritePbData(ctx, cqlPbDataTables[i].table,
+			cqlPbDataTables[i].keys, func(value []byte) ([]byte, error) {
+				var agreement = new(MembershipAgreement)
+				var hash string
+				var err error
+
+				if err = m.unmarshal(value, agreement); err != nil {
+					return nil, err
+				}
+				if len(agreement.AgreementPdf) == 0 {
+					return nil, nil
+				}
+
+				hash, err = m.putBlob(ctx, agreement.AgreementPdf)
+				if err != nil {
+					return nil, err
+				}
+				agreement.AgreementPdf = nil
+				agreement.AgreementPdfHash = proto.String(hash)
+				return m.marshal(agreement)
+			})
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
 
-	return m.conn.AtomicBatchMutate(
-		bmods, cassandra.ConsistencyLevel_QUORUM)
+	return count, nil
 }
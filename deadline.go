@@ -0,0 +1,364 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package membersys
+
+import (
+	"context"
+	"time"
+
+	"github.com/starshipfactory/membersys/config"
+)
+
+// Membership store which limits the time every operation of the
+// underlying store may take to the deadline configured for it.
+type deadlineStore struct {
+	store     MembershipStore
+	fallback  time.Duration
+	deadlines map[string]time.Duration
+}
+
+// Operations which go through the whole database, such as backups. They
+// aren't limited by default_deadline, only by deadlines configured for
+// them explicitly.
+var bulkOperations = map[string]bool{
+	"ExportRecords":             true,
+	"MoveAgreementsToBlobStore": true,
+	"PurgeExpiredRecords":       true,
+}
+
+// Wrap "store" so that its operations are cancelled once the deadline
+// configured for them in "dbconfig" has passed. Deadlines of the contexts
+// passed in still apply if they are earlier.
+func NewDeadlineStore(store MembershipStore,
+	dbconfig *config.DatabaseConfig) MembershipStore {
+	var d *deadlineStore = &deadlineStore{
+		store: store,
+		fallback: time.Duration(dbconfig.GetDefaultDeadline()) *
+			time.Millisecond,
+		deadlines: make(map[string]time.Duration),
+	}
+	var op *config.DatabaseConfig_OperationDeadline
+
+	for _, op = range dbconfig.OperationDeadline {
+		d.deadlines[op.GetOperation()] = time.Duration(op.GetDeadline()) *
+			time.Millisecond
+	}
+
+	return d
+}
+
+// Derive the context for running the operation "op" from "ctx".
+func (d *deadlineStore) context(ctx context.Context, op string) (
+	context.Context, context.CancelFunc) {
+	var deadline time.Duration
+	var ok bool
+
+	if deadline, ok = d.deadlines[op]; !ok && !bulkOperations[op] {
+		deadline = d.fallback
+	}
+	if deadline == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, deadline)
+}
+
+func (d *deadlineStore) StoreMembershipRequest(ctx context.Context,
+	req *FormInputData) (string, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = d.context(ctx, "StoreMembershipRequest")
+	defer cancel()
+	return d.store.StoreMembershipRequest(ctx, req)
+}
+
+func (d *deadlineStore) GetMemberDetailByUsername(ctx context.Context,
+	username string) (*MembershipAgreement, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = d.context(ctx, "GetMemberDetailByUsername")
+	defer cancel()
+	return d.store.GetMemberDetailByUsername(ctx, username)
+}
+
+func (d *deadlineStore) GetMemberDetail(ctx context.Context, id string) (
+	*MembershipAgreement, int64, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = d.context(ctx, "GetMemberDetail")
+	defer cancel()
+	return d.store.GetMemberDetail(ctx, id)
+}
+
+func (d *deadlineStore) SetMemberFee(ctx context.Context, id string,
+	fee uint64, yearly bool, version int64, actor *Actor) (int64, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = d.context(ctx, "SetMemberFee")
+	defer cancel()
+	return d.store.SetMemberFee(ctx, id, fee, yearly, version, actor)
+}
+
+func (d *deadlineStore) SetLongValue(ctx context.Context, id string,
+	field string, value uint64, version int64, actor *Actor) (int64, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = d.context(ctx, "SetLongValue")
+	defer cancel()
+	return d.store.SetLongValue(ctx, id, field, value, version, actor)
+}
+
+func (d *deadlineStore) SetBoolValue(ctx context.Context, id string,
+	field string, value bool, version int64, actor *Actor) (int64, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = d.context(ctx, "SetBoolValue")
+	defer cancel()
+	return d.store.SetBoolValue(ctx, id, field, value, version, actor)
+}
+
+func (d *deadlineStore) SetTextValue(ctx context.Context, id string, field,
+	value string, version int64, actor *Actor) (int64, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = d.context(ctx, "SetTextValue")
+	defer cancel()
+	return d.store.SetTextValue(ctx, id, field, value, version, actor)
+}
+
+func (d *deadlineStore) GetMembershipRequest(ctx context.Context, id, table,
+	prefix string) (*MembershipAgreement, int64, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = d.context(ctx, "GetMembershipRequest")
+	defer cancel()
+	return d.store.GetMembershipRequest(ctx, id, table, prefix)
+}
+
+func (d *deadlineStore) EnumerateMembers(ctx context.Context,
+	filter *MemberFilter, prev string, num int32) ([]*Member, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = d.context(ctx, "EnumerateMembers")
+	defer cancel()
+	return d.store.EnumerateMembers(ctx, filter, prev, num)
+}
+
+func (d *deadlineStore) EnumerateMembershipRequests(ctx context.Context,
+	criterion, prev string, num int32) ([]*MemberWithKey, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = d.context(ctx, "EnumerateMembershipRequests")
+	defer cancel()
+	return d.store.EnumerateMembershipRequests(ctx, criterion, prev, num)
+}
+
+func (d *deadlineStore) EnumerateQueuedMembers(ctx context.Context,
+	criterion, prev string, num int32) ([]*MemberWithKey, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = d.context(ctx, "EnumerateQueuedMembers")
+	defer cancel()
+	return d.store.EnumerateQueuedMembers(ctx, criterion, prev, num)
+}
+
+func (d *deadlineStore) EnumerateDeQueuedMembers(ctx context.Context,
+	criterion, prev string, num int32) ([]*MemberWithKey, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = d.context(ctx, "EnumerateDeQueuedMembers")
+	defer cancel()
+	return d.store.EnumerateDeQueuedMembers(ctx, criterion, prev, num)
+}
+
+func (d *deadlineStore) EnumerateTrashedMembers(ctx context.Context,
+	criterion, prev string, num int32) ([]*MemberWithKey, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = d.context(ctx, "EnumerateTrashedMembers")
+	defer cancel()
+	return d.store.EnumerateTrashedMembers(ctx, criterion, prev, num)
+}
+
+func (d *deadlineStore) MoveMemberToTrash(ctx context.Context, id string,
+	actor *Actor, reason string) error {
+	var cancel context.CancelFunc
+	ctx, cancel = d.context(ctx, "MoveMemberToTrash")
+	defer cancel()
+	return d.store.MoveMemberToTrash(ctx, id, actor, reason)
+}
+
+func (d *deadlineStore) MoveApplicantToNewMember(ctx context.Context,
+	id string, actor *Actor) error {
+	var cancel context.CancelFunc
+	ctx, cancel = d.context(ctx, "MoveApplicantToNewMember")
+	defer cancel()
+	return d.store.MoveApplicantToNewMember(ctx, id, actor)
+}
+
+func (d *deadlineStore) MoveApplicantToTrash(ctx context.Context, id string,
+	actor *Actor) error {
+	var cancel context.CancelFunc
+	ctx, cancel = d.context(ctx, "MoveApplicantToTrash")
+	defer cancel()
+	return d.store.MoveApplicantToTrash(ctx, id, actor)
+}
+
+func (d *deadlineStore) MoveQueuedRecordToTrash(ctx context.Context,
+	id string, actor *Actor) error {
+	var cancel context.CancelFunc
+	ctx, cancel = d.context(ctx, "MoveQueuedRecordToTrash")
+	defer cancel()
+	return d.store.MoveQueuedRecordToTrash(ctx, id, actor)
+}
+
+func (d *deadlineStore) MergeApplications(ctx context.Context, id,
+	duplicate string, actor *Actor) error {
+	var cancel context.CancelFunc
+	ctx, cancel = d.context(ctx, "MergeApplications")
+	defer cancel()
+	return d.store.MergeApplications(ctx, id, duplicate, actor)
+}
+
+func (d *deadlineStore) DecideFeeReduction(ctx context.Context, id string,
+	approved bool, valid_until uint64, comment string, actor *Actor) error {
+	var cancel context.CancelFunc
+	ctx, cancel = d.context(ctx, "DecideFeeReduction")
+	defer cancel()
+	return d.store.DecideFeeReduction(ctx, id, approved, valid_until,
+		comment, actor)
+}
+
+func (d *deadlineStore) VerifyApplicationEmail(ctx context.Context, id,
+	email string, actor *Actor) error {
+	var cancel context.CancelFunc
+	ctx, cancel = d.context(ctx, "VerifyApplicationEmail")
+	defer cancel()
+	return d.store.VerifyApplicationEmail(ctx, id, email, actor)
+}
+
+func (d *deadlineStore) StoreMembershipAgreement(ctx context.Context,
+	id string, agreement_data []byte, actor *Actor) error {
+	var cancel context.CancelFunc
+	ctx, cancel = d.context(ctx, "StoreMembershipAgreement")
+	defer cancel()
+	return d.store.StoreMembershipAgreement(ctx, id, agreement_data, actor)
+}
+
+func (d *deadlineStore) MoveQueuedRecordToMember(ctx context.Context,
+	id string, agreement *MembershipAgreement, actor *Actor) error {
+	var cancel context.CancelFunc
+	ctx, cancel = d.context(ctx, "MoveQueuedRecordToMember")
+	defer cancel()
+	return d.store.MoveQueuedRecordToMember(ctx, id, agreement, actor)
+}
+
+func (d *deadlineStore) AddImportedMember(ctx context.Context,
+	agreement *MembershipAgreement, actor *Actor) error {
+	var cancel context.CancelFunc
+	ctx, cancel = d.context(ctx, "AddImportedMember")
+	defer cancel()
+	return d.store.AddImportedMember(ctx, agreement, actor)
+}
+
+func (d *deadlineStore) MoveDeQueuedRecordToArchive(ctx context.Context,
+	id string, actor *Actor) error {
+	var cancel context.CancelFunc
+	ctx, cancel = d.context(ctx, "MoveDeQueuedRecordToArchive")
+	defer cancel()
+	return d.store.MoveDeQueuedRecordToArchive(ctx, id, actor)
+}
+
+func (d *deadlineStore) RestoreArchivedRecord(ctx context.Context,
+	id string, actor *Actor) error {
+	var cancel context.CancelFunc
+	ctx, cancel = d.context(ctx, "RestoreArchivedRecord")
+	defer cancel()
+	return d.store.RestoreArchivedRecord(ctx, id, actor)
+}
+
+func (d *deadlineStore) EnumerateExpiringRecords(ctx context.Context,
+	before time.Time) ([]*ExpiringRecord, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = d.context(ctx, "EnumerateExpiringRecords")
+	defer cancel()
+	return d.store.EnumerateExpiringRecords(ctx, before)
+}
+
+func (d *deadlineStore) PurgeExpiredRecords(ctx context.Context) error {
+	var cancel context.CancelFunc
+	ctx, cancel = d.context(ctx, "PurgeExpiredRecords")
+	defer cancel()
+	return d.store.PurgeExpiredRecords(ctx)
+}
+
+func (d *deadlineStore) ExportRecords(ctx context.Context,
+	fn func(*BackupRecord) error) error {
+	var cancel context.CancelFunc
+	ctx, cancel = d.context(ctx, "ExportRecords")
+	defer cancel()
+	return d.store.ExportRecords(ctx, fn)
+}
+
+func (d *deadlineStore) ImportRecord(ctx context.Context,
+	record *BackupRecord) error {
+	var cancel context.CancelFunc
+	ctx, cancel = d.context(ctx, "ImportRecord")
+	defer cancel()
+	return d.store.ImportRecord(ctx, record)
+}
+
+func (d *deadlineStore) GetAgreementPdf(ctx context.Context,
+	agreement *MembershipAgreement) ([]byte, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = d.context(ctx, "GetAgreementPdf")
+	defer cancel()
+	return d.store.GetAgreementPdf(ctx, agreement)
+}
+
+func (d *deadlineStore) GetFeeReductionDocument(ctx context.Context,
+	agreement *MembershipAgreement) ([]byte, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = d.context(ctx, "GetFeeReductionDocument")
+	defer cancel()
+	return d.store.GetFeeReductionDocument(ctx, agreement)
+}
+
+func (d *deadlineStore) MoveAgreementsToBlobStore(ctx context.Context) (
+	int, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = d.context(ctx, "MoveAgreementsToBlobStore")
+	defer cancel()
+	return d.store.MoveAgreementsToBlobStore(ctx)
+}
+
+func (d *deadlineStore) GetAuditLog(ctx context.Context, subject string) (
+	[]*AuditLogEntry, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = d.context(ctx, "GetAuditLog")
+	defer cancel()
+	return d.store.GetAuditLog(ctx, subject)
+}
+
+func (d *deadlineStore) GetMemberRevisions(ctx context.Context, id string) (
+	[]*MemberRevision, error) {
+	var cancel context.CancelFunc
+	ctx, cancel = d.context(ctx, "GetMemberRevisions")
+	defer cancel()
+	return d.store.GetMemberRevisions(ctx, id)
+}
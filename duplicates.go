@@ -0,0 +1,331 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package membersys
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Number of records of each lifecycle state examined per search when
+// looking for duplicates.
+const duplicateSearchLimit int32 = 100
+
+// Number of typos tolerated when comparing names and streets.
+const duplicateMaxDistance = 2
+
+// Reasons for considering two records duplicates, strongest first.
+const (
+	DuplicateEmail       = "email"
+	DuplicateUsername    = "username"
+	DuplicateNameAddress = "name_address"
+)
+
+// Bring "text" into a form in which names and addresses are compared:
+// normalised like search terms, without punctuation, with the words
+// sorted so e.g. first and last name can be swapped.
+func duplicateCompareText(text string) string {
+	var words []string = strings.FieldsFunc(normalizeSearchText(text),
+		func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+
+	sort.Strings(words)
+	return strings.Join(words, " ")
+}
+
+// Compute the number of characters which have to be inserted, removed or
+// replaced to turn "a" into "b".
+func editDistance(a, b string) int {
+	var ra, rb []rune = []rune(a), []rune(b)
+	var prev, cur []int
+	var i, j int
+
+	prev = make([]int, len(rb)+1)
+	cur = make([]int, len(rb)+1)
+	for j = range prev {
+		prev[j] = j
+	}
+
+	for i = 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j = 1; j <= len(rb); j++ {
+			var cost int = 1
+
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+
+	return prev[len(rb)]
+}
+
+// Determine whether "a" and "b" are the same apart from a few typos.
+// Empty values are never similar.
+func similarText(a, b string) bool {
+	a = duplicateCompareText(a)
+	b = duplicateCompareText(b)
+	if a == "" || b == "" {
+		return false
+	}
+	return editDistance(a, b) <= duplicateMaxDistance
+}
+
+// Determine why "candidate" may be the same person as "member", if at all.
+// Streets are only compared if both are known, since the member list
+// doesn't include them; the city has to match in any case.
+func duplicateReason(member, candidate *Member) string {
+	if member.GetEmail() != "" && strings.EqualFold(member.GetEmail(),
+		candidate.GetEmail()) {
+		return DuplicateEmail
+	}
+	if member.GetUsername() != "" && strings.EqualFold(
+		member.GetUsername(), candidate.GetUsername()) {
+		return DuplicateUsername
+	}
+	if !similarText(member.GetName(), candidate.GetName()) ||
+		!similarText(member.GetCity(), candidate.GetCity()) {
+		return ""
+	}
+	if member.GetStreet() != "" && candidate.GetStreet() != "" &&
+		!similarText(member.GetStreet(), candidate.GetStreet()) {
+		return ""
+	}
+	return DuplicateNameAddress
+}
+
+// Search terms for finding possible duplicates of "member": the e-mail
+// address, the user name, the longest word of the name and the city.
+func duplicateCriteria(member *Member) []string {
+	var criteria []string
+	var longest, word string
+
+	for _, word = range strings.Fields(member.GetName()) {
+		if len([]rune(word)) > len([]rune(longest)) {
+			longest = word
+		}
+	}
+
+	for _, word = range []string{member.GetEmail(), member.GetUsername(),
+		longest, member.GetCity()} {
+		if len(strings.TrimSpace(word)) > 0 && !strings.ContainsAny(word, " \t") {
+			criteria = append(criteria, word)
+		}
+	}
+
+	return criteria
+}
+
+// Look for members using the e-mail address or the user name of "member".
+// Unlike FindDuplicates, this only takes two lookups, so it can be done
+// for every application submitted through the public form.
+func FindKnownMembers(ctx context.Context, db MembershipStore,
+	member *Member) ([]*PossibleDuplicate, error) {
+	var rv []*PossibleDuplicate
+	var agreement *MembershipAgreement
+	var err error
+
+	if member.GetEmail() != "" {
+		agreement, _, err = db.GetMemberDetail(ctx, member.GetEmail())
+		if err == nil {
+			rv = append(rv, &PossibleDuplicate{
+				Table:  proto.String("members"),
+				Key:    proto.String(agreement.GetMemberData().GetEmail()),
+				Name:   proto.String(agreement.GetMemberData().GetName()),
+				Reason: proto.String(DuplicateEmail),
+			})
+		} else if grpc.Code(err) != codes.NotFound {
+			return nil, err
+		}
+	}
+
+	if member.GetUsername() != "" {
+		agreement, err = db.GetMemberDetailByUsername(ctx,
+			member.GetUsername())
+		if err == nil && !strings.EqualFold(
+			agreement.GetMemberData().GetEmail(), member.GetEmail()) {
+			rv = append(rv, &PossibleDuplicate{
+				Table:  proto.String("members"),
+				Key:    proto.String(agreement.GetMemberData().GetEmail()),
+				Name:   proto.String(agreement.GetMemberData().GetName()),
+				Reason: proto.String(DuplicateUsername),
+			})
+		} else if err != nil && grpc.Code(err) != codes.NotFound {
+			return nil, err
+		}
+	}
+
+	return rv, nil
+}
+
+// Look for applicants, members and archived records which may belong to
+// the same person as "member", by e-mail address, user name or similar
+// name and address. The application "key" itself is skipped. Only the
+// first few records matching each search are examined, so this isn't
+// exhaustive. Since it takes several searches, this is only done when an
+// admin asks for it.
+func FindDuplicates(ctx context.Context, db MembershipStore, member *Member,
+	key string) ([]*PossibleDuplicate, error) {
+	var found = make(map[string]*PossibleDuplicate)
+	var rv []*PossibleDuplicate
+	var duplicate *PossibleDuplicate
+	var criterion string
+	var err error
+
+	// Record "candidate" of "table" if it is a possible duplicate,
+	// keeping the strongest reason.
+	var check = func(table, candidateKey string, candidate *Member) {
+		var reason string = duplicateReason(member, candidate)
+		var seen *PossibleDuplicate
+		var ok bool
+
+		if reason == "" || (table == "application" && candidateKey == key) {
+			return
+		}
+		if seen, ok = found[table+" "+candidateKey]; ok &&
+			seen.GetReason() <= reason {
+			return
+		}
+		found[table+" "+candidateKey] = &PossibleDuplicate{
+			Table:  proto.String(table),
+			Key:    proto.String(candidateKey),
+			Name:   proto.String(candidate.GetName()),
+			Reason: proto.String(reason),
+		}
+	}
+
+	for _, criterion = range duplicateCriteria(member) {
+		var records []*MemberWithKey
+		var record *MemberWithKey
+		var members []*Member
+		var candidate *Member
+
+		records, err = db.EnumerateMembershipRequests(ctx, criterion, "",
+			duplicateSearchLimit)
+		if err != nil {
+			return nil, err
+		}
+		for _, record = range records {
+			check("application", record.Key, &record.Member)
+		}
+
+		members, err = db.EnumerateMembers(ctx,
+			&MemberFilter{Criterion: criterion}, "", duplicateSearchLimit)
+		if err != nil {
+			return nil, err
+		}
+		for _, candidate = range members {
+			check("members", candidate.GetEmail(), candidate)
+		}
+
+		records, err = db.EnumerateTrashedMembers(ctx, criterion, "",
+			duplicateSearchLimit)
+		if err != nil {
+			return nil, err
+		}
+		for _, record = range records {
+			check("membership_archive", record.Key, &record.Member)
+		}
+	}
+
+	for _, duplicate = range found {
+		rv = append(rv, duplicate)
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		if rv[i].GetTable() != rv[j].GetTable() {
+			return rv[i].GetTable() < rv[j].GetTable()
+		}
+		return rv[i].GetKey() < rv[j].GetKey()
+	})
+
+	return rv, nil
+}
+
+// Combine the application "duplicate" into "agreement", which is kept.
+// Details only known from the duplicate are filled in, and the agreement
+// scan and fee reduction request are taken from the duplicate if
+// "agreement" has none. References to the application "duplicate_id" are
+// dropped.
+func mergeAgreements(agreement, duplicate *MembershipAgreement,
+	duplicate_id string) {
+	var md *Member
+	var duplicates []*PossibleDuplicate
+	var possible *PossibleDuplicate
+
+	md = proto.Clone(duplicate.GetMemberData()).(*Member)
+	proto.Merge(md, agreement.GetMemberData())
+	agreement.MemberData = md
+
+	if agreementPdfHash(agreement) == "" {
+		agreement.AgreementPdf = duplicate.AgreementPdf
+		agreement.AgreementPdfHash = duplicate.AgreementPdfHash
+	}
+	if agreement.FeeReduction == nil {
+		agreement.FeeReduction = duplicate.FeeReduction
+	}
+
+	if agreement.Metadata == nil {
+		agreement.Metadata = new(MembershipMetadata)
+	}
+	if duplicate.GetMetadata().GetComment() != "" {
+		if agreement.Metadata.GetComment() != "" {
+			agreement.Metadata.Comment = proto.String(
+				agreement.Metadata.GetComment() + "\n\n" +
+					duplicate.GetMetadata().GetComment())
+		} else {
+			agreement.Metadata.Comment = duplicate.Metadata.Comment
+		}
+	}
+
+	for _, possible = range agreement.Metadata.PossibleDuplicates {
+		if possible.GetTable() != "application" ||
+			possible.GetKey() != duplicate_id {
+			duplicates = append(duplicates, possible)
+		}
+	}
+	agreement.Metadata.PossibleDuplicates = duplicates
+}
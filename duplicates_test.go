@@ -0,0 +1,201 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package membersys
+
+import (
+	"context"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func TestEditDistance(t *testing.T) {
+	var tests = []struct {
+		a, b     string
+		distance int
+	}{
+		{"", "", 0},
+		{"abc", "", 3},
+		{"", "abc", 3},
+		{"kitten", "kitten", 0},
+		{"kitten", "sitten", 1},
+		{"kitten", "sitting", 3},
+		{"flaw", "lawn", 2},
+		{"muller", "mueller", 1},
+		// Characters are compared, not bytes.
+		{"zürich", "zurich", 1},
+	}
+	var i int
+
+	for i = range tests {
+		var a, b = tests[i].a, tests[i].b
+		var d int
+
+		if d = editDistance(a, b); d != tests[i].distance {
+			t.Errorf("Expected editDistance(%q, %q) to be %d, got %d",
+				a, b, tests[i].distance, d)
+		}
+		if d = editDistance(b, a); d != tests[i].distance {
+			t.Errorf("Expected editDistance(%q, %q) to be %d, got %d",
+				b, a, tests[i].distance, d)
+		}
+	}
+}
+
+func TestDuplicateReason(t *testing.T) {
+	var member = &Member{
+		Name:     proto.String("Jürg Müller"),
+		Street:   proto.String("Bahnhofstrasse 1"),
+		City:     proto.String("Zürich"),
+		Email:    proto.String("jmueller@example.com"),
+		Username: proto.String("jmu"),
+	}
+	var tests = []struct {
+		name      string
+		candidate *Member
+		reason    string
+	}{
+		{"same e-mail address", &Member{
+			Name:  proto.String("Someone Else"),
+			Email: proto.String("JMueller@example.com"),
+		}, DuplicateEmail},
+		{"same user name", &Member{
+			Name:     proto.String("Someone Else"),
+			Email:    proto.String("other@example.com"),
+			Username: proto.String("JMU"),
+		}, DuplicateUsername},
+		{"same name and city", &Member{
+			Name:  proto.String("Jurg Muller"),
+			City:  proto.String("Zurich"),
+			Email: proto.String("other@example.com"),
+		}, DuplicateNameAddress},
+		{"swapped name with typo", &Member{
+			Name:   proto.String("Mueller, Jürg"),
+			Street: proto.String("Bahnhofstrase 1"),
+			City:   proto.String("Zürich"),
+		}, DuplicateNameAddress},
+		{"different street", &Member{
+			Name:   proto.String("Jürg Müller"),
+			Street: proto.String("Seestrasse 120"),
+			City:   proto.String("Zürich"),
+		}, ""},
+		{"different city", &Member{
+			Name: proto.String("Jürg Müller"),
+			City: proto.String("Basel"),
+		}, ""},
+		{"different name", &Member{
+			Name: proto.String("Anna Meier"),
+			City: proto.String("Zürich"),
+		}, ""},
+		{"no city", &Member{
+			Name: proto.String("Jürg Müller"),
+		}, ""},
+	}
+	var reason string
+	var i int
+
+	for i = range tests {
+		reason = duplicateReason(member, tests[i].candidate)
+
+		if reason != tests[i].reason {
+			t.Errorf("%s: expected the reason %q, got %q", tests[i].name,
+				tests[i].reason, reason)
+		}
+	}
+
+	// Records without an e-mail address or user name aren't duplicates
+	// of each other for that reason alone.
+	if reason = duplicateReason(&Member{Name: proto.String("A")},
+		&Member{Name: proto.String("B")}); reason != "" {
+		t.Errorf("Expected records without details not to be "+
+			"duplicates, got %q", reason)
+	}
+}
+
+func TestFindKnownMembers(t *testing.T) {
+	var ctx = context.Background()
+	var db = newTestInMemoryDB(t)
+	var ada, grace, id string
+	var duplicates []*PossibleDuplicate
+	var i, j int
+	var err error
+
+	ada = storeTestApplication(t, db, "Ada Lovelace", "ada@example.com",
+		true)
+	grace = storeTestApplication(t, db, "Grace Hopper", "grace@example.com",
+		true)
+	for _, id = range []string{ada, grace} {
+		if err = db.MoveApplicantToNewMember(ctx, id, testActor); err != nil {
+			t.Fatalf("Error accepting %s: %s", id, err)
+		}
+		createTestMember(t, db, id)
+	}
+
+	var tests = []struct {
+		email, username string
+		reasons         []string
+	}{
+		{"nobody@example.com", "nobody", nil},
+		{"ada@example.com", "", []string{DuplicateEmail}},
+		{"ada@example.com", "user" + ada[:8], []string{DuplicateEmail}},
+		{"lovelace@example.com", "user" + ada[:8],
+			[]string{DuplicateUsername}},
+		{"grace@example.com", "user" + ada[:8],
+			[]string{DuplicateEmail, DuplicateUsername}},
+	}
+
+	for i = range tests {
+		var test = tests[i]
+
+		duplicates, err = FindKnownMembers(ctx, db, &Member{
+			Email:    proto.String(test.email),
+			Username: proto.String(test.username),
+		})
+		if err != nil {
+			t.Errorf("%s/%s: unexpected error: %s", test.email,
+				test.username, err)
+			continue
+		}
+		if len(duplicates) != len(test.reasons) {
+			t.Errorf("%s/%s: expected %d duplicates, got %v", test.email,
+				test.username, len(test.reasons), duplicates)
+			continue
+		}
+		for j = range duplicates {
+			if duplicates[j].GetReason() != test.reasons[j] ||
+				duplicates[j].GetTable() != "members" {
+				t.Errorf("%s/%s: unexpected duplicate %v", test.email,
+					test.username, duplicates[j])
+			}
+		}
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package membersys
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/membersys/config"
+)
+
+// Name of the only membership category if none are configured.
+const DefaultFeeCategory = "regular"
+
+// The membership categories of the fee schedule "fees", in the order they
+// are offered on the application form. If no categories are configured,
+// there is only DefaultFeeCategory, charging the minimum fees. If "fees"
+// is nil, the default minimum fees apply.
+func FeeCategories(fees *config.FeeConfig) []*config.FeeCategory {
+	if len(fees.GetCategory()) > 0 {
+		return fees.GetCategory()
+	}
+	return []*config.FeeCategory{
+		&config.FeeCategory{
+			Name:             proto.String(DefaultFeeCategory),
+			MonthlyFee:       proto.Uint64(fees.GetMinimumMonthlyFee()),
+			YearlyFee:        proto.Uint64(fees.GetMinimumYearlyFee()),
+			ReductionAllowed: proto.Bool(true),
+		},
+	}
+}
+
+// Look up the membership category "name" in the fee schedule "fees".
+// Members recorded without a category belong to the first one. Returns
+// nil if there is no such category.
+func FindFeeCategory(fees *config.FeeConfig, name string) *config.FeeCategory {
+	var categories []*config.FeeCategory = FeeCategories(fees)
+	var category *config.FeeCategory
+
+	if name == "" {
+		return categories[0]
+	}
+	for _, category = range categories {
+		if category.GetName() == name {
+			return category
+		}
+	}
+	return nil
+}
+
+// Lowest fee members of "category" can choose without requesting a
+// reduction.
+func CategoryFee(category *config.FeeCategory, yearly bool) uint64 {
+	if yearly {
+		return category.GetYearlyFee()
+	}
+	return category.GetMonthlyFee()
+}
+
+// Name of "category" as shown to applicants.
+func CategoryDescription(category *config.FeeCategory) string {
+	if len(category.GetDescription()) > 0 {
+		return category.GetDescription()
+	}
+	return category.GetName()
+}
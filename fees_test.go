@@ -0,0 +1,102 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package membersys
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/membersys/config"
+)
+
+func TestFindFeeCategory(t *testing.T) {
+	var fees = &config.FeeConfig{
+		Category: []*config.FeeCategory{
+			&config.FeeCategory{
+				Name:       proto.String("regular"),
+				MonthlyFee: proto.Uint64(30),
+				YearlyFee:  proto.Uint64(300),
+			},
+			&config.FeeCategory{
+				Name:       proto.String("student"),
+				MonthlyFee: proto.Uint64(15),
+				YearlyFee:  proto.Uint64(150),
+			},
+		},
+	}
+	var tests = []struct {
+		name    string
+		fees    *config.FeeConfig
+		find    string
+		found   string
+		monthly uint64
+		yearly  uint64
+	}{
+		{"named", fees, "student", "student", 15, 150},
+		{"no category", fees, "", "regular", 30, 300},
+		{"unknown", fees, "sponsor", "", 0, 0},
+		{"defaults", nil, "", DefaultFeeCategory, 20, 200},
+		{"minimum fees", &config.FeeConfig{
+			MinimumMonthlyFee: proto.Uint64(25),
+			MinimumYearlyFee:  proto.Uint64(250),
+		}, DefaultFeeCategory, DefaultFeeCategory, 25, 250},
+		{"unknown without categories", nil, "student", "", 0, 0},
+	}
+	var category *config.FeeCategory
+	var i int
+
+	for i = range tests {
+		var test = tests[i]
+
+		category = FindFeeCategory(test.fees, test.find)
+		if test.found == "" {
+			if category != nil {
+				t.Errorf("%s: expected no category, got %s", test.name,
+					category.GetName())
+			}
+			continue
+		}
+		if category == nil {
+			t.Errorf("%s: expected the category %s, got none", test.name,
+				test.found)
+			continue
+		}
+		if category.GetName() != test.found ||
+			CategoryFee(category, false) != test.monthly ||
+			CategoryFee(category, true) != test.yearly {
+			t.Errorf("%s: expected %s at %d/%d, got %s at %d/%d",
+				test.name, test.found, test.monthly, test.yearly,
+				category.GetName(), CategoryFee(category, false),
+				CategoryFee(category, true))
+		}
+	}
+}
@@ -0,0 +1,211 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package membersys
+
+import (
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Format of the dates accepted by ParseMemberFilter.
+const filterDateFormat = "2006-01-02"
+
+// Conditions for narrowing down the list of members. Only members meeting
+// all conditions which are set are listed. Time stamps are in seconds since
+// the epoch, like the ones in the member records.
+type MemberFilter struct {
+	// Words to search for in the name, e-mail address, city, user name
+	// and membership number of the members.
+	Criterion string
+
+	// Whether the member has a key to the premises.
+	HasKey *bool
+
+	// Whether the member pays the fee yearly rather than monthly.
+	FeeYearly *bool
+
+	// Lowest and highest membership fee, inclusive.
+	MinFee *uint64
+	MaxFee *uint64
+
+	// Time range the membership has been approved in. The start is
+	// inclusive, the end exclusive.
+	ApprovedAfter  *uint64
+	ApprovedBefore *uint64
+
+	// Country the member lives in.
+	Country string
+
+	// Membership category the member belongs to.
+	Category string
+
+	// Only list members in arrears, whose payments are not caught up to
+	// this time. Members who have never been recorded as having paid are
+	// always in arrears.
+	PaidBefore *uint64
+}
+
+// Parse the filter parameters of a member list request. "get" returns the
+// value of the named parameter, or an empty string if it hasn't been given.
+// The parameters are criterion, has_key, fee_yearly (true or false),
+// min_fee, max_fee, approved_after, approved_before, paid_before (dates as
+// YYYY-MM-DD), country and category.
+func ParseMemberFilter(get func(name string) string) (*MemberFilter, error) {
+	var filter = &MemberFilter{
+		Criterion: get("criterion"),
+		Country:   get("country"),
+		Category:  get("category"),
+	}
+	var err error
+
+	if filter.HasKey, err = parseFilterBool(get, "has_key"); err != nil {
+		return nil, err
+	}
+	if filter.FeeYearly, err = parseFilterBool(get, "fee_yearly"); err != nil {
+		return nil, err
+	}
+	if filter.MinFee, err = parseFilterFee(get, "min_fee"); err != nil {
+		return nil, err
+	}
+	if filter.MaxFee, err = parseFilterFee(get, "max_fee"); err != nil {
+		return nil, err
+	}
+	filter.ApprovedAfter, err = parseFilterDate(get, "approved_after")
+	if err != nil {
+		return nil, err
+	}
+	filter.ApprovedBefore, err = parseFilterDate(get, "approved_before")
+	if err != nil {
+		return nil, err
+	}
+	if filter.PaidBefore, err = parseFilterDate(get, "paid_before"); err != nil {
+		return nil, err
+	}
+
+	return filter, nil
+}
+
+func parseFilterBool(get func(string) string, name string) (*bool, error) {
+	var value bool
+	var err error
+
+	if len(get(name)) == 0 {
+		return nil, nil
+	}
+	if value, err = strconv.ParseBool(get(name)); err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument,
+			"Invalid value for %s: %s", name, get(name))
+	}
+	return &value, nil
+}
+
+func parseFilterFee(get func(string) string, name string) (*uint64, error) {
+	var value uint64
+	var err error
+
+	if len(get(name)) == 0 {
+		return nil, nil
+	}
+	if value, err = strconv.ParseUint(get(name), 10, 64); err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument,
+			"Invalid value for %s: %s", name, get(name))
+	}
+	return &value, nil
+}
+
+// Parse the date parameter "name" as the time stamp of the start of the
+// day, local time.
+func parseFilterDate(get func(string) string, name string) (*uint64, error) {
+	var value time.Time
+	var ts uint64
+	var err error
+
+	if len(get(name)) == 0 {
+		return nil, nil
+	}
+	value, err = time.ParseInLocation(filterDateFormat, get(name), time.Local)
+	if err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument,
+			"Invalid date for %s: %s", name, get(name))
+	}
+	ts = uint64(value.Unix())
+	return &ts, nil
+}
+
+// Determine whether "member", whose membership has been approved at the
+// time "approved", meets all conditions of the filter. A nil filter lets
+// every member pass.
+func (f *MemberFilter) matches(member *Member, approved uint64) bool {
+	if f == nil {
+		return true
+	}
+	if f.HasKey != nil && member.GetHasKey() != *f.HasKey {
+		return false
+	}
+	if f.FeeYearly != nil && member.GetFeeYearly() != *f.FeeYearly {
+		return false
+	}
+	if f.MinFee != nil && member.GetFee() < *f.MinFee {
+		return false
+	}
+	if f.MaxFee != nil && member.GetFee() > *f.MaxFee {
+		return false
+	}
+	if f.ApprovedAfter != nil && approved < *f.ApprovedAfter {
+		return false
+	}
+	if f.ApprovedBefore != nil && approved >= *f.ApprovedBefore {
+		return false
+	}
+	if len(f.Country) > 0 && member.GetCountry() != f.Country {
+		return false
+	}
+	if len(f.Category) > 0 && member.GetCategory() != f.Category {
+		return false
+	}
+	if f.PaidBefore != nil && member.PaymentsCaughtUpTo != nil &&
+		member.GetPaymentsCaughtUpTo() >= *f.PaidBefore {
+		return false
+	}
+	return matchesCriterion(member, f.Criterion)
+}
+
+// The search criterion of the filter, if any.
+func (f *MemberFilter) criterion() string {
+	if f == nil {
+		return ""
+	}
+	return f.Criterion
+}
@@ -0,0 +1,176 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package membersys
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/membersys/config"
+)
+
+// Error code for consents without a message of their own.
+const consentNotGiven = "consent-not-given"
+
+// Consents asked for if none are configured. Their labels are the
+// messages "consent-<name>" in the catalogs of i18n.go.
+var defaultConsents = []*config.ConsentConfig{
+	&config.ConsentConfig{
+		Name: proto.String("statutes"),
+		Url:  proto.String("http://www.starship-factory.ch/pages/statuten.html"),
+	},
+	&config.ConsentConfig{
+		Name: proto.String("rules"),
+		Url:  proto.String("http://www.starship-factory.ch/pages/reglement.html"),
+	},
+	&config.ConsentConfig{Name: proto.String("ipay")},
+	&config.ConsentConfig{Name: proto.String("gt18")},
+	&config.ConsentConfig{
+		Name: proto.String("privacy_ok"),
+		Url:  proto.String("https://www.starship-factory.ch/datenschutz/"),
+	},
+	&config.ConsentConfig{Name: proto.String("email_ok")},
+}
+
+// Error codes of the built-in consents.
+var consentErrors = map[string]string{
+	"statutes":   "statutes-not-accepted",
+	"rules":      "rules-not-accepted",
+	"ipay":       "payment-not-accepted",
+	"gt18":       "not-gt18",
+	"privacy_ok": "gdpr-not-accepted",
+	"email_ok":   "email-not-accepted",
+}
+
+// The consents asked for on the membership form configured by "form", in
+// the order they are shown. If none are configured, the built-in ones
+// are asked for.
+func FormConsents(form *config.FormConfig) []*config.ConsentConfig {
+	if len(form.GetConsent()) > 0 {
+		return form.GetConsent()
+	}
+	return defaultConsents
+}
+
+// Pick the text for "lang" from "translations", falling back to "text".
+func localizedText(text string, translations []*config.LocalizedText,
+	lang string) string {
+	var translation *config.LocalizedText
+
+	for _, translation = range translations {
+		if translation.GetLanguage() == lang {
+			return translation.GetText()
+		}
+	}
+	return text
+}
+
+// Text of the checkbox for "consent" in "lang". Consents without a
+// configured label use the built-in text for their name.
+func ConsentLabel(consent *config.ConsentConfig, lang string) string {
+	if consent.Label == nil {
+		return Message(lang, "consent-"+consent.GetName())
+	}
+	return localizedText(consent.GetLabel(), consent.LabelTranslation, lang)
+}
+
+// Error code and arguments of the message shown in "lang" if the
+// required "consent" hasn't been given. The built-in consents have
+// messages of their own, all others name the consent in a common one.
+func ConsentError(consent *config.ConsentConfig, lang string) (
+	string, []interface{}) {
+	var code string
+	var ok bool
+
+	if code, ok = consentErrors[consent.GetName()]; ok && consent.Label == nil {
+		return code, nil
+	}
+	return consentNotGiven, []interface{}{ConsentLabel(consent, lang)}
+}
+
+// Record that "consent" has been given at "now".
+func NewConsent(consent *config.ConsentConfig, now uint64) *Consent {
+	return &Consent{
+		Name:      proto.String(consent.GetName()),
+		Version:   consent.Version,
+		Url:       consent.Url,
+		Timestamp: proto.Uint64(now),
+	}
+}
+
+// Question asked by "field" in "lang". Defaults to the name of the field.
+func FormFieldLabel(field *config.FormFieldConfig, lang string) string {
+	if field.Label == nil {
+		return field.GetName()
+	}
+	return localizedText(field.GetLabel(), field.LabelTranslation, lang)
+}
+
+// Determine whether "value" is an acceptable answer to "field". Fields
+// of the type SELECT only accept their options.
+func IsFormFieldOption(field *config.FormFieldConfig, value string) bool {
+	var option string
+
+	if field.GetType() != config.FormFieldConfig_SELECT {
+		return true
+	}
+	for _, option = range field.Option {
+		if option == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Answer to the additional question "name" recorded in "metadata", or an
+// empty string if there is none.
+func FormFieldAnswer(metadata *MembershipMetadata, name string) string {
+	var value *FormFieldValue
+
+	for _, value = range metadata.GetExtraFields() {
+		if value.GetName() == name {
+			return value.GetValue()
+		}
+	}
+	return ""
+}
+
+// Determine whether the consent "name" has been given according to
+// "metadata".
+func HasConsent(metadata *MembershipMetadata, name string) bool {
+	var consent *Consent
+
+	for _, consent = range metadata.GetConsents() {
+		if consent.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,468 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package membersys
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gocql/gocql"
+	"github.com/golang/protobuf/proto"
+)
+
+// An inconsistency found in the membership database by CheckConsistency.
+type ConsistencyProblem struct {
+	// Table and key of the row affected.
+	Table string
+	Key   string
+
+	// What is wrong with the row.
+	Description string
+
+	// Whether the row has been repaired from its pb_data.
+	Repaired bool
+}
+
+// Values of the columns of the application table which are kept outside
+// of pb_data, as written by addApplicationToBatch.
+func cqlApplicationColumnValues(
+	agreement *MembershipAgreement) map[string]interface{} {
+	var md *Member = agreement.GetMemberData()
+
+	return map[string]interface{}{
+		"name": md.Name, "city": md.City,
+		"email": md.Email, "fee": int64(md.GetFee()),
+		"username": md.Username, "fee_yearly": md.GetFeeYearly(),
+		"category": md.Category,
+	}
+}
+
+// Values of the columns of member_records which are kept outside of
+// pb_data, as written by memberRecordValues.
+func cqlMemberColumnValues(
+	agreement *MembershipAgreement) map[string]interface{} {
+	var md *Member = agreement.GetMemberData()
+	var payments *int64
+
+	if md.PaymentsCaughtUpTo != nil {
+		payments = proto.Int64(int64(md.GetPaymentsCaughtUpTo()))
+	}
+
+	return map[string]interface{}{
+		"email": md.GetEmail(), "name": md.GetName(),
+		"city": md.GetCity(), "country": md.GetCountry(),
+		"username": md.Username, "fee": int64(md.GetFee()),
+		"fee_yearly": md.GetFeeYearly(), "has_key": md.GetHasKey(),
+		"payments_caught_up_to": payments, "category": md.Category,
+		"approval_ts": int64(
+			agreement.GetMetadata().GetApprovalTimestamp()),
+	}
+}
+
+// Format the column value "value" for comparing it. Cassandra returns
+// null values as the zero value of their type.
+func cqlColumnString(value interface{}) string {
+	if s, ok := value.(*string); ok {
+		if s == nil {
+			return ""
+		}
+		return *s
+	}
+	if i, ok := value.(*int64); ok {
+		if i == nil {
+			return "0"
+		}
+		return strconv.FormatInt(*i, 10)
+	}
+	return fmt.Sprint(value)
+}
+
+// Determine the fields every record needs which are missing from
+// "agreement".
+func missingRequiredFields(agreement *MembershipAgreement) []string {
+	var md *Member = agreement.GetMemberData()
+	var missing []string
+
+	if md == nil {
+		return []string{"member_data"}
+	}
+	if agreement.Metadata == nil {
+		missing = append(missing, "metadata")
+	}
+	if md.Name == nil {
+		missing = append(missing, "name")
+	}
+	if md.Street == nil {
+		missing = append(missing, "street")
+	}
+	if md.City == nil {
+		missing = append(missing, "city")
+	}
+	if md.Country == nil {
+		missing = append(missing, "country")
+	}
+	if md.Fee == nil {
+		missing = append(missing, "fee")
+	}
+	if md.FeeYearly == nil {
+		missing = append(missing, "fee_yearly")
+	}
+	if md.GetEmail() == "" {
+		missing = append(missing, "email")
+	}
+	return missing
+}
+
+// Decode "value" into "agreement", describing the problem if it can't be
+// decoded or lacks required fields. Records lacking required fields are
+// still decoded as far as possible.
+func (m *MembershipDB) checkRecord(value []byte,
+	agreement *MembershipAgreement) (bool, string) {
+	var missing []string
+	var err error
+
+	err = m.unmarshal(value, agreement)
+	if _, ok := err.(*proto.RequiredNotSetError); err != nil && !ok {
+		return false, "Undecodable pb_data: " + err.Error()
+	}
+	if missing = missingRequiredFields(agreement); len(missing) > 0 {
+		return agreement.MemberData != nil,
+			"Missing required fields: " + strings.Join(missing, ", ")
+	}
+	return true, ""
+}
+
+// Compare the columns of "row" to the values in "expected", returning the
+// names of the columns which differ, in alphabetical order.
+func differingColumns(row, expected map[string]interface{}) []string {
+	var columns []string
+	var column string
+	var value interface{}
+
+	for column, value = range expected {
+		if cqlColumnString(row[column]) != cqlColumnString(value) {
+			columns = append(columns, column)
+		}
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+// Overwrite "columns" of the row of "table" with the "key" column "key"
+// with the values from "expected", unless its pb_data has changed from
+// "value" in the meantime.
+func (m *MembershipDB) repairColumns(ctx context.Context, table string,
+	key interface{}, value []byte, columns []string,
+	expected map[string]interface{}) (bool, error) {
+	var sets []string
+	var args []interface{}
+	var column string
+
+	for _, column = range columns {
+		sets = append(sets, column+" = ?")
+		args = append(args, expected[column])
+	}
+	args = append(args, key, value)
+
+	return m.query(ctx, "UPDATE "+table+" SET "+strings.Join(sets, ", ")+
+		" WHERE id = ? IF pb_data = ?", args...).MapScanCAS(
+		make(map[string]interface{}))
+}
+
+// Scan all lifecycle tables for rows whose columns disagree with their
+// pb_data, records which can't be decoded or lack required fields,
+// member records whose e-mail address isn't mapped to them and the other
+// way around, and departing members who are still members. "fn" is called
+// for every problem found. If "repair" is set, the problems which can be
+// fixed from pb_data are fixed; the others have to be looked at by hand.
+func (m *MembershipDB) CheckConsistency(ctx context.Context, repair bool,
+	fn func(*ConsistencyProblem) error) error {
+	var members = make(map[string]int64)
+	var memberEmails = make(map[int64]string)
+	var mapped = make(map[string]bool)
+	var iter *gocql.Iter
+	var table, email string
+	var number int64
+	var err error
+
+	// Report "problem", repairing it using "fix" if requested.
+	var report = func(problem *ConsistencyProblem,
+		fix func() (bool, error)) error {
+		var err error
+
+		if repair && fix != nil {
+			if problem.Repaired, err = fix(); err != nil {
+				return err
+			}
+		}
+		return fn(problem)
+	}
+
+	for _, table = range recordTables {
+		var columns string = "id, pb_data"
+
+		if table == "application" {
+			columns = "id, pb_data, name, city, email, fee, " +
+				"username, fee_yearly, category"
+		}
+
+		iter = m.query(ctx, "SELECT "+columns+" FROM "+table).Iter()
+		for {
+			var row = make(map[string]interface{})
+			var agreement = new(MembershipAgreement)
+			var expected map[string]interface{}
+			var differing []string
+			var value []byte
+			var problem string
+			var ok bool
+
+			if !iter.MapScan(row) {
+				break
+			}
+
+			value, _ = row["pb_data"].([]byte)
+			if ok, problem = m.checkRecord(value, agreement); problem != "" {
+				err = report(&ConsistencyProblem{
+					Table:       table,
+					Key:         fmt.Sprint(row["id"]),
+					Description: problem,
+				}, nil)
+				if err != nil {
+					iter.Close()
+					return err
+				}
+			}
+			if !ok || table != "application" {
+				continue
+			}
+
+			expected = cqlApplicationColumnValues(agreement)
+			if differing = differingColumns(row, expected); len(differing) == 0 {
+				continue
+			}
+			err = report(&ConsistencyProblem{
+				Table: table,
+				Key:   fmt.Sprint(row["id"]),
+				Description: "Columns disagree with pb_data: " +
+					strings.Join(differing, ", "),
+			}, func() (bool, error) {
+				return m.repairColumns(ctx, table, row["id"], value,
+					differing, expected)
+			})
+			if err != nil {
+				iter.Close()
+				return err
+			}
+		}
+		if err = iter.Close(); err != nil {
+			return err
+		}
+	}
+
+	iter = m.query(ctx, "SELECT id, pb_data, email, name, city, country, "+
+		"username, fee, fee_yearly, has_key, payments_caught_up_to, "+
+		"category, approval_ts FROM member_records").Iter()
+	for {
+		var row = make(map[string]interface{})
+		var agreement = new(MembershipAgreement)
+		var expected map[string]interface{}
+		var differing []string
+		var key string
+		var value []byte
+		var problem string
+		var ok bool
+
+		if !iter.MapScan(row) {
+			break
+		}
+
+		number, _ = row["id"].(int64)
+		key = strconv.FormatInt(number, 10)
+		value, _ = row["pb_data"].([]byte)
+
+		// Undecodable records may still own an e-mail address.
+		memberEmails[number] = ""
+
+		if ok, problem = m.checkRecord(value, agreement); problem != "" {
+			err = report(&ConsistencyProblem{
+				Table:       "member_records",
+				Key:         key,
+				Description: problem,
+			}, nil)
+			if err != nil {
+				iter.Close()
+				return err
+			}
+		}
+		if !ok {
+			continue
+		}
+
+		members[agreement.GetMemberData().GetEmail()] = number
+		memberEmails[number] = agreement.GetMemberData().GetEmail()
+		if agreement.GetMemberData().GetId() != uint64(number) {
+			err = report(&ConsistencyProblem{
+				Table: "member_records",
+				Key:   key,
+				Description: fmt.Sprintf("pb_data has the membership "+
+					"number %d", agreement.GetMemberData().GetId()),
+			}, nil)
+			if err != nil {
+				iter.Close()
+				return err
+			}
+		}
+
+		expected = cqlMemberColumnValues(agreement)
+		if differing = differingColumns(row, expected); len(differing) == 0 {
+			continue
+		}
+		err = report(&ConsistencyProblem{
+			Table: "member_records",
+			Key:   key,
+			Description: "Columns disagree with pb_data: " +
+				strings.Join(differing, ", "),
+		}, func() (bool, error) {
+			return m.repairColumns(ctx, "member_records", number, value,
+				differing, expected)
+		})
+		if err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	if err = iter.Close(); err != nil {
+		return err
+	}
+
+	// Every e-mail address in member_emails must belong to the member it
+	// points to.
+	iter = m.query(ctx, "SELECT email, id FROM member_emails").Iter()
+	for iter.Scan(&email, &number) {
+		var owner string
+		var ok bool
+
+		if owner, ok = memberEmails[number]; ok && owner == email {
+			mapped[email] = true
+			continue
+		} else if ok && owner == "" {
+			continue
+		}
+
+		err = report(&ConsistencyProblem{
+			Table: "member_emails",
+			Key:   email,
+			Description: fmt.Sprintf("Orphaned, points to member %d",
+				number),
+		}, func() (bool, error) {
+			return m.query(ctx, "DELETE FROM member_emails "+
+				"WHERE email = ? IF id = ?", email, number).MapScanCAS(
+				make(map[string]interface{}))
+		})
+		if err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	if err = iter.Close(); err != nil {
+		return err
+	}
+
+	// The members left have no or a different entry in member_emails.
+	for email, number = range members {
+		var existing int64
+
+		if mapped[email] {
+			continue
+		}
+
+		err = m.query(ctx, "SELECT id FROM member_emails WHERE email = ?",
+			email).Scan(&existing)
+		if err == nil {
+			err = report(&ConsistencyProblem{
+				Table: "member_records",
+				Key:   strconv.FormatInt(number, 10),
+				Description: fmt.Sprintf("E-mail address %s belongs to "+
+					"member %d", email, existing),
+			}, nil)
+		} else if err == gocql.ErrNotFound {
+			err = report(&ConsistencyProblem{
+				Table: "member_records",
+				Key:   strconv.FormatInt(number, 10),
+				Description: fmt.Sprintf("E-mail address %s missing "+
+					"from member_emails", email),
+			}, func() (bool, error) {
+				return m.query(ctx, "INSERT INTO member_emails "+
+					"(email, id) VALUES (?, ?) IF NOT EXISTS", email,
+					number).MapScanCAS(make(map[string]interface{}))
+			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Departing members whose record is still among the members would
+	// have their account removed by member_creator.
+	iter = m.query(ctx, "SELECT id, pb_data FROM membership_dequeue").Iter()
+	for {
+		var agreement = new(MembershipAgreement)
+		var uuid gocql.UUID
+		var value []byte
+
+		if !iter.Scan(&uuid, &value) {
+			break
+		}
+		if ok, _ := m.checkRecord(value, agreement); !ok {
+			continue
+		}
+		email = agreement.GetMemberData().GetEmail()
+		if _, ok := members[email]; !ok {
+			continue
+		}
+
+		err = report(&ConsistencyProblem{
+			Table: "membership_dequeue",
+			Key:   uuid.String(),
+			Description: fmt.Sprintf("%s is still a member, but queued "+
+				"for removal", email),
+		}, nil)
+		if err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
@@ -1,57 +1,56 @@
 package main
 
 import (
-	"database/cassandra"
 	"flag"
 	"log"
+	"strings"
+
+	"github.com/gocql/gocql"
 )
 
 func main() {
-	var uuid cassandra.UUID
-	var conn *cassandra.RetryCassandraClient
-	var r *cassandra.ColumnOrSuperColumn
-	var cp *cassandra.ColumnPath
+	var uuid gocql.UUID
+	var cluster *gocql.ClusterConfig
+	var sess *gocql.Session
+	var row map[string]interface{} = make(map[string]interface{})
 	var err error
 
-	var uuid_str, dbserver, dbname, columnfamily, column string
+	var uuid_str, dbserver, dbname, table, column string
 
 	flag.StringVar(&uuid_str, "uuid-string", "",
 		"UUID string to look at")
-	flag.StringVar(&dbserver, "cassandra-server", "localhost:9160",
+	flag.StringVar(&dbserver, "cassandra-server", "localhost:9042",
 		"Database server to look at")
 	flag.StringVar(&dbname, "dbname", "sfmembersys",
 		"Database name to look at")
-	flag.StringVar(&columnfamily, "column-family", "",
-		"Column family to look at")
+	flag.StringVar(&table, "table", "",
+		"Table to look at")
 	flag.StringVar(&column, "column-name", "",
 		"Column name to look at")
 	flag.Parse()
 
-	uuid, err = cassandra.ParseUUID(uuid_str)
+	uuid, err = gocql.ParseUUID(uuid_str)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	conn, err = cassandra.NewRetryCassandraClient(dbserver)
-	if err != nil {
-		log.Fatal(err)
-	}
+	cluster = gocql.NewCluster(strings.Split(dbserver, ",")...)
+	cluster.Keyspace = dbname
+	cluster.Consistency = gocql.One
 
-	err = conn.SetKeyspace(dbname)
+	sess, err = cluster.CreateSession()
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer sess.Close()
 
-	cp = cassandra.NewColumnPath()
-	cp.ColumnFamily = columnfamily
-	cp.Column = []byte(column)
-
-	r, err = conn.Get([]byte(uuid), cp,
-		cassandra.ConsistencyLevel_ONE)
+	// Table and column names can't be passed as query parameters, but
+	// this is only a debugging tool anyway.
+	err = sess.Query("SELECT "+column+" AS value, WRITETIME("+column+
+		") AS timestamp FROM "+table+" WHERE id = ?", uuid).MapScan(row)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	log.Print(r.Column.Name, ": ", r.Column.Value, " (",
-		r.Column.Timestamp, ")")
+	log.Print(column, ": ", row["value"], " (", row["timestamp"], ")")
 }
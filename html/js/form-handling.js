@@ -5,6 +5,71 @@
  *
  */
 $(document).ready(function() {
+	// validation messages by language of the page, German as fallback
+	var translations = {
+		de: {
+			name: "Gib deinen Namen an.",
+			required: "Dieses Feld muss ausgefüllt sein.",
+			fee: "Der Betrag muss grösser als der Mindestbetrag sein, andernfalls musst du Reduktion beantragen.",
+			feeDigits: "Der Betrag muss grösser als der Mindestbetrag ({0}) sein, andernfalls musst du Reduktion beantragen.",
+			reductionReason: "Bitte begründe den Antrag auf Ermässigung.",
+			username: "Benutzernamen eingeben",
+			usernameLength: "Bitte mindestens {0} Zeichen verwenden",
+			usernameTaken: "{0} wurde bereits verwendet",
+			password: "Bitte ein Passwort angeben",
+			minLength: "Mindestens {0} Zeichen verwenden",
+			passwordRepeat: "Wiederhole das Passwort",
+			passwordMismatch: "Die Passwörter stimmen nicht überein.",
+			email: "Bitte gib eine gültige E-Mail Adresse an."
+		},
+		en: {
+			name: "Please enter your name.",
+			required: "This field is required.",
+			fee: "The amount must be at least the minimum fee, otherwise you have to request a reduction.",
+			feeDigits: "The amount must be at least the minimum fee ({0}), otherwise you have to request a reduction.",
+			reductionReason: "Please give a reason for requesting a reduction.",
+			username: "Enter a user name",
+			usernameLength: "Please use at least {0} characters",
+			usernameTaken: "{0} is already taken",
+			password: "Please enter a password",
+			minLength: "Use at least {0} characters",
+			passwordRepeat: "Repeat the password",
+			passwordMismatch: "The passwords do not match.",
+			email: "Please enter a valid e-mail address."
+		},
+		fr: {
+			name: "Indique ton nom.",
+			required: "Ce champ est obligatoire.",
+			fee: "Le montant doit être au moins égal à la cotisation minimale, sinon tu dois demander une réduction.",
+			feeDigits: "Le montant doit être au moins égal à la cotisation minimale ({0}), sinon tu dois demander une réduction.",
+			reductionReason: "Merci de justifier la demande de réduction.",
+			username: "Indique un nom d'utilisateur",
+			usernameLength: "Utilise au moins {0} caractères",
+			usernameTaken: "{0} est déjà utilisé",
+			password: "Indique un mot de passe",
+			minLength: "Utilise au moins {0} caractères",
+			passwordRepeat: "Répète le mot de passe",
+			passwordMismatch: "Les mots de passe ne correspondent pas.",
+			email: "Indique une adresse e-mail valide."
+		},
+		it: {
+			name: "Indica il tuo nome.",
+			required: "Questo campo è obbligatorio.",
+			fee: "L'importo deve essere almeno pari alla quota minima, altrimenti devi chiedere una riduzione.",
+			feeDigits: "L'importo deve essere almeno pari alla quota minima ({0}), altrimenti devi chiedere una riduzione.",
+			reductionReason: "Per favore motiva la richiesta di riduzione.",
+			username: "Inserisci un nome utente",
+			usernameLength: "Usa almeno {0} caratteri",
+			usernameTaken: "{0} è già in uso",
+			password: "Inserisci una password",
+			minLength: "Usa almeno {0} caratteri",
+			passwordRepeat: "Ripeti la password",
+			passwordMismatch: "Le password non corrispondono.",
+			email: "Inserisci un indirizzo e-mail valido."
+		}
+	};
+	var t = translations[$('html').attr('lang')] || translations.de;
+
 		// check if the username exisis in the backend
 	$.mockjax({
 		url: "users.action",
@@ -36,9 +101,9 @@ $(document).ready(function() {
 			}
 
 			if ($('#yearly').prop('checked'))
-				minfee = 200;
+				minfee = $('#fee1').data('yearly-fee');
 			else
-				minfee = 20;
+				minfee = $('#fee1').data('monthly-fee');
 
 			if ($(params[0]).prop('checked')) {
 				return true;
@@ -46,12 +111,12 @@ $(document).ready(function() {
 			else if ($(params[1]).prop('checked') && value >= minfee) {
 				return true;
 			}
-			else if ($(params[2]).prop('checked')) {
+			else if ($(params[2]).prop('checked') && !$(params[2]).prop('disabled')) {
 				return true;
 			}
 			//return value === target.prop('checked');
 			//return this.optional(element) || value == $(params[0]).value();
-	}, $.validator.format("Der Betrag muss grösser als der Mindestbetrag sein, andernfalls musst du Reduktion beantragen."));
+	}, $.validator.format(t.fee));
 
 	/** current edit END */
 
@@ -81,15 +146,19 @@ $(document).ready(function() {
 			"mr[customFee]" : {
 				feeSelect: ["#fee1","#fee2","#reduction"]
 			},
+			"mr[reductionReason]": {
+				required: {
+					depends: function(element) {
+						return $('#reduction').prop('checked') &&
+							!$('#reduction').prop('disabled');
+					}
+				}
+			},
 			/* "mr[reduction]" : {
 				feeSelect: ["#fee1","#fee2","#reduction"]
 			}, */
-			"mr[statutes]": "required",
-			"mr[rules]": "required",
-			"mr[ipay]": "required",
-			"mr[gt18]": "required",
-			"mr[privacy_ok]": "required",
-			"mr[email_ok]": "required",
+			// consents and additional questions are configured, so they
+			// come with their own required attributes and messages.
 
 			"mr[username]": {
 				required: false,
@@ -107,41 +176,36 @@ $(document).ready(function() {
 			}
 		},
 		messages: {
-			"mr[name]": "Gib deinen Namen an.",
-			"mr[address]": "Dieses Feld muss ausgefüllt sein.",
-			"mr[city]": "Dieses Feld muss ausgefüllt sein.",
-			"mr[zip]": "Dieses Feld muss ausgefüllt sein.",
-			"mr[country]": "Dieses Feld muss ausgefüllt sein.",
-			"mr[email]": "Dieses Feld muss ausgefüllt sein.",
-			"mr[fee]" : "Dieses Feld muss ausgefüllt sein.",
-			"mr[fee]" : "Dieses Feld muss ausgefüllt sein.",
+			"mr[name]": t.name,
+			"mr[address]": t.required,
+			"mr[city]": t.required,
+			"mr[zip]": t.required,
+			"mr[country]": t.required,
+			"mr[email]": t.required,
+			"mr[fee]" : t.required,
+			"mr[fee]" : t.required,
 			"mr[customFee]" : {
-				required: "Dieses Feld muss ausgefüllt sein.",
-				digits: jQuery.format("Der Betrag muss grösser als der Mindestbetrag ({0}) sein, andernfalls musst du Reduktion beantragen.")
+				required: t.required,
+				digits: jQuery.format(t.feeDigits)
 			},
-			"mr[statutes]": "Die Statuten müssen gelesen und akzeptiert werden.",
-			"mr[rules]": "Das Reglement muss gelesen und akzeptiert werden.",
-			"mr[ipay]": "Bitte bestätigen.",
-			"mr[gt18]": "Bitte bestätigen.",
-			"mr[privacy_ok]": "Elektronische Datenverarbeitung muss genehmigt werden.",
-			"mr[email_ok]": "E-Mailverkehr muss genehmigt werden.",
+			"mr[reductionReason]": t.reductionReason,
 			"mr[username]": {
-				required: "Benutzernamen eingeben",
-				minlength: jQuery.format("Bitte mindestens {0} Zeichen verwenden"),
-				remote: jQuery.format("{0} wurde bereits verwendet")
+				required: t.username,
+				minlength: jQuery.format(t.usernameLength),
+				remote: jQuery.format(t.usernameTaken)
 			},
 			"mr[password]": {
-				required: "Bitte ein Passwort angeben",
-				rangelength: jQuery.format("Mindestens {0} Zeichen verwenden")
+				required: t.password,
+				rangelength: jQuery.format(t.minLength)
 			},
 			"mr[passwordConfirm]": {
-				required: "Wiederhole das Passwort",
+				required: t.passwordRepeat,
 				//minlength: jQuery.format("Enter at least {0} characters"),
-				equalTo: "Die Passwörter stimmen nicht überein."
+				equalTo: t.passwordMismatch
 			},
 			"mr[email]": {
-				required: "Bitte gib eine gültige E-Mail Adresse an.",
-				minlength: jQuery.format("Mindestens {0} Zeichen verwenden")
+				required: t.email,
+				minlength: jQuery.format(t.minLength)
 			},
 			terms: " "
 		},
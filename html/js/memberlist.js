@@ -144,15 +144,7 @@ function doGoodbyeMember() {
 		},
 		type: 'POST',
 		success: function(response) {
-			var bid = id.replace('@', '_').replace('.', '_');
-			var tr = $('#mem-' + bid);
-			var tbodies = tr.parent();
-			for (i = 0; i < tbodies.length; i++) {
-				for (j = 0; j < tbodies[i].childNodes.length; j++) {
-					if (tbodies[i].childNodes[j].id == 'mem-' + bid)
-						tbodies[i].removeChild(tbodies[i].childNodes[j]);
-				}
-			}
+			loadMembers(member_offset);
 
 			$('#reasonUser')[0].value = '';
 			$('#reasonCsrfToken')[0].value = '';
@@ -183,7 +175,8 @@ function acceptMember(id, csrf_token) {
 			$('#agreementCsrfToken')[0].value = '';
 			$('#agreementUploadCsrfToken')[0].value = '';
 			$('#agreementForm')[0].reset();
-		}
+		},
+		error: showEditError('agreementUploadError', 'agreementErrorText')
 	});
 	return true;
 }
@@ -216,6 +209,321 @@ function rejectMember(id, csrf_token) {
 	return true;
 }
 
+// Merges the application "duplicate" into the application "id". The
+// duplicate is moved to the archive, the combined record stays in the list.
+function mergeApplicants(id, duplicate, csrf_token) {
+	if (!confirm("Der Antrag " + duplicate + " wird mit diesem Antrag " +
+		"zusammengeführt und anschliessend archiviert.")) {
+		return true;
+	}
+
+	new $.ajax({
+		url: '/admin/api/merge',
+		data: {
+			uuid: id,
+			duplicate: duplicate,
+			csrf_token: csrf_token
+		},
+		type: 'POST',
+		success: function(response) {
+			$('#' + duplicate).remove();
+			$('#' + id + ' .duplicates [data-duplicate="' + duplicate +
+				'"]').remove();
+		}
+	});
+	return true;
+}
+
+// Looks for records which may belong to the same person as the applicant
+// "id", and lists them below the name.
+function findDuplicates(id, merge_token) {
+	new $.ajax({
+		url: '/admin/api/duplicates',
+		data: {
+			uuid: id
+		},
+		type: 'GET',
+		success: function(response) {
+			var td = $('#' + id + ' td')[0];
+
+			$('#' + id + ' .duplicates').remove();
+			if (response.duplicates == null ||
+				response.duplicates.length == 0) {
+				alert('Keine möglichen Duplikate gefunden.');
+				return;
+			}
+			td.insertBefore(duplicateList({
+				key: id,
+				possible_duplicates: response.duplicates
+			}, merge_token), td.childNodes[1] || null);
+		}
+	});
+	return true;
+}
+
+// Opens the dialog for deciding about the fee reduction requested by the
+// applicant "id".
+function decideReduction(id, csrf_token) {
+	$('#reductionApplicant')[0].value = id;
+	$('#reductionCsrfToken')[0].value = csrf_token;
+	$('#reductionValidUntil')[0].value = '';
+	$('#reductionComment')[0].value = '';
+	$('#reductionDecisionError').addClass('hide');
+	$('#reductionDecisionModal').modal('show');
+}
+
+// Records the decision about the fee reduction entered in the dialog:
+// "approve" or "deny".
+function doDecideReduction(decision) {
+	var id = $('#reductionApplicant')[0].value;
+	var valid_until = $('#reductionValidUntil')[0].value;
+
+	new $.ajax({
+		url: '/admin/api/decide-reduction',
+		data: {
+			uuid: id,
+			csrf_token: $('#reductionCsrfToken')[0].value,
+			decision: decision,
+			valid_until: valid_until,
+			comment: $('#reductionComment')[0].value
+		},
+		type: 'POST',
+		success: function(response) {
+			var reduction = {
+				status: decision == 'approve' ? 'approved' : 'denied'
+			};
+
+			if (decision == 'approve' && valid_until.length > 0)
+				reduction.valid_until = Date.parse(valid_until) / 1000;
+
+			$('#' + id + ' .reduction-status').text(
+				reductionStatus(reduction));
+			$('#reductionDecisionModal').modal('hide');
+		},
+		error: showEditError('reductionDecisionError',
+			'reductionDecisionErrorText'),
+	});
+	return true;
+}
+
+// Labels for the states of fee reduction requests.
+var reduction_states = {
+	requested: 'Ermässigung beantragt',
+	approved: 'Ermässigung bewilligt',
+	denied: 'Ermässigung abgelehnt',
+};
+
+// Describes the state of the fee "reduction", along with the end of its
+// validity and who decided about it.
+function reductionStatus(reduction) {
+	var text = reduction_states[reduction.status];
+
+	if (reduction.valid_until)
+		text += ' bis ' +
+			new Date(reduction.valid_until * 1000).toLocaleDateString();
+	if (reduction.decider_uid)
+		text += ' (' + reduction.decider_uid + ')';
+
+	return text;
+}
+
+// Creates a description of the fee reduction requested by "applicant",
+// with links to the supporting document and for deciding about it.
+function reductionInfo(applicant, reduction_token) {
+	var reduction = applicant.fee_reduction;
+	var div = document.createElement('div');
+	var span = document.createElement('span');
+	var a;
+
+	div.className = 'reduction text-info';
+	span.className = 'reduction-status';
+	span.appendChild(document.createTextNode(reductionStatus(reduction)));
+	div.appendChild(span);
+	div.appendChild(document.createTextNode(': ' +
+		(reduction.justification || '')));
+
+	if (reduction.document_hash) {
+		div.appendChild(document.createTextNode(' '));
+		a = document.createElement('a');
+		a.href = '/admin/api/reduction-document?uuid=' +
+			encodeURIComponent(applicant.key);
+		a.target = '_blank';
+		a.appendChild(document.createTextNode('Beleg'));
+		div.appendChild(a);
+	}
+
+	div.appendChild(document.createTextNode(' '));
+	a = document.createElement('a');
+	a.href = "#";
+	a.onclick = function(e) {
+		decideReduction(applicant.key, reduction_token);
+	};
+	a.appendChild(document.createTextNode('Entscheiden'));
+	div.appendChild(a);
+
+	return div;
+}
+
+// Creates a label showing whether "applicant" has verified their e-mail
+// address, with a link for sending the verification mail again.
+function verificationInfo(applicant, verification_token) {
+	var div = document.createElement('div');
+	var span = document.createElement('span');
+	var a;
+
+	div.className = 'verification';
+	if (applicant.email_verified) {
+		span.className = 'label label-success';
+		span.appendChild(document.createTextNode('E-Mail bestätigt'));
+		div.appendChild(span);
+		return div;
+	}
+
+	span.className = 'label label-warning';
+	span.appendChild(document.createTextNode('E-Mail unbestätigt'));
+	div.appendChild(span);
+
+	div.appendChild(document.createTextNode(' '));
+	a = document.createElement('a');
+	a.href = "#";
+	a.onclick = function(e) {
+		resendVerification(applicant.key, verification_token);
+	};
+	a.appendChild(document.createTextNode('Erneut senden'));
+	div.appendChild(a);
+
+	return div;
+}
+
+// Sends the mail for verifying the e-mail address to the applicant "id"
+// again.
+function resendVerification(id, csrf_token) {
+	new $.ajax({
+		url: '/admin/api/resend-verification',
+		data: {
+			uuid: id,
+			csrf_token: csrf_token
+		},
+		type: 'POST',
+		success: function(response) {
+			alert('Die Bestätigungsmail wurde erneut gesendet.');
+		},
+		error: function(jqXHR, textStatus, errorThrown) {
+			alert('Fehler beim Senden der Bestätigungsmail: ' +
+				jqXHR.responseText);
+		}
+	});
+	return true;
+}
+
+// Labels for the lifecycle states and reasons of possible duplicates.
+var duplicate_tables = {
+	application: 'Antrag',
+	members: 'Mitglied',
+	membership_archive: 'Archiv',
+};
+var duplicate_reasons = {
+	email: 'gleiche E-Mail-Adresse',
+	username: 'gleicher Benutzername',
+	name_address: 'ähnlicher Name und Adresse',
+};
+
+// Creates a list of the possible duplicates of "applicant", with links for
+// merging duplicate applications into it.
+function duplicateList(applicant, merge_token) {
+	var ul = document.createElement('ul');
+	var i;
+
+	ul.className = 'duplicates list-unstyled text-warning';
+
+	for (i = 0; i < applicant.possible_duplicates.length; i++) {
+		var duplicate = applicant.possible_duplicates[i];
+		var li = document.createElement('li');
+		var a;
+
+		li.setAttribute('data-duplicate', duplicate.key);
+		li.appendChild(document.createTextNode('Mögliches Duplikat: ' +
+			duplicate.name + ' (' + duplicate_tables[duplicate.table] +
+			', ' + duplicate_reasons[duplicate.reason] + ')'));
+
+		if (duplicate.table == 'application') {
+			li.appendChild(document.createTextNode(' '));
+			a = document.createElement('a');
+			a.href = "#";
+			a.onclick = (function(id, duplicate_id) {
+				return function(e) {
+					mergeApplicants(id, duplicate_id, merge_token);
+				};
+			})(applicant.key, duplicate.key);
+			a.appendChild(document.createTextNode('Zusammenführen'));
+			li.appendChild(a);
+		}
+
+		ul.appendChild(li);
+	}
+
+	return ul;
+}
+
+// Version of the member record displayed in the detail view. Edits are
+// rejected with 409 Conflict if the record has been changed since.
+var member_version = null;
+
+// Send an edit of the record of the member "email" to "url". If the record
+// has been changed by someone else in the meantime, the current version is
+// loaded and the edit is retried once.
+function editMemberRecord(url, email, data, success, error, retried) {
+	data.email = email;
+	data.version = member_version;
+
+	new $.ajax({
+		url: url,
+		data: data,
+		type: 'POST',
+		success: function(response) {
+			member_version = response.version;
+			if (success)
+				success(response);
+		},
+		error: function(jqXHR, textStatus, errorThrown) {
+			if (jqXHR.status == 409 && !retried) {
+				new $.ajax({
+					url: '/admin/api/member',
+					data: {
+						email: email,
+					},
+					type: 'GET',
+					success: function(response) {
+						member_version = response.version;
+						editMemberRecord(url, email, data, success, error,
+							true);
+					},
+					error: error
+				});
+			} else if (error) {
+				error(jqXHR, textStatus, errorThrown);
+			}
+		}
+	});
+}
+
+// Returns a function displaying errors in the alert box "alertId" of an
+// edit dialog.
+function showEditError(alertId, textId) {
+	return function(jqXHR, textStatus, errorThrown) {
+		var errorText = $('#' + textId)[0];
+
+		while (errorText.childNodes.length > 0)
+			errorText.removeChild(errorText.firstChild);
+
+		errorText.appendChild(document.createTextNode(textStatus + ': ' +
+			jqXHR.responseText));
+
+		if ($('#' + alertId).hasClass('hide'))
+			$('#' + alertId).removeClass('hide');
+	};
+}
+
 // Retrieve and display detailed information about a specific member.
 function loadMember(email) {
 	new $.ajax({
@@ -234,6 +542,8 @@ function loadMember(email) {
 			var inner_el;
 			var abbr;
 
+			member_version = response.version;
+
 			while (label.childNodes.length > 0)
 				label.removeChild(label.firstChild);
 
@@ -242,6 +552,21 @@ function loadMember(email) {
 			while (data.childNodes.length > 0)
 				data.removeChild(data.firstChild);
 
+			row = document.createElement('div');
+			row.className = 'row';
+			col = document.createElement('div');
+			col.className = 'col-xs-4';
+			inner_el = document.createElement('strong');
+			inner_el.appendChild(document.createTextNode('Mitgliedsnummer'));
+			col.appendChild(inner_el);
+			row.appendChild(col);
+
+			col = document.createElement('div');
+			col.className = 'col-xs-8';
+			col.appendChild(document.createTextNode(md.id));
+			row.appendChild(col);
+			data.appendChild(row);
+
 			row = document.createElement('div');
 			row.className = 'row';
 
@@ -332,14 +657,16 @@ function loadMember(email) {
 			col.className = 'col-xs-8';
 
 			col.appendChild(document.createTextNode(
-				md.fee + " CHF pro " + (md.fee_yearly ? "Jahr" : "Monat")));
+				md.fee + " CHF pro " + (md.fee_yearly ? "Jahr" : "Monat") +
+				(md.category ? " (" + md.category + ")" : "")));
 			col.appendChild(document.createTextNode(' '));
 
 			inner_el = document.createElement('a');
 			inner_el.href = "#";
 			inner_el.onclick = function() {
 				$('#memberDetailModal').modal('hide');
-				editMembershipFee(md.email, md.name, md.fee, md.fee_yearly);
+				editMembershipFee(md.email, md.name, md.fee, md.fee_yearly,
+					md.category);
 			}
 			inner_el.appendChild(document.createTextNode('Bearbeiten'));
 
@@ -483,6 +810,19 @@ function loadMember(email) {
 			row.appendChild(col);
 			data.appendChild(row);
 
+			row = document.createElement('div');
+			row.className = 'row';
+
+			col = document.createElement('div');
+			col.className = 'col-xs-12';
+			inner_el = document.createElement('a');
+			inner_el.href = '/admin/member?email=' + encodeURIComponent(md.email);
+			inner_el.appendChild(document.createTextNode('Frühere Versionen'));
+
+			col.appendChild(inner_el);
+			row.appendChild(col);
+			data.appendChild(row);
+
 			$('#memberDetailModal').modal('show');
 		}
 	});
@@ -490,12 +830,13 @@ function loadMember(email) {
 }
 
 // Edit the membership fee details of the given member.
-function editMembershipFee(email, name, fee, fee_yearly) {
+function editMembershipFee(email, name, fee, fee_yearly, category) {
 	var lbl = $('#memberFeeEditLabel')[0];
 	var feef = $('#memberFeeField')[0];
 	var who = $('#memberFeeMail')[0];
 	var monthly = $('#memberFeeIntervalMonthly')[0];
 	var yearly = $('#memberFeeIntervalYearly')[0];
+	var catf = $('#memberFeeCategory')[0];
 
 	while (lbl.childNodes.length > 0)
 		lbl.removeChild(lbl.firstChild);
@@ -507,29 +848,44 @@ function editMembershipFee(email, name, fee, fee_yearly) {
 	monthly.checked = !fee_yearly;
 	yearly.checked = fee_yearly;
 
+	// The category can only be chosen if there are several. Members
+	// without one belong to the first.
+	if (catf) {
+		catf.value = category || catf.options[0].value;
+		$(catf).data('orig', catf.value);
+	}
+
 	$('#memberFeeEditModal').modal('show');
 }
 
-// Update the membership fee of the affected member.
+// Update the membership fee and category of the affected member.
 function doEditMembershipFee() {
 	var feef = $('#memberFeeField')[0];
 	var who = $('#memberFeeMail')[0];
 	var monthly = $('#memberFeeIntervalMonthly')[0];
 	var yearly = $('#memberFeeIntervalYearly')[0];
+	var catf = $('#memberFeeCategory')[0];
+	var done = function(response) {
+		$('#memberFeeEditModal').modal('hide');
+		loadMembers(member_offset);
+	};
 
-	new $.ajax({
-		url: '/admin/api/editfee',
-		data: {
-			email: who.value,
+	editMemberRecord('/admin/api/editfee', who.value, {
 			fee: feef.value,
 			fee_yearly: yearly.checked,
 		},
-		type: 'POST',
-		success: function(response) {
-			$('#memberFeeEditModal').modal('hide');
-			loadMembers(member_offset);
-		}
-	});
+		function(response) {
+			if (!catf || catf.value == $(catf).data('orig')) {
+				done(response);
+				return;
+			}
+			editMemberRecord('/admin/api/edittext', who.value, {
+					field: 'category',
+					value: catf.value,
+				}, done,
+				showEditError('memberFeeEditError', 'memberFeeEditErrorText'));
+		},
+		showEditError('memberFeeEditError', 'memberFeeEditErrorText'));
 }
 
 // Edit address details of the specified member.
@@ -577,6 +933,7 @@ function doEditMemberAddress() {
 
 	var origValues = {};
 	var newValues = {};
+	var changed = [];
 
 	origValues['street'] = streetorig.value;
 	origValues['zipcode'] = zipcodeorig.value;
@@ -587,24 +944,29 @@ function doEditMemberAddress() {
 	newValues['city'] = cityf.value;
 	newValues['country'] = countryf.value;
 
-	for (var property in origValues) {
+	for (var property in origValues)
 		if (newValues[property] != '' &&
-			origValues[property] != newValues[property]) {
-			new $.ajax({
-				url: '/admin/api/edittext',
-				data: {
-					email: who.value,
-					field: property,
-					value: newValues[property],
-				},
-				type: 'POST',
-				success: function(response) {
-					$('#memberAddressEditModal').modal('hide');
-					loadMembers(member_offset);
-				}
-			});
+			origValues[property] != newValues[property])
+			changed.push(property);
+
+	// Every edit changes the version of the record, so the fields have to
+	// be sent one after the other.
+	var editNext = function(response) {
+		var property = changed.shift();
+
+		if (property == null) {
+			$('#memberAddressEditModal').modal('hide');
+			loadMembers(member_offset);
+			return;
 		}
-	}
+
+		editMemberRecord('/admin/api/edittext', who.value, {
+				field: property,
+				value: newValues[property],
+			}, editNext,
+			showEditError('memberAddressEditError', 'memberAddressEditText'));
+	};
+	editNext();
 }
 
 // Edit the phone number of the specified user.
@@ -628,59 +990,45 @@ function doEditMemberPhone() {
 	var phonef = $('#memberPhoneNumberField')[0];
 	var who = $('#memberPhoneMail')[0];
 
-	new $.ajax({
-		url: '/admin/api/edittext',
-		data: {
-			email: who.value,
+	editMemberRecord('/admin/api/edittext', who.value, {
 			field: 'phone',
 			value: phonef.value,
 		},
-		type: 'POST',
-		success: function(response) {
+		function(response) {
 			$('#memberPhoneEditModal').modal('hide');
 			loadMembers(member_offset);
-		}
-	});
+		},
+		showEditError('memberPhoneEditError', 'memberPhoneEditText'));
 }
 
 // Set whether the member has a key.
 function editHasKey(email, has_key) {
-	new $.ajax({
-		url: '/admin/api/editbool',
-		data: {
-			email: email,
+	editMemberRecord('/admin/api/editbool', email, {
 			field: 'has_key',
 			value: has_key,
-		},
-		type: 'POST',
-		error: function(jqXHR, textStatus, errorThrown) {
+		}, null,
+		function(jqXHR, textStatus, errorThrown) {
 			$('#memberDetailHasKey').popover({
 				'title': 'Fehler beim Speichern',
 				'content': textStatus,
 			});
 			$('#memberDetailHasKey').popover('show');
-		}
-	});
+		});
 }
 
 // Set the date up to which payments are caught up.
 function editPaymentsCaughtUpTo(email, dt) {
-	new $.ajax({
-		url: '/admin/api/editlong',
-		data: {
-			email: email,
+	editMemberRecord('/admin/api/editlong', email, {
 			field: 'payments_caught_up_to',
 			value: Number(dt) / 1000,
-		},
-		type: 'POST',
-		error: function(jqXHR, textStatus, errorThrown) {
+		}, null,
+		function(jqXHR, textStatus, errorThrown) {
 			$('#memberDetailPaymentsTo').popover({
 				'title': 'Fehler beim Speichern',
 				'content': textStatus,
 			});
 			$('#memberDetailPaymentsTo').popover('show');
-		}
-	});
+		});
 }
 
 // Edit the stored user name of the specified user.
@@ -704,19 +1052,15 @@ function doEditMemberUser() {
 	var userf = $('#memberUserField')[0];
 	var who = $('#memberUserMail')[0];
 
-	new $.ajax({
-		url: '/admin/api/edittext',
-		data: {
-			email: who.value,
+	editMemberRecord('/admin/api/edittext', who.value, {
 			field: 'username',
 			value: userf.value,
 		},
-		type: 'POST',
-		success: function(response) {
+		function(response) {
 			$('#memberUserEditModal').modal('hide');
 			loadMembers(member_offset);
-		}
-	});
+		},
+		showEditError('memberUserEditError', 'memberUserEditText'));
 }
 
 // Use AJAX to load a list of all organization members and populate the
@@ -726,6 +1070,7 @@ function loadMembers(start) {
 		url: '/admin/api/members',
 		data: {
 			start: start,
+			criterion: search_criterion,
 		},
 		type: 'GET',
 		success: function(response) {
@@ -750,13 +1095,11 @@ function loadMembers(start) {
 			}
 
 			for (i = 0; i < members.length; i++) {
-				var id = members[i].email;
-				var bid = id.replace('@', '_').replace('.', '_');
 				var tr = document.createElement('tr');
 				var td;
 				var a;
 
-				tr.id = "mem-" + bid;
+				tr.id = "mem-" + members[i].id;
 
 				td = document.createElement('td');
 				td.appendChild(document.createTextNode(members[i].name));
@@ -780,7 +1123,8 @@ function loadMembers(start) {
 				td = document.createElement('td');
 				td.appendChild(document.createTextNode(
 					members[i].fee + " CHF pro " +
-					(members[i].fee_yearly ? "Jahr" : "Monat")
+					(members[i].fee_yearly ? "Jahr" : "Monat") +
+					(members[i].category ? " (" + members[i].category + ")" : "")
 					));
 				tr.appendChild(td);
 
@@ -872,6 +1216,9 @@ function loadApplicants(criterion, start, single) {
 			var approval_token = response.approval_csrf_token;
 			var rejection_token = response.rejection_csrf_token;
 			var upload_token = response.agreement_upload_csrf_token;
+			var merge_token = response.merge_csrf_token;
+			var reduction_token = response.reduction_csrf_token;
+			var verification_token = response.verification_csrf_token;
 			var i = 0;
 
 			while (body.childNodes.length > 0)
@@ -897,6 +1244,14 @@ function loadApplicants(criterion, start, single) {
 
 				td = document.createElement('td');
 				td.appendChild(document.createTextNode(applicant.name));
+				if (applicant.possible_duplicates != null &&
+					applicant.possible_duplicates.length > 0)
+					td.appendChild(duplicateList(applicant, merge_token));
+				if (applicant.fee_reduction != null)
+					td.appendChild(reductionInfo(applicant, reduction_token));
+				if (verification_token)
+					td.appendChild(verificationInfo(applicant,
+						verification_token));
 				tr.appendChild(td);
 
 				td = document.createElement('td');
@@ -910,7 +1265,8 @@ function loadApplicants(criterion, start, single) {
 				td = document.createElement('td');
 				td.appendChild(document.createTextNode(
 					applicant.fee + " CHF pro " +
-					(applicant.fee_yearly ? "Jahr" : "Monat")
+					(applicant.fee_yearly ? "Jahr" : "Monat") +
+					(applicant.category ? " (" + applicant.category + ")" : "")
 					));
 				tr.appendChild(td);
 
@@ -938,6 +1294,18 @@ function loadApplicants(criterion, start, single) {
 				}
 				a.appendChild(document.createTextNode('Ablehnen'));
 				td.appendChild(a);
+
+				td.appendChild(document.createTextNode(' '));
+
+				a = document.createElement('a');
+				a.href = "#";
+				a.onclick = function(e) {
+					var target = e.target == null ? e.srcElement : e.target;
+					var tr = target.parentNode.parentNode;
+					findDuplicates(tr.id, merge_token);
+				}
+				a.appendChild(document.createTextNode('Duplikate suchen'));
+				td.appendChild(a);
 				tr.appendChild(td);
 
 				body.appendChild(tr);
@@ -966,7 +1334,7 @@ function forwardApplicants() {
 	var lastrecord = membertable[membertable.length - 1];
 	var lastid = lastrecord.id;
 
-	loadApplicants("", lastid);
+	loadApplicants(search_criterion, lastid);
 }
 
 // Use AJAX to load a list of all applicants queued to become organization
@@ -976,6 +1344,7 @@ function loadQueue(start) {
 		url: '/admin/api/queue',
 		data: {
 			start: start,
+			criterion: search_criterion,
 		},
 		type: 'GET',
 		success: function(response) {
@@ -1034,7 +1403,8 @@ function loadQueue(start) {
 				td = document.createElement('td');
 				td.appendChild(document.createTextNode(
 					member.fee + " CHF pro " +
-					(member.fee_yearly ? "Jahr" : "Monat")
+					(member.fee_yearly ? "Jahr" : "Monat") +
+					(member.category ? " (" + member.category + ")" : "")
 					));
 				tr.appendChild(td);
 
@@ -1086,6 +1456,7 @@ function loadDequeue(start) {
 		url: '/admin/api/dequeue',
 		data: {
 			start: start,
+			criterion: search_criterion,
 		},
 		type: 'GET',
 		success: function(response) {
@@ -1144,7 +1515,8 @@ function loadDequeue(start) {
 				td = document.createElement('td');
 				td.appendChild(document.createTextNode(
 					member.fee + " CHF pro " +
-					(member.fee_yearly ? "Jahr" : "Monat")
+					(member.fee_yearly ? "Jahr" : "Monat") +
+					(member.category ? " (" + member.category + ")" : "")
 					));
 				tr.appendChild(td);
 
@@ -1184,21 +1556,24 @@ function loadTrash(start) {
 		url: '/admin/api/trash',
 		data: {
 			start: start,
+			criterion: search_criterion,
 		},
 		type: 'GET',
 		success: function(response) {
 			var body = $('#trashlist tbody')[0];
 			var prevarr = $('#trash ul.pager li.previous');
 			var nextarr = $('#trash ul.pager li.next');
+			var trashed = response.trashed;
+			var token = response.csrf_token;
 			var i = 0;
 
 			while (body.childNodes.length > 0)
 				body.removeChild(body.firstChild);
 
-			if (response == null || response.length == 0) {
+			if (trashed == null || trashed.length == 0) {
 				var tr = document.createElement('tr');
 				var td = document.createElement('td');
-				td.colspan = 4;
+				td.colspan = 7;
 				td.appendChild(document.createTextNode(
 					'Derzeit sind keine Löschungen in Verarbeitung.'));
 				tr.appendChild(td);
@@ -1206,13 +1581,13 @@ function loadTrash(start) {
 				return;
 			}
 
-			for (i = 0; i < response.length; i++) {
-				var member = response[i];
+			for (i = 0; i < trashed.length; i++) {
+				var member = trashed[i];
 				var tr = document.createElement('tr');
 				var td;
 				var a;
 
-				tr.id = "dq-" + member.key;
+				tr.id = "tr-" + member.key;
 
 				td = document.createElement('td');
 				td.appendChild(document.createTextNode(member.name));
@@ -1240,10 +1615,23 @@ function loadTrash(start) {
 				td = document.createElement('td');
 				td.appendChild(document.createTextNode(
 					member.fee + " CHF pro " +
-					(member.fee_yearly ? "Jahr" : "Monat")
+					(member.fee_yearly ? "Jahr" : "Monat") +
+					(member.category ? " (" + member.category + ")" : "")
 					));
 				tr.appendChild(td);
 
+				td = document.createElement('td');
+				a = document.createElement('a');
+				a.href = "#";
+				a.onclick = function(e) {
+					var target = e.target == null ? e.srcElement : e.target;
+					var tr = target.parentNode.parentNode;
+					restoreTrashed(tr.id.substr(3), token);
+				}
+				a.appendChild(document.createTextNode('Wiederherstellen'));
+				td.appendChild(a);
+				tr.appendChild(td);
+
 				body.appendChild(tr);
 			}
 
@@ -1253,7 +1641,7 @@ function loadTrash(start) {
 				prevarr.addClass('disabled');
 			}
 
-			if (response.length == page_size) {
+			if (trashed.length == page_size) {
 				nextarr.removeClass('disabled');
 			} else {
 				nextarr.addClass('disabled');
@@ -1264,6 +1652,40 @@ function loadTrash(start) {
 	return true;
 }
 
+// Move a record from the trash back to the applications, or to the members
+// if it belonged to a former member.
+function restoreTrashed(id, csrf_token) {
+	new $.ajax({
+		url: '/admin/api/restore',
+		data: {
+			uuid: id,
+			csrf_token: csrf_token
+		},
+		type: 'POST',
+		success: function(response) {
+			var tr = $('#tr-' + id);
+			var tbodies = tr.parent();
+			for (i = 0; i < tbodies.length; i++)
+				for (j = 0; j < tbodies[i].childNodes.length; j++)
+					if (tbodies[i].childNodes[j].id == 'tr-' + id)
+						tbodies[i].removeChild(tbodies[i].childNodes[j]);
+		},
+		error: function(jqXHR, textStatus, errorThrown) {
+			var errorText = $('#trashRestoreErrorText')[0];
+
+			while (errorText.childNodes.length > 0)
+				errorText.removeChild(errorText.firstChild);
+
+			errorText.appendChild(document.createTextNode(textStatus + ': ' +
+				jqXHR.responseText));
+
+			if ($('#trashRestoreError').hasClass('hide'))
+				$('#trashRestoreError').removeClass('hide');
+		}
+	});
+	return true;
+}
+
 // Go to the next batch of queued records starting with the current one.
 function forwardTrash() {
 	var membertable = $('#trashlist tbody tr');
@@ -1273,14 +1695,41 @@ function forwardTrash() {
 	loadTrash(lastid);
 }
 
+// Search term the lists are currently restricted to.
+var search_criterion = "";
+
+// Restrict all lists to the records matching "criterion" and reload the
+// list which is currently shown.
+function searchRecords(criterion) {
+	var tab = $('ul.nav-tabs li.active a').attr('href');
+
+	search_criterion = criterion;
+	member_offset = "";
+
+	if (tab == "#applicants")
+		loadApplicants(search_criterion, "");
+	else if (tab == "#queue")
+		loadQueue("");
+	else if (tab == "#dequeue")
+		loadDequeue("");
+	else if (tab == "#trash")
+		loadTrash("");
+	else
+		loadMembers("");
+
+	return false;
+}
+
 // Register the required functions for switching between the different tabs.
 function load() {
+	search_criterion = $('#recordsearch')[0].value;
+
 	$('a[href="#members"]').on('show.bs.tab', function(e) {
 		loadMembers("");
 	});
 
 	$('a[href="#applicants"]').on('show.bs.tab', function(e) {
-		loadApplicants("", "");
+		loadApplicants(search_criterion, "");
 	});
 
 	$('a[href="#queue"]').on('show.bs.tab', function(e) {
@@ -1299,3 +1748,43 @@ function load() {
 
 	return true;
 }
+
+// Restore the record of a member to an earlier revision, as listed on the
+// member detail page.
+function revertMemberRevision(revision) {
+	var email = $('#memberRevisionEmail')[0].value;
+	var version = $('#memberRevisionVersion')[0].value;
+	var csrf_token = $('#memberRevisionCsrfToken')[0].value;
+
+	if (!confirm("Sollen die Daten des Mitglieds wirklich auf diesen " +
+		"Stand zurückgesetzt werden?")) {
+		return true;
+	}
+
+	new $.ajax({
+		url: '/admin/api/revert',
+		data: {
+			email: email,
+			revision: revision,
+			version: version,
+			csrf_token: csrf_token
+		},
+		type: 'POST',
+		success: function(response) {
+			window.location.reload();
+		},
+		error: function(jqXHR, textStatus, errorThrown) {
+			var errorText = $('#memberRevisionErrorText')[0];
+
+			while (errorText.childNodes.length > 0)
+				errorText.removeChild(errorText.firstChild);
+
+			errorText.appendChild(document.createTextNode(textStatus + ': ' +
+				jqXHR.responseText));
+
+			if ($('#memberRevisionError').hasClass('hide'))
+				$('#memberRevisionError').removeClass('hide');
+		}
+	});
+	return true;
+}
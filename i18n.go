@@ -0,0 +1,328 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package membersys
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Language used if the applicant doesn't ask for one of the others.
+const DefaultLanguage = "de"
+
+// Languages the membership form and its messages are available in, as
+// ISO 639-1 codes.
+var Languages = []string{"de", "en", "fr", "it"}
+
+// Messages shown to applicants, by language and error code. The error
+// codes are the ones counted in num-form-submission-errors. The texts of
+// the built-in consents are kept here as well, as "consent-<name>".
+var messageCatalogs = map[string]map[string]string{
+	"de": {
+		"no-name":                      "Ein Name ist erforderlich",
+		"no-street":                    "Eine Adresse ist erforderlich",
+		"no-city":                      "Ein Wohnort ist erforderlich",
+		"no-zip":                       "Eine Postleitzahl ist erforderlich",
+		"no-country":                   "Ein Wohnland ist erforderlich",
+		"no-email":                     "Muss angegeben werden",
+		"bad-email-format":             "Mailadresse sollte im Format a@b.ch sein",
+		"bad-phone-format":             "Telephonnummer sollte im Format +41 79 123 45 67 sein",
+		"password-mismatch":            "Passworte stimmen nicht überein",
+		"statutes-not-accepted":        "Statuten müssen akzeptiert werden",
+		"payment-not-accepted":         "Zahlungsbereitschaft ist notwendig",
+		"rules-not-accepted":           "Reglement muss akzeptiert werden",
+		"gdpr-not-accepted":            "Datenverarbeitung muss genehmigt werden",
+		"email-not-accepted":           "E-Mailverkehr muss genehmigt werden",
+		"not-gt18":                     "Man muss mindestens 18 Jahre sein, um uns beizutreten",
+		"fee-out-of-range":             "Der Betrag ist irgendwie etwas gross/klein, oder?",
+		"fee-not-a-number":             "Der Mitgliedsbeitrag kann nicht als Zahl identifiziert werden",
+		"no-fee":                       "Die Angabe eines Mitgliedsbeitrages ist notwendig",
+		"low-fee-without-reduction":    "Für einen Betrag unter %d %s muss eine Ermässigung beantragt werden",
+		"unknown-fee-value":            "Unbekannter Wert für den Mitgliedsbeitrag",
+		"unknown-fee-category":         "Unbekannte Mitgliederkategorie",
+		"reduction-not-allowed":        "Für die Kategorie %s kann keine Ermässigung beantragt werden",
+		"no-reduction-reason":          "Bitte begründe den Antrag auf Ermässigung",
+		"bad-reduction-document":       "Das Dokument muss ein PDF, JPEG oder PNG sein",
+		"reduction-document-too-large": "Das Dokument darf höchstens %d MB gross sein",
+		"consent-statutes":             "Ich habe die Statuten gelesen und akzeptiere diese.",
+		"consent-rules":                "Ich habe das Reglement gelesen und akzeptiere dieses.",
+		"consent-ipay":                 "Ich werde verbindlich den Mitgliederbeitrag monatlich bzw. jährlich im Voraus auf das Vereinskonto überweisen.",
+		"consent-gt18":                 "Ich bin mindestens 18 Jahre alt.",
+		"consent-privacy_ok":           "Ich habe die Datenschutzerklärung gelesen und erlaube dem Verein, die eingegebenen Daten elektronisch zu speichern und zum Zwecke der Mitgliederverwaltung auszuwerten.",
+		"consent-email_ok":             "Ich erlaube dem Verein und seinen Mitgliedern, mich über die eingegebene E-Mailadresse über Themen betreffend meiner Mitgliedschaft und meiner Mitbestimmung zu kontaktieren.",
+		"consent-not-given":            "Zustimmung erforderlich: %s",
+		"no-form-field":                "%s muss angegeben werden",
+		"unknown-form-field-value":     "Unbekannter Wert für %s",
+		"verification-link-invalid":    "Der Bestätigungslink ist ungültig",
+		"verification-link-expired":    "Der Bestätigungslink ist abgelaufen. Bitte melde dich bei uns, damit wir dir einen neuen schicken können",
+		"verification-address-changed": "Die E-Mail-Adresse des Antrags wurde inzwischen geändert",
+		"verification-failed":          "Die E-Mail-Adresse konnte nicht bestätigt werden. Bitte versuche es später noch einmal",
+	},
+	"en": {
+		"no-name":                      "A name is required",
+		"no-street":                    "An address is required",
+		"no-city":                      "A place of residence is required",
+		"no-zip":                       "A postcode is required",
+		"no-country":                   "A country of residence is required",
+		"no-email":                     "Must be given",
+		"bad-email-format":             "The e-mail address should look like a@b.ch",
+		"bad-phone-format":             "The phone number should look like +41 79 123 45 67",
+		"password-mismatch":            "The passwords don't match",
+		"statutes-not-accepted":        "The statutes have to be accepted",
+		"payment-not-accepted":         "You have to agree to pay the membership fee",
+		"rules-not-accepted":           "The rules have to be accepted",
+		"gdpr-not-accepted":            "Data processing has to be permitted",
+		"email-not-accepted":           "Contact by e-mail has to be permitted",
+		"not-gt18":                     "You have to be at least 18 years old to join us",
+		"fee-out-of-range":             "The amount seems somewhat large/small, doesn't it?",
+		"fee-not-a-number":             "The membership fee can't be recognised as a number",
+		"no-fee":                       "A membership fee has to be given",
+		"low-fee-without-reduction":    "For an amount below %d %s, a reduction has to be requested",
+		"unknown-fee-value":            "Unknown value for the membership fee",
+		"unknown-fee-category":         "Unknown membership category",
+		"reduction-not-allowed":        "No reduction can be requested for the category %s",
+		"no-reduction-reason":          "Please give a reason for requesting a reduction",
+		"bad-reduction-document":       "The document has to be a PDF, JPEG or PNG file",
+		"reduction-document-too-large": "The document must not be larger than %d MB",
+		"consent-statutes":             "I have read and accept the statutes.",
+		"consent-rules":                "I have read and accept the rules.",
+		"consent-ipay":                 "I commit to paying the membership fee monthly or yearly in advance to the bank account of the association.",
+		"consent-gt18":                 "I am at least 18 years old.",
+		"consent-privacy_ok":           "I have read the privacy policy and permit the association to store the data entered electronically and to process it for the purpose of managing its members.",
+		"consent-email_ok":             "I permit the association and its members to contact me at the e-mail address entered about matters concerning my membership and my say in the association.",
+		"consent-not-given":            "Consent required: %s",
+		"no-form-field":                "%s has to be given",
+		"unknown-form-field-value":     "Unknown value for %s",
+		"verification-link-invalid":    "The verification link is not valid",
+		"verification-link-expired":    "The verification link has expired. Please contact us so we can send you a new one",
+		"verification-address-changed": "The e-mail address of the application has been changed in the meantime",
+		"verification-failed":          "The e-mail address could not be verified. Please try again later",
+	},
+	"fr": {
+		"no-name":                      "Un nom est requis",
+		"no-street":                    "Une adresse est requise",
+		"no-city":                      "Un lieu de domicile est requis",
+		"no-zip":                       "Un code postal est requis",
+		"no-country":                   "Un pays de domicile est requis",
+		"no-email":                     "Doit être indiqué",
+		"bad-email-format":             "L'adresse e-mail doit être au format a@b.ch",
+		"bad-phone-format":             "Le numéro de téléphone doit être au format +41 79 123 45 67",
+		"password-mismatch":            "Les mots de passe ne correspondent pas",
+		"statutes-not-accepted":        "Les statuts doivent être acceptés",
+		"payment-not-accepted":         "L'engagement de payer la cotisation est nécessaire",
+		"rules-not-accepted":           "Le règlement doit être accepté",
+		"gdpr-not-accepted":            "Le traitement des données doit être autorisé",
+		"email-not-accepted":           "Le contact par e-mail doit être autorisé",
+		"not-gt18":                     "Il faut avoir au moins 18 ans pour nous rejoindre",
+		"fee-out-of-range":             "Le montant semble un peu grand/petit, non ?",
+		"fee-not-a-number":             "La cotisation ne peut pas être reconnue comme un nombre",
+		"no-fee":                       "Une cotisation doit être indiquée",
+		"low-fee-without-reduction":    "Pour un montant inférieur à %d %s, une réduction doit être demandée",
+		"unknown-fee-value":            "Valeur inconnue pour la cotisation",
+		"unknown-fee-category":         "Catégorie de membre inconnue",
+		"reduction-not-allowed":        "Aucune réduction ne peut être demandée pour la catégorie %s",
+		"no-reduction-reason":          "Veuillez justifier la demande de réduction",
+		"bad-reduction-document":       "Le document doit être un fichier PDF, JPEG ou PNG",
+		"reduction-document-too-large": "Le document ne doit pas dépasser %d Mo",
+		"consent-statutes":             "J'ai lu les statuts et je les accepte.",
+		"consent-rules":                "J'ai lu le règlement et je l'accepte.",
+		"consent-ipay":                 "Je m'engage à verser la cotisation mensuellement ou annuellement à l'avance sur le compte de l'association.",
+		"consent-gt18":                 "J'ai au moins 18 ans.",
+		"consent-privacy_ok":           "J'ai lu la déclaration de protection des données et j'autorise l'association à enregistrer électroniquement les données saisies et à les traiter pour la gestion de ses membres.",
+		"consent-email_ok":             "J'autorise l'association et ses membres à me contacter à l'adresse e-mail saisie pour des sujets concernant mon adhésion et ma participation aux décisions.",
+		"consent-not-given":            "Consentement requis : %s",
+		"no-form-field":                "%s doit être indiqué",
+		"unknown-form-field-value":     "Valeur inconnue pour %s",
+		"verification-link-invalid":    "Le lien de confirmation n'est pas valide",
+		"verification-link-expired":    "Le lien de confirmation a expiré. Contacte-nous pour que nous puissions t'en envoyer un nouveau",
+		"verification-address-changed": "L'adresse e-mail de la demande a été modifiée entre-temps",
+		"verification-failed":          "L'adresse e-mail n'a pas pu être confirmée. Réessaie plus tard",
+	},
+	"it": {
+		"no-name":                      "Il nome è obbligatorio",
+		"no-street":                    "L'indirizzo è obbligatorio",
+		"no-city":                      "Il luogo di residenza è obbligatorio",
+		"no-zip":                       "Il codice postale è obbligatorio",
+		"no-country":                   "Il paese di residenza è obbligatorio",
+		"no-email":                     "Deve essere indicato",
+		"bad-email-format":             "L'indirizzo e-mail dovrebbe essere nel formato a@b.ch",
+		"bad-phone-format":             "Il numero di telefono dovrebbe essere nel formato +41 79 123 45 67",
+		"password-mismatch":            "Le password non corrispondono",
+		"statutes-not-accepted":        "Lo statuto deve essere accettato",
+		"payment-not-accepted":         "È necessario impegnarsi a pagare la quota sociale",
+		"rules-not-accepted":           "Il regolamento deve essere accettato",
+		"gdpr-not-accepted":            "Il trattamento dei dati deve essere autorizzato",
+		"email-not-accepted":           "Il contatto via e-mail deve essere autorizzato",
+		"not-gt18":                     "Bisogna avere almeno 18 anni per unirsi a noi",
+		"fee-out-of-range":             "L'importo sembra un po' grande/piccolo, no?",
+		"fee-not-a-number":             "La quota sociale non può essere riconosciuta come numero",
+		"no-fee":                       "È necessario indicare una quota sociale",
+		"low-fee-without-reduction":    "Per un importo inferiore a %d %s bisogna richiedere una riduzione",
+		"unknown-fee-value":            "Valore sconosciuto per la quota sociale",
+		"unknown-fee-category":         "Categoria di socio sconosciuta",
+		"reduction-not-allowed":        "Per la categoria %s non si può richiedere una riduzione",
+		"no-reduction-reason":          "Per favore motiva la richiesta di riduzione",
+		"bad-reduction-document":       "Il documento deve essere un file PDF, JPEG o PNG",
+		"reduction-document-too-large": "Il documento non deve superare %d MB",
+		"consent-statutes":             "Ho letto lo statuto e lo accetto.",
+		"consent-rules":                "Ho letto il regolamento e lo accetto.",
+		"consent-ipay":                 "Mi impegno a versare la quota sociale mensilmente o annualmente in anticipo sul conto dell'associazione.",
+		"consent-gt18":                 "Ho almeno 18 anni.",
+		"consent-privacy_ok":           "Ho letto l'informativa sulla protezione dei dati e autorizzo l'associazione a memorizzare elettronicamente i dati inseriti e a trattarli ai fini della gestione dei soci.",
+		"consent-email_ok":             "Autorizzo l'associazione e i suoi soci a contattarmi all'indirizzo e-mail inserito per questioni riguardanti la mia adesione e la mia partecipazione alle decisioni.",
+		"consent-not-given":            "Consenso richiesto: %s",
+		"no-form-field":                "%s deve essere indicato",
+		"unknown-form-field-value":     "Valore sconosciuto per %s",
+		"verification-link-invalid":    "Il link di conferma non è valido",
+		"verification-link-expired":    "Il link di conferma è scaduto. Contattaci per riceverne uno nuovo",
+		"verification-address-changed": "Nel frattempo l'indirizzo e-mail della domanda è stato modificato",
+		"verification-failed":          "Non è stato possibile confermare l'indirizzo e-mail. Riprova più tardi",
+	},
+}
+
+// Determine whether the membership form is available in "lang".
+func IsSupportedLanguage(lang string) bool {
+	var _, ok = messageCatalogs[lang]
+	return ok
+}
+
+// Look up the message for the error "code" in the catalog of "lang",
+// falling back to the default language, and fill in "args". Unknown codes
+// are returned as they are.
+func Message(lang, code string, args ...interface{}) string {
+	var msg string
+	var ok bool
+
+	if msg, ok = messageCatalogs[lang][code]; !ok {
+		if msg, ok = messageCatalogs[DefaultLanguage][code]; !ok {
+			return code
+		}
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
+
+// Pick the language to talk to an applicant in. The language chosen
+// explicitly takes precedence if it is supported; otherwise, the supported
+// language the browser prefers most according to its Accept-Language
+// header "accept" is used. Regional variants like "fr-CH" count as the
+// language itself.
+func SelectLanguage(explicit, accept string) string {
+	type weightedLanguage struct {
+		lang   string
+		weight float64
+	}
+	var candidates []weightedLanguage
+	var part string
+
+	explicit = strings.ToLower(strings.TrimSpace(explicit))
+	if IsSupportedLanguage(explicit) {
+		return explicit
+	}
+
+	for _, part = range strings.Split(accept, ",") {
+		var fields []string = strings.Split(part, ";")
+		var candidate = weightedLanguage{weight: 1}
+		var param string
+		var region int
+		var err error
+
+		candidate.lang = strings.ToLower(strings.TrimSpace(fields[0]))
+		if region = strings.IndexAny(candidate.lang, "-_"); region >= 0 {
+			candidate.lang = candidate.lang[:region]
+		}
+		if !IsSupportedLanguage(candidate.lang) {
+			continue
+		}
+
+		for _, param = range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				candidate.weight, err = strconv.ParseFloat(param[2:], 64)
+				if err != nil {
+					candidate.weight = 0
+				}
+			}
+		}
+		if candidate.weight > 0 {
+			candidates = append(candidates, candidate)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return DefaultLanguage
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].weight > candidates[j].weight
+	})
+	return candidates[0].lang
+}
+
+// Determine the name of the translation of the file "path" into "lang",
+// e.g. form.en.html for form.html. Files in the default language have no
+// suffix.
+func LocalizedFileName(path, lang string) string {
+	var ext string = filepath.Ext(path)
+
+	if lang == DefaultLanguage {
+		return path
+	}
+	return strings.TrimSuffix(path, ext) + "." + lang + ext
+}
+
+// List the languages "path" has been translated into, i.e. for which a
+// file named by LocalizedFileName exists. The default language is always
+// included.
+func TranslatedLanguages(path string) []string {
+	var langs []string
+	var lang string
+
+	for _, lang = range Languages {
+		var err error
+
+		if lang != DefaultLanguage {
+			if _, err = os.Stat(LocalizedFileName(path, lang)); err != nil {
+				continue
+			}
+		}
+		langs = append(langs, lang)
+	}
+
+	return langs
+}
@@ -0,0 +1,90 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package membersys
+
+import (
+	"testing"
+)
+
+func TestSelectLanguage(t *testing.T) {
+	var tests = []struct {
+		explicit, accept, lang string
+	}{
+		{"", "", DefaultLanguage},
+		{"fr", "en", "fr"},
+		{" FR ", "", "fr"},
+		{"es", "it", "it"},
+		{"", "en-US,en;q=0.9", "en"},
+		{"", "fr-CH, de;q=0.8", "fr"},
+		{"", "it_CH", "it"},
+		{"", "de;q=0.5, fr;q=0.9, en;q=0.7", "fr"},
+		{"", "es, pt;q=0.9, en;q=0.1", "en"},
+		{"", "fr;q=0, en;q=0.2", "en"},
+		{"", "en;q=0.5, it;q=0.5", "en"},
+		{"", "en;q=invalid, it;q=0.1", "it"},
+		{"", "es, pt", DefaultLanguage},
+		{"", "*", DefaultLanguage},
+	}
+	var i int
+
+	for i = range tests {
+		var test = tests[i]
+		var lang string = SelectLanguage(test.explicit, test.accept)
+
+		if lang != test.lang {
+			t.Errorf("SelectLanguage(%q, %q): expected %s, got %s",
+				test.explicit, test.accept, test.lang, lang)
+		}
+	}
+}
+
+func TestLocalizedFileName(t *testing.T) {
+	var tests = []struct {
+		path, lang, localized string
+	}{
+		{"form.html", DefaultLanguage, "form.html"},
+		{"form.html", "en", "form.en.html"},
+		{"/srv/templates/verificationmail.txt", "fr",
+			"/srv/templates/verificationmail.fr.txt"},
+	}
+	var i int
+
+	for i = range tests {
+		var test = tests[i]
+		var localized string = LocalizedFileName(test.path, test.lang)
+
+		if localized != test.localized {
+			t.Errorf("LocalizedFileName(%q, %s): expected %s, got %s",
+				test.path, test.lang, test.localized, localized)
+		}
+	}
+}
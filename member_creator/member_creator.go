@@ -32,10 +32,9 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
-	"database/cassandra"
-	"encoding/binary"
 	"flag"
 	"io/ioutil"
 	"log"
@@ -50,40 +49,8 @@ import (
 	"gopkg.in/ldap.v2"
 )
 
-func makeMutation(mmap map[string][]*cassandra.Mutation, cf, name string,
-	value []byte, now time.Time) {
-	var m *cassandra.Mutation = cassandra.NewMutation()
-	var col *cassandra.Column = cassandra.NewColumn()
-
-	col.Name = []byte(name)
-	col.Value = value
-	col.Timestamp = proto.Int64(now.UnixNano())
-
-	m.ColumnOrSupercolumn = cassandra.NewColumnOrSuperColumn()
-	m.ColumnOrSupercolumn.Column = col
-	mmap[cf] = append(mmap[cf], m)
-}
-
-func makeMutationString(mmap map[string][]*cassandra.Mutation,
-	cf, name, value string, now time.Time) {
-	makeMutation(mmap, cf, name, []byte(value), now)
-}
-
-func makeMutationLong(mmap map[string][]*cassandra.Mutation,
-	cf, name string, value uint64, now time.Time) {
-	var val []byte = make([]byte, 8)
-	binary.BigEndian.PutUint64(val, value)
-	makeMutation(mmap, cf, name, val, now)
-}
-
-func makeMutationBool(mmap map[string][]*cassandra.Mutation,
-	cf, name string, value bool, now time.Time) {
-	var b byte
-	if value {
-		b = 0x1
-	}
-	makeMutation(mmap, cf, name, []byte{b}, now)
-}
+// Identification of the member creator in the audit log.
+var creatorActor = &membersys.Actor{User: "member_creator"}
 
 func asciiFilter(in string) string {
 	var rv []rune
@@ -98,13 +65,25 @@ func asciiFilter(in string) string {
 	return string(rv)
 }
 
+// Groups users of the membership category "category" are made a member of.
+func userGroups(ldapConfig *config.LdapConfig, category string) []string {
+	var groups = append([]string{}, ldapConfig.GetNewUserGroup()...)
+	var categoryGroups *config.LdapCategoryGroups
+
+	for _, categoryGroups = range ldapConfig.GetCategoryGroups() {
+		if categoryGroups.GetCategory() == category {
+			groups = append(groups, categoryGroups.GetGroup()...)
+		}
+	}
+
+	return groups
+}
+
 func main() {
-	var cf string = "members"
 	var config_file string
 	var config_contents []byte
 	var config config.MemberCreatorConfig
 	var greatestUid uint64 = 1000
-	var now time.Time
 	var noop, verbose bool
 	var welcome *membersys.WelcomeMail
 
@@ -114,13 +93,10 @@ func main() {
 	var entry *ldap.Entry
 	var tlsconfig tls.Config
 
-	var mmap map[string]map[string][]*cassandra.Mutation
-	var db *cassandra.RetryCassandraClient
-	var cp *cassandra.ColumnParent
-	var pred *cassandra.SlicePredicate
-	var kr *cassandra.KeyRange
-	var kss []*cassandra.KeySlice
-	var ks *cassandra.KeySlice
+	var ctx context.Context = context.Background()
+	var db membersys.MembershipStore
+	var queued []*membersys.MemberWithKey
+	var record *membersys.MemberWithKey
 
 	var err error
 
@@ -177,8 +153,6 @@ func main() {
 		tlsconfig.RootCAs.AppendCertsFromPEM(certData)
 	}
 
-	now = time.Now()
-
 	if !noop {
 		ld, err = ldap.DialTLS("tcp", config.LdapConfig.GetServer(),
 			&tlsconfig)
@@ -224,346 +198,247 @@ func main() {
 		}
 	}
 
-	// Connect to Cassandra so we can get a list of records to be processed.
-	db, err = cassandra.NewRetryCassandraClient(
-		config.DatabaseConfig.GetDatabaseServer())
+	// Connect to the database so we can get a list of records to be
+	// processed.
+	db, err = membersys.NewMembershipStore(config.DatabaseConfig,
+		time.Duration(config.DatabaseConfig.GetDatabaseTimeout())*time.Millisecond)
 	if err != nil {
-		log.Fatal("Error connecting to Cassandra database at ",
+		log.Fatal("Error connecting to the membership database at ",
 			config.DatabaseConfig.GetDatabaseServer(), ": ", err)
 	}
 
-	err = db.SetKeyspace(config.DatabaseConfig.GetDatabaseName())
+	queued, err = db.EnumerateQueuedMembers(ctx, "", "", 100)
 	if err != nil {
-		log.Fatal("Error setting keyspace: ", err)
+		log.Fatal("Error listing the membership queue: ", err)
 	}
 
-	cp = cassandra.NewColumnParent()
-	cp.ColumnFamily = "membership_queue"
-	pred = cassandra.NewSlicePredicate()
-	pred.ColumnNames = [][]byte{[]byte("pb_data")}
-	kr = cassandra.NewKeyRange()
-	kr.StartKey = []byte("queue:")
-	kr.EndKey = []byte("queue;")
+	for _, record = range queued {
+		var agreement *membersys.MembershipAgreement
 
-	kss, err = db.GetRangeSlices(cp, pred, kr,
-		cassandra.ConsistencyLevel_QUORUM)
-	if err != nil {
-		log.Fatal("Error getting range slice: ", err)
-	}
+		agreement, _, err = db.GetMembershipRequest(
+			ctx, record.Key, "membership_queue", "queue:")
+		if err != nil {
+			log.Print("Unable to fetch queued record ", record.Key, ": ",
+				err)
+			continue
+		}
 
-	for _, ks = range kss {
-		mmap = make(map[string]map[string][]*cassandra.Mutation)
-		var csc *cassandra.ColumnOrSuperColumn
-		for _, csc = range ks.Columns {
-			var col *cassandra.Column = csc.Column
-			var agreement membersys.MembershipAgreement
-			var m *cassandra.Mutation
+		if agreement.MemberData.Username != nil {
+			var attrs *ldap.AddRequest
 
-			if col == nil {
-				continue
-			}
+			greatestUid++
 
-			if string(col.Name) != "pb_data" {
-				log.Print("Column selected was not as requested: ",
-					col.Name)
-				continue
-			}
-
-			err = proto.Unmarshal(col.Value, &agreement)
-			if err != nil {
-				log.Print("Unable to parse column ", col.Name, " of ",
-					ks.Key, ": ", err)
-				continue
+			attrs = ldap.NewAddRequest("uid=" +
+				asciiFilter(agreement.MemberData.GetUsername()) + "," +
+				config.LdapConfig.GetNewUserSuffix() + "," +
+				config.LdapConfig.GetBase())
+
+			attrs.Attribute("uidNumber", []string{
+				strconv.FormatUint(greatestUid, 10)})
+			attrs.Attribute("gecos", []string{
+				asciiFilter(agreement.MemberData.GetName())})
+			attrs.Attribute("shadowLastChange", []string{"11457"})
+			attrs.Attribute("shadowMax", []string{"9999"})
+			attrs.Attribute("shadowWarning", []string{"7"})
+			attrs.Attribute("gidNumber", []string{strconv.FormatUint(
+				uint64(config.LdapConfig.GetNewUserGid()), 10)})
+			attrs.Attribute("objectClass", []string{
+				"account", "posixAccount", "shadowAccount", "top",
+			})
+			attrs.Attribute("uid", []string{
+				asciiFilter(agreement.MemberData.GetUsername())})
+			attrs.Attribute("cn", []string{
+				asciiFilter(agreement.MemberData.GetUsername())})
+			attrs.Attribute("homeDirectory", []string{"/home/" +
+				asciiFilter(agreement.MemberData.GetUsername())})
+			attrs.Attribute("loginShell", []string{
+				config.LdapConfig.GetNewUserShell()})
+			attrs.Attribute("userPassword", []string{
+				agreement.MemberData.GetPwhash(),
+			})
+
+			if verbose {
+				log.Print("Creating user: uid=" +
+					agreement.MemberData.GetUsername() +
+					"," + config.LdapConfig.GetNewUserSuffix() + "," +
+					config.LdapConfig.GetBase())
 			}
 
-			if agreement.MemberData.Username != nil {
-				var attrs *ldap.AddRequest
-
-				greatestUid++
-
-				attrs = ldap.NewAddRequest("uid=" +
-					asciiFilter(agreement.MemberData.GetUsername()) + "," +
-					config.LdapConfig.GetNewUserSuffix() + "," +
-					config.LdapConfig.GetBase())
+			if !noop {
+				var group string
 
-				attrs.Attribute("uidNumber", []string{
-					strconv.FormatUint(greatestUid, 10)})
-				attrs.Attribute("gecos", []string{
-					asciiFilter(agreement.MemberData.GetName())})
-				attrs.Attribute("shadowLastChange", []string{"11457"})
-				attrs.Attribute("shadowMax", []string{"9999"})
-				attrs.Attribute("shadowWarning", []string{"7"})
-				attrs.Attribute("gidNumber", []string{strconv.FormatUint(
-					uint64(config.LdapConfig.GetNewUserGid()), 10)})
-				attrs.Attribute("objectClass", []string{
-					"account", "posixAccount", "shadowAccount", "top",
-				})
-				attrs.Attribute("uid", []string{
-					asciiFilter(agreement.MemberData.GetUsername())})
-				attrs.Attribute("cn", []string{
-					asciiFilter(agreement.MemberData.GetUsername())})
-				attrs.Attribute("homeDirectory", []string{"/home/" +
-					asciiFilter(agreement.MemberData.GetUsername())})
-				attrs.Attribute("loginShell", []string{
-					config.LdapConfig.GetNewUserShell()})
-				attrs.Attribute("userPassword", []string{
-					agreement.MemberData.GetPwhash(),
-				})
-
-				agreement.MemberData.Id = proto.Uint64(greatestUid)
-				if verbose {
-					log.Print("Creating user: uid=" +
-						agreement.MemberData.GetUsername() +
-						"," + config.LdapConfig.GetNewUserSuffix() + "," +
-						config.LdapConfig.GetBase())
+				err = ld.Add(attrs)
+				if err != nil {
+					log.Print("Unable to create LDAP Account ",
+						agreement.MemberData.GetUsername(), ": ", err)
+					continue
 				}
 
-				if !noop {
-					var group string
-
-					err = ld.Add(attrs)
-					if err != nil {
-						log.Print("Unable to create LDAP Account ",
-							agreement.MemberData.GetUsername(), ": ", err)
-						continue
-					}
-
-					for _, group = range config.LdapConfig.GetNewUserGroup() {
-						var grpadd = ldap.NewModifyRequest("cn=" + group +
-							",ou=Groups," + config.LdapConfig.GetBase())
+				for _, group = range userGroups(config.LdapConfig,
+					agreement.MemberData.GetCategory()) {
+					var grpadd = ldap.NewModifyRequest("cn=" + group +
+						",ou=Groups," + config.LdapConfig.GetBase())
 
-						grpadd.Add("memberUid", []string{
-							agreement.MemberData.GetUsername()})
+					grpadd.Add("memberUid", []string{
+						agreement.MemberData.GetUsername()})
 
-						err = ld.Modify(grpadd)
-						if err != nil {
-							log.Print("Unable to add user ",
-								agreement.MemberData.GetUsername(),
-								" to group ", group, ": ",
-								err)
-						}
+					err = ld.Modify(grpadd)
+					if err != nil {
+						log.Print("Unable to add user ",
+							agreement.MemberData.GetUsername(),
+							" to group ", group, ": ",
+							err)
 					}
 				}
 			}
+		}
 
-			col.Value, err = proto.Marshal(&agreement)
-			if err != nil {
-				log.Print("Error marshalling agreement: ", err)
-				continue
-			}
-
-			mmap["member:"+string(agreement.MemberData.GetEmail())] =
-				make(map[string][]*cassandra.Mutation)
-			mmap["member:"+string(agreement.MemberData.GetEmail())][cf] =
-				make([]*cassandra.Mutation, 0)
-
-			makeMutation(mmap["member:"+string(agreement.MemberData.GetEmail())],
-				cf, "pb_data", col.Value, now)
-			makeMutationString(mmap["member:"+string(agreement.MemberData.GetEmail())],
-				cf, "name", agreement.MemberData.GetName(), now)
-			makeMutationString(mmap["member:"+string(agreement.MemberData.GetEmail())],
-				cf, "street", agreement.MemberData.GetStreet(), now)
-			makeMutationString(mmap["member:"+string(agreement.MemberData.GetEmail())],
-				cf, "city", agreement.MemberData.GetCity(), now)
-			makeMutationString(mmap["member:"+string(agreement.MemberData.GetEmail())],
-				cf, "country", agreement.MemberData.GetCountry(), now)
-			makeMutationString(mmap["member:"+string(agreement.MemberData.GetEmail())],
-				cf, "email", agreement.MemberData.GetEmail(), now)
-			if agreement.MemberData.Phone != nil {
-				makeMutationString(mmap["member:"+string(agreement.MemberData.GetEmail())],
-					cf, "phone", agreement.MemberData.GetPhone(), now)
-			}
-			if agreement.MemberData.Username != nil {
-				makeMutationString(mmap["member:"+string(agreement.MemberData.GetEmail())],
-					cf, "username", agreement.MemberData.GetUsername(), now)
-			}
-			makeMutationLong(mmap["member:"+string(agreement.MemberData.GetEmail())],
-				cf, "fee", agreement.MemberData.GetFee(), now)
-			makeMutationBool(mmap["member:"+string(agreement.MemberData.GetEmail())],
-				cf, "fee_yearly", agreement.MemberData.GetFeeYearly(), now)
-			makeMutationLong(mmap["member:"+string(agreement.MemberData.GetEmail())],
-				cf, "approval_ts", agreement.Metadata.GetApprovalTimestamp(),
-				now)
-			makeMutation(mmap["member:"+string(agreement.MemberData.GetEmail())],
-				cf, "agreement_pdf", agreement.AgreementPdf, now)
-
-			// Now, delete the original record.
-			m = cassandra.NewMutation()
-			m.Deletion = cassandra.NewDeletion()
-			m.Deletion.Predicate = cassandra.NewSlicePredicate()
-			m.Deletion.Predicate.ColumnNames = [][]byte{[]byte("pb_data")}
-			m.Deletion.Timestamp = col.Timestamp
-
-			mmap[string(ks.Key)] = make(map[string][]*cassandra.Mutation)
-			mmap[string(ks.Key)]["membership_queue"] = []*cassandra.Mutation{m}
-
-			// Write welcome e-mail to new member.
-			if welcome != nil {
-				err = welcome.SendMail(agreement.MemberData)
-				if err != nil {
-					log.Print("Error sending welcome e-mail to ",
-						agreement.MemberData.GetEmail(), ": ", err)
-				}
-			}
+		if noop {
+			log.Print("Would move ", record.Key, " to member ",
+				agreement.MemberData.GetEmail())
+			continue
 		}
 
-		// Apply all database mutations.
-		err = db.BatchMutate(mmap, cassandra.ConsistencyLevel_QUORUM)
+		err = db.MoveQueuedRecordToMember(ctx, record.Key, agreement,
+			creatorActor)
 		if err != nil {
-			log.Fatal("Error getting range slice: ", err)
+			log.Print("Error moving ", record.Key, " to member ",
+				agreement.MemberData.GetEmail(), ": ", err)
+			continue
+		}
+
+		if verbose {
+			log.Print("Assigned membership number ",
+				agreement.MemberData.GetId(), " to ",
+				agreement.MemberData.GetEmail())
+		}
+
+		// Write welcome e-mail to new member.
+		if welcome != nil {
+			err = welcome.SendMail(agreement.MemberData,
+				agreement.GetMetadata().GetLanguage())
+			if err != nil {
+				log.Print("Error sending welcome e-mail to ",
+					agreement.MemberData.GetEmail(), ": ", err)
+			}
 		}
 	}
 
 	// Delete parting members.
-	cp.ColumnFamily = "membership_dequeue"
-	kr.StartKey = []byte("dequeue:")
-	kr.EndKey = []byte("dequeue;")
-	kss, err = db.GetRangeSlices(cp, pred, kr,
-		cassandra.ConsistencyLevel_QUORUM)
+	queued, err = db.EnumerateDeQueuedMembers(ctx, "", "", 100)
 	if err != nil {
-		log.Fatal("Error getting range slice: ", err)
+		log.Fatal("Error listing the departing member queue: ", err)
 	}
 
-	for _, ks = range kss {
-		var csc *cassandra.ColumnOrSuperColumn
-		mmap = make(map[string]map[string][]*cassandra.Mutation)
-		for _, csc = range ks.Columns {
-			var uuid cassandra.UUID
-			var ldapuser string
-			var col *cassandra.Column = csc.Column
-			var agreement membersys.MembershipAgreement
-			var attrs *ldap.ModifyRequest
-			var m *cassandra.Mutation
-
-			if col == nil {
-				continue
-			}
+	for _, record = range queued {
+		var ldapuser string
+		var attrs *ldap.ModifyRequest
 
-			if string(col.Name) != "pb_data" {
-				log.Print("Column selected was not as requested: ",
-					col.Name)
-				continue
-			}
+		if record.Username == nil {
+			continue
+		}
 
-			err = proto.Unmarshal(col.Value, &agreement)
+		ldapuser = "uid=" +
+			asciiFilter(record.GetUsername()) + "," +
+			config.LdapConfig.GetNewUserSuffix() + "," +
+			config.LdapConfig.GetBase()
+		if noop {
+			log.Print("Would remove user ", ldapuser)
+		} else {
+			var groups []string
+			var groups_differ bool
+			var entry *ldap.Entry
+			var group string
+
+			sreq = ldap.NewSearchRequest(
+				config.LdapConfig.GetBase(), ldap.ScopeWholeSubtree,
+				ldap.NeverDerefAliases, 1000, 90, false,
+				"(&(objectClass=posixGroup)(memberUid="+
+					asciiFilter(record.GetUsername())+"))",
+				[]string{"cn"}, []ldap.Control{})
+
+			lres, err = ld.Search(sreq)
 			if err != nil {
-				log.Print("Unable to parse column ", ks.Key, ": ", err)
-				continue
-			}
-
-			if agreement.MemberData.Username == nil {
+				log.Print("Error searching groups for user ",
+					record.GetUsername(), ": ", err)
 				continue
 			}
 
-			ldapuser = "uid=" +
-				asciiFilter(agreement.MemberData.GetUsername()) + "," +
-				config.LdapConfig.GetNewUserSuffix() + "," +
-				config.LdapConfig.GetBase()
-			if noop {
-				log.Print("Would remove user ", ldapuser)
-			} else {
-				var groups []string
-				var groups_differ bool
-				var entry *ldap.Entry
-				var group string
-
-				sreq = ldap.NewSearchRequest(
-					config.LdapConfig.GetBase(), ldap.ScopeWholeSubtree,
-					ldap.NeverDerefAliases, 1000, 90, false,
-					"(&(objectClass=posixGroup)(memberUid="+
-						asciiFilter(agreement.MemberData.GetUsername())+"))",
-					[]string{"cn"}, []ldap.Control{})
+			for _, entry = range lres.Entries {
+				var cn string
+				var found bool
 
-				lres, err = ld.Search(sreq)
-				if err != nil {
-					log.Print("Error searching groups for user ",
-						agreement.MemberData.GetUsername(), ": ", err)
+				cn = entry.GetAttributeValue("cn")
+				if cn == "" {
+					log.Print("No group name set for ",
+						record.GetUsername())
 					continue
 				}
+				groups = append(groups, cn)
 
-				for _, entry = range lres.Entries {
-					var cn string
-					var found bool
-
-					cn = entry.GetAttributeValue("cn")
-					if cn == "" {
-						log.Print("No group name set for ",
-							agreement.MemberData.GetUsername())
-						continue
-					}
-					groups = append(groups, cn)
-
-					for _, group = range config.LdapConfig.GetNewUserGroup() {
-						if cn == group {
-							found = true
-						}
+				for _, group = range userGroups(config.LdapConfig,
+					record.GetCategory()) {
+					if cn == group {
+						found = true
 					}
+				}
 
-					for _, group = range config.LdapConfig.GetIgnoreUserGroup() {
-						if cn == group {
-							found = true
-						}
+				for _, group = range config.LdapConfig.GetIgnoreUserGroup() {
+					if cn == group {
+						found = true
 					}
+				}
 
-					if !found {
-						groups_differ = true
-					}
+				if !found {
+					groups_differ = true
 				}
+			}
 
-				if groups_differ {
-					log.Print("User is in other groups than expected: ",
-						strings.Join(groups, ", "))
-
-					for _, group = range config.LdapConfig.GetNewUserGroup() {
-						attrs = ldap.NewModifyRequest("cn=" + group +
-							",ou=Groups," + config.LdapConfig.GetBase())
-						attrs.Delete("memberUid", []string{
-							asciiFilter(agreement.MemberData.GetUsername())})
-						err = ld.Modify(attrs)
-						if err != nil {
-							log.Print("Error deleting ",
-								agreement.MemberData.GetUsername(), " from ",
-								group, ": ", err)
-						}
-					}
-				} else {
-					var dr = ldap.NewDelRequest(ldapuser, []ldap.Control{})
-					// The user appears to be only in the groups given in
-					// the config.
-					err = ld.Del(dr)
+			if groups_differ {
+				log.Print("User is in other groups than expected: ",
+					strings.Join(groups, ", "))
+
+				for _, group = range userGroups(config.LdapConfig,
+					record.GetCategory()) {
+					attrs = ldap.NewModifyRequest("cn=" + group +
+						",ou=Groups," + config.LdapConfig.GetBase())
+					attrs.Delete("memberUid", []string{
+						asciiFilter(record.GetUsername())})
+					err = ld.Modify(attrs)
 					if err != nil {
-						log.Print("Unable to delete user ", ldapuser, ": ",
-							err)
+						log.Print("Error deleting ",
+							record.GetUsername(), " from ",
+							group, ": ", err)
 					}
 				}
+			} else {
+				var dr = ldap.NewDelRequest(ldapuser, []ldap.Control{})
+				// The user appears to be only in the groups given in
+				// the config.
+				err = ld.Del(dr)
+				if err != nil {
+					log.Print("Unable to delete user ", ldapuser, ": ",
+						err)
+				}
 			}
+		}
 
-			m = cassandra.NewMutation()
-			m.Deletion = cassandra.NewDeletion()
-			m.Deletion.Predicate = pred
-			m.Deletion.Timestamp = col.Timestamp
-
-			mmap[string(ks.Key)] = make(map[string][]*cassandra.Mutation)
-			mmap[string(ks.Key)]["membership_dequeue"] = []*cassandra.Mutation{m}
-
-			// 2 years retention.
-			col.TTL = proto.Int32(720 * 24 * 3600)
-			col.Timestamp = proto.Int64(now.UnixNano())
-
-			uuid = cassandra.UUIDFromBytes(ks.Key[len("dequeue:"):])
-
-			m = cassandra.NewMutation()
-			m.ColumnOrSupercolumn = cassandra.NewColumnOrSuperColumn()
-			m.ColumnOrSupercolumn.Column = col
-			mmap["archive:"+string([]byte(uuid))] = make(map[string][]*cassandra.Mutation)
-			mmap["archive:"+string([]byte(uuid))]["membership_archive"] =
-				[]*cassandra.Mutation{m}
+		// The record is kept in the archive for the configured retention
+		// period of former members.
+		if !noop {
+			err = db.MoveDeQueuedRecordToArchive(ctx, record.Key,
+				creatorActor)
+			if err != nil {
+				log.Print("Error archiving departed member ", record.Key,
+					": ", err)
+			}
 		}
+	}
 
-		// Apply all database mutations.
-		err = db.BatchMutate(mmap, cassandra.ConsistencyLevel_QUORUM)
-		if err != nil {
-			log.Fatal("Error getting range slice: ", err)
+	// Delete archived records whose retention period is over.
+	if !noop {
+		if err = db.PurgeExpiredRecords(ctx); err != nil {
+			log.Print("Error purging expired records: ", err)
 		}
 	}
 
@@ -32,11 +32,13 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/golang/protobuf/proto"
@@ -45,9 +47,13 @@ import (
 )
 
 func main() {
-	var db *membersys.MembershipDB
+	var db membersys.MembershipStore
+	var org *config.OrganisationConfig
 	var config config.MembersysConfig
+	var organisation string
 	var config_contents []byte
+	var filter_values = make(map[string]*string)
+	var filter *membersys.MemberFilter
 	var config_path string
 	var prev_key string
 	var help bool
@@ -56,6 +62,30 @@ func main() {
 	flag.BoolVar(&help, "help", false, "Display help")
 	flag.StringVar(&config_path, "config", "",
 		"Path to the member creator configuration file")
+	flag.StringVar(&organisation, "organisation", "",
+		"Name of the organisation to work on, if several are configured")
+	filter_values["criterion"] = flag.String("search", "",
+		"Only list members whose name, e-mail address, city, user name "+
+			"or membership number match the given words")
+	filter_values["has_key"] = flag.String("has-key", "",
+		"Only list members with (true) or without (false) a key")
+	filter_values["fee_yearly"] = flag.String("fee-yearly", "",
+		"Only list members paying yearly (true) or monthly (false)")
+	filter_values["min_fee"] = flag.String("min-fee", "",
+		"Only list members paying at least this fee")
+	filter_values["max_fee"] = flag.String("max-fee", "",
+		"Only list members paying at most this fee")
+	filter_values["approved_after"] = flag.String("approved-after", "",
+		"Only list members approved on or after this date (YYYY-MM-DD)")
+	filter_values["approved_before"] = flag.String("approved-before", "",
+		"Only list members approved before this date (YYYY-MM-DD)")
+	filter_values["country"] = flag.String("country", "",
+		"Only list members living in this country")
+	filter_values["category"] = flag.String("category", "",
+		"Only list members of this membership category")
+	filter_values["paid_before"] = flag.String("paid-before", "",
+		"Only list members whose payments are not caught up to this "+
+			"date (YYYY-MM-DD)")
 	flag.Parse()
 
 	if help || config_path == "" {
@@ -63,6 +93,13 @@ func main() {
 		os.Exit(1)
 	}
 
+	filter, err = membersys.ParseMemberFilter(func(name string) string {
+		return *filter_values[name]
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	config_contents, err = ioutil.ReadFile(config_path)
 	if err != nil {
 		log.Fatal("Unable to read ", config_path, ": ", err)
@@ -75,21 +112,25 @@ func main() {
 		log.Fatal("Error parsing ", config_path, ": ", err)
 	}
 
-	db, err = membersys.NewMembershipDB(
-		config.DatabaseConfig.GetDatabaseServer(),
-		config.DatabaseConfig.GetDatabaseName(),
-		time.Duration(config.DatabaseConfig.GetDatabaseTimeout())*time.Millisecond)
+	org, err = membersys.FindOrganisation(&config, organisation)
+	if err != nil {
+		log.Fatal("Error selecting the organisation: ", err)
+	}
+
+	db, err = membersys.NewMembershipStore(org.DatabaseConfig,
+		time.Duration(org.DatabaseConfig.GetDatabaseTimeout())*time.Millisecond)
 	if err != nil {
-		log.Fatal("Unable to connect to the cassandra DB ",
-			config.DatabaseConfig.GetDatabaseServer(), " at ",
-			config.DatabaseConfig.GetDatabaseName(), ": ", err)
+		log.Fatal("Unable to connect to the membership database ",
+			org.DatabaseConfig.GetDatabaseServer(), " at ",
+			org.DatabaseConfig.GetDatabaseName(), ": ", err)
 	}
 
 	for {
 		var members []*membersys.Member
 		var member *membersys.Member
 
-		members, err = db.EnumerateMembers(prev_key, 25)
+		members, err = db.EnumerateMembers(context.Background(), filter,
+			prev_key, 25)
 
 		if err != nil {
 			log.Fatal("Error fetching data starting from ", prev_key, ": ",
@@ -100,11 +141,12 @@ func main() {
 		}
 
 		for _, member = range members {
-			fmt.Printf("Name:\t\t%s\r\nAddress:\t%s, %s\r\nEmail:\t\t%s\r\n"+
-				"Username:\t%s\r\n\r\n",
+			fmt.Printf("Number:\t\t%d\r\nName:\t\t%s\r\n"+
+				"Address:\t%s, %s\r\nEmail:\t\t%s\r\n"+
+				"Username:\t%s\r\n\r\n", member.GetId(),
 				member.GetName(), member.GetStreet(), member.GetCity(),
 				member.GetEmail(), member.GetUsername())
-			prev_key = member.GetEmail() + "\000"
+			prev_key = strconv.FormatUint(member.GetId(), 10) + "\000"
 		}
 	}
 }
@@ -32,6 +32,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"io/ioutil"
 	"log"
@@ -44,7 +45,7 @@ import (
 )
 
 func main() {
-	var db *membersys.MembershipDB
+	var db membersys.MembershipStore
 	var agreement *membersys.MembershipAgreement
 	var config config.MemberCreatorConfig
 	var wm *membersys.WelcomeMail
@@ -78,12 +79,10 @@ func main() {
 		log.Fatal("Error parsing ", config_path, ": ", err)
 	}
 
-	db, err = membersys.NewMembershipDB(
-		config.DatabaseConfig.GetDatabaseServer(),
-		config.DatabaseConfig.GetDatabaseName(),
+	db, err = membersys.NewMembershipStore(config.DatabaseConfig,
 		time.Duration(config.DatabaseConfig.GetDatabaseTimeout())*time.Millisecond)
 	if err != nil {
-		log.Fatal("Unable to connect to the cassandra DB ",
+		log.Fatal("Unable to connect to the membership database ",
 			config.DatabaseConfig.GetDatabaseServer(), " at ",
 			config.DatabaseConfig.GetDatabaseName(), ": ", err)
 	}
@@ -93,12 +92,13 @@ func main() {
 		log.Fatal("Error setting up mailer: ", err)
 	}
 
-	agreement, err = db.GetMemberDetail(lookup_key)
+	agreement, _, err = db.GetMemberDetail(context.Background(), lookup_key)
 	if err != nil {
 		log.Fatal("Error fetching member ", lookup_key, ": ", err)
 	}
 
-	err = wm.SendMail(agreement.GetMemberData())
+	err = wm.SendMail(agreement.GetMemberData(),
+		agreement.GetMetadata().GetLanguage())
 	if err != nil {
 		log.Fatal("Error sending mail to ",
 			agreement.GetMemberData().GetEmail(), ": ", err)
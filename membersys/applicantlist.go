@@ -33,8 +33,9 @@ package main
 
 import (
 	"ancient-solutions.com/ancientauth"
-	"database/cassandra"
+	"context"
 	"encoding/json"
+	"github.com/gocql/gocql"
 	"github.com/golang/protobuf/proto"
 	"github.com/starshipfactory/membersys"
 	"io/ioutil"
@@ -51,18 +52,25 @@ type applicantListType struct {
 	ApprovalCsrfToken        string                     `json:"approval_csrf_token"`
 	RejectionCsrfToken       string                     `json:"rejection_csrf_token"`
 	AgreementUploadCsrfToken string                     `json:"agreement_upload_csrf_token"`
+	MergeCsrfToken           string                     `json:"merge_csrf_token"`
+	ReductionCsrfToken       string                     `json:"reduction_csrf_token"`
+
+	// Only set if applicants are asked to verify their e-mail address.
+	VerificationCsrfToken string `json:"verification_csrf_token,omitempty"`
 }
 
 type ApplicantListHandler struct {
 	admingroup string
 	auth       *ancientauth.Authenticator
-	database   *membersys.MembershipDB
+	database   membersys.MembershipStore
 	pagesize   int32
+	verifier   *membersys.EmailVerifier
 }
 
 var applicantApprovalURL *url.URL
 var applicantRejectionURL *url.URL
 var applicantAgreementUploadURL *url.URL
+var applicantMergeURL *url.URL
 
 func init() {
 	var err error
@@ -78,6 +86,37 @@ func init() {
 	if err != nil {
 		log.Fatal("Error parsing static agreement upload URL: ", err)
 	}
+	applicantMergeURL, err = url.Parse("/admin/api/merge")
+	if err != nil {
+		log.Fatal("Error parsing static merge URL: ", err)
+	}
+}
+
+// Fill in the street, the possible duplicates, the fee reduction requests
+// and whether the e-mail address has been verified for each of
+// "applicants". The list columns don't include them, so the full records
+// have to be read.
+func addApplicationDetails(ctx context.Context,
+	database membersys.MembershipStore,
+	applicants []*membersys.MemberWithKey) {
+	var applicant *membersys.MemberWithKey
+	var agreement *membersys.MembershipAgreement
+	var err error
+
+	for _, applicant = range applicants {
+		agreement, _, err = database.GetMembershipRequest(ctx, applicant.Key,
+			"application", "applicant:")
+		if err != nil {
+			log.Print("Unable to look up the details of ",
+				applicant.Key, ": ", err)
+			continue
+		}
+		applicant.Street = agreement.GetMemberData().Street
+		applicant.PossibleDuplicates =
+			agreement.GetMetadata().GetPossibleDuplicates()
+		applicant.FeeReduction = agreement.GetFeeReduction()
+		applicant.EmailVerified = agreement.GetMemberData().EmailVerified
+	}
 }
 
 // Output a JSON list of all applicants currently waiting to become members.
@@ -95,7 +134,7 @@ func (a *ApplicantListHandler) ServeHTTP(rw http.ResponseWriter, req *http.Reque
 		var memberreq *membersys.MembershipAgreement
 		var mwk *membersys.MemberWithKey
 		var bigint *big.Int = big.NewInt(0)
-		var uuid cassandra.UUID
+		var uuid gocql.UUID
 		var ok bool
 		bigint, ok = bigint.SetString(req.FormValue("start"), 10)
 		if !ok {
@@ -105,9 +144,15 @@ func (a *ApplicantListHandler) ServeHTTP(rw http.ResponseWriter, req *http.Reque
 			return
 		}
 		if bigint.BitLen() == 128 {
-			uuid = cassandra.UUIDFromBytes(bigint.Bytes())
+			uuid, err = gocql.UUIDFromBytes(bigint.Bytes())
+			if err != nil {
+				rw.WriteHeader(http.StatusInternalServerError)
+				rw.Write([]byte("Unable to convert " + req.FormValue("start") +
+					" to an UUID: " + err.Error()))
+				return
+			}
 			memberreq, _, err = a.database.GetMembershipRequest(
-				uuid.String(), "application", "applicant:")
+				req.Context(), uuid.String(), "application", "applicant:")
 			if err != nil {
 				rw.WriteHeader(http.StatusInternalServerError)
 				rw.Write([]byte("Unable to retrieve the membership request " +
@@ -117,17 +162,22 @@ func (a *ApplicantListHandler) ServeHTTP(rw http.ResponseWriter, req *http.Reque
 			mwk = new(membersys.MemberWithKey)
 			mwk.Key = uuid.String()
 			proto.Merge(&mwk.Member, memberreq.GetMemberData())
+			mwk.PossibleDuplicates =
+				memberreq.GetMetadata().GetPossibleDuplicates()
+			mwk.FeeReduction = memberreq.GetFeeReduction()
 			applist.Applicants = []*membersys.MemberWithKey{mwk}
 		}
 	} else {
 		applist.Applicants, err = a.database.EnumerateMembershipRequests(
-			req.FormValue("criterion"), req.FormValue("start"), a.pagesize)
+			req.Context(), req.FormValue("criterion"), req.FormValue("start"),
+			a.pagesize)
 		if err != nil {
 			log.Print("Error enumerating applications: ", err)
 			rw.WriteHeader(http.StatusInternalServerError)
 			rw.Write([]byte("Error enumerating applications: " + err.Error()))
 			return
 		}
+		addApplicationDetails(req.Context(), a.database, applist.Applicants)
 	}
 
 	applist.AgreementUploadCsrfToken, err = a.auth.GenCSRFToken(
@@ -156,6 +206,33 @@ func (a *ApplicantListHandler) ServeHTTP(rw http.ResponseWriter, req *http.Reque
 		rw.Write([]byte("Error generating CSRF token: " + err.Error()))
 		return
 	}
+	applist.MergeCsrfToken, err = a.auth.GenCSRFToken(
+		req, applicantMergeURL, 10*time.Minute)
+	if err != nil {
+		log.Print("Error generating CSRF token: ", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Error generating CSRF token: " + err.Error()))
+		return
+	}
+	applist.ReductionCsrfToken, err = a.auth.GenCSRFToken(
+		req, feeReductionDecisionURL, 10*time.Minute)
+	if err != nil {
+		log.Print("Error generating CSRF token: ", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Error generating CSRF token: " + err.Error()))
+		return
+	}
+
+	if a.verifier != nil {
+		applist.VerificationCsrfToken, err = a.auth.GenCSRFToken(
+			req, verificationResendURL, 10*time.Minute)
+		if err != nil {
+			log.Print("Error generating CSRF token: ", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			rw.Write([]byte("Error generating CSRF token: " + err.Error()))
+			return
+		}
+	}
 
 	rw.Header().Set("Content-Type", "application/json; encoding=utf8")
 	enc = json.NewEncoder(rw)
@@ -171,7 +248,12 @@ func (a *ApplicantListHandler) ServeHTTP(rw http.ResponseWriter, req *http.Reque
 type MemberAcceptHandler struct {
 	admingroup string
 	auth       *ancientauth.Authenticator
-	database   *membersys.MembershipDB
+	database   membersys.MembershipStore
+
+	// Whether only applicants who have verified their e-mail address
+	// can be accepted.
+	requireVerification bool
+	useProxyRealIP      bool
 }
 
 func (m *MemberAcceptHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
@@ -205,7 +287,26 @@ func (m *MemberAcceptHandler) ServeHTTP(rw http.ResponseWriter, req *http.Reques
 		return
 	}
 
-	err = m.database.MoveApplicantToNewMember(id, user)
+	if m.requireVerification {
+		var agreement *membersys.MembershipAgreement
+		agreement, _, err = m.database.GetMembershipRequest(req.Context(),
+			id, "application", "applicant:")
+		if err != nil {
+			log.Print("Error looking up applicant ", id, ": ", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			rw.Write([]byte(err.Error()))
+			return
+		}
+		if !agreement.GetMemberData().GetEmailVerified() {
+			rw.WriteHeader(http.StatusPreconditionFailed)
+			rw.Write([]byte("The e-mail address of the applicant " +
+				"hasn't been verified yet"))
+			return
+		}
+	}
+
+	err = m.database.MoveApplicantToNewMember(req.Context(), id,
+		requestActor(req, user, m.useProxyRealIP))
 	if err != nil {
 		log.Print("Error moving applicant ", id, " to new user: ", err)
 		rw.WriteHeader(http.StatusLengthRequired)
@@ -219,9 +320,10 @@ func (m *MemberAcceptHandler) ServeHTTP(rw http.ResponseWriter, req *http.Reques
 
 // Object for rejecting membership applications.
 type MemberRejectHandler struct {
-	admingroup string
-	auth       *ancientauth.Authenticator
-	database   *membersys.MembershipDB
+	admingroup     string
+	auth           *ancientauth.Authenticator
+	database       membersys.MembershipStore
+	useProxyRealIP bool
 }
 
 func (m *MemberRejectHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
@@ -253,7 +355,8 @@ func (m *MemberRejectHandler) ServeHTTP(rw http.ResponseWriter, req *http.Reques
 		return
 	}
 
-	err = m.database.MoveApplicantToTrash(id, user)
+	err = m.database.MoveApplicantToTrash(req.Context(), id,
+		requestActor(req, user, m.useProxyRealIP))
 	if err != nil {
 		log.Print("Error moving applicant ", id, " to trash: ", err)
 		rw.WriteHeader(http.StatusLengthRequired)
@@ -267,9 +370,10 @@ func (m *MemberRejectHandler) ServeHTTP(rw http.ResponseWriter, req *http.Reques
 
 // Object for uploading membership agreements.
 type MemberAgreementUploadHandler struct {
-	admingroup string
-	auth       *ancientauth.Authenticator
-	database   *membersys.MembershipDB
+	admingroup     string
+	auth           *ancientauth.Authenticator
+	database       membersys.MembershipStore
+	useProxyRealIP bool
 }
 
 func (m *MemberAgreementUploadHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
@@ -324,7 +428,8 @@ func (m *MemberAgreementUploadHandler) ServeHTTP(rw http.ResponseWriter, req *ht
 
 	mf.Close()
 
-	err = m.database.StoreMembershipAgreement(id, agreement_data)
+	err = m.database.StoreMembershipAgreement(req.Context(), id, agreement_data,
+		requestActor(req, user, m.useProxyRealIP))
 	if err != nil {
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte("Error storing membership agreement: " + err.Error()))
@@ -336,3 +441,120 @@ func (m *MemberAgreementUploadHandler) ServeHTTP(rw http.ResponseWriter, req *ht
 	rw.WriteHeader(http.StatusOK)
 	rw.Write([]byte("{}"))
 }
+
+// Object for merging duplicate membership applications.
+type duplicateListType struct {
+	Duplicates []*membersys.PossibleDuplicate `json:"duplicates"`
+}
+
+// Look for records which may belong to the same person as an applicant.
+// This takes several searches, so it is only done when asked for.
+type ApplicantDuplicatesHandler struct {
+	admingroup string
+	auth       *ancientauth.Authenticator
+	database   membersys.MembershipStore
+}
+
+// Output a JSON list of the possible duplicates of the application "uuid".
+func (a *ApplicantDuplicatesHandler) ServeHTTP(rw http.ResponseWriter,
+	req *http.Request) {
+	var id string = req.FormValue("uuid")
+	var agreement *membersys.MembershipAgreement
+	var duplist duplicateListType
+	var enc *json.Encoder
+	var err error
+
+	if !a.auth.IsAuthenticatedScope(req, a.admingroup) {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if len(id) == 0 {
+		rw.WriteHeader(http.StatusLengthRequired)
+		rw.Write([]byte("No uuid given"))
+		return
+	}
+
+	agreement, _, err = a.database.GetMembershipRequest(req.Context(), id,
+		"application", "applicant:")
+	if err != nil {
+		log.Print("Unable to retrieve the membership request ", id, ": ",
+			err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Unable to retrieve the membership request " +
+			id + ": " + err.Error()))
+		return
+	}
+
+	duplist.Duplicates, err = membersys.FindDuplicates(req.Context(),
+		a.database, agreement.GetMemberData(), id)
+	if err != nil {
+		log.Print("Error looking for duplicates of ", id, ": ", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Error looking for duplicates: " + err.Error()))
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json; encoding=utf8")
+	enc = json.NewEncoder(rw)
+	if err = enc.Encode(duplist); err != nil {
+		log.Print("Error JSON encoding duplicate list: ", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Error encoding result: " + err.Error()))
+		return
+	}
+}
+
+type MemberMergeHandler struct {
+	admingroup     string
+	auth           *ancientauth.Authenticator
+	database       membersys.MembershipStore
+	useProxyRealIP bool
+}
+
+// Merge the application "duplicate" into the application "uuid".
+func (m *MemberMergeHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var user string = m.auth.GetAuthenticatedUser(req)
+	var id string = req.PostFormValue("uuid")
+	var duplicate string = req.PostFormValue("duplicate")
+	var ok bool
+	var err error
+
+	if user == "" {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if len(m.admingroup) > 0 && !m.auth.IsAuthenticatedScope(req, m.admingroup) {
+		rw.WriteHeader(http.StatusForbidden)
+		rw.Write([]byte("User not authorized for this service"))
+		return
+	}
+
+	ok, err = m.auth.VerifyCSRFToken(req, req.PostFormValue("csrf_token"), false)
+	if err != nil && err != ancientauth.CSRFToken_WeakProtectionError {
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte(err.Error()))
+		log.Print("Error verifying CSRF token: ", err)
+		return
+	}
+	if !ok {
+		rw.WriteHeader(http.StatusForbidden)
+		rw.Write([]byte("CSRF token validation failed"))
+		log.Print("Invalid CSRF token reveived")
+		return
+	}
+
+	err = m.database.MergeApplications(req.Context(), id, duplicate,
+		requestActor(req, user, m.useProxyRealIP))
+	if err != nil {
+		log.Print("Error merging applicant ", duplicate, " into ", id, ": ",
+			err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("{}"))
+}
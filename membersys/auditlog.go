@@ -0,0 +1,112 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"ancient-solutions.com/ancientauth"
+	"github.com/starshipfactory/membersys"
+)
+
+type auditLogType struct {
+	Entries           []*membersys.AuditLogEntry `json:"entries"`
+	Verified          bool                       `json:"verified"`
+	VerificationError string                     `json:"verification_error,omitempty"`
+}
+
+// Determine who made the request "req" and where it came from, for
+// recording in the audit log.
+func requestActor(req *http.Request, user string,
+	useProxyRealIP bool) *membersys.Actor {
+	var actor = &membersys.Actor{
+		User:     user,
+		SourceIP: req.RemoteAddr,
+	}
+
+	if useProxyRealIP {
+		actor.SourceIP = req.Header.Get("X-Real-IP")
+	}
+
+	return actor
+}
+
+// Display the audit log of a specific member, and whether it is intact.
+type MemberAuditLogHandler struct {
+	admingroup string
+	auth       *ancientauth.Authenticator
+	database   membersys.MembershipStore
+}
+
+func (m *MemberAuditLogHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var memberid string = req.FormValue("email")
+	var auditlog auditLogType
+	var enc *json.Encoder
+	var err error
+
+	if !m.auth.IsAuthenticatedScope(req, m.admingroup) {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if len(memberid) == 0 {
+		rw.WriteHeader(http.StatusLengthRequired)
+		rw.Write([]byte("No email given"))
+		return
+	}
+
+	auditlog.Entries, err = m.database.GetAuditLog(req.Context(), memberid)
+	if err != nil {
+		log.Print("Error fetching audit log of ", memberid, ": ", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Error fetching audit log: " + err.Error()))
+		return
+	}
+
+	if err = membersys.VerifyAuditLog(auditlog.Entries); err != nil {
+		log.Print("Audit log verification failed: ", err)
+		auditlog.VerificationError = err.Error()
+	} else {
+		auditlog.Verified = true
+	}
+
+	rw.Header().Set("Content-Type", "application/json; encoding=utf8")
+	enc = json.NewEncoder(rw)
+	if err = enc.Encode(auditlog); err != nil {
+		log.Print("Error JSON encoding audit log: ", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Error encoding result: " + err.Error()))
+		return
+	}
+}
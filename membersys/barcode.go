@@ -32,9 +32,9 @@
 package main
 
 import (
-	"database/cassandra"
 	"github.com/boombuler/barcode"
 	"github.com/boombuler/barcode/code128"
+	"github.com/gocql/gocql"
 	"image/png"
 	"log"
 	"math/big"
@@ -45,7 +45,7 @@ func MakeBarcode(rw http.ResponseWriter, req *http.Request) {
 	var id = req.FormValue("id")
 	var bigint *big.Int = big.NewInt(0)
 	var code barcode.Barcode
-	var uuid cassandra.UUID
+	var uuid gocql.UUID
 	var err error
 
 	if id == "" {
@@ -53,7 +53,7 @@ func MakeBarcode(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	uuid, err = cassandra.ParseUUID(id)
+	uuid, err = gocql.ParseUUID(id)
 	if err != nil {
 		log.Print("Error parsing UUID: ", err)
 		rw.WriteHeader(http.StatusInternalServerError)
@@ -61,7 +61,7 @@ func MakeBarcode(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	bigint.SetBytes([]byte(uuid))
+	bigint.SetBytes(uuid.Bytes())
 	id = bigint.String()
 
 	code, err = code128.Encode(id)
@@ -35,18 +35,20 @@ import (
 	"crypto/sha1"
 	"encoding/base64"
 	"expvar"
-	"fmt"
 	"hash"
 	"html/template"
+	"io/ioutil"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"net/url"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/starshipfactory/membersys"
+	"github.com/starshipfactory/membersys/config"
 )
 
 // accepted as a string is used repeatedly in fields.
@@ -57,6 +59,7 @@ var fmap = template.FuncMap{
 	"url":        UserInputFormatter,
 	"derefbool":  DereferenceBoolean,
 	"formatDate": FormatDate,
+	"message":    membersys.Message,
 }
 
 func UserInputFormatter(v ...interface{}) string {
@@ -82,19 +85,98 @@ var numRequests *expvar.Int = expvar.NewInt("num-http-requests")
 var numSubmitted *expvar.Int = expvar.NewInt("num-successful-form-submissions")
 var numSubmitErrors *expvar.Map = expvar.NewMap("num-form-submission-errors")
 
-// Regular expressions for verification of the email and phone number fields.
-var emailRe *regexp.Regexp
-var phoneRe *regexp.Regexp
-
 // Data type for the HTTP handler which takes the requests. We require the
 // templates and a passthrough object for static content requests, so we
 // need to hold some state.
 type FormInputHandler struct {
-	applicationTmpl *template.Template
-	database        *membersys.MembershipDB
-	passthrough     http.Handler
-	printTmpl       *template.Template
-	useProxyRealIP  bool
+	applicationTmpls map[string]*template.Template
+	database         membersys.MembershipStore
+	fees             *config.FeeConfig
+	form             *config.FormConfig
+	passthrough      http.Handler
+	printTmpls       map[string]*template.Template
+	useProxyRealIP   bool
+	verifier         *membersys.EmailVerifier
+}
+
+// Pick the translation of a template from "tmpls" for "lang", falling
+// back to the default language.
+func localizedTemplate(tmpls map[string]*template.Template,
+	lang string) *template.Template {
+	var tmpl *template.Template
+	var ok bool
+
+	if tmpl, ok = tmpls[lang]; ok {
+		return tmpl
+	}
+	return tmpls[membersys.DefaultLanguage]
+}
+
+// Record the problem "code" with the form field "field" in "data", using
+// the message for "code" in the language of the form.
+func (self *FormInputHandler) fieldError(data *membersys.FormInputData,
+	field, code string, args ...interface{}) {
+	data.FieldErr[field] = membersys.Message(data.Language, code, args...)
+	numSubmitErrors.Add(code, 1)
+}
+
+// Record the fee reduction requested on the form in "data", along with
+// the justification and the supporting document, if one has been
+// uploaded. Returns false if the request can't be accepted like this.
+func (self *FormInputHandler) readFeeReduction(req *http.Request,
+	data *membersys.FormInputData) bool {
+	var status string = membersys.FeeReductionRequested
+	var justification string = strings.TrimSpace(
+		req.PostFormValue("mr[reductionReason]"))
+	var mf multipart.File
+	var header *multipart.FileHeader
+	var document []byte
+	var doctype string
+	var err error
+
+	data.FeeReduction = &membersys.FeeReduction{
+		Status:        &status,
+		Justification: &justification,
+	}
+	if len(justification) == 0 {
+		self.fieldError(data, "reductionReason", "no-reduction-reason")
+		return false
+	}
+
+	mf, header, err = req.FormFile("mr[reductionDocument]")
+	if err == http.ErrMissingFile || err == http.ErrNotMultipart {
+		return true
+	} else if err != nil {
+		log.Print("Unable to retrieve uploaded reduction document: ", err)
+		self.fieldError(data, "reductionDocument", "bad-reduction-document")
+		return false
+	}
+	defer mf.Close()
+
+	if header.Size > membersys.MaxFeeReductionDocumentSize {
+		self.fieldError(data, "reductionDocument",
+			"reduction-document-too-large",
+			membersys.MaxFeeReductionDocumentSize/1048576)
+		return false
+	}
+
+	if document, err = ioutil.ReadAll(mf); err != nil {
+		log.Print("Error reading in reduction document: ", err)
+		self.fieldError(data, "reductionDocument", "bad-reduction-document")
+		return false
+	}
+
+	// Go by the contents of the document rather than by the type the
+	// browser claims it has.
+	doctype = http.DetectContentType(document)
+	if !membersys.IsFeeReductionDocumentType(doctype) {
+		self.fieldError(data, "reductionDocument", "bad-reduction-document")
+		return false
+	}
+
+	data.FeeReduction.DocumentType = &doctype
+	data.FeeReductionDocument = document
+	return true
 }
 
 // Parse the form data from the membership signup form and verify that it
@@ -105,7 +187,16 @@ func (self *FormInputHandler) ServeHTTP(w http.ResponseWriter, req *http.Request
 	var data membersys.FormInputData
 	var fee float64
 	var yearly bool = false
-	var minfee float64
+	var category *config.FeeCategory
+	var errs map[string]*membersys.ValidationError
+	var verr *membersys.ValidationError
+	var fieldName string
+	var reduction, found bool
+	var consent *config.ConsentConfig
+	var consents []*membersys.Consent
+	var field *config.FormFieldConfig
+	var extraFields []*membersys.FormFieldValue
+	var now time.Time = time.Now()
 	var ok bool = true
 
 	numRequests.Add(1)
@@ -122,10 +213,20 @@ func (self *FormInputHandler) ServeHTTP(w http.ResponseWriter, req *http.Request
 	data.FieldErr = make(map[string]string)
 	data.MemberData = &membersys.Member{}
 
-	if err = req.ParseForm(); err != nil {
+	// The language can be chosen explicitly on the form, otherwise the
+	// one preferred by the browser is used. The form is sent as multipart
+	// data so documents supporting fee reduction requests can be
+	// uploaded along with it.
+	err = req.ParseMultipartForm(membersys.MaxFeeReductionDocumentSize)
+	if err == http.ErrNotMultipart {
+		err = nil
+	}
+	data.Language = membersys.SelectLanguage(req.Form.Get("lang"),
+		req.Header.Get("Accept-Language"))
+	if err != nil {
 		data.CommonErr = err.Error()
 		numSubmitErrors.Add(err.Error(), 1)
-		err = self.applicationTmpl.Execute(w, data)
+		err = localizedTemplate(self.applicationTmpls, data.Language).Execute(w, data)
 		if err != nil {
 			log.Print("Error executing application template: ",
 				err)
@@ -136,7 +237,7 @@ func (self *FormInputHandler) ServeHTTP(w http.ResponseWriter, req *http.Request
 	// No data entered: the user is probably just going to the web site
 	// for the first time, so data validation is useless.
 	if len(req.PostForm) == 0 {
-		err = self.applicationTmpl.Execute(w, data)
+		err = localizedTemplate(self.applicationTmpls, data.Language).Execute(w, data)
 		if err != nil {
 			log.Print("Error executing application template: ",
 				err)
@@ -150,10 +251,7 @@ func (self *FormInputHandler) ServeHTTP(w http.ResponseWriter, req *http.Request
 	// some countries don't have the concept of last names, and would
 	// set a bad precedent for people reading and using this code.
 	var name string = req.PostFormValue("mr[name]")
-	if len(name) <= 0 {
-		numSubmitErrors.Add("no-name", 1)
-		data.FieldErr["name"] = "Ein Name ist erforderlich"
-	} else {
+	if len(name) > 0 {
 		data.MemberData.Name = &name
 	}
 
@@ -161,18 +259,12 @@ func (self *FormInputHandler) ServeHTTP(w http.ResponseWriter, req *http.Request
 	// format for home addresses, not everything has a house number, and
 	// we don't want to encourage people to think so.
 	var address string = req.PostFormValue("mr[address]")
-	if len(address) <= 0 {
-		numSubmitErrors.Add("no-street", 1)
-		data.FieldErr["address"] = "Eine Adresse ist erforderlich"
-	} else {
+	if len(address) > 0 {
 		data.MemberData.Street = &address
 	}
 
 	var city string = req.PostFormValue("mr[city]")
-	if len(city) <= 0 {
-		numSubmitErrors.Add("no-city", 1)
-		data.FieldErr["city"] = "Ein Wohnort ist erforderlich"
-	} else {
+	if len(city) > 0 {
 		data.MemberData.City = &city
 	}
 
@@ -185,44 +277,23 @@ func (self *FormInputHandler) ServeHTTP(w http.ResponseWriter, req *http.Request
 	// «G1 1PP». The only realistic way to deal with these is to allow
 	// free text for zip codes.
 	var zip string = req.PostFormValue("mr[zip]")
-	if len(zip) <= 0 {
-		numSubmitErrors.Add("no-zip", 1)
-		data.FieldErr["zip"] = "Eine Postleitzahl ist erforderlich"
-	} else {
+	if len(zip) > 0 {
 		data.MemberData.Zipcode = &zip
 	}
 
 	// The country could arguably be a list.
 	var country string = req.PostFormValue("mr[country]")
-	if len(country) <= 0 {
-		numSubmitErrors.Add("no-country", 1)
-		data.FieldErr["country"] = "Ein Wohnland ist erforderlich"
-	} else {
+	if len(country) > 0 {
 		data.MemberData.Country = &country
 	}
 
 	var email string = req.PostFormValue("mr[email]")
-	if !emailRe.MatchString(email) {
-		if len(email) > 0 {
-			data.FieldErr["email"] = "Mailadresse sollte im Format a@b.ch sein"
-			numSubmitErrors.Add("bad-email-format", 1)
-		} else {
-			data.FieldErr["email"] = "Muss angegeben werden"
-			numSubmitErrors.Add("no-email", 1)
-		}
-		ok = false
-	} else {
+	if len(email) > 0 {
 		data.MemberData.Email = &email
 	}
 
 	var phone string = req.PostFormValue("mr[telephone]")
-	if len(phone) > 0 && !phoneRe.MatchString(phone) {
-		data.FieldErr["telephone"] = "Telephonnummer sollte im Format +41 79 123 45 67 sein"
-		numSubmitErrors.Add("bad-phone-format", 1)
-		ok = false
-	} else {
-		data.MemberData.Phone = &phone
-	}
+	data.MemberData.Phone = &phone
 
 	// TODO(tonnerre): Verify the user name field.
 	var username string = strings.ToLower(
@@ -233,8 +304,7 @@ func (self *FormInputHandler) ServeHTTP(w http.ResponseWriter, req *http.Request
 
 	var pw string = req.PostFormValue("mr[password]")
 	if pw != req.PostFormValue("mr[passwordConfirm]") {
-		data.FieldErr["password"] = "Passworte stimmen nicht überein"
-		numSubmitErrors.Add("password-mismatch", 1)
+		self.fieldError(&data, "password", "password-mismatch")
 		ok = false
 	} else {
 		var h hash.Hash = sha1.New()
@@ -243,40 +313,43 @@ func (self *FormInputHandler) ServeHTTP(w http.ResponseWriter, req *http.Request
 		data.MemberData.Pwhash = &pw
 	}
 
-	if req.PostFormValue("mr[statutes]") != accepted {
-		data.FieldErr["statutes"] = "Statuten müssen akzeptiert werden"
-		numSubmitErrors.Add("statutes-not-accepted", 1)
-		ok = false
-	}
-
-	if req.PostFormValue("mr[ipay]") != accepted {
-		data.FieldErr["ipay"] = "Zahlungsbereitschaft ist notwendig"
-		numSubmitErrors.Add("payment-not-accepted", 1)
-		ok = false
-	}
-
-	if req.PostFormValue("mr[rules]") != accepted {
-		data.FieldErr["rules"] = "Reglement muss akzeptiert werden"
-		numSubmitErrors.Add("rules-not-accepted", 1)
-		ok = false
-	}
-
-	if req.PostFormValue("mr[privacy_ok]") != accepted {
-		data.FieldErr["privacy_ok"] = "Datenverarbeitung muss genehmigt werden"
-		numSubmitErrors.Add("gdpr-not-accepted", 1)
-		ok = false
+	// Record which version of each document the applicant has agreed to,
+	// so it can be shown later on.
+	for _, consent = range membersys.FormConsents(self.form) {
+		if req.PostFormValue("mr["+consent.GetName()+"]") == accepted {
+			consents = append(consents, membersys.NewConsent(consent,
+				uint64(now.Unix())))
+		} else if consent.GetRequired() {
+			var code string
+			var args []interface{}
+
+			code, args = membersys.ConsentError(consent, data.Language)
+			self.fieldError(&data, consent.GetName(), code, args...)
+			ok = false
+		}
 	}
 
-	if req.PostFormValue("mr[email_ok]") != accepted {
-		data.FieldErr["email_ok"] = "E-Mailverkehr muss genehmigt werden"
-		numSubmitErrors.Add("email-not-accepted", 1)
-		ok = false
-	}
+	for _, field = range self.form.GetField() {
+		var value string = strings.TrimSpace(
+			req.PostFormValue("mr[field_" + field.GetName() + "]"))
 
-	if req.PostFormValue("mr[gt18]") != "yes" {
-		data.FieldErr["gt18"] = "Man muss mindestens 18 Jahre sein, um uns beizutreten"
-		numSubmitErrors.Add("not-gt18", 1)
-		ok = false
+		if len(value) == 0 {
+			if field.GetRequired() {
+				self.fieldError(&data, "field_"+field.GetName(), "no-form-field",
+					membersys.FormFieldLabel(field, data.Language))
+				ok = false
+			}
+		} else if !membersys.IsFormFieldOption(field, value) {
+			self.fieldError(&data, "field_"+field.GetName(),
+				"unknown-form-field-value",
+				membersys.FormFieldLabel(field, data.Language))
+			ok = false
+		} else {
+			extraFields = append(extraFields, &membersys.FormFieldValue{
+				Name:  proto.String(field.GetName()),
+				Value: proto.String(value),
+			})
+		}
 	}
 
 	// Determine whether the user requests yearly payments.
@@ -285,21 +358,22 @@ func (self *FormInputHandler) ServeHTTP(w http.ResponseWriter, req *http.Request
 	}
 	data.MemberData.FeeYearly = &yearly
 
-	if yearly {
-		minfee = 200
-	} else {
-		minfee = 20
+	// Forms without a choice of categories apply for the first one.
+	// Unknown categories are kept, so they are reported below.
+	var categoryName string = req.PostFormValue("mr[category]")
+	category = membersys.FindFeeCategory(self.fees, categoryName)
+	if category != nil {
+		categoryName = category.GetName()
 	}
+	data.MemberData.Category = &categoryName
 
 	if len(req.PostFormValue("mr[customFee]")) > 0 {
 		fee, err = strconv.ParseFloat(req.PostFormValue("mr[customFee]"), 64)
 		if err == strconv.ErrRange {
-			data.FieldErr["customFee"] = "Der Betrag ist irgendwie etwas gross/klein, oder?"
-			numSubmitErrors.Add("fee-out-of-range", 1)
+			self.fieldError(&data, "customFee", "fee-out-of-range")
 			ok = false
 		} else if err == strconv.ErrSyntax {
-			data.FieldErr["customFee"] = "Der Mitgliedsbeitrag kann nicht als Zahl identifiziert werden"
-			numSubmitErrors.Add("fee-not-a-number", 1)
+			self.fieldError(&data, "customFee", "fee-not-a-number")
 			log.Print("Unable to parse ", req.PostFormValue("mr[customFee]"),
 				" as a valid fee")
 			ok = false
@@ -309,27 +383,38 @@ func (self *FormInputHandler) ServeHTTP(w http.ResponseWriter, req *http.Request
 			log.Print("Error converting ", req.PostFormValue("mr[customFee]"),
 				" to a number: ", err)
 			ok = false
-		}
-	}
-	if req.PostFormValue("mr[fee]") == "custom" {
-		if fee < minfee && req.PostFormValue("mr[reduction]") != "requested" {
-			data.FieldErr["customFee"] = fmt.Sprintf("Für einen Betrag unter %.0f CHF muss eine Ermässigung beantragt werden", minfee)
-			numSubmitErrors.Add("low-fee-without-reduction", 1)
-			ok = false
-		} else if len(req.PostFormValue("mr[customFee]")) <= 0 {
-			data.FieldErr["customFee"] = "Die Angabe eines Mitgliedsbeitrages ist notwendig"
-			ok = false
-		} else {
+		} else if req.PostFormValue("mr[fee]") == "custom" {
 			var intfee uint64 = uint64(fee)
 			data.MemberData.Fee = &intfee
 		}
-	} else if req.PostFormValue("mr[fee]") != fmt.Sprintf("SFr. %d.--", int64(minfee)) {
-		data.FieldErr["fee"] = "Unbekannter Wert für den Mitgliedsbeitrag"
-		numSubmitErrors.Add("unknown-fee-value", 1)
-		ok = false
-	} else {
-		var intfee uint64 = uint64(minfee)
+	}
+	if req.PostFormValue("mr[fee]") == "category" && category != nil {
+		var intfee uint64 = membersys.CategoryFee(category, yearly)
 		data.MemberData.Fee = &intfee
+	} else if req.PostFormValue("mr[fee]") != "custom" &&
+		req.PostFormValue("mr[fee]") != "category" {
+		self.fieldError(&data, "fee", "unknown-fee-value")
+		ok = false
+	}
+
+	// The member data is subject to the same rules wherever it comes
+	// from. Problems found with the form fields above take precedence.
+	reduction = req.PostFormValue("mr[reduction]") == "requested"
+	errs = membersys.ValidateMember(data.MemberData, self.fees, reduction)
+	for fieldName, verr = range errs {
+		if _, found = data.FieldErr[fieldName]; !found {
+			self.fieldError(&data, fieldName, verr.Code, verr.Args...)
+		}
+		ok = false
+	}
+
+	// Fees below the one of the category need the reduction to be
+	// justified.
+	if _, found = data.FieldErr["customFee"]; !found && category != nil &&
+		data.MemberData.Fee != nil && data.MemberData.GetFee() <
+		membersys.CategoryFee(category, yearly) &&
+		!self.readFeeReduction(req, &data) {
+		ok = false
 	}
 
 	data.Metadata = new(membersys.MembershipMetadata)
@@ -346,33 +431,57 @@ func (self *FormInputHandler) ServeHTTP(w http.ResponseWriter, req *http.Request
 	data.Metadata.UserAgent = new(string)
 	*data.Metadata.UserAgent = req.Header.Get("User-Agent")
 
+	data.Metadata.Language = &data.Language
+	data.Metadata.Consents = consents
+	data.Metadata.ExtraFields = extraFields
+
 	if ok {
-		data.Key, err = self.database.StoreMembershipRequest(&data)
+		// Flag the application if the applicant is already a member.
+		// This is informational only, so failures don't stop the
+		// application from being submitted. Similar names and
+		// addresses are only looked for when an admin asks for it.
+		data.Metadata.PossibleDuplicates, err = membersys.FindKnownMembers(
+			req.Context(), self.database, data.MemberData)
+		if err != nil {
+			log.Print("Error looking for duplicates of the application of ",
+				data.MemberData.GetName(), ": ", err)
+			numSubmitErrors.Add("duplicate-check", 1)
+		}
+
+		data.Key, err = self.database.StoreMembershipRequest(req.Context(), &data)
 		if err != nil {
 			log.Print("Error storing membership request for ", data.MemberData.GetName(),
 				" in database: ", err)
 			numSubmitErrors.Add("cassandra-store", 1)
 
 			data.CommonErr = err.Error()
-			self.applicationTmpl.Execute(w, data)
+			localizedTemplate(self.applicationTmpls, data.Language).Execute(w, data)
 		} else {
 			numSubmitted.Add(1)
-			err = self.printTmpl.Execute(w, data)
+
+			// The application is kept even if the mail can't be
+			// sent; it can be sent again from the admin interface.
+			if self.verifier != nil {
+				err = self.verifier.SendMail(data.Key, data.MemberData,
+					data.Language)
+				if err != nil {
+					log.Print("Error sending verification mail to ",
+						data.MemberData.GetEmail(), ": ", err)
+					numSubmitErrors.Add("verification-mail", 1)
+				}
+			}
+
+			err = localizedTemplate(self.printTmpls, data.Language).Execute(w, data)
 			if err != nil {
 				log.Print("Error executing print template: ", err)
 				numSubmitErrors.Add("template-errors", 1)
 			}
 		}
 	} else {
-		err = self.applicationTmpl.Execute(w, data)
+		err = localizedTemplate(self.applicationTmpls, data.Language).Execute(w, data)
 		if err != nil {
 			log.Print("Error executing request form template: ",
 				err)
 		}
 	}
 }
-
-func init() {
-	emailRe = regexp.MustCompile(`^[A-Za-z0-9-_\.]+@[A-Za-z0-9-_\.]+$`)
-	phoneRe = regexp.MustCompile(`^\+?[0-9 -\.]+$`)
-}
@@ -42,6 +42,7 @@ import (
 
 	"ancient-solutions.com/ancientauth"
 	"github.com/starshipfactory/membersys"
+	"github.com/starshipfactory/membersys/config"
 )
 
 type memberListType struct {
@@ -49,6 +50,14 @@ type memberListType struct {
 	CsrfToken string              `json:"csrf_token"`
 }
 
+// Member details along with the version of the record, which has to be
+// passed to the edit handlers. The version is transmitted as a string,
+// since JavaScript numbers can't hold it without losing precision.
+type memberDetailType struct {
+	*membersys.MembershipAgreement
+	Version int64 `json:"version,string"`
+}
+
 var memberGoodbyeURL *url.URL
 
 func init() {
@@ -63,7 +72,7 @@ func init() {
 type TotalListHandler struct {
 	admingroup           string
 	auth                 *ancientauth.Authenticator
-	database             *membersys.MembershipDB
+	database             membersys.MembershipStore
 	pagesize             int32
 	template             *template.Template
 	uniqueMemberTemplate *template.Template
@@ -76,11 +85,17 @@ type TotalRecordList struct {
 	DeQueue    []*membersys.MemberWithKey
 	Trash      []*membersys.MemberWithKey
 
+	// Search term the lists have been restricted to.
+	Criterion string
+
 	ApprovalCsrfToken  string
 	RejectionCsrfToken string
 	UploadCsrfToken    string
 	CancelCsrfToken    string
 	GoodbyeCsrfToken   string
+	RestoreCsrfToken   string
+	MergeCsrfToken     string
+	ReductionCsrfToken string
 
 	PageSize int32
 }
@@ -99,14 +114,18 @@ func (m *TotalListHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request)
 	if len(m.admingroup) > 0 && !m.auth.IsAuthenticatedScope(req, m.admingroup) {
 		var agreement *membersys.MembershipAgreement
 
-		agreement, err = m.database.GetMemberDetailByUsername(user)
+		agreement, err = m.database.GetMemberDetailByUsername(req.Context(), user)
 		if err != nil {
 			log.Print("Can't get membership agreement for ", user, ": ", err)
 			return
 		}
 
 		err = m.uniqueMemberTemplate.ExecuteTemplate(rw, "memberdetail.html",
-			agreement.GetMemberData())
+			&memberDetailPage{
+				Member:       agreement.GetMemberData(),
+				FeeReduction: agreement.GetFeeReduction(),
+				Metadata:     agreement.GetMetadata(),
+			})
 		if err != nil {
 			log.Print("Can't run membership detail template: ", err)
 		}
@@ -115,21 +134,27 @@ func (m *TotalListHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request)
 	}
 
 	all_records.Applicants, err = m.database.EnumerateMembershipRequests(
-		req.FormValue("applicant_criterion"),
+		req.Context(), req.FormValue("criterion"),
 		req.FormValue("applicant_start"), m.pagesize)
 	if err != nil {
 		log.Print("Unable to list applicants from ",
 			req.FormValue("applicant_start"), ": ", err)
+	} else {
+		addApplicationDetails(req.Context(), m.database,
+			all_records.Applicants)
 	}
 
 	all_records.Members, err = m.database.EnumerateMembers(
-		req.FormValue("member_start"), m.pagesize)
+		req.Context(), &membersys.MemberFilter{
+			Criterion: req.FormValue("criterion"),
+		}, req.FormValue("member_start"), m.pagesize)
 	if err != nil {
 		log.Print("Unable to list members from ",
 			req.FormValue("member_start"), ": ", err)
 	}
 
 	all_records.Queue, err = m.database.EnumerateQueuedMembers(
+		req.Context(), req.FormValue("criterion"),
 		req.FormValue("queued_start"), m.pagesize)
 	if err != nil {
 		log.Print("Unable to list queued members from ",
@@ -137,6 +162,7 @@ func (m *TotalListHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request)
 	}
 
 	all_records.DeQueue, err = m.database.EnumerateDeQueuedMembers(
+		req.Context(), req.FormValue("criterion"),
 		req.FormValue("queued_start"), m.pagesize)
 	if err != nil {
 		log.Print("Unable to list dequeued members from ",
@@ -144,6 +170,7 @@ func (m *TotalListHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request)
 	}
 
 	all_records.Trash, err = m.database.EnumerateTrashedMembers(
+		req.Context(), req.FormValue("criterion"),
 		req.FormValue("trashed_start"), m.pagesize)
 	if err != nil {
 		log.Print("Unable to list trashed members from ",
@@ -176,6 +203,23 @@ func (m *TotalListHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request)
 		log.Print("Error generating member goodbye CSRF token: ", err)
 	}
 
+	all_records.RestoreCsrfToken, err = m.auth.GenCSRFToken(
+		req, trashRestoreURL, 10*time.Minute)
+	if err != nil {
+		log.Print("Error generating trash restore CSRF token: ", err)
+	}
+	all_records.MergeCsrfToken, err = m.auth.GenCSRFToken(
+		req, applicantMergeURL, 10*time.Minute)
+	if err != nil {
+		log.Print("Error generating merge CSRF token: ", err)
+	}
+	all_records.ReductionCsrfToken, err = m.auth.GenCSRFToken(
+		req, feeReductionDecisionURL, 10*time.Minute)
+	if err != nil {
+		log.Print("Error generating reduction decision CSRF token: ", err)
+	}
+
+	all_records.Criterion = req.FormValue("criterion")
 	all_records.PageSize = m.pagesize
 
 	err = m.template.ExecuteTemplate(rw, "memberlist.html", all_records)
@@ -188,12 +232,13 @@ func (m *TotalListHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request)
 type MemberListHandler struct {
 	admingroup string
 	auth       *ancientauth.Authenticator
-	database   *membersys.MembershipDB
+	database   membersys.MembershipStore
 	pagesize   int32
 }
 
 func (m *MemberListHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	var memlist memberListType
+	var filter *membersys.MemberFilter
 	var enc *json.Encoder
 	var err error
 
@@ -202,8 +247,14 @@ func (m *MemberListHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request)
 		return
 	}
 
+	if filter, err = membersys.ParseMemberFilter(req.FormValue); err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
 	memlist.Members, err = m.database.EnumerateMembers(
-		req.FormValue("start"), m.pagesize)
+		req.Context(), filter, req.FormValue("start"), m.pagesize)
 	if err != nil {
 		log.Print("Error enumerating members: ", err)
 		rw.WriteHeader(http.StatusInternalServerError)
@@ -232,9 +283,10 @@ func (m *MemberListHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request)
 
 // Object for removing members from the organization.
 type MemberGoodbyeHandler struct {
-	admingroup string
-	auth       *ancientauth.Authenticator
-	database   *membersys.MembershipDB
+	admingroup     string
+	auth           *ancientauth.Authenticator
+	database       membersys.MembershipStore
+	useProxyRealIP bool
 }
 
 func (m *MemberGoodbyeHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
@@ -267,7 +319,8 @@ func (m *MemberGoodbyeHandler) ServeHTTP(rw http.ResponseWriter, req *http.Reque
 		return
 	}
 
-	err = m.database.MoveMemberToTrash(id, user, reason)
+	err = m.database.MoveMemberToTrash(req.Context(), id,
+		requestActor(req, user, m.useProxyRealIP), reason)
 	if err != nil {
 		log.Print("Error moving member ", id, " to trash: ", err)
 		rw.WriteHeader(http.StatusLengthRequired)
@@ -284,13 +337,14 @@ func (m *MemberGoodbyeHandler) ServeHTTP(rw http.ResponseWriter, req *http.Reque
 type MemberDetailHandler struct {
 	admingroup string
 	auth       *ancientauth.Authenticator
-	database   *membersys.MembershipDB
+	database   membersys.MembershipStore
 }
 
 func (m *MemberDetailHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	var user string = m.auth.GetAuthenticatedUser(req)
 	var member *membersys.MembershipAgreement
 	var memberid string = req.FormValue("email")
+	var version int64
 	var enc *json.Encoder
 	var err error
 
@@ -305,7 +359,7 @@ func (m *MemberDetailHandler) ServeHTTP(rw http.ResponseWriter, req *http.Reques
 		return
 	}
 
-	member, err = m.database.GetMemberDetail(memberid)
+	member, version, err = m.database.GetMemberDetail(req.Context(), memberid)
 	if err != nil {
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte("Error fetching member details: " +
@@ -329,25 +383,59 @@ func (m *MemberDetailHandler) ServeHTTP(rw http.ResponseWriter, req *http.Reques
 
 	rw.Header().Set("Content-Type", "application/json; encoding=utf8")
 	enc = json.NewEncoder(rw)
-	if err = enc.Encode(member); err != nil {
+	err = enc.Encode(memberDetailType{
+		MembershipAgreement: member,
+		Version:             version,
+	})
+	if err != nil {
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte("Error encoding JSON structure: " + err.Error()))
 		return
 	}
 }
 
+// Parse the version of the member record an edit is based on.
+func parseMemberVersion(req *http.Request) (int64, error) {
+	return strconv.ParseInt(req.FormValue("version"), 10, 64)
+}
+
+// Report the result of an edit to the client. If the record has been
+// modified since the version the edit was based on, the client is told to
+// reload the record and try again.
+func writeMemberUpdateResult(rw http.ResponseWriter, version int64,
+	err error) {
+	if membersys.IsVersionConflict(err) {
+		rw.WriteHeader(http.StatusConflict)
+		rw.Write([]byte(err.Error()))
+		return
+	} else if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Error updating member details: " +
+			err.Error()))
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json; encoding=utf8")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("{\"version\":\"" +
+		strconv.FormatInt(version, 10) + "\"}"))
+}
+
 // Change one of a number of long fields.
 type MemberLongFieldHandler struct {
-	admingroup string
-	auth       *ancientauth.Authenticator
-	database   *membersys.MembershipDB
+	admingroup     string
+	auth           *ancientauth.Authenticator
+	database       membersys.MembershipStore
+	useProxyRealIP bool
 }
 
 func (m *MemberLongFieldHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var user string = m.auth.GetAuthenticatedUser(req)
 	var memberid string = req.FormValue("email")
 	var field string = req.FormValue("field")
 	var value string = req.FormValue("value")
 	var longValue uint64
+	var version int64
 	var err error
 
 	if len(m.admingroup) > 0 && !m.auth.IsAuthenticatedScope(req, m.admingroup) {
@@ -361,38 +449,40 @@ func (m *MemberLongFieldHandler) ServeHTTP(rw http.ResponseWriter, req *http.Req
 		return
 	}
 
-	longValue, err = strconv.ParseUint(value, 10, 64)
+	version, err = parseMemberVersion(req)
 	if err != nil {
 		rw.WriteHeader(http.StatusBadRequest)
-		rw.Write([]byte("Not a number: " + err.Error()))
+		rw.Write([]byte("Invalid record version: " + err.Error()))
 		return
 	}
 
-	err = m.database.SetLongValue(memberid, field, longValue)
+	longValue, err = strconv.ParseUint(value, 10, 64)
 	if err != nil {
-		rw.WriteHeader(http.StatusInternalServerError)
-		rw.Write([]byte("Error updating member details: " +
-			err.Error()))
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte("Not a number: " + err.Error()))
 		return
 	}
 
-	rw.Header().Set("Content-Type", "application/json; encoding=utf8")
-	rw.WriteHeader(http.StatusOK)
-	rw.Write([]byte("{}"))
+	version, err = m.database.SetLongValue(req.Context(), memberid, field,
+		longValue, version, requestActor(req, user, m.useProxyRealIP))
+	writeMemberUpdateResult(rw, version, err)
 }
 
 // Change one of a number of boolean fields.
 type MemberBoolFieldHandler struct {
-	admingroup string
-	auth       *ancientauth.Authenticator
-	database   *membersys.MembershipDB
+	admingroup     string
+	auth           *ancientauth.Authenticator
+	database       membersys.MembershipStore
+	useProxyRealIP bool
 }
 
 func (m *MemberBoolFieldHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var user string = m.auth.GetAuthenticatedUser(req)
 	var memberid string = req.FormValue("email")
 	var field string = req.FormValue("field")
 	var value string = req.FormValue("value")
 	var boolValue bool
+	var version int64
 	var err error
 
 	if len(m.admingroup) > 0 && !m.auth.IsAuthenticatedScope(req, m.admingroup) {
@@ -406,6 +496,13 @@ func (m *MemberBoolFieldHandler) ServeHTTP(rw http.ResponseWriter, req *http.Req
 		return
 	}
 
+	version, err = parseMemberVersion(req)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte("Invalid record version: " + err.Error()))
+		return
+	}
+
 	if value == "true" {
 		boolValue = true
 	} else if value == "false" {
@@ -416,30 +513,27 @@ func (m *MemberBoolFieldHandler) ServeHTTP(rw http.ResponseWriter, req *http.Req
 		return
 	}
 
-	err = m.database.SetBoolValue(memberid, field, boolValue)
-	if err != nil {
-		rw.WriteHeader(http.StatusInternalServerError)
-		rw.Write([]byte("Error updating member details: " +
-			err.Error()))
-		return
-	}
-
-	rw.Header().Set("Content-Type", "application/json; encoding=utf8")
-	rw.WriteHeader(http.StatusOK)
-	rw.Write([]byte("{}"))
+	version, err = m.database.SetBoolValue(req.Context(), memberid, field,
+		boolValue, version, requestActor(req, user, m.useProxyRealIP))
+	writeMemberUpdateResult(rw, version, err)
 }
 
-// Change one of a number of text fields.
+// Change one of a number of text fields. The membership category has to
+// be one of those in "fees".
 type MemberTextFieldHandler struct {
-	admingroup string
-	auth       *ancientauth.Authenticator
-	database   *membersys.MembershipDB
+	admingroup     string
+	auth           *ancientauth.Authenticator
+	database       membersys.MembershipStore
+	fees           *config.FeeConfig
+	useProxyRealIP bool
 }
 
 func (m *MemberTextFieldHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var user string = m.auth.GetAuthenticatedUser(req)
 	var memberid string = req.FormValue("email")
 	var field string = req.FormValue("field")
 	var value string = req.FormValue("value")
+	var version int64
 	var err error
 
 	if len(m.admingroup) > 0 && !m.auth.IsAuthenticatedScope(req, m.admingroup) {
@@ -453,32 +547,40 @@ func (m *MemberTextFieldHandler) ServeHTTP(rw http.ResponseWriter, req *http.Req
 		return
 	}
 
-	err = m.database.SetTextValue(memberid, field, value)
+	if field == "category" && membersys.FindFeeCategory(m.fees, value) == nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte("Unknown membership category: " + value))
+		return
+	}
+
+	version, err = parseMemberVersion(req)
 	if err != nil {
-		rw.WriteHeader(http.StatusInternalServerError)
-		rw.Write([]byte("Error updating member details: " +
-			err.Error()))
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte("Invalid record version: " + err.Error()))
 		return
 	}
 
-	rw.Header().Set("Content-Type", "application/json; encoding=utf8")
-	rw.WriteHeader(http.StatusOK)
-	rw.Write([]byte("{}"))
+	version, err = m.database.SetTextValue(req.Context(), memberid, field,
+		value, version, requestActor(req, user, m.useProxyRealIP))
+	writeMemberUpdateResult(rw, version, err)
 }
 
 // Change the membership fee.
 type MemberFeeHandler struct {
-	admingroup string
-	auth       *ancientauth.Authenticator
-	database   *membersys.MembershipDB
+	admingroup     string
+	auth           *ancientauth.Authenticator
+	database       membersys.MembershipStore
+	useProxyRealIP bool
 }
 
 func (m *MemberFeeHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var user string = m.auth.GetAuthenticatedUser(req)
 	var memberid string = req.FormValue("email")
 	var fee_s string = req.FormValue("fee")
 	var fee_yearly_s string = req.FormValue("fee_yearly")
 	var fee uint64
 	var fee_yearly bool
+	var version int64
 	var err error
 
 	if len(m.admingroup) > 0 && !m.auth.IsAuthenticatedScope(req, m.admingroup) {
@@ -492,6 +594,13 @@ func (m *MemberFeeHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request)
 		return
 	}
 
+	version, err = parseMemberVersion(req)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte("Invalid record version: " + err.Error()))
+		return
+	}
+
 	fee, err = strconv.ParseUint(fee_s, 10, 64)
 	if err != nil {
 		rw.WriteHeader(http.StatusBadRequest)
@@ -506,17 +615,10 @@ func (m *MemberFeeHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request)
 	} else {
 		rw.WriteHeader(http.StatusBadRequest)
 		rw.Write([]byte("Not a boolean"))
-	}
-
-	err = m.database.SetMemberFee(memberid, fee, fee_yearly)
-	if err != nil {
-		rw.WriteHeader(http.StatusInternalServerError)
-		rw.Write([]byte("Error updating membership fee: " +
-			err.Error()))
 		return
 	}
 
-	rw.Header().Set("Content-Type", "application/json; encoding=utf8")
-	rw.WriteHeader(http.StatusOK)
-	rw.Write([]byte("{}"))
+	version, err = m.database.SetMemberFee(req.Context(), memberid, fee,
+		fee_yearly, version, requestActor(req, user, m.useProxyRealIP))
+	writeMemberUpdateResult(rw, version, err)
 }
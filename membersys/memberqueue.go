@@ -50,7 +50,7 @@ type queueListType struct {
 type MemberQueueListHandler struct {
 	admingroup string
 	auth       *ancientauth.Authenticator
-	database   *membersys.MembershipDB
+	database   membersys.MembershipStore
 	pagesize   int32
 }
 
@@ -58,7 +58,7 @@ type MemberQueueListHandler struct {
 type MemberDeQueueListHandler struct {
 	admingroup string
 	auth       *ancientauth.Authenticator
-	database   *membersys.MembershipDB
+	database   membersys.MembershipStore
 	pagesize   int32
 }
 
@@ -83,7 +83,8 @@ func (m *MemberQueueListHandler) ServeHTTP(rw http.ResponseWriter, req *http.Req
 	}
 
 	qlist.Queued, err = m.database.EnumerateQueuedMembers(
-		req.FormValue("start"), m.pagesize)
+		req.Context(), req.FormValue("criterion"), req.FormValue("start"),
+		m.pagesize)
 	if err != nil {
 		log.Print("Error enumerating membership queue: ", err)
 		rw.WriteHeader(http.StatusInternalServerError)
@@ -121,7 +122,8 @@ func (m *MemberDeQueueListHandler) ServeHTTP(rw http.ResponseWriter, req *http.R
 	}
 
 	qlist.Queued, err = m.database.EnumerateDeQueuedMembers(
-		req.FormValue("start"), m.pagesize)
+		req.Context(), req.FormValue("criterion"), req.FormValue("start"),
+		m.pagesize)
 	if err != nil {
 		log.Print("Error enumerating membership queue: ", err)
 		rw.WriteHeader(http.StatusInternalServerError)
@@ -150,9 +152,10 @@ func (m *MemberDeQueueListHandler) ServeHTTP(rw http.ResponseWriter, req *http.R
 
 // Object for cancelling a queued future member.
 type MemberQueueCancelHandler struct {
-	admingroup string
-	auth       *ancientauth.Authenticator
-	database   *membersys.MembershipDB
+	admingroup     string
+	auth           *ancientauth.Authenticator
+	database       membersys.MembershipStore
+	useProxyRealIP bool
 }
 
 func (m *MemberQueueCancelHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
@@ -184,7 +187,8 @@ func (m *MemberQueueCancelHandler) ServeHTTP(rw http.ResponseWriter, req *http.R
 		return
 	}
 
-	err = m.database.MoveQueuedRecordToTrash(id, user)
+	err = m.database.MoveQueuedRecordToTrash(req.Context(), id,
+		requestActor(req, user, m.useProxyRealIP))
 	if err != nil {
 		log.Print("Error moving queued record ", id, " to trash: ", err)
 		rw.WriteHeader(http.StatusLengthRequired)
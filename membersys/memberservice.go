@@ -33,11 +33,15 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"html/template"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 	textTemplate "text/template"
 	"time"
 
@@ -47,240 +51,476 @@ import (
 	"github.com/starshipfactory/membersys/config"
 )
 
-func main() {
-	var help bool
-	var bindto, config_file string
-	var config_contents []byte
-	var application_tmpl, memberlist_tmpl, print_tmpl *template.Template
-	var unique_member_detail_template *template.Template
-	var vcf_template *textTemplate.Template
-	var authenticator *ancientauth.Authenticator
-	var debug_authenticator bool
-	var config config.MembersysConfig
-	var db *membersys.MembershipDB
-	var err error
+// Serves the organisation configured for the host name requests are made
+// for.
+type organisationMux struct {
+	hosts map[string]http.Handler
 
-	flag.BoolVar(&help, "help", false, "Display help")
-	flag.StringVar(&bindto, "bind", "127.0.0.1:8080",
-		"The address to bind the web server to")
-	flag.StringVar(&config_file, "config", "",
-		"Path to a file containing a MembersysConfig protocol buffer")
-	flag.BoolVar(&debug_authenticator, "debug-authenticator", false,
-		"Debug the authenticator?")
-	flag.Parse()
+	// Handler for requests for any host name, if there is only one
+	// organisation.
+	fallback http.Handler
+}
 
-	if help || config_file == "" {
-		flag.Usage()
-		os.Exit(1)
+func (o *organisationMux) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var host string = req.Host
+	var handler http.Handler
+	var ok bool
+	var err error
+
+	if strings.Contains(host, ":") {
+		if host, _, err = net.SplitHostPort(host); err != nil {
+			host = req.Host
+		}
 	}
 
-	config_contents, err = ioutil.ReadFile(config_file)
-	if err != nil {
-		log.Fatal("Unable to read ", config_file, ": ", err)
+	if handler, ok = o.hosts[strings.ToLower(host)]; ok {
+		handler.ServeHTTP(rw, req)
+	} else if o.fallback != nil {
+		o.fallback.ServeHTTP(rw, req)
+	} else {
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte("No organisation is served under this host name"))
 	}
-	err = proto.Unmarshal(config_contents, &config)
-	if err != nil {
-		err = proto.UnmarshalText(string(config_contents), &config)
+}
+
+// Functions available to the templates of "org", in addition to fmap.
+func organisationFuncs(org *config.OrganisationConfig) map[string]interface{} {
+	return map[string]interface{}{
+		"organisation": org.GetName,
+		"currency":     org.Fees.GetCurrency,
+		"feeCategories": func() []*config.FeeCategory {
+			return membersys.FeeCategories(org.Fees)
+		},
+		"feeCategory": func(name string) *config.FeeCategory {
+			return membersys.FindFeeCategory(org.Fees, name)
+		},
+		"categoryFee":         membersys.CategoryFee,
+		"categoryDescription": membersys.CategoryDescription,
+		"consents": func() []*config.ConsentConfig {
+			return membersys.FormConsents(org.Form)
+		},
+		"consentLabel": membersys.ConsentLabel,
+		"consentError": func(consent *config.ConsentConfig, lang string) string {
+			var code string
+			var args []interface{}
+
+			code, args = membersys.ConsentError(consent, lang)
+			return membersys.Message(lang, code, args...)
+		},
+		"hasConsent":      membersys.HasConsent,
+		"formFields":      org.Form.GetField,
+		"formFieldLabel":  membersys.FormFieldLabel,
+		"formFieldAnswer": membersys.FormFieldAnswer,
 	}
-	if err != nil {
-		log.Fatal("Error parsing ", config_file, ": ", err)
+}
+
+// Parse the template "name" of "org" along with its translations, keyed
+// by language.
+func parseLocalizedTemplates(org *config.OrganisationConfig, name string) (
+	map[string]*template.Template, error) {
+	var tmpls = make(map[string]*template.Template)
+	var path string = filepath.Join(org.GetTemplateDir(), name)
+	var lang string
+
+	for _, lang = range membersys.TranslatedLanguages(path) {
+		var file string = membersys.LocalizedFileName(path, lang)
+		var tmpl *template.Template = template.New(filepath.Base(file))
+		var err error
+
+		tmpl.Funcs(fmap)
+		tmpl.Funcs(organisationFuncs(org))
+		if tmpl, err = tmpl.ParseFiles(file); err != nil {
+			return nil, err
+		}
+		tmpls[lang] = tmpl
 	}
 
+	return tmpls, nil
+}
+
+// Load the templates of "org", connect to its database and set up the
+// handlers serving it. All data of the organisation is kept in its own
+// database, and only members of its auth group can administer it.
+func newOrganisationHandler(cfg *config.MembersysConfig,
+	org *config.OrganisationConfig, debug_authenticator bool) (
+	http.Handler, error) {
+	var mux *http.ServeMux = http.NewServeMux()
+	var application_tmpls, print_tmpls map[string]*template.Template
+	var memberlist_tmpl *template.Template
+	var unique_member_detail_template *template.Template
+	var vcf_template *textTemplate.Template
+	var verify_tmpls map[string]*template.Template
+	var authenticator *ancientauth.Authenticator
+	var verifier *membersys.EmailVerifier
+	var db membersys.MembershipStore
+	var err error
+
 	// Load and parse the HTML templates to be displayed.
-	application_tmpl, err = template.ParseFiles(
-		config.GetTemplateDir() + "/form.html")
+	application_tmpls, err = parseLocalizedTemplates(org, "form.html")
 	if err != nil {
-		log.Fatal("Unable to parse form template: ", err)
+		return nil, fmt.Errorf("Unable to parse form template: %s", err)
 	}
 
-	print_tmpl, err = template.ParseFiles(
-		config.GetTemplateDir() + "/printlayout.html")
+	print_tmpls, err = parseLocalizedTemplates(org, "printlayout.html")
 	if err != nil {
-		log.Fatal("Unable to parse print layout template: ", err)
+		return nil, fmt.Errorf("Unable to parse print layout template: %s",
+			err)
+	}
+
+	// Applicants are only asked to verify their e-mail address if mails
+	// can be sent.
+	if org.VerificationMail != nil {
+		verify_tmpls, err = parseLocalizedTemplates(org, "verify.html")
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse verification template: %s",
+				err)
+		}
+
+		verifier, err = membersys.NewEmailVerifier(org.VerificationMail,
+			org.GetName())
+		if err != nil {
+			return nil, fmt.Errorf("Unable to set up verification mails: %s",
+				err)
+		}
 	}
 
 	memberlist_tmpl = template.New("memberlist")
 	memberlist_tmpl.Funcs(fmap)
+	memberlist_tmpl.Funcs(organisationFuncs(org))
 	memberlist_tmpl, err = memberlist_tmpl.ParseFiles(
-		config.GetTemplateDir() + "/memberlist.html")
+		org.GetTemplateDir() + "/memberlist.html")
 	if err != nil {
-		log.Fatal("Unable to parse member list template: ", err)
+		return nil, fmt.Errorf("Unable to parse member list template: %s",
+			err)
 	}
 
 	unique_member_detail_template = template.New("memberdetail")
 	unique_member_detail_template.Funcs(fmap)
+	unique_member_detail_template.Funcs(organisationFuncs(org))
 	unique_member_detail_template, err =
 		unique_member_detail_template.ParseFiles(
-			config.GetTemplateDir() + "/memberdetail.html")
+			org.GetTemplateDir() + "/memberdetail.html")
 	if err != nil {
-		log.Fatal("Unable to parse member detail template: ", err)
+		return nil, fmt.Errorf("Unable to parse member detail template: %s",
+			err)
 	}
 
-	vcf_template, err = textTemplate.ParseFiles(
-		config.GetTemplateDir() + "/contactdetails.vcf")
+	vcf_template = textTemplate.New("contactdetails.vcf")
+	vcf_template.Funcs(organisationFuncs(org))
+	vcf_template, err = vcf_template.ParseFiles(
+		org.GetTemplateDir() + "/contactdetails.vcf")
 	if err != nil {
-		log.Fatal("Unable to parse member VCF template: ", err)
+		return nil, fmt.Errorf("Unable to parse member VCF template: %s",
+			err)
 	}
 
 	authenticator, err = ancientauth.NewAuthenticator(
-		config.AuthenticationConfig.GetAppName(),
-		config.AuthenticationConfig.GetCertPath(),
-		config.AuthenticationConfig.GetKeyPath(),
-		config.AuthenticationConfig.GetCaBundlePath(),
-		config.AuthenticationConfig.GetAuthServerHost(),
-		config.AuthenticationConfig.GetX509KeyserverHost(),
-		int(config.AuthenticationConfig.GetX509CertificateCacheSize()))
+		org.GetAppName(),
+		cfg.AuthenticationConfig.GetCertPath(),
+		cfg.AuthenticationConfig.GetKeyPath(),
+		cfg.AuthenticationConfig.GetCaBundlePath(),
+		cfg.AuthenticationConfig.GetAuthServerHost(),
+		cfg.AuthenticationConfig.GetX509KeyserverHost(),
+		int(cfg.AuthenticationConfig.GetX509CertificateCacheSize()))
 	if err != nil {
-		log.Fatal("Unable to assemble authenticator: ", err)
+		return nil, fmt.Errorf("Unable to assemble authenticator: %s", err)
 	}
 
 	if debug_authenticator {
 		authenticator.Debug()
 	}
 
-	db, err = membersys.NewMembershipDB(
-		config.DatabaseConfig.GetDatabaseServer(),
-		config.DatabaseConfig.GetDatabaseName(),
-		time.Duration(config.DatabaseConfig.GetDatabaseTimeout())*time.Millisecond)
+	db, err = membersys.NewMembershipStore(org.DatabaseConfig,
+		time.Duration(org.DatabaseConfig.GetDatabaseTimeout())*time.Millisecond)
 	if err != nil {
-		log.Fatal("Unable to connect to the cassandra DB ",
-			config.DatabaseConfig.GetDatabaseServer(), " at ",
-			config.DatabaseConfig.GetDatabaseName(), ": ", err)
+		return nil, fmt.Errorf("Unable to connect to the membership "+
+			"database %s at %s: %s",
+			org.DatabaseConfig.GetDatabaseServer(),
+			org.DatabaseConfig.GetDatabaseName(), err)
 	}
 
 	// Register the URL handlers to be invoked.
-	http.Handle("/admin/api/members", &MemberListHandler{
-		admingroup: config.AuthenticationConfig.GetAuthGroup(),
+	mux.Handle("/admin/api/members", &MemberListHandler{
+		admingroup: org.GetAuthGroup(),
 		auth:       authenticator,
 		database:   db,
-		pagesize:   config.GetResultPageSize(),
+		pagesize:   cfg.GetResultPageSize(),
 	})
 
-	http.Handle("/admin/api/applicants", &ApplicantListHandler{
-		admingroup: config.AuthenticationConfig.GetAuthGroup(),
+	mux.Handle("/admin/api/applicants", &ApplicantListHandler{
+		admingroup: org.GetAuthGroup(),
 		auth:       authenticator,
 		database:   db,
-		pagesize:   config.GetResultPageSize(),
+		pagesize:   cfg.GetResultPageSize(),
+		verifier:   verifier,
 	})
 
-	http.Handle("/admin/api/queue", &MemberQueueListHandler{
-		admingroup: config.AuthenticationConfig.GetAuthGroup(),
+	mux.Handle("/admin/api/queue", &MemberQueueListHandler{
+		admingroup: org.GetAuthGroup(),
 		auth:       authenticator,
 		database:   db,
-		pagesize:   config.GetResultPageSize(),
+		pagesize:   cfg.GetResultPageSize(),
 	})
 
-	http.Handle("/admin/api/dequeue", &MemberDeQueueListHandler{
-		admingroup: config.AuthenticationConfig.GetAuthGroup(),
+	mux.Handle("/admin/api/dequeue", &MemberDeQueueListHandler{
+		admingroup: org.GetAuthGroup(),
 		auth:       authenticator,
 		database:   db,
-		pagesize:   config.GetResultPageSize(),
+		pagesize:   cfg.GetResultPageSize(),
 	})
 
-	http.Handle("/admin/api/trash", &MemberTrashListHandler{
-		admingroup: config.AuthenticationConfig.GetAuthGroup(),
+	mux.Handle("/admin/api/trash", &MemberTrashListHandler{
+		admingroup: org.GetAuthGroup(),
 		auth:       authenticator,
 		database:   db,
-		pagesize:   config.GetResultPageSize(),
+		pagesize:   cfg.GetResultPageSize(),
 	})
 
-	http.Handle("/admin/api/accept", &MemberAcceptHandler{
-		admingroup: config.AuthenticationConfig.GetAuthGroup(),
-		auth:       authenticator,
-		database:   db,
+	mux.Handle("/admin/api/accept", &MemberAcceptHandler{
+		admingroup:          org.GetAuthGroup(),
+		auth:                authenticator,
+		database:            db,
+		requireVerification: org.VerificationMail.GetRequireVerification(),
+		useProxyRealIP:      cfg.GetUseProxyRealIp(),
 	})
 
-	http.Handle("/admin/api/reject", &MemberRejectHandler{
-		admingroup: config.AuthenticationConfig.GetAuthGroup(),
-		auth:       authenticator,
-		database:   db,
+	mux.Handle("/admin/api/reject", &MemberRejectHandler{
+		admingroup:     org.GetAuthGroup(),
+		auth:           authenticator,
+		database:       db,
+		useProxyRealIP: cfg.GetUseProxyRealIp(),
 	})
 
-	http.Handle("/admin/api/editlong", &MemberLongFieldHandler{
-		admingroup: config.AuthenticationConfig.GetAuthGroup(),
+	mux.Handle("/admin/api/duplicates", &ApplicantDuplicatesHandler{
+		admingroup: org.GetAuthGroup(),
 		auth:       authenticator,
 		database:   db,
 	})
 
-	http.Handle("/admin/api/editbool", &MemberBoolFieldHandler{
-		admingroup: config.AuthenticationConfig.GetAuthGroup(),
-		auth:       authenticator,
-		database:   db,
+	mux.Handle("/admin/api/merge", &MemberMergeHandler{
+		admingroup:     org.GetAuthGroup(),
+		auth:           authenticator,
+		database:       db,
+		useProxyRealIP: cfg.GetUseProxyRealIp(),
 	})
 
-	http.Handle("/admin/api/edittext", &MemberTextFieldHandler{
-		admingroup: config.AuthenticationConfig.GetAuthGroup(),
-		auth:       authenticator,
-		database:   db,
+	mux.Handle("/admin/api/decide-reduction", &FeeReductionDecisionHandler{
+		admingroup:     org.GetAuthGroup(),
+		auth:           authenticator,
+		database:       db,
+		useProxyRealIP: cfg.GetUseProxyRealIp(),
 	})
 
-	http.Handle("/admin/api/editfee", &MemberFeeHandler{
-		admingroup: config.AuthenticationConfig.GetAuthGroup(),
+	mux.Handle("/admin/api/reduction-document", &FeeReductionDocumentHandler{
+		admingroup: org.GetAuthGroup(),
 		auth:       authenticator,
 		database:   db,
 	})
 
-	http.Handle("/admin/api/agreement-upload", &MemberAgreementUploadHandler{
-		admingroup: config.AuthenticationConfig.GetAuthGroup(),
-		auth:       authenticator,
-		database:   db,
+	if verifier != nil {
+		mux.Handle("/admin/api/resend-verification", &VerificationResendHandler{
+			admingroup: org.GetAuthGroup(),
+			auth:       authenticator,
+			database:   db,
+			verifier:   verifier,
+		})
+
+		mux.Handle("/verify", &EmailVerificationHandler{
+			database:       db,
+			verifier:       verifier,
+			tmpls:          verify_tmpls,
+			useProxyRealIP: cfg.GetUseProxyRealIp(),
+		})
+	}
+
+	mux.Handle("/admin/api/editlong", &MemberLongFieldHandler{
+		admingroup:     org.GetAuthGroup(),
+		auth:           authenticator,
+		database:       db,
+		useProxyRealIP: cfg.GetUseProxyRealIp(),
 	})
 
-	http.Handle("/admin/api/cancel-queued", &MemberQueueCancelHandler{
-		admingroup: config.AuthenticationConfig.GetAuthGroup(),
-		auth:       authenticator,
-		database:   db,
+	mux.Handle("/admin/api/editbool", &MemberBoolFieldHandler{
+		admingroup:     org.GetAuthGroup(),
+		auth:           authenticator,
+		database:       db,
+		useProxyRealIP: cfg.GetUseProxyRealIp(),
 	})
 
-	http.Handle("/admin/api/goodbye-member", &MemberGoodbyeHandler{
-		admingroup: config.AuthenticationConfig.GetAuthGroup(),
+	mux.Handle("/admin/api/edittext", &MemberTextFieldHandler{
+		admingroup:     org.GetAuthGroup(),
+		auth:           authenticator,
+		database:       db,
+		fees:           org.Fees,
+		useProxyRealIP: cfg.GetUseProxyRealIp(),
+	})
+
+	mux.Handle("/admin/api/editfee", &MemberFeeHandler{
+		admingroup:     org.GetAuthGroup(),
+		auth:           authenticator,
+		database:       db,
+		useProxyRealIP: cfg.GetUseProxyRealIp(),
+	})
+
+	mux.Handle("/admin/api/agreement-upload", &MemberAgreementUploadHandler{
+		admingroup:     org.GetAuthGroup(),
+		auth:           authenticator,
+		database:       db,
+		useProxyRealIP: cfg.GetUseProxyRealIp(),
+	})
+
+	mux.Handle("/admin/api/cancel-queued", &MemberQueueCancelHandler{
+		admingroup:     org.GetAuthGroup(),
+		auth:           authenticator,
+		database:       db,
+		useProxyRealIP: cfg.GetUseProxyRealIp(),
+	})
+
+	mux.Handle("/admin/api/restore", &MemberRestoreHandler{
+		admingroup:     org.GetAuthGroup(),
+		auth:           authenticator,
+		database:       db,
+		useProxyRealIP: cfg.GetUseProxyRealIp(),
+	})
+
+	mux.Handle("/admin/api/goodbye-member", &MemberGoodbyeHandler{
+		admingroup:     org.GetAuthGroup(),
+		auth:           authenticator,
+		database:       db,
+		useProxyRealIP: cfg.GetUseProxyRealIp(),
+	})
+
+	mux.Handle("/admin/api/member", &MemberDetailHandler{
+		admingroup: org.GetAuthGroup(),
 		auth:       authenticator,
 		database:   db,
 	})
 
-	http.Handle("/admin/api/member", &MemberDetailHandler{
-		admingroup: config.AuthenticationConfig.GetAuthGroup(),
+	mux.Handle("/admin/api/audit", &MemberAuditLogHandler{
+		admingroup: org.GetAuthGroup(),
 		auth:       authenticator,
 		database:   db,
 	})
 
-	http.Handle("/admin", &TotalListHandler{
-		admingroup:           config.AuthenticationConfig.GetAuthGroup(),
+	mux.Handle("/admin/api/revert", &MemberRevertHandler{
+		admingroup:     org.GetAuthGroup(),
+		auth:           authenticator,
+		database:       db,
+		useProxyRealIP: cfg.GetUseProxyRealIp(),
+	})
+
+	mux.Handle("/admin/member", &MemberRevisionsHandler{
+		admingroup:           org.GetAuthGroup(),
+		auth:                 authenticator,
+		database:             db,
+		uniqueMemberTemplate: unique_member_detail_template,
+	})
+
+	mux.Handle("/admin", &TotalListHandler{
+		admingroup:           org.GetAuthGroup(),
 		auth:                 authenticator,
 		database:             db,
-		pagesize:             config.GetResultPageSize(),
+		pagesize:             cfg.GetResultPageSize(),
 		template:             memberlist_tmpl,
 		uniqueMemberTemplate: unique_member_detail_template,
 	})
 
-	http.HandleFunc("/barcode", MakeBarcode)
+	mux.HandleFunc("/barcode", MakeBarcode)
 
 	// Takeout related handlers
-	http.Handle("/takeout", &TakeoutOverviewHandler{
+	mux.Handle("/takeout", &TakeoutOverviewHandler{
 		auth:                 authenticator,
 		database:             db,
 		uniqueMemberTemplate: unique_member_detail_template,
 	})
 
-	http.Handle("/takeout/pdf", &TakeoutPDFDownloadHandler{
+	mux.Handle("/takeout/pdf", &TakeoutPDFDownloadHandler{
 		auth:     authenticator,
 		database: db,
 	})
 
-	http.Handle("/takeout/vcf", &TakeoutVCFDownloadHandler{
+	mux.Handle("/takeout/vcf", &TakeoutVCFDownloadHandler{
 		auth:        authenticator,
 		database:    db,
 		vcfTemplate: vcf_template,
 	})
 
-	http.Handle("/", &FormInputHandler{
-		applicationTmpl: application_tmpl,
-		database:        db,
-		passthrough:     http.FileServer(http.Dir(config.GetTemplateDir())),
-		printTmpl:       print_tmpl,
-		useProxyRealIP:  config.GetUseProxyRealIp(),
+	mux.Handle("/", &FormInputHandler{
+		applicationTmpls: application_tmpls,
+		database:         db,
+		fees:             org.Fees,
+		form:             org.Form,
+		passthrough:      http.FileServer(http.Dir(org.GetTemplateDir())),
+		printTmpls:       print_tmpls,
+		useProxyRealIP:   cfg.GetUseProxyRealIp(),
+		verifier:         verifier,
 	})
 
+	return mux, nil
+}
+
+func main() {
+	var help bool
+	var bindto, config_file string
+	var config_contents []byte
+	var debug_authenticator bool
+	var orgs []*config.OrganisationConfig
+	var org *config.OrganisationConfig
+	var config config.MembersysConfig
+	var mux = &organisationMux{hosts: make(map[string]http.Handler)}
+	var err error
+
+	flag.BoolVar(&help, "help", false, "Display help")
+	flag.StringVar(&bindto, "bind", "127.0.0.1:8080",
+		"The address to bind the web server to")
+	flag.StringVar(&config_file, "config", "",
+		"Path to a file containing a MembersysConfig protocol buffer")
+	flag.BoolVar(&debug_authenticator, "debug-authenticator", false,
+		"Debug the authenticator?")
+	flag.Parse()
+
+	if help || config_file == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	config_contents, err = ioutil.ReadFile(config_file)
+	if err != nil {
+		log.Fatal("Unable to read ", config_file, ": ", err)
+	}
+	err = proto.Unmarshal(config_contents, &config)
+	if err != nil {
+		err = proto.UnmarshalText(string(config_contents), &config)
+	}
+	if err != nil {
+		log.Fatal("Error parsing ", config_file, ": ", err)
+	}
+
+	if orgs, err = membersys.Organisations(&config); err != nil {
+		log.Fatal("Error in the organisation configuration: ", err)
+	}
+
+	for _, org = range orgs {
+		var handler http.Handler
+		var host string
+
+		handler, err = newOrganisationHandler(&config, org,
+			debug_authenticator)
+		if err != nil {
+			log.Fatal("Error setting up organisation ", org.GetName(),
+				": ", err)
+		}
+
+		for _, host = range org.HostName {
+			mux.hosts[strings.ToLower(host)] = handler
+		}
+		if len(orgs) == 1 {
+			mux.fallback = handler
+		}
+	}
+
+	http.Handle("/", mux)
+
 	err = http.ListenAndServe(bindto, nil)
 	if err != nil {
 		log.Fatal("ListenAndServe: ", err)
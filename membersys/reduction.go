@@ -0,0 +1,192 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"ancient-solutions.com/ancientauth"
+	"github.com/starshipfactory/membersys"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+var feeReductionDecisionURL *url.URL
+
+func init() {
+	var err error
+	feeReductionDecisionURL, err = url.Parse("/admin/api/decide-reduction")
+	if err != nil {
+		log.Fatal("Error parsing static reduction decision URL: ", err)
+	}
+}
+
+// Object for approving or denying fee reductions requested along with
+// membership applications.
+type FeeReductionDecisionHandler struct {
+	admingroup     string
+	auth           *ancientauth.Authenticator
+	database       membersys.MembershipStore
+	useProxyRealIP bool
+}
+
+// Record the decision about the fee reduction requested by the applicant
+// "uuid". "decision" is either "approve" or "deny"; approved reductions
+// apply until "valid_until" (YYYY-MM-DD), if given.
+func (m *FeeReductionDecisionHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var user string = m.auth.GetAuthenticatedUser(req)
+	var id string = req.PostFormValue("uuid")
+	var approved bool
+	var valid_until uint64
+	var ok bool
+	var err error
+
+	if user == "" {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if len(m.admingroup) > 0 && !m.auth.IsAuthenticatedScope(req, m.admingroup) {
+		rw.WriteHeader(http.StatusForbidden)
+		rw.Write([]byte("User not authorized for this service"))
+		return
+	}
+
+	ok, err = m.auth.VerifyCSRFToken(req, req.PostFormValue("csrf_token"), false)
+	if err != nil && err != ancientauth.CSRFToken_WeakProtectionError {
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte(err.Error()))
+		log.Print("Error verifying CSRF token: ", err)
+		return
+	}
+	if !ok {
+		rw.WriteHeader(http.StatusForbidden)
+		rw.Write([]byte("CSRF token validation failed"))
+		log.Print("Invalid CSRF token reveived")
+		return
+	}
+
+	if req.PostFormValue("decision") == "approve" {
+		approved = true
+	} else if req.PostFormValue("decision") != "deny" {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte("Unknown decision: " + req.PostFormValue("decision")))
+		return
+	}
+
+	if approved && len(req.PostFormValue("valid_until")) > 0 {
+		var until time.Time
+		until, err = time.Parse("2006-01-02", req.PostFormValue("valid_until"))
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte("Unable to parse the end of validity: " +
+				err.Error()))
+			return
+		}
+		valid_until = uint64(until.Unix())
+	}
+
+	err = m.database.DecideFeeReduction(req.Context(), id, approved,
+		valid_until, req.PostFormValue("comment"),
+		requestActor(req, user, m.useProxyRealIP))
+	if grpc.Code(err) == codes.FailedPrecondition {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(err.Error()))
+		return
+	} else if err != nil {
+		log.Print("Error recording the reduction decision for ", id, ": ",
+			err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("{}"))
+}
+
+// Handler object for downloading the documents supporting fee reduction
+// requests.
+type FeeReductionDocumentHandler struct {
+	admingroup string
+	auth       *ancientauth.Authenticator
+	database   membersys.MembershipStore
+}
+
+// Serve the document supporting the fee reduction request of the
+// applicant "uuid", or of the member "email".
+func (m *FeeReductionDocumentHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var agreement *membersys.MembershipAgreement
+	var document []byte
+	var err error
+
+	if !m.auth.IsAuthenticatedScope(req, m.admingroup) {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if len(req.FormValue("uuid")) > 0 {
+		agreement, _, err = m.database.GetMembershipRequest(req.Context(),
+			req.FormValue("uuid"), "application", "applicant:")
+	} else {
+		agreement, _, err = m.database.GetMemberDetail(req.Context(),
+			req.FormValue("email"))
+	}
+	if err == nil {
+		document, err = m.database.GetFeeReductionDocument(req.Context(),
+			agreement)
+	}
+	if grpc.Code(err) == codes.NotFound {
+		rw.Header().Set("Content-type", "text/plain; charset=utf-8")
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte("No supporting document found"))
+		return
+	} else if err != nil {
+		log.Print("Can't get reduction document: ", err)
+		rw.Header().Set("Content-type", "text/plain; charset=utf-8")
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Error retrieving the supporting document"))
+		return
+	}
+
+	// The document has been uploaded by the applicant, so browsers must
+	// not second-guess its type.
+	rw.Header().Set("Content-type",
+		agreement.GetFeeReduction().GetDocumentType())
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(http.StatusOK)
+
+	rw.Write(document)
+}
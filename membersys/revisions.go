@@ -0,0 +1,234 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"ancient-solutions.com/ancientauth"
+	"github.com/starshipfactory/membersys"
+)
+
+// Data for the member detail template. Members looking at their own data
+// only get the member data; admins also get the previous revisions of the
+// record.
+type memberDetailPage struct {
+	*membersys.Member
+
+	// Fee reduction requested by the member, and the decision about it.
+	FeeReduction *membersys.FeeReduction
+
+	// Consents given and additional questions answered on the membership
+	// form.
+	Metadata *membersys.MembershipMetadata
+
+	Admin           bool
+	Version         int64
+	Revisions       []*memberRevisionView
+	RevertCsrfToken string
+}
+
+// A previous revision of a member record, along with the changes which
+// replaced it.
+type memberRevisionView struct {
+	Version  int64
+	Replaced string
+	Changes  []*membersys.FieldDiff
+}
+
+var memberRevertURL *url.URL
+
+func init() {
+	var err error
+	memberRevertURL, err = url.Parse("/admin/api/revert")
+	if err != nil {
+		log.Fatal("Error parsing member revert URL: ", err)
+	}
+}
+
+// Display the details of a member to an admin, along with the previous
+// revisions of the record.
+type MemberRevisionsHandler struct {
+	admingroup           string
+	auth                 *ancientauth.Authenticator
+	database             membersys.MembershipStore
+	uniqueMemberTemplate *template.Template
+}
+
+func (m *MemberRevisionsHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var memberid string = req.FormValue("email")
+	var agreement *membersys.MembershipAgreement
+	var revisions []*membersys.MemberRevision
+	var revision *membersys.MemberRevision
+	var after *membersys.Member
+	var page memberDetailPage
+	var err error
+
+	if m.auth.GetAuthenticatedUser(req) == "" {
+		m.auth.RequestAuthorization(rw, req)
+		return
+	}
+
+	if !m.auth.IsAuthenticatedScope(req, m.admingroup) {
+		rw.WriteHeader(http.StatusForbidden)
+		rw.Write([]byte("User not authorized for this service"))
+		return
+	}
+
+	if len(memberid) == 0 {
+		rw.WriteHeader(http.StatusLengthRequired)
+		rw.Write([]byte("No email given"))
+		return
+	}
+
+	agreement, page.Version, err = m.database.GetMemberDetail(req.Context(),
+		memberid)
+	if err != nil {
+		log.Print("Error fetching member details of ", memberid, ": ", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Error fetching member details: " + err.Error()))
+		return
+	}
+
+	revisions, err = m.database.GetMemberRevisions(req.Context(), memberid)
+	if err != nil {
+		log.Print("Error fetching revisions of ", memberid, ": ", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Error fetching revisions: " + err.Error()))
+		return
+	}
+
+	page.Member = agreement.GetMemberData()
+	page.FeeReduction = agreement.GetFeeReduction()
+	page.Metadata = agreement.GetMetadata()
+	page.Admin = true
+
+	// Each revision was replaced by the one before it in the list, or by
+	// the current record for the newest one.
+	after = agreement.GetMemberData()
+	for _, revision = range revisions {
+		page.Revisions = append(page.Revisions, &memberRevisionView{
+			Version: revision.Version,
+			Replaced: time.Unix(0, revision.Version).Format(
+				"2006-01-02 15:04:05"),
+			Changes: membersys.DiffMembers(
+				revision.Agreement.GetMemberData(), after),
+		})
+		after = revision.Agreement.GetMemberData()
+	}
+
+	page.RevertCsrfToken, err = m.auth.GenCSRFToken(req, memberRevertURL,
+		10*time.Minute)
+	if err != nil {
+		log.Print("Error generating member revert CSRF token: ", err)
+	}
+
+	err = m.uniqueMemberTemplate.ExecuteTemplate(rw, "memberdetail.html",
+		page)
+	if err != nil {
+		log.Print("Can't run membership detail template: ", err)
+	}
+}
+
+// Restore a member record to a previous revision.
+type MemberRevertHandler struct {
+	admingroup     string
+	auth           *ancientauth.Authenticator
+	database       membersys.MembershipStore
+	useProxyRealIP bool
+}
+
+func (m *MemberRevertHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var user string = m.auth.GetAuthenticatedUser(req)
+	var memberid string = req.PostFormValue("email")
+	var revision, version int64
+	var ok bool
+	var err error
+
+	if user == "" {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if len(m.admingroup) > 0 && !m.auth.IsAuthenticatedScope(req, m.admingroup) {
+		rw.WriteHeader(http.StatusForbidden)
+		rw.Write([]byte("User not authorized for this service"))
+		return
+	}
+
+	ok, err = m.auth.VerifyCSRFToken(req, req.PostFormValue("csrf_token"), false)
+	if err != nil && err != ancientauth.CSRFToken_WeakProtectionError {
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte(err.Error()))
+		log.Print("Error verifying CSRF token: ", err)
+		return
+	}
+	if !ok {
+		rw.WriteHeader(http.StatusForbidden)
+		rw.Write([]byte("CSRF token validation failed"))
+		log.Print("Invalid CSRF token reveived")
+		return
+	}
+
+	if len(memberid) == 0 {
+		rw.WriteHeader(http.StatusLengthRequired)
+		rw.Write([]byte("No email given"))
+		return
+	}
+
+	revision, err = strconv.ParseInt(req.PostFormValue("revision"), 10, 64)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte("Invalid revision: " + err.Error()))
+		return
+	}
+
+	version, err = parseMemberVersion(req)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte("Invalid record version: " + err.Error()))
+		return
+	}
+
+	version, err = membersys.RevertMember(req.Context(), m.database,
+		memberid, revision, version, requestActor(req, user, m.useProxyRealIP))
+	if err != nil {
+		log.Print("Error reverting ", memberid, " to revision ", revision,
+			": ", err)
+	}
+	writeMemberUpdateResult(rw, version, err)
+}
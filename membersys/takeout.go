@@ -39,12 +39,14 @@ import (
 
 	"ancient-solutions.com/ancientauth"
 	"github.com/starshipfactory/membersys"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 )
 
 // Handler object for displaying user takeout data.
 type TakeoutOverviewHandler struct {
 	auth                 *ancientauth.Authenticator
-	database             *membersys.MembershipDB
+	database             membersys.MembershipStore
 	uniqueMemberTemplate *template.Template
 }
 
@@ -59,7 +61,7 @@ func (m *TakeoutOverviewHandler) ServeHTTP(rw http.ResponseWriter, req *http.Req
 		return
 	}
 
-	agreement, err = m.database.GetMemberDetailByUsername(user)
+	agreement, err = m.database.GetMemberDetailByUsername(req.Context(), user)
 	if err != nil {
 		log.Print("Can't get membership agreement for ", user, ": ", err)
 		rw.Header().Set("Content-type", "text/plain; charset=utf-8")
@@ -69,7 +71,11 @@ func (m *TakeoutOverviewHandler) ServeHTTP(rw http.ResponseWriter, req *http.Req
 	}
 
 	err = m.uniqueMemberTemplate.ExecuteTemplate(rw, "memberdetail.html",
-		agreement.GetMemberData())
+		&memberDetailPage{
+			Member:       agreement.GetMemberData(),
+			FeeReduction: agreement.GetFeeReduction(),
+			Metadata:     agreement.GetMetadata(),
+		})
 	if err != nil {
 		log.Print("Can't run membership detail template: ", err)
 	}
@@ -78,13 +84,14 @@ func (m *TakeoutOverviewHandler) ServeHTTP(rw http.ResponseWriter, req *http.Req
 // Handler object for downloading the membership agreement PDF.
 type TakeoutPDFDownloadHandler struct {
 	auth     *ancientauth.Authenticator
-	database *membersys.MembershipDB
+	database membersys.MembershipStore
 }
 
 // Serve the membership agreement PDF of the requestor.
 func (m *TakeoutPDFDownloadHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	var agreement *membersys.MembershipAgreement
 	var user string
+	var pdf []byte
 	var err error
 
 	if user = m.auth.GetAuthenticatedUser(req); user == "" {
@@ -92,7 +99,7 @@ func (m *TakeoutPDFDownloadHandler) ServeHTTP(rw http.ResponseWriter, req *http.
 		return
 	}
 
-	agreement, err = m.database.GetMemberDetailByUsername(user)
+	agreement, err = m.database.GetMemberDetailByUsername(req.Context(), user)
 	if err != nil {
 		log.Print("Can't get membership agreement for ", user, ": ", err)
 		rw.Header().Set("Content-type", "text/plain; charset=utf-8")
@@ -101,23 +108,30 @@ func (m *TakeoutPDFDownloadHandler) ServeHTTP(rw http.ResponseWriter, req *http.
 		return
 	}
 
-	if len(agreement.AgreementPdf) == 0 {
+	pdf, err = m.database.GetAgreementPdf(req.Context(), agreement)
+	if grpc.Code(err) == codes.NotFound {
 		rw.Header().Set("Content-type", "text/plain; charset=utf-8")
 		rw.WriteHeader(http.StatusNotFound)
 		rw.Write([]byte("Agreement PDF not found for " + user))
 		return
+	} else if err != nil {
+		log.Print("Can't get agreement PDF for ", user, ": ", err)
+		rw.Header().Set("Content-type", "text/plain; charset=utf-8")
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Error retrieving membership agreement PDF"))
+		return
 	}
 
 	rw.Header().Set("Content-type", "application/pdf")
 	rw.WriteHeader(http.StatusOK)
 
-	rw.Write(agreement.AgreementPdf)
+	rw.Write(pdf)
 }
 
 // Handler object for downloading the user data as VCF.
 type TakeoutVCFDownloadHandler struct {
 	auth        *ancientauth.Authenticator
-	database    *membersys.MembershipDB
+	database    membersys.MembershipStore
 	vcfTemplate *textTemplate.Template
 }
 
@@ -132,7 +146,7 @@ func (m *TakeoutVCFDownloadHandler) ServeHTTP(rw http.ResponseWriter, req *http.
 		return
 	}
 
-	agreement, err = m.database.GetMemberDetailByUsername(user)
+	agreement, err = m.database.GetMemberDetailByUsername(req.Context(), user)
 	if err != nil {
 		log.Print("Can't get membership agreement for ", user, ": ", err)
 		rw.Header().Set("Content-type", "text/plain; charset=utf-8")
@@ -37,18 +37,35 @@ import (
 	"github.com/starshipfactory/membersys"
 	"log"
 	"net/http"
+	"net/url"
+	"time"
 )
 
+type trashListType struct {
+	Trashed   []*membersys.MemberWithKey `json:"trashed"`
+	CsrfToken string                     `json:"csrf_token"`
+}
+
+var trashRestoreURL *url.URL
+
+func init() {
+	var err error
+	trashRestoreURL, err = url.Parse("/admin/api/restore")
+	if err != nil {
+		log.Fatal("Error parsing trash restore URL: ", err)
+	}
+}
+
 // Object for displaying a list of deleted members.
 type MemberTrashListHandler struct {
 	admingroup string
 	auth       *ancientauth.Authenticator
-	database   *membersys.MembershipDB
+	database   membersys.MembershipStore
 	pagesize   int32
 }
 
 func (m *MemberTrashListHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	var memberlist []*membersys.MemberWithKey
+	var memberlist trashListType
 	var enc *json.Encoder
 	var err error
 
@@ -57,8 +74,9 @@ func (m *MemberTrashListHandler) ServeHTTP(rw http.ResponseWriter, req *http.Req
 		return
 	}
 
-	memberlist, err = m.database.EnumerateTrashedMembers(
-		req.FormValue("start"), m.pagesize)
+	memberlist.Trashed, err = m.database.EnumerateTrashedMembers(
+		req.Context(), req.FormValue("criterion"), req.FormValue("start"),
+		m.pagesize)
 	if err != nil {
 		log.Print("Error enumerating trashed members: ", err)
 		rw.WriteHeader(http.StatusInternalServerError)
@@ -66,6 +84,15 @@ func (m *MemberTrashListHandler) ServeHTTP(rw http.ResponseWriter, req *http.Req
 		return
 	}
 
+	memberlist.CsrfToken, err = m.auth.GenCSRFToken(req, trashRestoreURL,
+		10*time.Minute)
+	if err != nil {
+		log.Print("Error generating CSRF token: ", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Error generating CSRF token: " + err.Error()))
+		return
+	}
+
 	rw.Header().Set("Content-Type", "application/json; encoding=utf8")
 	enc = json.NewEncoder(rw)
 	if err = enc.Encode(memberlist); err != nil {
@@ -75,3 +102,55 @@ func (m *MemberTrashListHandler) ServeHTTP(rw http.ResponseWriter, req *http.Req
 		return
 	}
 }
+
+// Object for restoring records from the trash.
+type MemberRestoreHandler struct {
+	admingroup     string
+	auth           *ancientauth.Authenticator
+	database       membersys.MembershipStore
+	useProxyRealIP bool
+}
+
+func (m *MemberRestoreHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var user string = m.auth.GetAuthenticatedUser(req)
+	var id string = req.PostFormValue("uuid")
+	var ok bool
+	var err error
+
+	if user == "" {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if len(m.admingroup) > 0 && !m.auth.IsAuthenticatedScope(req, m.admingroup) {
+		rw.WriteHeader(http.StatusForbidden)
+		rw.Write([]byte("User not authorized for this service"))
+		return
+	}
+
+	ok, err = m.auth.VerifyCSRFToken(req, req.PostFormValue("csrf_token"), false)
+	if err != nil && err != ancientauth.CSRFToken_WeakProtectionError {
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte(err.Error()))
+		log.Print("Error verifying CSRF token: ", err)
+		return
+	}
+	if !ok {
+		rw.WriteHeader(http.StatusForbidden)
+		rw.Write([]byte("CSRF token validation failed"))
+		log.Print("Invalid CSRF token reveived")
+		return
+	}
+
+	err = m.database.RestoreArchivedRecord(req.Context(), id,
+		requestActor(req, user, m.useProxyRealIP))
+	if err != nil {
+		log.Print("Error restoring ", id, " from the trash: ", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("{}"))
+}
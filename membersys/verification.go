@@ -0,0 +1,229 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"expvar"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"ancient-solutions.com/ancientauth"
+	"github.com/starshipfactory/membersys"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+var numVerified *expvar.Int = expvar.NewInt("num-email-verifications")
+
+var verificationResendURL *url.URL
+
+func init() {
+	var err error
+	verificationResendURL, err = url.Parse("/admin/api/resend-verification")
+	if err != nil {
+		log.Fatal("Error parsing static verification resend URL: ", err)
+	}
+}
+
+// Data for the page shown after following a verification link. Valid
+// links first show a button confirming the address, which sends the
+// parameters of the link back.
+type verificationPage struct {
+	Language string
+	Verified bool
+	Confirm  bool
+	Error    string
+	Email    string
+	Id       string
+	Expires  string
+	Token    string
+}
+
+// Handler for the links applicants are mailed to verify their e-mail
+// address with.
+type EmailVerificationHandler struct {
+	database       membersys.MembershipStore
+	verifier       *membersys.EmailVerifier
+	tmpls          map[string]*template.Template
+	useProxyRealIP bool
+}
+
+// Check the link and ask the applicant to confirm the e-mail address of
+// the application "id". Only the confirmation, which is posted, marks the
+// address as verified, so mail scanners and link previews fetching the
+// link don't verify it on behalf of the applicant. Following a link again
+// after it has been used just shows that the address is verified.
+func (v *EmailVerificationHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var id string = req.FormValue("id")
+	var agreement *membersys.MembershipAgreement
+	var page = verificationPage{
+		Id:      id,
+		Expires: req.FormValue("expires"),
+		Token:   req.FormValue("token"),
+	}
+	var email string
+	var expires int64
+	var err error
+
+	page.Language = membersys.SelectLanguage(req.FormValue("lang"),
+		req.Header.Get("Accept-Language"))
+
+	expires, err = strconv.ParseInt(req.FormValue("expires"), 10, 64)
+	if err != nil {
+		err = grpc.Errorf(codes.PermissionDenied, "Invalid expiry: %s", err)
+	} else {
+		agreement, _, err = v.database.GetMembershipRequest(req.Context(),
+			id, "application", "applicant:")
+	}
+	if err == nil {
+		email = agreement.GetMemberData().GetEmail()
+		if agreement.GetMetadata().GetLanguage() != "" {
+			page.Language = agreement.GetMetadata().GetLanguage()
+		}
+		err = v.verifier.CheckToken(id, email, expires,
+			req.FormValue("token"), time.Now())
+	}
+	if err == nil && req.Method == http.MethodPost {
+		err = v.database.VerifyApplicationEmail(req.Context(), id, email,
+			requestActor(req, email, v.useProxyRealIP))
+		if err == nil {
+			numVerified.Add(1)
+		}
+	} else if err == nil && !agreement.GetMemberData().GetEmailVerified() {
+		page.Confirm = true
+		page.Email = email
+	}
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err == nil {
+		page.Verified = !page.Confirm
+	} else if grpc.Code(err) == codes.AlreadyExists {
+		page.Verified = true
+	} else if grpc.Code(err) == codes.DeadlineExceeded {
+		rw.WriteHeader(http.StatusForbidden)
+		page.Error = membersys.Message(page.Language,
+			"verification-link-expired")
+	} else if grpc.Code(err) == codes.FailedPrecondition {
+		rw.WriteHeader(http.StatusForbidden)
+		page.Error = membersys.Message(page.Language,
+			"verification-address-changed")
+	} else if grpc.Code(err) == codes.PermissionDenied ||
+		grpc.Code(err) == codes.NotFound {
+		rw.WriteHeader(http.StatusForbidden)
+		page.Error = membersys.Message(page.Language,
+			"verification-link-invalid")
+	} else {
+		log.Print("Error verifying the e-mail address of ", id, ": ", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		page.Error = membersys.Message(page.Language, "verification-failed")
+	}
+
+	err = localizedTemplate(v.tmpls, page.Language).Execute(rw, page)
+	if err != nil {
+		log.Print("Error executing verification template: ", err)
+	}
+}
+
+// Object for sending the verification mail to an applicant again, e.g.
+// because the link has expired.
+type VerificationResendHandler struct {
+	admingroup string
+	auth       *ancientauth.Authenticator
+	database   membersys.MembershipStore
+	verifier   *membersys.EmailVerifier
+}
+
+// Send a new verification link to the e-mail address of the applicant
+// "uuid".
+func (m *VerificationResendHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var user string = m.auth.GetAuthenticatedUser(req)
+	var id string = req.PostFormValue("uuid")
+	var agreement *membersys.MembershipAgreement
+	var ok bool
+	var err error
+
+	if user == "" {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if len(m.admingroup) > 0 && !m.auth.IsAuthenticatedScope(req, m.admingroup) {
+		rw.WriteHeader(http.StatusForbidden)
+		rw.Write([]byte("User not authorized for this service"))
+		return
+	}
+
+	ok, err = m.auth.VerifyCSRFToken(req, req.PostFormValue("csrf_token"), false)
+	if err != nil && err != ancientauth.CSRFToken_WeakProtectionError {
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte(err.Error()))
+		log.Print("Error verifying CSRF token: ", err)
+		return
+	}
+	if !ok {
+		rw.WriteHeader(http.StatusForbidden)
+		rw.Write([]byte("CSRF token validation failed"))
+		log.Print("Invalid CSRF token reveived")
+		return
+	}
+
+	agreement, _, err = m.database.GetMembershipRequest(req.Context(), id,
+		"application", "applicant:")
+	if err != nil {
+		log.Print("Error looking up application ", id, ": ", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	if agreement.GetMemberData().GetEmailVerified() {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte("The e-mail address has already been verified"))
+		return
+	}
+
+	err = m.verifier.SendMail(id, agreement.GetMemberData(),
+		agreement.GetMetadata().GetLanguage())
+	if err != nil {
+		log.Print("Error sending the verification mail for ", id, ": ", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("{}"))
+}
@@ -0,0 +1,153 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/membersys"
+	"github.com/starshipfactory/membersys/config"
+)
+
+func main() {
+	var db membersys.MembershipStore
+	var org *config.OrganisationConfig
+	var config config.MembersysConfig
+	var organisation string
+	var config_contents []byte
+	var config_path, output_path, key_path string
+	var out io.Writer = os.Stdout
+	var f *os.File
+	var key []byte
+	var compress bool
+	var help, verbose bool
+	var count int
+	var closeErr, err error
+
+	flag.BoolVar(&help, "help", false, "Display help")
+	flag.StringVar(&config_path, "config", "",
+		"Path to the membersys configuration file")
+	flag.StringVar(&organisation, "organisation", "",
+		"Name of the organisation to work on, if several are configured")
+	flag.StringVar(&output_path, "output", "-",
+		"File to write the backup to, or - for standard output")
+	flag.StringVar(&key_path, "key-file", "",
+		"File containing the key to encrypt the backup with, "+
+			"as 64 hexadecimal digits")
+	flag.BoolVar(&compress, "compress", false,
+		"Whether or not to compress the backup using gzip")
+	flag.BoolVar(&verbose, "verbose", false,
+		"Whether or not to display verbose messages")
+	flag.Parse()
+
+	if help || config_path == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if key_path != "" {
+		if key, err = membersys.ReadKeyFile(key_path); err != nil {
+			log.Fatal("Unable to read key from ", key_path, ": ", err)
+		}
+	}
+
+	config_contents, err = ioutil.ReadFile(config_path)
+	if err != nil {
+		log.Fatal("Unable to read ", config_path, ": ", err)
+	}
+	err = proto.Unmarshal(config_contents, &config)
+	if err != nil {
+		err = proto.UnmarshalText(string(config_contents), &config)
+	}
+	if err != nil {
+		log.Fatal("Error parsing ", config_path, ": ", err)
+	}
+
+	org, err = membersys.FindOrganisation(&config, organisation)
+	if err != nil {
+		log.Fatal("Error selecting the organisation: ", err)
+	}
+
+	db, err = membersys.NewMembershipStore(org.DatabaseConfig,
+		time.Duration(org.DatabaseConfig.GetDatabaseTimeout())*time.Millisecond)
+	if err != nil {
+		log.Fatal("Unable to connect to the membership database ",
+			org.DatabaseConfig.GetDatabaseServer(), " at ",
+			org.DatabaseConfig.GetDatabaseName(), ": ", err)
+	}
+
+	if output_path != "-" {
+		// Write to a temporary file first, so the previous backup is
+		// only replaced once the new one is complete. TempFile creates
+		// the file readable only by the owner, which suits the
+		// personal data in the backup.
+		f, err = ioutil.TempFile(filepath.Dir(output_path),
+			"."+filepath.Base(output_path)+".")
+		if err != nil {
+			log.Fatal("Unable to create temporary file for ", output_path,
+				": ", err)
+		}
+		out = f
+	}
+
+	count, err = membersys.WriteBackup(context.Background(), db, out,
+		compress, key)
+	if f != nil {
+		if err == nil {
+			err = f.Sync()
+		}
+		if closeErr = f.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(f.Name(), output_path)
+		}
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}
+	if err != nil {
+		log.Fatal("Error writing backup after ", count, " records: ", err)
+	}
+
+	if verbose {
+		log.Print("Wrote ", count, " records")
+	}
+}
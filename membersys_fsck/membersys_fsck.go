@@ -0,0 +1,124 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/membersys"
+	"github.com/starshipfactory/membersys/config"
+)
+
+func main() {
+	var db *membersys.MembershipDB
+	var org *config.OrganisationConfig
+	var config_data config.MembersysConfig
+	var organisation string
+	var config_contents []byte
+	var config_path string
+	var help, repair bool
+	var found, repaired int
+	var err error
+
+	flag.BoolVar(&help, "help", false, "Display help")
+	flag.StringVar(&config_path, "config", "",
+		"Path to the membersys configuration file")
+	flag.StringVar(&organisation, "organisation", "",
+		"Name of the organisation to work on, if several are configured")
+	flag.BoolVar(&repair, "repair", false,
+		"Repair the problems which can be fixed from pb_data")
+	flag.Parse()
+
+	if help || config_path == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	config_contents, err = ioutil.ReadFile(config_path)
+	if err != nil {
+		log.Fatal("Unable to read ", config_path, ": ", err)
+	}
+	err = proto.Unmarshal(config_contents, &config_data)
+	if err != nil {
+		err = proto.UnmarshalText(string(config_contents), &config_data)
+	}
+	if err != nil {
+		log.Fatal("Error parsing ", config_path, ": ", err)
+	}
+
+	org, err = membersys.FindOrganisation(&config_data, organisation)
+	if err != nil {
+		log.Fatal("Error selecting the organisation: ", err)
+	}
+
+	if org.DatabaseConfig.GetDatabaseType() !=
+		config.DatabaseConfig_CASSANDRA {
+		log.Fatal("Only Cassandra keeps denormalised columns to check")
+	}
+
+	db, err = membersys.OpenMembershipDB(org.DatabaseConfig,
+		time.Duration(org.DatabaseConfig.GetDatabaseTimeout())*time.Millisecond)
+	if err != nil {
+		log.Fatal("Unable to connect to the membership database ",
+			org.DatabaseConfig.GetDatabaseServer(), " at ",
+			org.DatabaseConfig.GetDatabaseName(), ": ", err)
+	}
+
+	err = db.CheckConsistency(context.Background(), repair,
+		func(problem *membersys.ConsistencyProblem) error {
+			var status string
+
+			found++
+			if problem.Repaired {
+				repaired++
+				status = " (repaired)"
+			}
+			fmt.Printf("%s %s: %s%s\n", problem.Table, problem.Key,
+				problem.Description, status)
+			return nil
+		})
+	if err != nil {
+		log.Fatal("Error checking the database: ", err)
+	}
+
+	log.Print("Found ", found, " problems, repaired ", repaired)
+	if found > repaired {
+		os.Exit(1)
+	}
+}
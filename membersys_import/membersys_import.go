@@ -0,0 +1,505 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/membersys"
+	"github.com/starshipfactory/membersys/config"
+)
+
+// Format of the dates in the imported file.
+const dateFormat = "2006-01-02"
+
+// Fields which can be imported. Dates are given as YYYY-MM-DD, booleans
+// as yes/no, true/false, 1/0 or ja/nein.
+var fields = []string{
+	"name", "street", "city", "zipcode", "country", "email", "phone",
+	"username", "fee", "fee_yearly", "has_key", "approval_date",
+	"payments_caught_up_to", "comment", "reduction", "category",
+}
+
+// Parse the column mapping "spec", a comma separated list of
+// field=column pairs. Fields which aren't mentioned are read from the
+// column of the same name, if there is one.
+func parseMapping(spec string) (map[string]string, error) {
+	var mapping = make(map[string]string)
+	var field, pair string
+
+	for _, field = range fields {
+		mapping[field] = field
+	}
+	if spec == "" {
+		return mapping, nil
+	}
+
+	for _, pair = range strings.Split(spec, ",") {
+		var parts []string = strings.SplitN(pair, "=", 2)
+
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid mapping %s, should be "+
+				"field=column", pair)
+		}
+		if _, ok := mapping[parts[0]]; !ok {
+			return nil, fmt.Errorf("Unknown field %s", parts[0])
+		}
+		mapping[parts[0]] = parts[1]
+	}
+
+	return mapping, nil
+}
+
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "", "no", "false", "0", "nein":
+		return false, nil
+	case "yes", "true", "1", "ja":
+		return true, nil
+	}
+	return false, fmt.Errorf("Invalid boolean value %s", value)
+}
+
+func parseDate(value string) (*uint64, error) {
+	var t time.Time
+	var err error
+
+	if value == "" {
+		return nil, nil
+	}
+	if t, err = time.ParseInLocation(dateFormat, value, time.Local); err != nil {
+		return nil, err
+	}
+	return proto.Uint64(uint64(t.Unix())), nil
+}
+
+// Convert the CSV record "row" into a membership agreement. "get"
+// returns the value of a field in the row. Returns whether the member
+// has been granted a fee reduction along with it.
+func rowToAgreement(get func(field string) string, source, importer string,
+	now time.Time) (*membersys.MembershipAgreement, bool, error) {
+	var md = new(membersys.Member)
+	var metadata = &membersys.MembershipMetadata{
+		RequestTimestamp:  proto.Uint64(uint64(now.Unix())),
+		ApprovalTimestamp: proto.Uint64(uint64(now.Unix())),
+		ApproverUid:       proto.String(importer),
+		ImportSource:      proto.String(source),
+		ImporterUid:       proto.String(importer),
+	}
+	var field, value string
+	var approved *uint64
+	var reduction, yes bool
+	var fee uint64
+	var err error
+
+	// Text fields are only set if they have been given, so the required
+	// ones are reported as missing.
+	for _, field = range []string{"name", "street", "city", "zipcode",
+		"country", "email", "phone", "username", "category"} {
+		if value = strings.TrimSpace(get(field)); value == "" {
+			continue
+		}
+		switch field {
+		case "name":
+			md.Name = proto.String(value)
+		case "street":
+			md.Street = proto.String(value)
+		case "city":
+			md.City = proto.String(value)
+		case "zipcode":
+			md.Zipcode = proto.String(value)
+		case "country":
+			md.Country = proto.String(value)
+		case "email":
+			md.Email = proto.String(value)
+		case "phone":
+			md.Phone = proto.String(value)
+		case "username":
+			md.Username = proto.String(strings.ToLower(value))
+		case "category":
+			md.Category = proto.String(value)
+		}
+	}
+
+	if value = strings.TrimSpace(get("fee")); value != "" {
+		if fee, err = strconv.ParseUint(value, 10, 64); err != nil {
+			return nil, false, fmt.Errorf("Invalid fee %s, expected a "+
+				"whole amount", value)
+		}
+		md.Fee = proto.Uint64(fee)
+	}
+	if yes, err = parseBool(get("fee_yearly")); err != nil {
+		return nil, false, err
+	}
+	md.FeeYearly = proto.Bool(yes)
+	if yes, err = parseBool(get("has_key")); err != nil {
+		return nil, false, err
+	}
+	md.HasKey = proto.Bool(yes)
+	if reduction, err = parseBool(get("reduction")); err != nil {
+		return nil, false, err
+	}
+
+	md.PaymentsCaughtUpTo, err = parseDate(get("payments_caught_up_to"))
+	if err != nil {
+		return nil, false, err
+	}
+	if approved, err = parseDate(get("approval_date")); err != nil {
+		return nil, false, err
+	}
+	if approved != nil {
+		metadata.ApprovalTimestamp = approved
+	}
+	if value = get("comment"); value != "" {
+		metadata.Comment = proto.String(value)
+	}
+
+	return &membersys.MembershipAgreement{
+		MemberData: md,
+		Metadata:   metadata,
+	}, reduction, nil
+}
+
+// Record the e-mail address and user name of "md" as taken by "what" in
+// "emails" and "usernames".
+func takeNames(emails, usernames map[string]string, md *membersys.Member,
+	what string) {
+	if md.GetEmail() != "" {
+		emails[strings.ToLower(md.GetEmail())] = what
+	}
+	if md.GetUsername() != "" {
+		usernames[md.GetUsername()] = what
+	}
+}
+
+// Call "fn" for every member in "db".
+func enumerateMembers(ctx context.Context, db membersys.MembershipStore,
+	fn func(*membersys.Member)) error {
+	var prev string
+
+	for {
+		var members []*membersys.Member
+		var member *membersys.Member
+		var err error
+
+		members, err = db.EnumerateMembers(ctx, nil, prev, 100)
+		if err != nil {
+			return err
+		}
+		if len(members) == 0 {
+			return nil
+		}
+
+		for _, member = range members {
+			fn(member)
+			prev = strconv.FormatUint(member.GetId(), 10) + "\000"
+		}
+	}
+}
+
+// Call "fn" for every record listed by "enumerate", which lists the
+// records beginning at and including "prev".
+func enumerateRecords(ctx context.Context,
+	enumerate func(ctx context.Context, criterion, prev string,
+		num int32) ([]*membersys.MemberWithKey, error),
+	fn func(*membersys.MemberWithKey)) error {
+	var prev string
+
+	for {
+		var records []*membersys.MemberWithKey
+		var record *membersys.MemberWithKey
+		var count int
+		var err error
+
+		if records, err = enumerate(ctx, "", prev, 100); err != nil {
+			return err
+		}
+
+		for _, record = range records {
+			if record.Key == prev {
+				continue
+			}
+			fn(record)
+			prev = record.Key
+			count++
+		}
+		if count == 0 {
+			return nil
+		}
+	}
+}
+
+func main() {
+	var db membersys.MembershipStore
+	var org *config.OrganisationConfig
+	var config config.MembersysConfig
+	var organisation string
+	var ctx context.Context = context.Background()
+	var now time.Time = time.Now()
+	var emails = make(map[string]string)
+	var usernames = make(map[string]string)
+	var mapping map[string]string
+	var columns = make(map[string]int)
+	var header []string
+	var reader *csv.Reader
+	var in *os.File
+	var actor *membersys.Actor
+	var config_contents []byte
+	var config_path, input_path, mapping_spec string
+	var source, importer, delimiter string
+	var help, dry_run bool
+	var i, line, imported, failed int
+	var err error
+
+	flag.BoolVar(&help, "help", false, "Display help")
+	flag.StringVar(&config_path, "config", "",
+		"Path to the membersys configuration file")
+	flag.StringVar(&organisation, "organisation", "",
+		"Name of the organisation to work on, if several are configured")
+	flag.StringVar(&input_path, "input", "",
+		"CSV file to import the members from")
+	flag.StringVar(&mapping_spec, "mapping", "",
+		"Comma separated list of field=column pairs naming the CSV "+
+			"columns to read the fields from. Fields: "+
+			strings.Join(fields, ", "))
+	flag.StringVar(&delimiter, "delimiter", ",",
+		"Character separating the columns of the CSV file")
+	flag.StringVar(&source, "source", "",
+		"Import source to record in the members records "+
+			"(default: name of the input file)")
+	flag.StringVar(&importer, "importer", "",
+		"User name to record as having imported the members "+
+			"(default: the current user)")
+	flag.BoolVar(&dry_run, "dry-run", false,
+		"Only report what would be imported, without changing anything")
+	flag.Parse()
+
+	if help || config_path == "" || input_path == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if mapping, err = parseMapping(mapping_spec); err != nil {
+		log.Fatal("Error parsing --mapping: ", err)
+	}
+	if len([]rune(delimiter)) != 1 {
+		log.Fatal("--delimiter must be a single character")
+	}
+	if source == "" {
+		source = filepath.Base(input_path)
+	}
+	if importer == "" {
+		var u *user.User
+
+		if u, err = user.Current(); err != nil {
+			log.Fatal("Unable to determine the current user: ", err)
+		}
+		importer = u.Username
+	}
+	actor = &membersys.Actor{User: importer}
+
+	config_contents, err = ioutil.ReadFile(config_path)
+	if err != nil {
+		log.Fatal("Unable to read ", config_path, ": ", err)
+	}
+	err = proto.Unmarshal(config_contents, &config)
+	if err != nil {
+		err = proto.UnmarshalText(string(config_contents), &config)
+	}
+	if err != nil {
+		log.Fatal("Error parsing ", config_path, ": ", err)
+	}
+
+	org, err = membersys.FindOrganisation(&config, organisation)
+	if err != nil {
+		log.Fatal("Error selecting the organisation: ", err)
+	}
+
+	db, err = membersys.NewMembershipStore(org.DatabaseConfig,
+		time.Duration(org.DatabaseConfig.GetDatabaseTimeout())*time.Millisecond)
+	if err != nil {
+		log.Fatal("Unable to connect to the membership database ",
+			org.DatabaseConfig.GetDatabaseServer(), " at ",
+			org.DatabaseConfig.GetDatabaseName(), ": ", err)
+	}
+
+	// Collect the e-mail addresses and user names already taken by
+	// members, applicants and queued members.
+	err = enumerateMembers(ctx, db, func(md *membersys.Member) {
+		takeNames(emails, usernames, md,
+			fmt.Sprintf("member %d", md.GetId()))
+	})
+	if err == nil {
+		err = enumerateRecords(ctx, db.EnumerateMembershipRequests,
+			func(record *membersys.MemberWithKey) {
+				takeNames(emails, usernames, &record.Member,
+					"applicant "+record.Key)
+			})
+	}
+	if err == nil {
+		err = enumerateRecords(ctx, db.EnumerateQueuedMembers,
+			func(record *membersys.MemberWithKey) {
+				takeNames(emails, usernames, &record.Member,
+					"queued member "+record.Key)
+			})
+	}
+	if err != nil {
+		log.Fatal("Error reading the existing records: ", err)
+	}
+
+	if in, err = os.Open(input_path); err != nil {
+		log.Fatal("Unable to open ", input_path, ": ", err)
+	}
+	defer in.Close()
+
+	reader = csv.NewReader(in)
+	reader.Comma = []rune(delimiter)[0]
+	if header, err = reader.Read(); err != nil {
+		log.Fatal("Error reading the header of ", input_path, ": ", err)
+	}
+	for i = range header {
+		columns[strings.TrimSpace(header[i])] = i
+	}
+	if _, ok := columns[mapping["email"]]; !ok {
+		log.Fatal("No column ", mapping["email"], " for the e-mail "+
+			"address in ", input_path)
+	}
+
+	for line = 2; ; line++ {
+		var agreement *membersys.MembershipAgreement
+		var md *membersys.Member
+		var row []string
+		var problems []string
+		var errs map[string]*membersys.ValidationError
+		var field, email string
+		var reduction bool
+
+		row, err = reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Fatal("Error reading ", input_path, ": ", err)
+		}
+
+		agreement, reduction, err = rowToAgreement(func(field string) string {
+			var column int
+			var ok bool
+
+			column, ok = columns[mapping[field]]
+			if !ok || column >= len(row) {
+				return ""
+			}
+			return row[column]
+		}, source, importer, now)
+		if err != nil {
+			fmt.Printf("line %d: %s\n", line, err)
+			failed++
+			continue
+		}
+		md = agreement.GetMemberData()
+		email = strings.ToLower(md.GetEmail())
+
+		errs = membersys.ValidateMember(md, org.Fees, reduction)
+		for field = range errs {
+			problems = append(problems, field+": "+
+				errs[field].Message(membersys.DefaultLanguage))
+		}
+		sort.Strings(problems)
+		if what, ok := emails[email]; ok && email != "" {
+			problems = append(problems, "E-mail address "+md.GetEmail()+
+				" already used by "+what)
+		}
+		if what, ok := usernames[md.GetUsername()]; ok && md.Username != nil {
+			problems = append(problems, "User name "+md.GetUsername()+
+				" already used by "+what)
+		}
+		if len(problems) > 0 {
+			fmt.Printf("line %d: %s: %s\n", line, md.GetEmail(),
+				strings.Join(problems, "; "))
+			failed++
+			continue
+		}
+
+		// Rows without a category are recorded in the first one.
+		if md.Category == nil {
+			md.Category = proto.String(
+				membersys.FindFeeCategory(org.Fees, "").GetName())
+		}
+
+		// Later rows may not reuse what earlier rows have claimed.
+		emails[email] = fmt.Sprintf("line %d", line)
+		if md.Username != nil {
+			usernames[md.GetUsername()] = fmt.Sprintf("line %d", line)
+		}
+
+		if dry_run {
+			fmt.Printf("line %d: %s: would import %s\n", line,
+				md.GetEmail(), md.GetName())
+			imported++
+			continue
+		}
+
+		if err = db.AddImportedMember(ctx, agreement, actor); err != nil {
+			fmt.Printf("line %d: %s: %s\n", line, md.GetEmail(), err)
+			failed++
+			continue
+		}
+		fmt.Printf("line %d: %s: imported %s as member %d\n", line,
+			md.GetEmail(), md.GetName(), md.GetId())
+		imported++
+	}
+
+	if dry_run {
+		log.Print(imported, " members would be imported, ", failed,
+			" rows have problems")
+	} else {
+		log.Print("Imported ", imported, " members, ", failed,
+			" rows have problems")
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,162 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/starshipfactory/membersys"
+)
+
+func TestParseMapping(t *testing.T) {
+	var tests = []struct {
+		spec    string
+		columns map[string]string
+		err     string
+	}{
+		{"", map[string]string{"name": "name", "fee": "fee"}, ""},
+		{"name=Name,email=E-Mail", map[string]string{"name": "Name",
+			"email": "E-Mail", "city": "city"}, ""},
+		{"fee=Beitrag=CHF", map[string]string{"fee": "Beitrag=CHF"}, ""},
+		{"name", nil, "Invalid mapping name"},
+		{"shoe_size=Size", nil, "Unknown field shoe_size"},
+	}
+	var mapping map[string]string
+	var field string
+	var i int
+	var err error
+
+	for i = range tests {
+		var test = tests[i]
+
+		mapping, err = parseMapping(test.spec)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: expected an error containing %q, got %v",
+					test.spec, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.spec, err)
+			continue
+		}
+		if len(mapping) != len(fields) {
+			t.Errorf("%q: expected %d fields, got %d", test.spec,
+				len(fields), len(mapping))
+		}
+		for field = range test.columns {
+			if mapping[field] != test.columns[field] {
+				t.Errorf("%q: expected %s to be read from %s, got %s",
+					test.spec, field, test.columns[field], mapping[field])
+			}
+		}
+	}
+}
+
+func TestRowToAgreement(t *testing.T) {
+	var now = time.Date(2020, 3, 1, 12, 0, 0, 0, time.Local)
+	var approved = time.Date(2019, 5, 17, 0, 0, 0, 0, time.Local)
+	var row = map[string]string{
+		"name":          " Ada Lovelace ",
+		"email":         "ada@example.com",
+		"username":      "ADA",
+		"fee":           "25",
+		"fee_yearly":    "ja",
+		"has_key":       "no",
+		"reduction":     "yes",
+		"approval_date": "2019-05-17",
+		"comment":       "Founding member",
+	}
+	var get = func(field string) string { return row[field] }
+	var agreement *membersys.MembershipAgreement
+	var md *membersys.Member
+	var reduction bool
+	var err error
+
+	agreement, reduction, err = rowToAgreement(get, "old.csv", "admin", now)
+	if err != nil {
+		t.Fatalf("Error converting the row: %s", err)
+	}
+	md = agreement.GetMemberData()
+	if md.GetName() != "Ada Lovelace" || md.GetUsername() != "ada" ||
+		md.GetFee() != 25 || !md.GetFeeYearly() || md.GetHasKey() {
+		t.Errorf("Unexpected member data %v", md)
+	}
+	if md.Street != nil || md.PaymentsCaughtUpTo != nil {
+		t.Errorf("Empty fields have been set: %v", md)
+	}
+	if !reduction {
+		t.Errorf("The fee reduction hasn't been reported")
+	}
+	if agreement.GetMetadata().GetApprovalTimestamp() !=
+		uint64(approved.Unix()) ||
+		agreement.GetMetadata().GetRequestTimestamp() !=
+			uint64(now.Unix()) ||
+		agreement.GetMetadata().GetImportSource() != "old.csv" ||
+		agreement.GetMetadata().GetComment() != "Founding member" {
+		t.Errorf("Unexpected metadata %v", agreement.GetMetadata())
+	}
+}
+
+func TestRowToAgreementInvalid(t *testing.T) {
+	var tests = []struct {
+		field, value string
+	}{
+		{"fee", "25.50"},
+		{"fee", "-25"},
+		{"fee", "CHF 25"},
+		{"fee_yearly", "maybe"},
+		{"has_key", "2"},
+		{"approval_date", "17.05.2019"},
+		{"payments_caught_up_to", "2019-13-01"},
+	}
+	var i int
+	var err error
+
+	for i = range tests {
+		var test = tests[i]
+		var get = func(field string) string {
+			if field == test.field {
+				return test.value
+			}
+			return ""
+		}
+
+		if _, _, err = rowToAgreement(get, "old.csv", "admin",
+			time.Now()); err == nil {
+			t.Errorf("%s %q: expected an error", test.field, test.value)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/membersys"
+	"github.com/starshipfactory/membersys/config"
+)
+
+func main() {
+	var db membersys.MembershipStore
+	var org *config.OrganisationConfig
+	var config config.MembersysConfig
+	var organisation string
+	var config_contents []byte
+	var config_path, input_path, key_path string
+	var in *os.File
+	var key []byte
+	var help, verbose bool
+	var count int
+	var err error
+
+	flag.BoolVar(&help, "help", false, "Display help")
+	flag.StringVar(&config_path, "config", "",
+		"Path to the membersys configuration file of the database to "+
+			"restore into")
+	flag.StringVar(&organisation, "organisation", "",
+		"Name of the organisation to work on, if several are configured")
+	flag.StringVar(&input_path, "input", "-",
+		"File to read the backup from, or - for standard input")
+	flag.StringVar(&key_path, "key-file", "",
+		"File containing the key the backup has been encrypted with")
+	flag.BoolVar(&verbose, "verbose", false,
+		"Whether or not to display verbose messages")
+	flag.Parse()
+
+	if help || config_path == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if key_path != "" {
+		if key, err = membersys.ReadKeyFile(key_path); err != nil {
+			log.Fatal("Unable to read key from ", key_path, ": ", err)
+		}
+	}
+
+	config_contents, err = ioutil.ReadFile(config_path)
+	if err != nil {
+		log.Fatal("Unable to read ", config_path, ": ", err)
+	}
+	err = proto.Unmarshal(config_contents, &config)
+	if err != nil {
+		err = proto.UnmarshalText(string(config_contents), &config)
+	}
+	if err != nil {
+		log.Fatal("Error parsing ", config_path, ": ", err)
+	}
+
+	org, err = membersys.FindOrganisation(&config, organisation)
+	if err != nil {
+		log.Fatal("Error selecting the organisation: ", err)
+	}
+
+	db, err = membersys.NewMembershipStore(org.DatabaseConfig,
+		time.Duration(org.DatabaseConfig.GetDatabaseTimeout())*time.Millisecond)
+	if err != nil {
+		log.Fatal("Unable to connect to the membership database ",
+			org.DatabaseConfig.GetDatabaseServer(), " at ",
+			org.DatabaseConfig.GetDatabaseName(), ": ", err)
+	}
+
+	if input_path != "-" {
+		if in, err = os.Open(input_path); err != nil {
+			log.Fatal("Unable to open ", input_path, ": ", err)
+		}
+	} else {
+		// The backup is read twice, so keep a copy of standard input.
+		// The file is unlinked right away, since the backup contains
+		// personal data.
+		if in, err = ioutil.TempFile("", "membersys_restore"); err != nil {
+			log.Fatal("Unable to create temporary file: ", err)
+		}
+		os.Remove(in.Name())
+		if _, err = io.Copy(in, os.Stdin); err != nil {
+			log.Fatal("Unable to read the backup: ", err)
+		}
+	}
+	defer in.Close()
+
+	// Check the whole backup first, so incomplete backups are refused
+	// before anything has been changed.
+	if _, err = in.Seek(0, io.SeekStart); err != nil {
+		log.Fatal("Unable to rewind the backup: ", err)
+	}
+	if count, err = membersys.VerifyBackup(in, key); err != nil {
+		log.Fatal("Refusing to restore the backup: ", err)
+	}
+	if verbose {
+		log.Print("The backup contains ", count, " records")
+	}
+	if _, err = in.Seek(0, io.SeekStart); err != nil {
+		log.Fatal("Unable to rewind the backup: ", err)
+	}
+
+	count, err = membersys.RestoreBackup(context.Background(), db, in, key)
+	if err != nil {
+		log.Fatal("Error restoring backup after ", count, " records: ", err)
+	}
+
+	if verbose {
+		log.Print("Restored ", count, " records")
+	}
+}
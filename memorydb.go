@@ -0,0 +1,1376 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package membersys
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/membersys/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// A single row of the in-memory database.
+type inMemoryRecord struct {
+	agreement *MembershipAgreement
+	timestamp int64
+	expires   time.Time
+}
+
+// Membership database which keeps all records in memory. All data is lost
+// when the process exits, so this is only useful for development and
+// testing. Records are keyed like the rows of the original Thrift schema,
+// i.e. a prefix denoting the lifecycle state followed by the raw UUID, and
+// listed in key order. Since no operation ever has to wait for anything,
+// the contexts passed to them are ignored.
+type InMemoryMembershipDB struct {
+	mtx          sync.Mutex
+	tables       map[string]map[string]*inMemoryRecord
+	auditLog     map[string][]*AuditLogEntry
+	revisions    map[uint64][]*MemberRevision
+	memberEmails map[string]uint64
+	lastMember   uint64
+	retention    *config.DatabaseConfig_RetentionConfig
+	blobs        BlobStore
+}
+
+var applicationPrefix string = "applicant:"
+var applicationEnd string = "applicant;"
+var queuePrefix string = "queue:"
+var queueEnd string = "queue;"
+var dequeuePrefix string = "dequeue:"
+var dequeueEnd string = "dequeue;"
+var archivePrefix string = "archive:"
+var archiveEnd string = "archive;"
+var memberPrefix string = "member:"
+var memberEnd string = "member;"
+
+// Create a new, empty in-memory membership database.
+func NewInMemoryMembershipDB() *InMemoryMembershipDB {
+	return &InMemoryMembershipDB{
+		tables: map[string]map[string]*inMemoryRecord{
+			"application":        make(map[string]*inMemoryRecord),
+			"membership_queue":   make(map[string]*inMemoryRecord),
+			"membership_dequeue": make(map[string]*inMemoryRecord),
+			"membership_archive": make(map[string]*inMemoryRecord),
+			"members":            make(map[string]*inMemoryRecord),
+		},
+		auditLog:     make(map[string][]*AuditLogEntry),
+		revisions:    make(map[uint64][]*MemberRevision),
+		memberEmails: make(map[string]uint64),
+		blobs:        newMemoryBlobStore(),
+	}
+}
+
+// Key of the member with the membership number "number" in the members
+// table. Numbers are padded so the members are listed in numeric order.
+func memberKey(number uint64) string {
+	return fmt.Sprintf("%s%020d", memberPrefix, number)
+}
+
+// Fetch the record of the member with the e-mail address "email". Must be
+// called with the mutex held.
+func (m *InMemoryMembershipDB) getMember(email string) (
+	*inMemoryRecord, error) {
+	var number uint64
+	var ok bool
+
+	if number, ok = m.memberEmails[email]; !ok {
+		return nil, grpc.Errorf(codes.NotFound, "Not found")
+	}
+	return m.get("members", memberKey(number))
+}
+
+// Fetch the row "key" from "table". Expired rows are removed on the way.
+// Must be called with the mutex held.
+func (m *InMemoryMembershipDB) get(table, key string) (*inMemoryRecord, error) {
+	var rows map[string]*inMemoryRecord
+	var rec *inMemoryRecord
+	var ok bool
+
+	if rows, ok = m.tables[table]; !ok {
+		return nil, grpc.Errorf(codes.InvalidArgument,
+			"Unknown table "+table)
+	}
+
+	if rec, ok = rows[key]; !ok {
+		return nil, grpc.Errorf(codes.NotFound, "Not found")
+	}
+
+	if !rec.expires.IsZero() && time.Now().After(rec.expires) {
+		delete(rows, key)
+		return nil, grpc.Errorf(codes.NotFound, "Not found")
+	}
+
+	return rec, nil
+}
+
+// Write a copy of "agreement" to the row "key" of "table". If "ttl" is
+// positive, the row will expire after "ttl" seconds. Must be called with
+// the mutex held.
+func (m *InMemoryMembershipDB) put(table, key string,
+	agreement *MembershipAgreement, now time.Time, ttl int32) {
+	var rec = &inMemoryRecord{
+		agreement: proto.Clone(agreement).(*MembershipAgreement),
+		timestamp: now.UnixNano(),
+	}
+
+	if ttl > 0 {
+		rec.expires = now.Add(time.Duration(ttl) * time.Second)
+	}
+
+	m.tables[table][key] = rec
+}
+
+// Chain "entries" to the audit log of their subject. Nothing is added if
+// this fails, so it should be called before any other modification. Must
+// be called with the mutex held.
+func (m *InMemoryMembershipDB) audit(entries ...*AuditLogEntry) error {
+	var chain []*AuditLogEntry
+	var last *AuditLogEntry
+	var err error
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	chain = m.auditLog[entries[0].GetSubject()]
+	if len(chain) > 0 {
+		last = chain[len(chain)-1]
+	}
+
+	if err = chainAuditEntries(last, entries); err != nil {
+		return err
+	}
+
+	m.auditLog[entries[0].GetSubject()] = append(chain, entries...)
+	return nil
+}
+
+// List the keys of "table" between "start" (inclusive) and "end"
+// (exclusive), in byte order. Must be called with the mutex held.
+func (m *InMemoryMembershipDB) keyRange(table, start, end string) []string {
+	var now = time.Now()
+	var keys []string
+	var key string
+	var rec *inMemoryRecord
+
+	for key, rec = range m.tables[table] {
+		if !rec.expires.IsZero() && now.After(rec.expires) {
+			delete(m.tables[table], key)
+			continue
+		}
+		if key >= start && key < end {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Determine the first key of an UUID keyed range starting at "prev".
+func uuidRangeStart(prefix, prev string) (string, error) {
+	var uuid gocql.UUID
+	var err error
+
+	if len(prev) == 0 {
+		return prefix, nil
+	}
+
+	if uuid, err = gocql.ParseUUID(prev); err != nil {
+		return "", err
+	}
+
+	return prefix + string(uuid[:]), nil
+}
+
+// Extract the UUID from the row "key" starting with "prefix".
+func uuidFromKey(key, prefix string) gocql.UUID {
+	var uuid gocql.UUID
+	copy(uuid[:], key[len(prefix):])
+	return uuid
+}
+
+// Store the given membership request in the database.
+func (m *InMemoryMembershipDB) StoreMembershipRequest(ctx context.Context,
+	req *FormInputData) (key string, err error) {
+	var pb *MembershipAgreement = new(MembershipAgreement)
+	var now = time.Now()
+	var uuid gocql.UUID
+
+	uuid = gocql.UUIDFromTime(now)
+
+	if req.Metadata.RequestTimestamp == nil {
+		req.Metadata.RequestTimestamp = proto.Uint64(uint64(now.Unix()))
+	}
+	pb.MemberData = req.MemberData
+	pb.Metadata = req.Metadata
+	pb.FeeReduction = req.FeeReduction
+
+	if pb.FeeReduction != nil && len(req.FeeReductionDocument) > 0 {
+		var hash string = blobHash(req.FeeReductionDocument)
+		if err = m.blobs.PutBlob(ctx, hash, req.FeeReductionDocument); err != nil {
+			return "", err
+		}
+		pb.FeeReduction.DocumentHash = proto.String(hash)
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	err = m.audit(newAuditMove(applicantActor(req), pb, uuid.String(),
+		AuditActionApply, "", "application", now))
+	if err != nil {
+		return "", err
+	}
+
+	m.put("application", applicationPrefix+string(uuid[:]), pb, now, 0)
+	return hex.EncodeToString(uuid[:]), nil
+}
+
+// Retrieve a specific members detailed membership data, but fetch it by the
+// user name of the member.
+func (m *InMemoryMembershipDB) GetMemberDetailByUsername(ctx context.Context,
+	username string) (*MembershipAgreement, error) {
+	var key string
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	for _, key = range m.keyRange("members", memberPrefix, memberEnd) {
+		var rec = m.tables["members"][key]
+		if rec.agreement.GetMemberData().GetUsername() == username {
+			return proto.Clone(rec.agreement).(*MembershipAgreement), nil
+		}
+	}
+
+	return nil, grpc.Errorf(codes.NotFound, "Not found")
+}
+
+// Retrieve a specific members detailed membership data, along with the
+// version of the record.
+func (m *InMemoryMembershipDB) GetMemberDetail(ctx context.Context, id string) (
+	*MembershipAgreement, int64, error) {
+	var rec *inMemoryRecord
+	var err error
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if rec, err = m.getMember(id); err != nil {
+		return nil, 0, err
+	}
+
+	return proto.Clone(rec.agreement).(*MembershipAgreement),
+		rec.timestamp, nil
+}
+
+// Apply "modify" to the membership data of the member "id" and write it
+// back to the members table, provided the record is still at "version".
+// The time stamp of the record serves as its version. Changes to any of
+// "fields" are recorded in the audit log.
+func (m *InMemoryMembershipDB) updateMember(ctx context.Context, id string,
+	version int64, fields []string, actor *Actor,
+	modify func(*MembershipAgreement) error) (int64, error) {
+	var member *MembershipAgreement
+	var entries []*AuditLogEntry
+	var rec *inMemoryRecord
+	var number uint64
+	var email string
+	var err error
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if rec, err = m.getMember(id); err != nil {
+		return 0, err
+	}
+
+	if rec.timestamp != version {
+		return 0, versionConflict(id)
+	}
+
+	member = proto.Clone(rec.agreement).(*MembershipAgreement)
+	if err = modify(member); err != nil {
+		return 0, err
+	}
+	number = member.GetMemberData().GetId()
+	email = member.GetMemberData().GetEmail()
+
+	entries = newAuditEdits(actor, id, rec.agreement.GetMemberData(),
+		member.GetMemberData(), fields, time.Now())
+	if email != id {
+		if _, ok := m.memberEmails[email]; ok {
+			return 0, grpc.Errorf(codes.AlreadyExists,
+				"The e-mail address %s is already in use", email)
+		}
+		if err = m.audit(auditEntriesFor(email, entries)...); err != nil {
+			return 0, err
+		}
+		delete(m.memberEmails, id)
+		m.memberEmails[email] = number
+	}
+	if err = m.audit(entries...); err != nil {
+		return 0, err
+	}
+
+	// Keep the previous state of the record around.
+	m.revisions[number] = append(m.revisions[number], &MemberRevision{
+		Version:   rec.timestamp,
+		Agreement: rec.agreement,
+	})
+
+	version = nextVersion(version)
+	m.put("members", memberKey(number), member, time.Unix(0, version), 0)
+	return version, nil
+}
+
+// Update the membership fee for the given member.
+func (m *InMemoryMembershipDB) SetMemberFee(ctx context.Context, id string,
+	fee uint64, yearly bool, version int64, actor *Actor) (int64, error) {
+	return m.updateMember(ctx, id, version, []string{"fee", "fee_yearly"}, actor,
+		func(member *MembershipAgreement) error {
+			member.MemberData.Fee = proto.Uint64(fee)
+			member.MemberData.FeeYearly = proto.Bool(yearly)
+			return nil
+		})
+}
+
+// Update the specified long field for the given member.
+func (m *InMemoryMembershipDB) SetLongValue(ctx context.Context, id string,
+	field string, value uint64, version int64, actor *Actor) (int64, error) {
+	return m.updateMember(ctx, id, version, []string{field}, actor,
+		func(member *MembershipAgreement) error {
+			return setMemberLongField(member, field, value)
+		})
+}
+
+// Update the specified boolean field for the given member.
+func (m *InMemoryMembershipDB) SetBoolValue(ctx context.Context, id string,
+	field string, value bool, version int64, actor *Actor) (int64, error) {
+	return m.updateMember(ctx, id, version, []string{field}, actor,
+		func(member *MembershipAgreement) error {
+			return setMemberBoolField(member, field, value)
+		})
+}
+
+// Update the specified text column on the membership data.
+func (m *InMemoryMembershipDB) SetTextValue(ctx context.Context, id string,
+	field, value string, version int64, actor *Actor) (int64, error) {
+	return m.updateMember(ctx, id, version, []string{field}, actor,
+		func(member *MembershipAgreement) error {
+			return setMemberTextField(member, field, value)
+		})
+}
+
+// Retrieve an individual applicants data.
+func (m *InMemoryMembershipDB) GetMembershipRequest(ctx context.Context, id,
+	table, prefix string) (*MembershipAgreement, int64, error) {
+	var rec *inMemoryRecord
+	var uuid gocql.UUID
+	var err error
+
+	if uuid, err = gocql.ParseUUID(id); err != nil {
+		return nil, 0, err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if rec, err = m.get(table, prefix+string(uuid[:])); err != nil {
+		return nil, 0, err
+	}
+
+	return proto.Clone(rec.agreement).(*MembershipAgreement),
+		rec.timestamp, nil
+}
+
+// Get a list of all members currently in the database. Returns a set of
+// "num" entries meeting "filter", beginning after "prev". Only the fields which are also
+// kept as separate columns in Cassandra are filled in.
+func (m *InMemoryMembershipDB) EnumerateMembers(ctx context.Context,
+	filter *MemberFilter, prev string, num int32) ([]*Member, error) {
+	var rv []*Member
+	var start, key string
+	var number uint64
+	var err error
+
+	// Callers page past the last entry by appending a NUL byte to it.
+	start = memberPrefix
+	if len(prev) > 0 {
+		number, err = strconv.ParseUint(strings.TrimSuffix(prev, "\000"),
+			10, 64)
+		if err != nil {
+			return nil, grpc.Errorf(codes.InvalidArgument,
+				"Invalid membership number %s", prev)
+		}
+		start = memberKey(number)
+		if strings.HasSuffix(prev, "\000") {
+			start += "\000"
+		}
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	for _, key = range m.keyRange("members", start, memberEnd) {
+		var agreement = m.tables["members"][key].agreement
+		var md = agreement.GetMemberData()
+
+		if int32(len(rv)) >= num {
+			break
+		}
+		if !filter.matches(md,
+			agreement.GetMetadata().GetApprovalTimestamp()) {
+			continue
+		}
+
+		rv = append(rv, &Member{
+			Id:                 md.Id,
+			Name:               proto.String(md.GetName()),
+			City:               proto.String(md.GetCity()),
+			Country:            proto.String(md.GetCountry()),
+			Email:              md.Email,
+			Phone:              md.Phone,
+			Username:           md.Username,
+			Fee:                proto.Uint64(md.GetFee()),
+			FeeYearly:          proto.Bool(md.GetFeeYearly()),
+			HasKey:             md.HasKey,
+			PaymentsCaughtUpTo: md.PaymentsCaughtUpTo,
+			Category:           md.Category,
+		})
+	}
+
+	return rv, nil
+}
+
+// Get a list of all membership applications currently in the database.
+// Returns a set of "num" entries matching "criterion", beginning after
+// "prev".
+func (m *InMemoryMembershipDB) EnumerateMembershipRequests(ctx context.Context,
+	criterion, prev string, num int32) ([]*MemberWithKey, error) {
+	var rv []*MemberWithKey
+	var start, key string
+	var err error
+
+	if start, err = uuidRangeStart(applicationPrefix, prev); err != nil {
+		return rv, err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	for _, key = range m.keyRange("application", start, applicationEnd) {
+		var md = m.tables["application"][key].agreement.GetMemberData()
+		var member *MemberWithKey = new(MemberWithKey)
+
+		if int32(len(rv)) >= num {
+			break
+		}
+		if !matchesCriterion(md, criterion) {
+			continue
+		}
+
+		member.Key = uuidFromKey(key, applicationPrefix).String()
+		member.Name = proto.String(md.GetName())
+		member.Street = proto.String(md.GetStreet())
+		member.City = proto.String(md.GetCity())
+		member.Email = md.Email
+		member.Username = md.Username
+		member.Fee = proto.Uint64(md.GetFee())
+		member.FeeYearly = proto.Bool(md.GetFeeYearly())
+		member.Category = md.Category
+
+		rv = append(rv, member)
+	}
+
+	return rv, nil
+}
+
+// Get a list of all future members which are currently in the queue.
+func (m *InMemoryMembershipDB) EnumerateQueuedMembers(ctx context.Context,
+	criterion, prev string, num int32) ([]*MemberWithKey, error) {
+	return m.enumerateRecordsIn(ctx,
+		"membership_queue", queuePrefix, queueEnd, criterion, prev, num)
+}
+
+// Get a list of all future members which are currently in the departing
+// queue.
+func (m *InMemoryMembershipDB) EnumerateDeQueuedMembers(ctx context.Context,
+	criterion, prev string, num int32) ([]*MemberWithKey, error) {
+	return m.enumerateRecordsIn(ctx,
+		"membership_dequeue", dequeuePrefix, dequeueEnd, criterion, prev, num)
+}
+
+// Get a list of all members which are currently in the trash.
+func (m *InMemoryMembershipDB) EnumerateTrashedMembers(ctx context.Context,
+	criterion, prev string, num int32) ([]*MemberWithKey, error) {
+	return m.enumerateRecordsIn(ctx,
+		"membership_archive", archivePrefix, archiveEnd, criterion, prev, num)
+}
+
+// List the records of "table" matching "criterion", beginning at the UUID
+// "prev".
+func (m *InMemoryMembershipDB) enumerateRecordsIn(ctx context.Context,
+	table, prefix, end, criterion, prev string, num int32) (
+	[]*MemberWithKey, error) {
+	var rv []*MemberWithKey
+	var start, key string
+	var err error
+
+	if start, err = uuidRangeStart(prefix, prev); err != nil {
+		return rv, err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	for _, key = range m.keyRange(table, start, end) {
+		var md = m.tables[table][key].agreement.GetMemberData()
+		var member *MemberWithKey = new(MemberWithKey)
+
+		if int32(len(rv)) >= num {
+			break
+		}
+		if !matchesCriterion(md, criterion) {
+			continue
+		}
+
+		proto.Merge(&member.Member, md)
+		member.Key = uuidFromKey(key, prefix).String()
+
+		rv = append(rv, member)
+	}
+
+	return rv, nil
+}
+
+// Move a member record to the queue for getting their user account removed
+// (e.g. when they leave us).
+func (m *InMemoryMembershipDB) MoveMemberToTrash(ctx context.Context, id string,
+	actor *Actor, reason string) error {
+	var now time.Time = time.Now()
+	var member *MembershipAgreement
+	var entry *AuditLogEntry
+	var rec *inMemoryRecord
+	var uuid gocql.UUID
+	var err error
+
+	uuid = gocql.UUIDFromTime(now)
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if rec, err = m.getMember(id); err != nil {
+		return err
+	}
+
+	member = proto.Clone(rec.agreement).(*MembershipAgreement)
+	member.Metadata.GoodbyeInitiator = proto.String(actor.User)
+	member.Metadata.GoodbyeTimestamp = proto.Uint64(uint64(now.Unix()))
+	member.Metadata.GoodbyeReason = proto.String(reason)
+
+	entry = newAuditMove(actor, member, id, AuditActionGoodbye, "members",
+		"membership_dequeue", now)
+	entry.Comment = proto.String(reason)
+	if err = m.audit(entry); err != nil {
+		return err
+	}
+
+	delete(m.tables["members"], memberKey(member.GetMemberData().GetId()))
+	delete(m.memberEmails, id)
+	m.put("membership_dequeue", dequeuePrefix+string(uuid[:]), member, now, 0)
+	return nil
+}
+
+// Move the record of the given applicant to the queue of new users to be
+// processed. The approver will be set to "initiator".
+func (m *InMemoryMembershipDB) MoveApplicantToNewMember(ctx context.Context,
+	id string, actor *Actor) error {
+	return m.moveRecordToTable(ctx, id, actor, AuditActionAccept,
+		"application", applicationPrefix, "membership_queue", queuePrefix, 0)
+}
+
+// Move the record of the given applicant to a temporary archive of deleted
+// applications. The deleter will be set to "initiator".
+func (m *InMemoryMembershipDB) MoveApplicantToTrash(ctx context.Context,
+	id string, actor *Actor) error {
+	return m.moveRecordToTable(ctx, id, actor, AuditActionReject,
+		"application", applicationPrefix, "membership_archive", archivePrefix,
+		retentionTTL(m.retention.GetRejectedApplicationDays()))
+}
+
+// Move a member from the queue to the trash (e.g. if they can't be
+// processed).
+func (m *InMemoryMembershipDB) MoveQueuedRecordToTrash(ctx context.Context,
+	id string, actor *Actor) error {
+	return m.moveRecordToTable(ctx, id, actor, AuditActionCancel,
+		"membership_queue", queuePrefix, "membership_archive", archivePrefix,
+		retentionTTL(m.retention.GetCancelledQueueDays()))
+}
+
+// Move the record of the given applicant to a different table.
+func (m *InMemoryMembershipDB) moveRecordToTable(ctx context.Context,
+	id string, actor *Actor, action, src_table, src_prefix, dst_table,
+	dst_prefix string, ttl int32) error {
+	var now time.Time = time.Now()
+	var member *MembershipAgreement
+	var rec *inMemoryRecord
+	var uuid gocql.UUID
+	var err error
+
+	if uuid, err = gocql.ParseUUID(id); err != nil {
+		return err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if rec, err = m.get(src_table, src_prefix+string(uuid[:])); err != nil {
+		return err
+	}
+
+	member = proto.Clone(rec.agreement).(*MembershipAgreement)
+	if dst_table == "membership_queue" && agreementPdfHash(member) == "" {
+		return errors.New("No membership agreement scan has been uploaded")
+	}
+
+	// Fill in details concerning the approval.
+	member.Metadata.ApproverUid = proto.String(actor.User)
+	member.Metadata.ApprovalTimestamp = proto.Uint64(uint64(now.Unix()))
+
+	err = m.audit(newAuditMove(actor, member, uuid.String(), action,
+		src_table, dst_table, now))
+	if err != nil {
+		return err
+	}
+
+	delete(m.tables[src_table], src_prefix+string(uuid[:]))
+	m.put(dst_table, dst_prefix+string(uuid[:]), member, now, ttl)
+	return nil
+}
+
+// Add the membership agreement form scan to the given membership request
+// record. The scan itself is kept in the blob store.
+func (m *InMemoryMembershipDB) StoreMembershipAgreement(ctx context.Context,
+	id string, agreement_data []byte, actor *Actor) error {
+	var now time.Time = time.Now()
+	var agreement *MembershipAgreement
+	var rec *inMemoryRecord
+	var hash string = blobHash(agreement_data)
+	var uuid gocql.UUID
+	var err error
+
+	if uuid, err = gocql.ParseUUID(id); err != nil {
+		return err
+	}
+	if err = m.blobs.PutBlob(ctx, hash, agreement_data); err != nil {
+		return err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if rec, err = m.get("application", applicationPrefix+string(uuid[:])); err != nil {
+		return err
+	}
+
+	err = m.audit(newAuditAgreementUpload(actor, rec.agreement,
+		uuid.String(), agreement_data, now))
+	if err != nil {
+		return err
+	}
+
+	agreement = proto.Clone(rec.agreement).(*MembershipAgreement)
+	agreement.AgreementPdf = nil
+	agreement.AgreementPdfHash = proto.String(hash)
+
+	m.put("application", applicationPrefix+string(uuid[:]), agreement,
+		now, 0)
+	return nil
+}
+
+// Record the decision about the fee reduction requested along with the
+// application "id". Approved reductions apply until "valid_until", or
+// indefinitely if it is 0.
+func (m *InMemoryMembershipDB) DecideFeeReduction(ctx context.Context,
+	id string, approved bool, valid_until uint64, comment string,
+	actor *Actor) error {
+	var now time.Time = time.Now()
+	var agreement *MembershipAgreement
+	var rec *inMemoryRecord
+	var uuid gocql.UUID
+	var old_status string
+	var err error
+
+	if uuid, err = gocql.ParseUUID(id); err != nil {
+		return err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if rec, err = m.get("application", applicationPrefix+string(uuid[:])); err != nil {
+		return err
+	}
+
+	agreement = proto.Clone(rec.agreement).(*MembershipAgreement)
+	old_status, err = decideFeeReduction(agreement, approved, valid_until,
+		comment, actor, now)
+	if err != nil {
+		return err
+	}
+
+	err = m.audit(newAuditFeeReduction(actor, agreement, uuid.String(),
+		old_status, now))
+	if err != nil {
+		return err
+	}
+
+	m.put("application", applicationPrefix+string(uuid[:]), agreement,
+		now, 0)
+	return nil
+}
+
+// Mark the e-mail address of the application "id" as verified, provided
+// it is still "email".
+func (m *InMemoryMembershipDB) VerifyApplicationEmail(ctx context.Context,
+	id, email string, actor *Actor) error {
+	var now time.Time = time.Now()
+	var agreement *MembershipAgreement
+	var rec *inMemoryRecord
+	var uuid gocql.UUID
+	var err error
+
+	if uuid, err = gocql.ParseUUID(id); err != nil {
+		return err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if rec, err = m.get("application", applicationPrefix+string(uuid[:])); err != nil {
+		return err
+	}
+
+	agreement = proto.Clone(rec.agreement).(*MembershipAgreement)
+	if err = verifyApplicationEmail(agreement, email, actor, now); err != nil {
+		return err
+	}
+
+	err = m.audit(newAuditEntry(actor, email, uuid.String(),
+		AuditActionVerifyEmail, now))
+	if err != nil {
+		return err
+	}
+
+	m.put("application", applicationPrefix+string(uuid[:]), agreement,
+		now, 0)
+	return nil
+}
+
+// Merge the application "duplicate" into the application "id". The
+// combined record is kept as "id", the duplicate is moved to the archive
+// like a rejected application.
+func (m *InMemoryMembershipDB) MergeApplications(ctx context.Context, id,
+	duplicate string, actor *Actor) error {
+	var now time.Time = time.Now()
+	var agreement, other *MembershipAgreement
+	var entry *AuditLogEntry
+	var rec *inMemoryRecord
+	var uuid, other_uuid gocql.UUID
+	var err error
+
+	if uuid, err = gocql.ParseUUID(id); err != nil {
+		return err
+	}
+	if other_uuid, err = gocql.ParseUUID(duplicate); err != nil {
+		return err
+	}
+	if uuid == other_uuid {
+		return grpc.Errorf(codes.InvalidArgument,
+			"Cannot merge application %s with itself", id)
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if rec, err = m.get("application", applicationPrefix+string(uuid[:])); err != nil {
+		return err
+	}
+	agreement = proto.Clone(rec.agreement).(*MembershipAgreement)
+	rec, err = m.get("application", applicationPrefix+string(other_uuid[:]))
+	if err != nil {
+		return err
+	}
+	other = proto.Clone(rec.agreement).(*MembershipAgreement)
+
+	mergeAgreements(agreement, other, other_uuid.String())
+	other.Metadata.ApproverUid = proto.String(actor.User)
+	other.Metadata.ApprovalTimestamp = proto.Uint64(uint64(now.Unix()))
+
+	for _, entry = range newAuditMerge(actor, agreement, other,
+		uuid.String(), other_uuid.String(), now) {
+		if err = m.audit(entry); err != nil {
+			return err
+		}
+	}
+
+	m.put("application", applicationPrefix+string(uuid[:]), agreement,
+		now, 0)
+	delete(m.tables["application"], applicationPrefix+string(other_uuid[:]))
+	m.put("membership_archive", archivePrefix+string(other_uuid[:]), other,
+		now, retentionTTL(m.retention.GetRejectedApplicationDays()))
+	return nil
+}
+
+// Turn the queued record "id" into a member record holding "agreement",
+// once the account of the new member has been created. The next membership
+// number is assigned to the member.
+func (m *InMemoryMembershipDB) MoveQueuedRecordToMember(ctx context.Context,
+	id string, agreement *MembershipAgreement, actor *Actor) error {
+	var now time.Time = time.Now()
+	var uuid gocql.UUID
+	var email string
+	var err error
+
+	if uuid, err = gocql.ParseUUID(id); err != nil {
+		return err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if _, err = m.get("membership_queue", queuePrefix+string(uuid[:])); err != nil {
+		return err
+	}
+
+	email = agreement.GetMemberData().GetEmail()
+	if _, ok := m.memberEmails[email]; ok {
+		return grpc.Errorf(codes.AlreadyExists,
+			"There already is a member with the e-mail address %s", email)
+	}
+
+	err = m.audit(newAuditMove(actor, agreement, uuid.String(),
+		AuditActionCreateAccount, "membership_queue", "members", now))
+	if err != nil {
+		return err
+	}
+
+	m.lastMember++
+	agreement.MemberData.Id = proto.Uint64(m.lastMember)
+	m.memberEmails[email] = m.lastMember
+
+	delete(m.tables["membership_queue"], queuePrefix+string(uuid[:]))
+	m.put("members", memberKey(m.lastMember), agreement, now, 0)
+	return nil
+}
+
+// Add "agreement", imported from another system, as a member record and
+// assign the next membership number to it.
+func (m *InMemoryMembershipDB) AddImportedMember(ctx context.Context,
+	agreement *MembershipAgreement, actor *Actor) error {
+	var now time.Time = time.Now()
+	var email string = agreement.GetMemberData().GetEmail()
+	var err error
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if _, ok := m.memberEmails[email]; ok {
+		return grpc.Errorf(codes.AlreadyExists,
+			"There already is a member with the e-mail address %s", email)
+	}
+
+	err = m.audit(newAuditMove(actor, agreement,
+		strconv.FormatUint(m.lastMember+1, 10), AuditActionImport, "",
+		"members", now))
+	if err != nil {
+		return err
+	}
+
+	m.lastMember++
+	agreement.MemberData.Id = proto.Uint64(m.lastMember)
+	m.memberEmails[email] = m.lastMember
+	m.put("members", memberKey(m.lastMember), agreement, now, 0)
+	return nil
+}
+
+// Move the record "id" of a departed member from the departing queue to
+// the archive, once their account has been removed.
+func (m *InMemoryMembershipDB) MoveDeQueuedRecordToArchive(ctx context.Context,
+	id string, actor *Actor) error {
+	var now time.Time = time.Now()
+	var rec *inMemoryRecord
+	var uuid gocql.UUID
+	var err error
+
+	if uuid, err = gocql.ParseUUID(id); err != nil {
+		return err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if rec, err = m.get("membership_dequeue", dequeuePrefix+string(uuid[:])); err != nil {
+		return err
+	}
+
+	err = m.audit(newAuditMove(actor, rec.agreement, uuid.String(),
+		AuditActionArchive, "membership_dequeue", "membership_archive", now))
+	if err != nil {
+		return err
+	}
+
+	delete(m.tables["membership_dequeue"], dequeuePrefix+string(uuid[:]))
+	m.put("membership_archive", archivePrefix+string(uuid[:]), rec.agreement,
+		now, retentionTTL(m.retention.GetFormerMemberDays()))
+	return nil
+}
+
+// Move the record "id" from the archive back to the applications, or for
+// former members, back to the members.
+func (m *InMemoryMembershipDB) RestoreArchivedRecord(ctx context.Context,
+	id string, actor *Actor) error {
+	var now time.Time = time.Now()
+	var agreement *MembershipAgreement
+	var rec *inMemoryRecord
+	var uuid gocql.UUID
+	var dst_table string
+	var number uint64
+	var email string
+	var err error
+
+	if uuid, err = gocql.ParseUUID(id); err != nil {
+		return err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if rec, err = m.get("membership_archive", archivePrefix+string(uuid[:])); err != nil {
+		return err
+	}
+
+	agreement = proto.Clone(rec.agreement).(*MembershipAgreement)
+	dst_table = restoreArchivedAgreement(agreement)
+	if dst_table == "members" {
+		email = agreement.GetMemberData().GetEmail()
+		if _, ok := m.memberEmails[email]; ok {
+			return grpc.Errorf(codes.AlreadyExists,
+				"There already is a member with the e-mail address %s",
+				email)
+		}
+	}
+
+	err = m.audit(newAuditMove(actor, agreement, uuid.String(),
+		AuditActionRestore, "membership_archive", dst_table, now))
+	if err != nil {
+		return err
+	}
+
+	delete(m.tables["membership_archive"], archivePrefix+string(uuid[:]))
+	if dst_table == "members" {
+		// Members who left before membership numbers were introduced
+		// get a new one.
+		if number = agreement.GetMemberData().GetId(); number == 0 {
+			m.lastMember++
+			number = m.lastMember
+			agreement.MemberData.Id = proto.Uint64(number)
+		}
+		m.memberEmails[email] = number
+		m.put("members", memberKey(number), agreement, now, 0)
+	} else {
+		m.put("application", applicationPrefix+string(uuid[:]), agreement,
+			now, 0)
+	}
+	return nil
+}
+
+// Retrieve the audit log of the member with the e-mail address "subject",
+// oldest entry first.
+func (m *InMemoryMembershipDB) GetAuditLog(ctx context.Context,
+	subject string) ([]*AuditLogEntry, error) {
+	var rv []*AuditLogEntry
+	var entry *AuditLogEntry
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	for _, entry = range m.auditLog[subject] {
+		rv = append(rv, proto.Clone(entry).(*AuditLogEntry))
+	}
+
+	return rv, nil
+}
+
+// Retrieve the previous states of the record of the member "id", newest
+// first.
+func (m *InMemoryMembershipDB) GetMemberRevisions(ctx context.Context,
+	id string) ([]*MemberRevision, error) {
+	var rv []*MemberRevision
+	var revisions []*MemberRevision
+	var i int
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	revisions = m.revisions[m.memberEmails[id]]
+	for i = len(revisions) - 1; i >= 0; i-- {
+		rv = append(rv, &MemberRevision{
+			Version: revisions[i].Version,
+			Agreement: proto.Clone(
+				revisions[i].Agreement).(*MembershipAgreement),
+		})
+	}
+
+	return rv, nil
+}
+
+// Key prefixes of the UUID keyed tables.
+var recordPrefixes = map[string]string{
+	"application":        applicationPrefix,
+	"membership_queue":   queuePrefix,
+	"membership_dequeue": dequeuePrefix,
+	"membership_archive": archivePrefix,
+}
+
+// Ends of the key ranges of the UUID keyed tables.
+var recordEnds = map[string]string{
+	"application":        applicationEnd,
+	"membership_queue":   queueEnd,
+	"membership_dequeue": dequeueEnd,
+	"membership_archive": archiveEnd,
+}
+
+// List the records which will be deleted before "before" because their
+// retention period is over, the earliest first.
+func (m *InMemoryMembershipDB) EnumerateExpiringRecords(ctx context.Context,
+	before time.Time) ([]*ExpiringRecord, error) {
+	var rv []*ExpiringRecord
+	var table, key string
+	var rec *inMemoryRecord
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	for _, table = range recordTables {
+		for key, rec = range m.tables[table] {
+			if rec.expires.IsZero() || !rec.expires.Before(before) {
+				continue
+			}
+			rv = append(rv, &ExpiringRecord{
+				Key:     uuidFromKey(key, recordPrefixes[table]).String(),
+				Table:   table,
+				Expires: rec.expires,
+				Agreement: proto.Clone(
+					rec.agreement).(*MembershipAgreement),
+			})
+		}
+	}
+
+	sortByExpiry(rv)
+	return rv, nil
+}
+
+// Delete the records whose retention period is over, along with the
+// blobs no record refers to any more.
+func (m *InMemoryMembershipDB) PurgeExpiredRecords(ctx context.Context) error {
+	var table string
+	var err error
+
+	m.mtx.Lock()
+	// Listing the rows drops the expired ones.
+	for _, table = range recordTables {
+		m.keyRange(table, "", "")
+	}
+	m.mtx.Unlock()
+
+	_, err = sweepBlobs(ctx, m.blobs, m.countBlobReferences)
+	return err
+}
+
+// Count the references of all records to blobs in "refs". Revisions only
+// count as long as the member is still around.
+func (m *InMemoryMembershipDB) countBlobReferences(refs map[string]int) error {
+	var revisions []*MemberRevision
+	var revision *MemberRevision
+	var table map[string]*inMemoryRecord
+	var rec *inMemoryRecord
+	var number uint64
+	var ok bool
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	for _, table = range m.tables {
+		for _, rec = range table {
+			countBlobReferences(refs, rec.agreement)
+		}
+	}
+
+	for number, revisions = range m.revisions {
+		if _, ok = m.tables["members"][memberKey(number)]; !ok {
+			continue
+		}
+		for _, revision = range revisions {
+			countBlobReferences(refs, revision.Agreement)
+		}
+	}
+
+	return nil
+}
+
+// Call "fn" for every agreement blob, every record of every lifecycle
+// state, and for the last membership number assigned. Stops at the first
+// error. The records are copied first, so "fn" is called without holding
+// the mutex.
+func (m *InMemoryMembershipDB) ExportRecords(ctx context.Context,
+	fn func(*BackupRecord) error) error {
+	var now time.Time = time.Now()
+	var records []*BackupRecord
+	var record *BackupRecord
+	var table, key string
+	var err error
+
+	if err = exportBlobs(ctx, m.blobs, nil, fn); err != nil {
+		return err
+	}
+
+	m.mtx.Lock()
+	for _, table = range recordTables {
+		var prefix string = recordPrefixes[table]
+
+		for _, key = range m.keyRange(table, prefix, recordEnds[table]) {
+			var rec *inMemoryRecord = m.tables[table][key]
+
+			record = &BackupRecord{
+				Table: proto.String(table),
+				Key:   proto.String(uuidFromKey(key, prefix).String()),
+				Agreement: proto.Clone(
+					rec.agreement).(*MembershipAgreement),
+			}
+			if !rec.expires.IsZero() {
+				record.Ttl = proto.Int32(
+					int32(rec.expires.Sub(now)/time.Second) + 1)
+			}
+			records = append(records, record)
+		}
+	}
+	for _, key = range m.keyRange("members", memberPrefix, memberEnd) {
+		var agreement *MembershipAgreement = proto.Clone(
+			m.tables["members"][key].agreement).(*MembershipAgreement)
+
+		records = append(records, &BackupRecord{
+			Table: proto.String("members"),
+			Key: proto.String(strconv.FormatUint(
+				agreement.GetMemberData().GetId(), 10)),
+			Agreement: agreement,
+		})
+	}
+	if m.lastMember > 0 {
+		records = append(records, &BackupRecord{
+			Table:            proto.String("member_numbers"),
+			Key:              proto.String("members"),
+			LastMemberNumber: proto.Uint64(m.lastMember),
+		})
+	}
+	m.mtx.Unlock()
+
+	for _, record = range records {
+		if err = fn(record); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Write "record" as it has been exported from a database. Records with the
+// same key are replaced, so an import can be repeated.
+func (m *InMemoryMembershipDB) ImportRecord(ctx context.Context,
+	record *BackupRecord) error {
+	var now time.Time = time.Now()
+	var agreement *MembershipAgreement = record.GetAgreement()
+	var uuid gocql.UUID
+	var number uint64
+	var err error
+
+	if err = checkBackupRecord(record); err != nil {
+		return err
+	}
+	if record.GetTable() == "agreement_blobs" {
+		return m.blobs.PutBlob(ctx, record.GetKey(), record.BlobData)
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if record.GetTable() == "member_numbers" {
+		if record.GetLastMemberNumber() > m.lastMember {
+			m.lastMember = record.GetLastMemberNumber()
+		}
+		return nil
+	}
+
+	if record.GetTable() == "members" {
+		var email string = agreement.GetMemberData().GetEmail()
+		var rec *inMemoryRecord
+		var existing uint64
+		var ok bool
+
+		if number, err = strconv.ParseUint(record.GetKey(), 10, 64); err != nil {
+			return err
+		}
+		if existing, ok = m.memberEmails[email]; ok && existing != number {
+			return grpc.Errorf(codes.AlreadyExists,
+				"There already is a member with the e-mail address %s", email)
+		}
+
+		// The member may have been known under a different e-mail
+		// address before.
+		if rec, err = m.get("members", memberKey(number)); err == nil {
+			delete(m.memberEmails, rec.agreement.GetMemberData().GetEmail())
+		}
+
+		if number > m.lastMember {
+			m.lastMember = number
+		}
+		agreement = proto.Clone(agreement).(*MembershipAgreement)
+		agreement.MemberData.Id = proto.Uint64(number)
+		m.memberEmails[email] = number
+		m.put("members", memberKey(number), agreement, now, 0)
+		return nil
+	}
+
+	if uuid, err = gocql.ParseUUID(record.GetKey()); err != nil {
+		return err
+	}
+	m.put(record.GetTable(), recordPrefixes[record.GetTable()]+
+		string(uuid[:]), agreement, now, record.GetTtl())
+	return nil
+}
+
+// Retrieve the scanned membership agreement of "agreement" from the blob
+// store.
+func (m *InMemoryMembershipDB) GetAgreementPdf(ctx context.Context,
+	agreement *MembershipAgreement) ([]byte, error) {
+	return readAgreementPdf(ctx, m.blobs, nil, agreement)
+}
+
+// Retrieve the document supporting the fee reduction request of
+// "agreement" from the blob store.
+func (m *InMemoryMembershipDB) GetFeeReductionDocument(ctx context.Context,
+	agreement *MembershipAgreement) ([]byte, error) {
+	return readFeeReductionDocument(ctx, m.blobs, nil, agreement)
+}
+
+// Move the agreement embedded in "agreement" to the blob store, returning
+// the record referring to it instead. Returns nil if there is nothing to
+// move.
+func (m *InMemoryMembershipDB) moveAgreementToBlobStore(ctx context.Context,
+	agreement *MembershipAgreement) (*MembershipAgreement, error) {
+	var hash string
+	var err error
+
+	if len(agreement.AgreementPdf) == 0 {
+		return nil, nil
+	}
+
+	hash = blobHash(agreement.AgreementPdf)
+	if err = m.blobs.PutBlob(ctx, hash, agreement.AgreementPdf); err != nil {
+		return nil, err
+	}
+
+	agreement = proto.Clone(agreement).(*MembershipAgreement)
+	agreement.AgreementPdf = nil
+	agreement.AgreementPdfHash = proto.String(hash)
+	return agreement, nil
+}
+
+// Move the agreements embedded in records written by earlier versions to
+// the blob store. Returns the number of records which have been
+// rewritten.
+func (m *InMemoryMembershipDB) MoveAgreementsToBlobStore(
+	ctx context.Context) (int, error) {
+	var agreement *MembershipAgreement
+	var revisions []*MemberRevision
+	var revision *MemberRevision
+	var table map[string]*inMemoryRecord
+	var rec *inMemoryRecord
+	var count int
+	var err error
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	for _, table = range m.tables {
+		for _, rec = range table {
+			agreement, err = m.moveAgreementToBlobStore(ctx, rec.agreement)
+			if err != nil {
+				return count, err
+			}
+			if agreement != nil {
+				rec.agreement = agreement
+				count++
+			}
+		}
+	}
+
+	for _, revisions = range m.revisions {
+		for _, revision = range revisions {
+			agreement, err = m.moveAgreementToBlobStore(ctx,
+				revision.Agreement)
+			if err != nil {
+				return count, err
+			}
+			if agreement != nil {
+				revision.Agreement = agreement
+				count++
+			}
+		}
+	}
+
+	return count, nil
+}
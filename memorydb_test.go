@@ -0,0 +1,183 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package membersys
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Create an in-memory database using the retention periods of the tests.
+func newTestInMemoryDB(t *testing.T) MembershipStore {
+	var db = NewInMemoryMembershipDB()
+	db.retention = testRetention
+	return db
+}
+
+func TestInMemoryLifecycle(t *testing.T) {
+	testStoreLifecycle(t, newTestInMemoryDB)
+}
+
+func TestInMemoryMembers(t *testing.T) {
+	testStoreMembers(t, newTestInMemoryDB)
+}
+
+func TestInMemoryFilters(t *testing.T) {
+	testStoreFilters(t, newTestInMemoryDB)
+}
+
+func TestInMemoryAuditLog(t *testing.T) {
+	testStoreAuditLog(t, newTestInMemoryDB)
+}
+
+// Records are stored under the prefix of their lifecycle state, followed
+// by the raw UUID.
+func TestInMemoryPrefixes(t *testing.T) {
+	var ctx = context.Background()
+	var db = NewInMemoryMembershipDB()
+	var uuid gocql.UUID
+	var id string
+	var err error
+
+	id = storeTestApplication(t, db, "Ada Lovelace", "ada@example.com",
+		true)
+	if uuid, err = gocql.ParseUUID(id); err != nil {
+		t.Fatalf("Invalid key %s: %s", id, err)
+	}
+
+	if _, ok := db.tables["application"][applicationPrefix+
+		string(uuid[:])]; !ok {
+		t.Errorf("The application isn't stored under %q", applicationPrefix)
+	}
+
+	if err = db.MoveApplicantToNewMember(ctx, id, testActor); err != nil {
+		t.Fatalf("Error accepting %s: %s", id, err)
+	}
+	if _, ok := db.tables["membership_queue"][queuePrefix+
+		string(uuid[:])]; !ok {
+		t.Errorf("The queued record isn't stored under %q", queuePrefix)
+	}
+
+	// Looking a record up with the prefix of another state fails.
+	_, _, err = db.GetMembershipRequest(ctx, id, "membership_queue",
+		applicationPrefix)
+	if grpc.Code(err) != codes.NotFound {
+		t.Errorf("Expected the record not to be found under %q, got %v",
+			applicationPrefix, err)
+	}
+
+	createTestMember(t, db, id)
+	if _, ok := db.tables["members"][memberKey(1)]; !ok {
+		t.Errorf("The member isn't stored under %q", memberKey(1))
+	}
+	if memberKey(2) >= memberKey(10) {
+		t.Errorf("Member keys aren't in numeric order: %q >= %q",
+			memberKey(2), memberKey(10))
+	}
+}
+
+// Records vanish once their retention period is over, and the blobs only
+// they referred to are deleted when purging, once their grace period is
+// over.
+func TestInMemoryExpiry(t *testing.T) {
+	var ctx = context.Background()
+	var db = NewInMemoryMembershipDB()
+	var agreement *MembershipAgreement
+	var trashed []*MemberWithKey
+	var uuid gocql.UUID
+	var id string
+	var err error
+
+	db.retention = testRetention
+	id = storeTestApplication(t, db, "Ada Lovelace", "ada@example.com",
+		true)
+	agreement, _, err = db.GetMembershipRequest(ctx, id, "application",
+		applicationPrefix)
+	if err != nil {
+		t.Fatalf("Error fetching %s: %s", id, err)
+	}
+	if err = db.MoveApplicantToTrash(ctx, id, testActor); err != nil {
+		t.Fatalf("Error rejecting %s: %s", id, err)
+	}
+
+	if err = db.PurgeExpiredRecords(ctx); err != nil {
+		t.Fatalf("Error purging: %s", err)
+	}
+	if _, err = db.blobs.GetBlob(ctx,
+		agreement.GetAgreementPdfHash()); err != nil {
+		t.Errorf("The agreement of a rejected application has been "+
+			"deleted: %s", err)
+	}
+
+	uuid, _ = gocql.ParseUUID(id)
+	db.tables["membership_archive"][archivePrefix+string(uuid[:])].expires =
+		time.Now().Add(-time.Second)
+
+	trashed, err = db.EnumerateTrashedMembers(ctx, "", "", 10)
+	if err != nil {
+		t.Fatalf("Error listing the trash: %s", err)
+	}
+	if len(trashed) != 0 {
+		t.Errorf("Expired records are still listed: %v", trashed)
+	}
+	if findTestRecord(t, db, id) != "" {
+		t.Errorf("The expired record can still be fetched")
+	}
+
+	if err = db.PurgeExpiredRecords(ctx); err != nil {
+		t.Fatalf("Error purging: %s", err)
+	}
+	if _, err = db.blobs.GetBlob(ctx,
+		agreement.GetAgreementPdfHash()); err != nil {
+		t.Errorf("A blob stored within the grace period has been "+
+			"deleted: %s", err)
+	}
+
+	db.blobs.(*memoryBlobStore).stored[agreement.GetAgreementPdfHash()] =
+		time.Now().Add(-blobGracePeriod - time.Second)
+	if err = db.PurgeExpiredRecords(ctx); err != nil {
+		t.Fatalf("Error purging: %s", err)
+	}
+	if _, err = db.blobs.GetBlob(ctx,
+		agreement.GetAgreementPdfHash()); err == nil {
+		t.Errorf("The agreement of an expired record has been kept")
+	}
+}
+
+func TestInMemoryRevisions(t *testing.T) {
+	testStoreRevisions(t, newTestInMemoryDB)
+}
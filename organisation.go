@@ -0,0 +1,200 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package membersys
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/membersys/config"
+)
+
+// Describe the database "dbconfig" refers to, so organisations sharing a
+// database can be detected. Returns an empty string for databases which
+// can't be shared.
+func databaseIdentity(dbconfig *config.DatabaseConfig) string {
+	switch dbconfig.GetDatabaseType() {
+	case config.DatabaseConfig_CASSANDRA:
+		return "cassandra " + dbconfig.GetDatabaseServer() + " " +
+			dbconfig.GetDatabaseName()
+	case config.DatabaseConfig_SQLITE:
+		if dbconfig.GetDatabaseDsn() != "" {
+			return "sqlite " + dbconfig.GetDatabaseDsn()
+		}
+		return "sqlite " + dbconfig.GetDatabaseName() + ".db"
+	case config.DatabaseConfig_POSTGRESQL:
+		return "postgresql " + dbconfig.GetDatabaseDsn()
+	}
+	return ""
+}
+
+// Fill in the settings of "org" which are taken from "cfg".
+func resolveOrganisation(cfg *config.MembersysConfig,
+	org *config.OrganisationConfig) *config.OrganisationConfig {
+	var rv *config.OrganisationConfig = proto.Clone(org).(*config.OrganisationConfig)
+	var dbconfig *config.DatabaseConfig
+
+	if rv.TemplateDir == nil {
+		rv.TemplateDir = proto.String(cfg.GetTemplateDir())
+	}
+	if rv.AuthGroup == nil {
+		rv.AuthGroup = proto.String(cfg.GetAuthenticationConfig().GetAuthGroup())
+	}
+	if rv.AppName == nil {
+		if cfg.GetAuthenticationConfig().AppName != nil {
+			rv.AppName = proto.String(
+				cfg.GetAuthenticationConfig().GetAppName())
+		} else {
+			rv.AppName = proto.String(rv.GetName() + " Membership System")
+		}
+	}
+
+	dbconfig = new(config.DatabaseConfig)
+	if cfg.DatabaseConfig != nil {
+		dbconfig = proto.Clone(cfg.DatabaseConfig).(*config.DatabaseConfig)
+	}
+	if org.DatabaseConfig != nil {
+		proto.Merge(dbconfig, org.DatabaseConfig)
+	}
+	rv.DatabaseConfig = dbconfig
+
+	if rv.Fees == nil {
+		rv.Fees = cfg.Fees
+	}
+	if rv.Form == nil {
+		rv.Form = cfg.Form
+	}
+	if rv.VerificationMail == nil {
+		rv.VerificationMail = cfg.VerificationMail
+	}
+
+	return rv
+}
+
+// Determine the organisations served according to "cfg", with the settings
+// not given for the individual organisations taken from "cfg". If no
+// organisations are configured, the settings of "cfg" make up a single
+// organisation. Fails if organisations share a host name or database.
+func Organisations(cfg *config.MembersysConfig) (
+	[]*config.OrganisationConfig, error) {
+	var orgs []*config.OrganisationConfig
+	var org *config.OrganisationConfig
+	var names = make(map[string]bool)
+	var hosts = make(map[string]string)
+	var databases = make(map[string]string)
+	var blobDirs = make(map[string]string)
+	var host, database string
+	var other string
+	var ok bool
+
+	if len(cfg.Organisation) == 0 {
+		return []*config.OrganisationConfig{
+			resolveOrganisation(cfg, &config.OrganisationConfig{
+				Name:    proto.String(cfg.GetOrganisationName()),
+				AppName: proto.String(cfg.GetAuthenticationConfig().GetAppName()),
+			}),
+		}, nil
+	}
+
+	for _, org = range cfg.Organisation {
+		org = resolveOrganisation(cfg, org)
+
+		if names[org.GetName()] {
+			return nil, fmt.Errorf("Organisation %s is configured twice",
+				org.GetName())
+		}
+		names[org.GetName()] = true
+
+		if len(cfg.Organisation) > 1 && len(org.HostName) == 0 {
+			return nil, fmt.Errorf("No host names configured for "+
+				"organisation %s", org.GetName())
+		}
+		for _, host = range org.HostName {
+			host = strings.ToLower(host)
+			if other, ok = hosts[host]; ok {
+				return nil, fmt.Errorf("Organisations %s and %s both use "+
+					"the host name %s", other, org.GetName(), host)
+			}
+			hosts[host] = org.GetName()
+		}
+
+		database = databaseIdentity(org.DatabaseConfig)
+		if other, ok = databases[database]; ok && database != "" {
+			return nil, fmt.Errorf("Organisations %s and %s share the "+
+				"database %s", other, org.GetName(), database)
+		}
+		databases[database] = org.GetName()
+
+		if org.DatabaseConfig.BlobDirectory != nil {
+			var dir = org.DatabaseConfig.GetBlobDirectory()
+			if other, ok = blobDirs[dir]; ok {
+				return nil, fmt.Errorf("Organisations %s and %s share the "+
+					"blob directory %s", other, org.GetName(), dir)
+			}
+			blobDirs[dir] = org.GetName()
+		}
+
+		orgs = append(orgs, org)
+	}
+
+	return orgs, nil
+}
+
+// Find the organisation called "name" among those served according to
+// "cfg". "name" may be empty if only one organisation is served.
+func FindOrganisation(cfg *config.MembersysConfig, name string) (
+	*config.OrganisationConfig, error) {
+	var orgs []*config.OrganisationConfig
+	var org *config.OrganisationConfig
+	var err error
+
+	if orgs, err = Organisations(cfg); err != nil {
+		return nil, err
+	}
+
+	if name == "" {
+		if len(orgs) > 1 {
+			return nil, fmt.Errorf("%d organisations are configured, "+
+				"one has to be selected", len(orgs))
+		}
+		return orgs[0], nil
+	}
+
+	for _, org = range orgs {
+		if org.GetName() == name {
+			return org, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Organisation %s is not configured", name)
+}
@@ -0,0 +1,178 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package membersys
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/membersys/config"
+)
+
+// Configuration of an organisation called "name" served under "host",
+// keeping its data in the Cassandra keyspace "keyspace".
+func testOrganisation(name, host, keyspace string) *config.OrganisationConfig {
+	return &config.OrganisationConfig{
+		Name:     proto.String(name),
+		HostName: []string{host},
+		DatabaseConfig: &config.DatabaseConfig{
+			DatabaseName: proto.String(keyspace),
+		},
+	}
+}
+
+// Keep the data of "org" in SQLite rather than Cassandra.
+func withSQLite(org *config.OrganisationConfig) *config.OrganisationConfig {
+	org.DatabaseConfig.DatabaseType = config.DatabaseConfig_SQLITE.Enum()
+	return org
+}
+
+// Keep the blobs of "org" in "dir" rather than the database.
+func withBlobDirectory(org *config.OrganisationConfig,
+	dir string) *config.OrganisationConfig {
+	org.DatabaseConfig.BlobDirectory = proto.String(dir)
+	return org
+}
+
+func TestOrganisations(t *testing.T) {
+	var tests = []struct {
+		name string
+		orgs []*config.OrganisationConfig
+		err  string
+	}{
+		{"distinct", []*config.OrganisationConfig{
+			testOrganisation("Alpha", "alpha.example.com", "alpha"),
+			testOrganisation("Beta", "beta.example.com", "beta"),
+		}, ""},
+		{"same name", []*config.OrganisationConfig{
+			testOrganisation("Alpha", "alpha.example.com", "alpha"),
+			testOrganisation("Alpha", "beta.example.com", "beta"),
+		}, "configured twice"},
+		{"no host name", []*config.OrganisationConfig{
+			testOrganisation("Alpha", "alpha.example.com", "alpha"),
+			&config.OrganisationConfig{Name: proto.String("Beta")},
+		}, "No host names configured for organisation Beta"},
+		{"same host name", []*config.OrganisationConfig{
+			testOrganisation("Alpha", "alpha.example.com", "alpha"),
+			testOrganisation("Beta", "ALPHA.example.com", "beta"),
+		}, "both use the host name alpha.example.com"},
+		{"same database", []*config.OrganisationConfig{
+			testOrganisation("Alpha", "alpha.example.com", "alpha"),
+			testOrganisation("Beta", "beta.example.com", "alpha"),
+		}, "share the database cassandra"},
+		{"separate database types", []*config.OrganisationConfig{
+			testOrganisation("Alpha", "alpha.example.com", "alpha"),
+			withSQLite(testOrganisation("Beta", "beta.example.com",
+				"alpha")),
+		}, ""},
+		{"same SQLite database", []*config.OrganisationConfig{
+			withSQLite(testOrganisation("Alpha", "alpha.example.com",
+				"alpha")),
+			withSQLite(testOrganisation("Beta", "beta.example.com",
+				"alpha")),
+		}, "share the database sqlite alpha.db"},
+		{"same blob directory", []*config.OrganisationConfig{
+			withBlobDirectory(testOrganisation("Alpha",
+				"alpha.example.com", "alpha"), "/srv/blobs"),
+			withBlobDirectory(testOrganisation("Beta", "beta.example.com",
+				"beta"), "/srv/blobs"),
+		}, "share the blob directory /srv/blobs"},
+	}
+	var orgs []*config.OrganisationConfig
+	var i int
+	var err error
+
+	for i = range tests {
+		var test = tests[i]
+
+		orgs, err = Organisations(&config.MembersysConfig{
+			TemplateDir:          proto.String("/srv/templates"),
+			AuthenticationConfig: new(config.AuthenticationConfig),
+			Organisation:         test.orgs,
+		})
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected an error containing %q, got %v",
+					test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		} else if len(orgs) != len(test.orgs) {
+			t.Errorf("%s: expected %d organisations, got %d", test.name,
+				len(test.orgs), len(orgs))
+		}
+	}
+}
+
+// Settings not given for an organisation are taken from the top level
+// configuration, which makes up the only organisation if there are none.
+func TestOrganisationsDefaults(t *testing.T) {
+	var cfg = &config.MembersysConfig{
+		TemplateDir:          proto.String("/srv/templates"),
+		AuthenticationConfig: new(config.AuthenticationConfig),
+		OrganisationName:     proto.String("Starship Factory"),
+		DatabaseConfig: &config.DatabaseConfig{
+			DatabaseServer: proto.String("db.example.com:9042"),
+		},
+		Fees: &config.FeeConfig{MinimumMonthlyFee: proto.Uint64(30)},
+	}
+	var orgs []*config.OrganisationConfig
+	var err error
+
+	if orgs, err = Organisations(cfg); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(orgs) != 1 || orgs[0].GetName() != "Starship Factory" ||
+		orgs[0].GetTemplateDir() != "/srv/templates" {
+		t.Errorf("Unexpected single organisation %v", orgs)
+	}
+
+	cfg.Organisation = []*config.OrganisationConfig{
+		testOrganisation("Alpha", "alpha.example.com", "alpha"),
+	}
+	if orgs, err = Organisations(cfg); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if orgs[0].GetTemplateDir() != "/srv/templates" ||
+		orgs[0].GetFees().GetMinimumMonthlyFee() != 30 ||
+		orgs[0].GetDatabaseConfig().GetDatabaseServer() !=
+			"db.example.com:9042" ||
+		orgs[0].GetDatabaseConfig().GetDatabaseName() != "alpha" {
+		t.Errorf("Settings haven't been inherited: %v", orgs[0])
+	}
+	if cfg.Organisation[0].TemplateDir != nil {
+		t.Errorf("The configuration has been modified")
+	}
+}
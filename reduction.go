@@ -0,0 +1,108 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package membersys
+
+import (
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// States of a request for a fee reduction.
+const (
+	FeeReductionRequested = "requested"
+	FeeReductionApproved  = "approved"
+	FeeReductionDenied    = "denied"
+)
+
+// Largest document accepted in support of a fee reduction request.
+const MaxFeeReductionDocumentSize = 5 * 1048576
+
+// Types of documents accepted in support of fee reduction requests. They
+// are restricted to types which can't run scripts when they are viewed.
+var feeReductionDocumentTypes = []string{
+	"application/pdf", "image/jpeg", "image/png",
+}
+
+// Determine whether documents of the MIME type "doctype" are accepted in
+// support of fee reduction requests.
+func IsFeeReductionDocumentType(doctype string) bool {
+	var t string
+
+	for _, t = range feeReductionDocumentTypes {
+		if t == doctype {
+			return true
+		}
+	}
+	return false
+}
+
+// Record the decision of "actor" about the fee reduction requested along
+// with "agreement". Approved reductions apply until "valid_until", or
+// indefinitely if it is 0. Returns the state of the request before the
+// decision. A decision can be revised by deciding again.
+func decideFeeReduction(agreement *MembershipAgreement, approved bool,
+	valid_until uint64, comment string, actor *Actor, now time.Time) (
+	string, error) {
+	var reduction *FeeReduction = agreement.GetFeeReduction()
+	var old_status string = reduction.GetStatus()
+
+	if reduction == nil {
+		return "", grpc.Errorf(codes.FailedPrecondition,
+			"No fee reduction has been requested")
+	}
+
+	if approved {
+		reduction.Status = proto.String(FeeReductionApproved)
+	} else {
+		reduction.Status = proto.String(FeeReductionDenied)
+	}
+	reduction.ValidUntil = nil
+	if approved && valid_until > 0 {
+		reduction.ValidUntil = proto.Uint64(valid_until)
+	}
+
+	reduction.DeciderUid = nil
+	if actor != nil {
+		reduction.DeciderUid = proto.String(actor.User)
+	}
+	reduction.DecisionTimestamp = proto.Uint64(uint64(now.Unix()))
+
+	reduction.DecisionComment = nil
+	if len(comment) > 0 {
+		reduction.DecisionComment = proto.String(comment)
+	}
+
+	return old_status, nil
+}
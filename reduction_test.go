@@ -0,0 +1,124 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package membersys
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestDecideFeeReduction(t *testing.T) {
+	var now = time.Unix(1600000000, 0)
+	var tests = []struct {
+		name       string
+		reduction  *FeeReduction
+		approved   bool
+		validUntil uint64
+		comment    string
+		old        string
+		expected   *FeeReduction
+	}{
+		{"approve", &FeeReduction{
+			Status:        proto.String(FeeReductionRequested),
+			Justification: proto.String("Student"),
+		}, true, 1700000000, "Until the end of the semester",
+			FeeReductionRequested, &FeeReduction{
+				Status:            proto.String(FeeReductionApproved),
+				Justification:     proto.String("Student"),
+				DeciderUid:        proto.String("admin"),
+				DecisionTimestamp: proto.Uint64(1600000000),
+				ValidUntil:        proto.Uint64(1700000000),
+				DecisionComment:   proto.String("Until the end of the semester"),
+			}},
+		{"approve indefinitely", &FeeReduction{
+			Status: proto.String(FeeReductionRequested),
+		}, true, 0, "", FeeReductionRequested, &FeeReduction{
+			Status:            proto.String(FeeReductionApproved),
+			DeciderUid:        proto.String("admin"),
+			DecisionTimestamp: proto.Uint64(1600000000),
+		}},
+		{"deny", &FeeReduction{
+			Status: proto.String(FeeReductionRequested),
+		}, false, 1700000000, "", FeeReductionRequested, &FeeReduction{
+			Status:            proto.String(FeeReductionDenied),
+			DeciderUid:        proto.String("admin"),
+			DecisionTimestamp: proto.Uint64(1600000000),
+		}},
+		// Revising a decision drops what's left of the previous one.
+		{"revise", &FeeReduction{
+			Status:            proto.String(FeeReductionApproved),
+			DeciderUid:        proto.String("other"),
+			DecisionTimestamp: proto.Uint64(1500000000),
+			ValidUntil:        proto.Uint64(1700000000),
+			DecisionComment:   proto.String("Fine"),
+		}, false, 0, "", FeeReductionApproved, &FeeReduction{
+			Status:            proto.String(FeeReductionDenied),
+			DeciderUid:        proto.String("admin"),
+			DecisionTimestamp: proto.Uint64(1600000000),
+		}},
+	}
+	var agreement *MembershipAgreement
+	var old string
+	var i int
+	var err error
+
+	for i = range tests {
+		var test = tests[i]
+
+		agreement = &MembershipAgreement{FeeReduction: test.reduction}
+		old, err = decideFeeReduction(agreement, test.approved,
+			test.validUntil, test.comment, testActor, now)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if old != test.old {
+			t.Errorf("%s: expected the previous state %s, got %s",
+				test.name, test.old, old)
+		}
+		if !proto.Equal(agreement.GetFeeReduction(), test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected,
+				agreement.GetFeeReduction())
+		}
+	}
+
+	_, err = decideFeeReduction(new(MembershipAgreement), true, 0, "",
+		testActor, now)
+	if grpc.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Expected deciding without a request to fail with "+
+			"FailedPrecondition, got %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package membersys
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// A previous state of a member record, which has been replaced by a later
+// modification.
+type MemberRevision struct {
+	// Version of the record in this state.
+	Version int64
+
+	// Contents of the record.
+	Agreement *MembershipAgreement
+}
+
+// A field which differs between two states of a member record.
+type FieldDiff struct {
+	Field    string
+	OldValue string
+	NewValue string
+}
+
+// Fields of the member data which are compared between revisions.
+var memberRevisionFields = []string{
+	"name", "street", "city", "zipcode", "country", "phone", "email",
+	"username", "fee", "fee_yearly", "has_key", "payments_caught_up_to",
+	"category",
+}
+
+// Text fields which are restored when reverting to a revision. The user
+// name can't be changed once it has been set, and the e-mail address is
+// what the record is looked up by, so it has to be changed explicitly.
+var revertTextFields = []string{
+	"name", "street", "city", "zipcode", "country", "phone", "category",
+}
+
+// List the fields which differ between the member data "before" and
+// "after".
+func DiffMembers(before, after *Member) []*FieldDiff {
+	var rv []*FieldDiff
+	var field string
+
+	for _, field = range memberRevisionFields {
+		var old_value = fmt.Sprint(memberColumnValue(before, field))
+		var new_value = fmt.Sprint(memberColumnValue(after, field))
+
+		if old_value != new_value {
+			rv = append(rv, &FieldDiff{
+				Field:    field,
+				OldValue: old_value,
+				NewValue: new_value,
+			})
+		}
+	}
+
+	return rv
+}
+
+// Restore the record of the member "id" to the state it had at the
+// version "revision". The record must currently be at "version". The
+// differing fields are changed one by one using the regular update
+// functions, so every change is checked against the current version and
+// recorded in the audit log. If one of the updates fails, the fields
+// changed before remain changed. Returns the new version of the record.
+func RevertMember(ctx context.Context, db MembershipStore, id string, revision,
+	version int64, actor *Actor) (int64, error) {
+	var revisions []*MemberRevision
+	var rev *MemberRevision
+	var target, current *Member
+	var agreement *MembershipAgreement
+	var field string
+	var err error
+
+	if revisions, err = db.GetMemberRevisions(ctx, id); err != nil {
+		return 0, err
+	}
+
+	for _, rev = range revisions {
+		if rev.Version == revision {
+			target = rev.Agreement.GetMemberData()
+		}
+	}
+	if target == nil {
+		return 0, grpc.Errorf(codes.NotFound,
+			"No revision %d of the record of %s", revision, id)
+	}
+
+	if agreement, _, err = db.GetMemberDetail(ctx, id); err != nil {
+		return 0, err
+	}
+	current = agreement.GetMemberData()
+
+	if target.GetFee() != current.GetFee() ||
+		target.GetFeeYearly() != current.GetFeeYearly() {
+		version, err = db.SetMemberFee(ctx, id, target.GetFee(),
+			target.GetFeeYearly(), version, actor)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for _, field = range revertTextFields {
+		var value = fmt.Sprint(memberColumnValue(target, field))
+
+		if value == fmt.Sprint(memberColumnValue(current, field)) {
+			continue
+		}
+
+		version, err = db.SetTextValue(ctx, id, field, value, version, actor)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if target.GetHasKey() != current.GetHasKey() {
+		version, err = db.SetBoolValue(ctx, id, "has_key", target.GetHasKey(),
+			version, actor)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if target.GetPaymentsCaughtUpTo() != current.GetPaymentsCaughtUpTo() {
+		version, err = db.SetLongValue(ctx, id, "payments_caught_up_to",
+			target.GetPaymentsCaughtUpTo(), version, actor)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return version, nil
+}
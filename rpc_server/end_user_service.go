@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"github.com/starshipfactory/membersys"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -10,7 +11,7 @@ import (
 // EndUserService provides an RPC interface for end user centric requests to
 // the user database.
 type EndUserService struct {
-	database *membersys.MembershipDB
+	database membersys.MembershipStore
 }
 
 // GetMemberDetailByUsername fetches the membership agreement for the
@@ -21,9 +22,14 @@ func (e *EndUserService) GetMemberDetail(
 	var agreement *membersys.MembershipAgreement
 	var err error
 
-	agreement, err = e.database.GetMemberDetailByUsername(user.GetUsername())
+	agreement, err = e.database.GetMemberDetailByUsername(ctx,
+		user.GetUsername())
 	// Generate a gRPC compatible error.
-	if err != nil && grpc.Code(err) == codes.Unknown {
+	if err != nil && errors.Is(err, context.DeadlineExceeded) {
+		err = grpc.Errorf(codes.DeadlineExceeded, err.Error())
+	} else if err != nil && errors.Is(err, context.Canceled) {
+		err = grpc.Errorf(codes.Canceled, err.Error())
+	} else if err != nil && grpc.Code(err) == codes.Unknown {
 		err = grpc.Errorf(codes.Internal, err.Error())
 	}
 	return agreement, err
@@ -28,7 +28,7 @@ func main() {
 	var certFile string
 	var keyFile string
 
-	var db *membersys.MembershipDB
+	var db membersys.MembershipStore
 	var end_user_service *EndUserService
 	var err error
 
@@ -61,13 +61,12 @@ func main() {
 		log.Fatal("Unable to parse ", config_file, ": ", err)
 	}
 
-	// Connect to Cassandra.
-	db, err = membersys.NewMembershipDB(
-		config_data.DatabaseConfig.GetDatabaseServer(),
-		config_data.DatabaseConfig.GetDatabaseName(),
-		30*time.Second)
+	// Connect to the membership database.
+	db, err = membersys.NewMembershipStore(config_data.DatabaseConfig,
+		time.Duration(config_data.DatabaseConfig.GetDatabaseTimeout())*
+			time.Millisecond)
 	if err != nil {
-		log.Fatal("Error connecting to Cassandra database at ",
+		log.Fatal("Error connecting to the membership database at ",
 			config_data.DatabaseConfig.GetDatabaseServer(), ": ", err)
 	}
 
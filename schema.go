@@ -0,0 +1,654 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package membersys
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/golang/protobuf/proto"
+)
+
+// A column to be added to an existing Cassandra table.
+type SchemaColumn struct {
+	Table   string
+	Column  string
+	CQLType string
+}
+
+// A single step in the evolution of the Cassandra schema. Migrations are
+// applied in order; the schema version of a keyspace is the number of
+// migrations which have been applied to it.
+type SchemaMigration struct {
+	// Short name describing the migration.
+	Name string
+
+	// Columns to add to existing tables. Columns which exist already are
+	// skipped, since older versions of setup_cassandra created them
+	// without recording a schema version.
+	AddColumns []SchemaColumn
+
+	// CQL statements to execute once the columns have been added.
+	Statements []string
+
+	// Columns to remove from existing tables once the statements have
+	// been executed. Columns which don't exist are skipped.
+	DropColumns []SchemaColumn
+
+	// Function for rewriting existing data once the schema has been
+	// changed, e.g. to fill in new columns from pb_data. May be nil.
+	Rewrite func(sess *gocql.Session) error
+}
+
+// All migrations of the Cassandra schema, in the order they have to be
+// applied. Never change or reorder migrations which have been released;
+// append new ones instead.
+var SchemaMigrations = []*SchemaMigration{
+	&SchemaMigration{
+		Name: "create_tables",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS application (
+				id timeuuid PRIMARY KEY,
+				name text,
+				street text,
+				city text,
+				country text,
+				email text,
+				email_verified boolean,
+				phone text,
+				username text,
+				sourceip ascii,
+				useragent text,
+				pwhash text,
+				fee bigint,
+				fee_yearly boolean,
+				pb_data blob,
+				application_pdf blob
+			) WITH comment = 'Membership applications'`,
+			`CREATE TABLE IF NOT EXISTS members (
+				email text PRIMARY KEY,
+				name text,
+				street text,
+				city text,
+				country text,
+				phone text,
+				username text,
+				fee bigint,
+				fee_yearly boolean,
+				approval_ts bigint,
+				agreement_pdf blob,
+				pb_data blob
+			) WITH comment = 'Current Starship Factory members'`,
+			"CREATE INDEX IF NOT EXISTS members_name ON members (name)",
+			"CREATE INDEX IF NOT EXISTS members_street ON members (street)",
+			"CREATE INDEX IF NOT EXISTS members_city ON members (city)",
+			"CREATE INDEX IF NOT EXISTS members_country ON members (country)",
+			"CREATE INDEX IF NOT EXISTS members_username ON members (username)",
+			"CREATE INDEX IF NOT EXISTS members_fee ON members (fee)",
+			"CREATE INDEX IF NOT EXISTS members_fee_yearly " +
+				"ON members (fee_yearly)",
+			"CREATE INDEX IF NOT EXISTS members_approval_ts " +
+				"ON members (approval_ts)",
+			`CREATE TABLE IF NOT EXISTS member_agreements (
+				email text PRIMARY KEY,
+				agreement_pdf blob,
+				pb_data blob
+			) WITH comment = 'PDFs of membership agreements'`,
+			`CREATE TABLE IF NOT EXISTS membership_queue (
+				id timeuuid PRIMARY KEY,
+				pb_data blob
+			) WITH comment = 'Queue of approved membership agreements'`,
+			`CREATE TABLE IF NOT EXISTS membership_dequeue (
+				id timeuuid PRIMARY KEY,
+				pb_data blob
+			) WITH comment = 'Queue of departing members for deletion'`,
+			`CREATE TABLE IF NOT EXISTS membership_archive (
+				id timeuuid PRIMARY KEY,
+				pb_data blob
+			) WITH comment = 'Recently departed former members'`,
+		},
+	},
+	&SchemaMigration{
+		Name: "add_zipcode_key_and_payment_columns",
+		AddColumns: []SchemaColumn{
+			{"application", "zipcode", "text"},
+			{"members", "zipcode", "text"},
+			{"members", "has_key", "boolean"},
+			{"members", "payments_caught_up_to", "bigint"},
+		},
+		Statements: []string{
+			"CREATE INDEX IF NOT EXISTS members_zipcode ON members (zipcode)",
+			"CREATE INDEX IF NOT EXISTS members_has_key ON members (has_key)",
+			"CREATE INDEX IF NOT EXISTS members_payments_caught_up_to " +
+				"ON members (payments_caught_up_to)",
+		},
+		Rewrite: rewriteZipcodeKeyAndPayments,
+	},
+	&SchemaMigration{
+		Name: "add_member_version",
+		AddColumns: []SchemaColumn{
+			{"members", "version", "bigint"},
+		},
+		Rewrite: rewriteMemberVersion,
+	},
+	&SchemaMigration{
+		Name: "add_audit_log",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS audit_log (
+				subject text,
+				seq bigint,
+				pb_data blob,
+				PRIMARY KEY (subject, seq)
+			) WITH CLUSTERING ORDER BY (seq ASC)
+			AND comment = 'Hash chained log of changes to member records'`,
+		},
+	},
+	&SchemaMigration{
+		Name: "add_member_revisions",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS member_revisions (
+				email text,
+				version bigint,
+				pb_data blob,
+				PRIMARY KEY (email, version)
+			) WITH CLUSTERING ORDER BY (version DESC)
+			AND comment = 'Previous states of member records'`,
+		},
+	},
+	&SchemaMigration{
+		Name: "number_members",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS member_records (
+				id bigint PRIMARY KEY,
+				email text,
+				name text,
+				street text,
+				city text,
+				zipcode text,
+				country text,
+				phone text,
+				username text,
+				fee bigint,
+				fee_yearly boolean,
+				has_key boolean,
+				payments_caught_up_to bigint,
+				approval_ts bigint,
+				agreement_pdf blob,
+				pb_data blob,
+				version bigint
+			) WITH comment = 'Current Starship Factory members by number'`,
+			"CREATE INDEX IF NOT EXISTS member_records_name " +
+				"ON member_records (name)",
+			"CREATE INDEX IF NOT EXISTS member_records_street " +
+				"ON member_records (street)",
+			"CREATE INDEX IF NOT EXISTS member_records_city " +
+				"ON member_records (city)",
+			"CREATE INDEX IF NOT EXISTS member_records_zipcode " +
+				"ON member_records (zipcode)",
+			"CREATE INDEX IF NOT EXISTS member_records_country " +
+				"ON member_records (country)",
+			"CREATE INDEX IF NOT EXISTS member_records_username " +
+				"ON member_records (username)",
+			"CREATE INDEX IF NOT EXISTS member_records_fee " +
+				"ON member_records (fee)",
+			"CREATE INDEX IF NOT EXISTS member_records_fee_yearly " +
+				"ON member_records (fee_yearly)",
+			"CREATE INDEX IF NOT EXISTS member_records_has_key " +
+				"ON member_records (has_key)",
+			"CREATE INDEX IF NOT EXISTS member_records_payments_caught_up_to " +
+				"ON member_records (payments_caught_up_to)",
+			"CREATE INDEX IF NOT EXISTS member_records_approval_ts " +
+				"ON member_records (approval_ts)",
+			`CREATE TABLE IF NOT EXISTS member_emails (
+				email text PRIMARY KEY,
+				id bigint
+			) WITH comment = 'Membership numbers by e-mail address'`,
+			`CREATE TABLE IF NOT EXISTS member_numbers (
+				name text PRIMARY KEY,
+				last_id bigint
+			) WITH comment = 'Last membership number assigned'`,
+			`CREATE TABLE IF NOT EXISTS member_record_revisions (
+				id bigint,
+				version bigint,
+				pb_data blob,
+				PRIMARY KEY (id, version)
+			) WITH CLUSTERING ORDER BY (version DESC)
+			AND comment = 'Previous states of member records'`,
+		},
+		Rewrite: NumberMembers,
+	},
+	&SchemaMigration{
+		Name: "limit_denormalised_columns",
+		Statements: []string{
+			"DROP INDEX IF EXISTS member_records_street",
+			"DROP INDEX IF EXISTS member_records_zipcode",
+		},
+		DropColumns: []SchemaColumn{
+			{"application", "street", ""},
+			{"application", "zipcode", ""},
+			{"application", "country", ""},
+			{"application", "email_verified", ""},
+			{"application", "phone", ""},
+			{"application", "sourceip", ""},
+			{"application", "useragent", ""},
+			{"application", "pwhash", ""},
+			{"member_records", "street", ""},
+			{"member_records", "zipcode", ""},
+			{"member_records", "phone", ""},
+		},
+	},
+	&SchemaMigration{
+		Name: "add_agreement_blobs",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS agreement_blobs (
+				hash text PRIMARY KEY,
+				data blob
+			) WITH comment = 'Scanned membership agreements by hash'`,
+		},
+		DropColumns: []SchemaColumn{
+			{"application", "application_pdf", ""},
+			{"member_records", "agreement_pdf", ""},
+		},
+	},
+	&SchemaMigration{
+		// Records from before have no category, so there is nothing
+		// to fill in.
+		Name: "add_fee_category",
+		AddColumns: []SchemaColumn{
+			{"application", "category", "text"},
+			{"member_records", "category", "text"},
+		},
+		Statements: []string{
+			"CREATE INDEX IF NOT EXISTS member_records_category " +
+				"ON member_records (category)",
+		},
+	},
+}
+
+// Schema version the code in this package requires.
+var CurrentSchemaVersion int = len(SchemaMigrations)
+
+// Table recording which migrations have been applied to the keyspace.
+const schemaMigrationsTableDef = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version int PRIMARY KEY,
+	name text,
+	applied timestamp
+) WITH comment = 'Schema migrations applied by setup_cassandra'`
+
+// Fill in the zipcode, has_key and payments_caught_up_to columns of
+// existing records from their pb_data.
+func rewriteZipcodeKeyAndPayments(sess *gocql.Session) error {
+	var agreement *MembershipAgreement
+	var iter *gocql.Iter
+	var uuid gocql.UUID
+	var email string
+	var value []byte
+	var err error
+
+	iter = sess.Query("SELECT id, pb_data FROM application").Iter()
+	for iter.Scan(&uuid, &value) {
+		var md *Member
+
+		agreement = new(MembershipAgreement)
+		if err = proto.Unmarshal(value, agreement); err != nil {
+			iter.Close()
+			return fmt.Errorf("Error decoding application %s: %s",
+				uuid.String(), err)
+		}
+		md = agreement.GetMemberData()
+
+		err = sess.Query("UPDATE application SET zipcode = ? WHERE id = ?",
+			md.Zipcode, uuid).Exec()
+		if err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	if err = iter.Close(); err != nil {
+		return err
+	}
+
+	iter = sess.Query("SELECT email, pb_data FROM members").Iter()
+	for iter.Scan(&email, &value) {
+		var md *Member
+		var payments *int64
+
+		agreement = new(MembershipAgreement)
+		if err = proto.Unmarshal(value, agreement); err != nil {
+			iter.Close()
+			return fmt.Errorf("Error decoding member %s: %s", email, err)
+		}
+		md = agreement.GetMemberData()
+
+		if md.PaymentsCaughtUpTo != nil {
+			payments = proto.Int64(int64(md.GetPaymentsCaughtUpTo()))
+		}
+
+		err = sess.Query("UPDATE members SET zipcode = ?, has_key = ?, "+
+			"payments_caught_up_to = ? WHERE email = ?", md.Zipcode,
+			md.HasKey, payments, email).Exec()
+		if err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+// Initialize the version of existing member records from the time stamp
+// pb_data has been written at.
+func rewriteMemberVersion(sess *gocql.Session) error {
+	var iter *gocql.Iter
+	var email string
+	var written int64
+	var err error
+
+	iter = sess.Query("SELECT email, WRITETIME(pb_data) FROM members").Iter()
+	for iter.Scan(&email, &written) {
+		// Versions are in nanoseconds, time stamps in microseconds.
+		err = sess.Query("UPDATE members SET version = ? WHERE email = ?",
+			written*1000, email).Exec()
+		if err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+// Statement for writing the member records numbered by NumberMembers, which
+// runs before the category column has been added. The records predate
+// categories, so the category, the last value of memberRecordValues, is
+// left out.
+const cqlInsertNumberedMember = "INSERT INTO member_records (id, email, " +
+	"pb_data, name, city, country, username, fee, fee_yearly, has_key, " +
+	"payments_caught_up_to, approval_ts, version) " +
+	"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+
+// Number the members in the e-mail keyed members table in the order they
+// have been approved in, and copy them and their revisions to the tables
+// keyed by membership number. The old tables are left alone. This is also
+// used by thrift_to_cql, which fills the old tables of an already set up
+// keyspace.
+func NumberMembers(sess *gocql.Session) error {
+	var agreements []*MembershipAgreement
+	var versions = make(map[string]int64)
+	var agreement *MembershipAgreement
+	var iter *gocql.Iter
+	var email string
+	var value []byte
+	var version *int64
+	var values []interface{}
+	var revision int64
+	var number int64
+	var err error
+
+	iter = sess.Query("SELECT email, pb_data, version FROM members").Iter()
+	for iter.Scan(&email, &value, &version) {
+		agreement = new(MembershipAgreement)
+		if err = proto.Unmarshal(value, agreement); err != nil {
+			iter.Close()
+			return fmt.Errorf("Error decoding member %s: %s", email, err)
+		}
+		if agreement.MemberData == nil {
+			agreement.MemberData = new(Member)
+		}
+		agreement.MemberData.Email = proto.String(email)
+
+		agreements = append(agreements, agreement)
+		if version != nil {
+			versions[email] = *version
+		}
+	}
+	if err = iter.Close(); err != nil {
+		return err
+	}
+
+	sortByApproval(agreements)
+
+	for _, agreement = range agreements {
+		number++
+		email = agreement.MemberData.GetEmail()
+		agreement.MemberData.Id = proto.Uint64(uint64(number))
+
+		if value, err = proto.Marshal(agreement); err != nil {
+			return err
+		}
+
+		values = memberRecordValues(agreement, value, versions[email])
+		err = sess.Query(cqlInsertNumberedMember,
+			values[:len(values)-1]...).Exec()
+		if err != nil {
+			return err
+		}
+		err = sess.Query("INSERT INTO member_emails (email, id) "+
+			"VALUES (?, ?)", email, number).Exec()
+		if err != nil {
+			return err
+		}
+
+		iter = sess.Query("SELECT version, pb_data FROM member_revisions "+
+			"WHERE email = ?", email).Iter()
+		for iter.Scan(&revision, &value) {
+			err = sess.Query("INSERT INTO member_record_revisions "+
+				"(id, version, pb_data) VALUES (?, ?, ?)", number,
+				revision, value).Exec()
+			if err != nil {
+				iter.Close()
+				return err
+			}
+		}
+		if err = iter.Close(); err != nil {
+			return err
+		}
+	}
+
+	return sess.Query("INSERT INTO member_numbers (name, last_id) "+
+		"VALUES ('members', ?)", number).Exec()
+}
+
+// Determine when each migration has been applied to "keyspace". The
+// result maps schema versions to the time the migration was applied.
+func GetAppliedSchemaMigrations(sess *gocql.Session, keyspace string) (
+	map[int]time.Time, error) {
+	var rv = make(map[int]time.Time)
+	var iter *gocql.Iter
+	var table string
+	var version int
+	var applied time.Time
+	var err error
+
+	// Keyspaces set up before schema versions were introduced don't
+	// have the table yet.
+	err = sess.Query("SELECT table_name FROM system_schema.tables "+
+		"WHERE keyspace_name = ? AND table_name = 'schema_migrations'",
+		keyspace).Scan(&table)
+	if err == gocql.ErrNotFound {
+		return rv, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	iter = sess.Query("SELECT version, applied FROM " + keyspace +
+		".schema_migrations").Iter()
+	for iter.Scan(&version, &applied) {
+		rv[version] = applied
+	}
+
+	return rv, iter.Close()
+}
+
+// Determine the schema version of "keyspace", i.e. the number of
+// migrations which have been applied to it in order.
+func GetSchemaVersion(sess *gocql.Session, keyspace string) (int, error) {
+	var applied map[int]time.Time
+	var version int
+	var ok bool
+	var err error
+
+	if applied, err = GetAppliedSchemaMigrations(sess, keyspace); err != nil {
+		return 0, err
+	}
+
+	for _, ok = applied[version+1]; ok; _, ok = applied[version+1] {
+		version++
+	}
+
+	return version, nil
+}
+
+// Return an error unless "keyspace" is at the schema version required by
+// this package.
+func CheckSchemaVersion(sess *gocql.Session, keyspace string) error {
+	var version int
+	var err error
+
+	if version, err = GetSchemaVersion(sess, keyspace); err != nil {
+		return err
+	}
+
+	if version < CurrentSchemaVersion {
+		return fmt.Errorf("Keyspace %s is at schema version %d, but "+
+			"version %d is required; please run setup_cassandra up",
+			keyspace, version, CurrentSchemaVersion)
+	} else if version > CurrentSchemaVersion {
+		return fmt.Errorf("Keyspace %s is at schema version %d, which is "+
+			"newer than version %d supported by this binary", keyspace,
+			version, CurrentSchemaVersion)
+	}
+
+	return nil
+}
+
+// Add "col" to its table unless it exists already.
+func addSchemaColumn(sess *gocql.Session, keyspace string,
+	col SchemaColumn) error {
+	var name string
+	var err error
+
+	err = sess.Query("SELECT column_name FROM system_schema.columns "+
+		"WHERE keyspace_name = ? AND table_name = ? AND column_name = ?",
+		keyspace, col.Table, col.Column).Scan(&name)
+	if err == nil {
+		return nil
+	} else if err != gocql.ErrNotFound {
+		return err
+	}
+
+	return sess.Query("ALTER TABLE " + keyspace + "." + col.Table +
+		" ADD " + col.Column + " " + col.CQLType).Exec()
+}
+
+// Remove "col" from its table unless it has been removed already.
+func dropSchemaColumn(sess *gocql.Session, keyspace string,
+	col SchemaColumn) error {
+	var name string
+	var err error
+
+	err = sess.Query("SELECT column_name FROM system_schema.columns "+
+		"WHERE keyspace_name = ? AND table_name = ? AND column_name = ?",
+		keyspace, col.Table, col.Column).Scan(&name)
+	if err == gocql.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return sess.Query("ALTER TABLE " + keyspace + "." + col.Table +
+		" DROP " + col.Column).Exec()
+}
+
+// Apply all migrations to "keyspace" which haven't been applied yet.
+// "sess" must be bound to "keyspace". Before each migration is applied,
+// "progress" is called with its version, if it is not nil.
+func ApplySchemaMigrations(sess *gocql.Session, keyspace string,
+	progress func(version int, migration *SchemaMigration)) error {
+	var migration *SchemaMigration
+	var col SchemaColumn
+	var stmt string
+	var version int
+	var i int
+	var err error
+
+	if err = sess.Query(schemaMigrationsTableDef).Exec(); err != nil {
+		return err
+	}
+
+	if version, err = GetSchemaVersion(sess, keyspace); err != nil {
+		return err
+	}
+
+	for i = version; i < len(SchemaMigrations); i++ {
+		migration = SchemaMigrations[i]
+
+		if progress != nil {
+			progress(i+1, migration)
+		}
+
+		for _, col = range migration.AddColumns {
+			if err = addSchemaColumn(sess, keyspace, col); err != nil {
+				return fmt.Errorf("Error adding column %s.%s: %s",
+					col.Table, col.Column, err)
+			}
+		}
+
+		for _, stmt = range migration.Statements {
+			if err = sess.Query(stmt).Exec(); err != nil {
+				return fmt.Errorf("Error executing %s: %s", stmt, err)
+			}
+		}
+
+		for _, col = range migration.DropColumns {
+			if err = dropSchemaColumn(sess, keyspace, col); err != nil {
+				return fmt.Errorf("Error removing column %s.%s: %s",
+					col.Table, col.Column, err)
+			}
+		}
+
+		if migration.Rewrite != nil {
+			if err = migration.Rewrite(sess); err != nil {
+				return fmt.Errorf("Error rewriting data for %s: %s",
+					migration.Name, err)
+			}
+		}
+
+		err = sess.Query("INSERT INTO schema_migrations (version, name, "+
+			"applied) VALUES (?, ?, ?)", i+1, migration.Name,
+			time.Now()).Exec()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package membersys
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func TestNormalizeSearchText(t *testing.T) {
+	var tests = []struct {
+		text     string
+		expected string
+	}{
+		{"Zürich", "zurich"},
+		{"ZÜRICH", "zurich"},
+		{"Genève", "geneve"},
+		{"Straße", "strasse"},
+		{"Łódź", "lodz"},
+		{"Œuvre Ærø", "oeuvre aero"},
+		{"Þórr", "thorr"},
+		// Decomposed accents are dropped as well.
+		{"Zu\u0308rich", "zurich"},
+		{"ada@example.com", "ada@example.com"},
+		{"", ""},
+	}
+	var i int
+
+	for i = range tests {
+		var normalized = normalizeSearchText(tests[i].text)
+
+		if normalized != tests[i].expected {
+			t.Errorf("Expected %q to be normalized to %q, got %q",
+				tests[i].text, tests[i].expected, normalized)
+		}
+	}
+}
+
+func TestMatchesCriterion(t *testing.T) {
+	var member = &Member{
+		Id:       proto.Uint64(42),
+		Name:     proto.String("Jürg Müller"),
+		City:     proto.String("Zürich"),
+		Email:    proto.String("jmueller@example.com"),
+		Username: proto.String("jmu"),
+		Street:   proto.String("Bahnhofstrasse 1"),
+	}
+	var tests = []struct {
+		criterion string
+		matches   bool
+	}{
+		{"", true},
+		{"müller", true},
+		{"MULLER", true},
+		{"jurg zurich", true},
+		{"zurich jurg", true},
+		{"mueller", true},
+		{"jmu", true},
+		{"42", true},
+		{"42 muller", true},
+		{"4", false},
+		{"müller basel", false},
+		{"bahnhofstrasse", false},
+		{"meier", false},
+	}
+	var i int
+
+	for i = range tests {
+		if matchesCriterion(member, tests[i].criterion) != tests[i].matches {
+			t.Errorf("Expected matchesCriterion(%q) to be %v",
+				tests[i].criterion, tests[i].matches)
+		}
+	}
+}
@@ -1,314 +1,120 @@
 package main
 
 import (
-	"database/cassandra"
 	"flag"
+	"fmt"
 	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/starshipfactory/membersys"
 )
 
-func mkstringp(input string) *string {
-	var rv *string = new(string)
-	*rv = input
-	return rv
-}
+// Print the applied and pending migrations of "dbname".
+func status(sess *gocql.Session, dbname string) {
+	var applied map[int]time.Time
+	var migration *membersys.SchemaMigration
+	var version int
+	var i int
+	var err error
 
-func mkindextypep(input cassandra.IndexType) *cassandra.IndexType {
-	var rv *cassandra.IndexType = new(cassandra.IndexType)
-	*rv = input
-	return rv
-}
+	if applied, err = membersys.GetAppliedSchemaMigrations(sess, dbname); err != nil {
+		log.Fatal("Unable to determine applied migrations: ", err)
+	}
+	if version, err = membersys.GetSchemaVersion(sess, dbname); err != nil {
+		log.Fatal("Unable to determine schema version: ", err)
+	}
 
-func contains(list []string, elem string) bool {
-	var i string
+	fmt.Printf("Keyspace %s is at schema version %d of %d\n", dbname,
+		version, membersys.CurrentSchemaVersion)
 
-	for _, i = range list {
-		if i == elem {
-			return true
+	for i, migration = range membersys.SchemaMigrations {
+		var ts time.Time
+		var ok bool
+
+		if ts, ok = applied[i+1]; ok {
+			fmt.Printf("%4d %-40s applied %s\n", i+1, migration.Name,
+				ts.Format(time.RFC3339))
+		} else {
+			fmt.Printf("%4d %-40s pending\n", i+1, migration.Name)
 		}
 	}
-
-	return false
 }
 
-var desired_cf_defs = []*cassandra.CfDef{
-	// column family: application
-	&cassandra.CfDef{
-		Name:               "application",
-		ComparatorType:     "AsciiType",
-		Comment:            mkstringp("Membership applications"),
-		KeyValidationClass: mkstringp("BytesType"),
-		ColumnType:         "Standard",
-		Caching:            "keys_only",
-		SpeculativeRetry:   "100ms",
-		ColumnMetadata: []*cassandra.ColumnDef{
-			&cassandra.ColumnDef{
-				Name:            []byte("name"),
-				ValidationClass: "UTF8Type",
-			},
-			&cassandra.ColumnDef{
-				Name:            []byte("street"),
-				ValidationClass: "UTF8Type",
-			},
-			&cassandra.ColumnDef{
-				Name:            []byte("city"),
-				ValidationClass: "UTF8Type",
-			},
-			&cassandra.ColumnDef{
-				Name:            []byte("zipcode"),
-				ValidationClass: "UTF8Type",
-			},
-			&cassandra.ColumnDef{
-				Name:            []byte("country"),
-				ValidationClass: "UTF8Type",
-			},
-			&cassandra.ColumnDef{
-				Name:            []byte("email"),
-				ValidationClass: "UTF8Type",
-			},
-			&cassandra.ColumnDef{
-				Name:            []byte("phone"),
-				ValidationClass: "UTF8Type",
-			},
-			&cassandra.ColumnDef{
-				Name:            []byte("username"),
-				ValidationClass: "UTF8Type",
-			},
-			&cassandra.ColumnDef{
-				Name:            []byte("sourceip"),
-				ValidationClass: "AsciiType",
-			},
-			&cassandra.ColumnDef{
-				Name:            []byte("useragent"),
-				ValidationClass: "UTF8Type",
-			},
-			&cassandra.ColumnDef{
-				Name:            []byte("pwhash"),
-				ValidationClass: "UTF8Type",
-			},
-			&cassandra.ColumnDef{
-				Name:            []byte("fee"),
-				ValidationClass: "LongType",
-			},
-			&cassandra.ColumnDef{
-				Name:            []byte("email_verified"),
-				ValidationClass: "BooleanType",
-			},
-			&cassandra.ColumnDef{
-				Name:            []byte("fee_yearly"),
-				ValidationClass: "BooleanType",
-			},
-			&cassandra.ColumnDef{
-				Name:            []byte("pb_data"),
-				ValidationClass: "BytesType",
-			},
-		},
-	},
-	// column family: members
-	&cassandra.CfDef{
-		Name:               "members",
-		ComparatorType:     "AsciiType",
-		Comment:            mkstringp("Current Starship Factory members"),
-		KeyValidationClass: mkstringp("AsciiType"),
-		ColumnType:         "Standard",
-		Caching:            "keys_only",
-		SpeculativeRetry:   "20ms",
-		ColumnMetadata: []*cassandra.ColumnDef{
-			&cassandra.ColumnDef{
-				Name:            []byte("name"),
-				ValidationClass: "UTF8Type",
-				IndexType:       mkindextypep(cassandra.IndexType_KEYS),
-			},
-			&cassandra.ColumnDef{
-				Name:            []byte("street"),
-				ValidationClass: "UTF8Type",
-				IndexType:       mkindextypep(cassandra.IndexType_KEYS),
-			},
-			&cassandra.ColumnDef{
-				Name:            []byte("city"),
-				ValidationClass: "UTF8Type",
-				IndexType:       mkindextypep(cassandra.IndexType_KEYS),
-			},
-			&cassandra.ColumnDef{
-				Name:            []byte("zipcode"),
-				ValidationClass: "UTF8Type",
-				IndexType:       mkindextypep(cassandra.IndexType_KEYS),
-			},
-			&cassandra.ColumnDef{
-				Name:            []byte("country"),
-				ValidationClass: "UTF8Type",
-				IndexType:       mkindextypep(cassandra.IndexType_KEYS),
-			},
-			&cassandra.ColumnDef{
-				Name:            []byte("email"),
-				ValidationClass: "UTF8Type",
-				IndexType:       mkindextypep(cassandra.IndexType_KEYS),
-			},
-			&cassandra.ColumnDef{
-				Name:            []byte("phone"),
-				ValidationClass: "UTF8Type",
-			},
-			&cassandra.ColumnDef{
-				Name:            []byte("username"),
-				ValidationClass: "UTF8Type",
-				IndexType:       mkindextypep(cassandra.IndexType_KEYS),
-			},
-			&cassandra.ColumnDef{
-				Name:            []byte("fee"),
-				ValidationClass: "LongType",
-				IndexType:       mkindextypep(cassandra.IndexType_KEYS),
-			},
-			&cassandra.ColumnDef{
-				Name:            []byte("fee_yearly"),
-				ValidationClass: "BooleanType",
-				IndexType:       mkindextypep(cassandra.IndexType_KEYS),
-			},
-			&cassandra.ColumnDef{
-				Name:            []byte("has_key"),
-				ValidationClass: "BooleanType",
-				IndexType:       mkindextypep(cassandra.IndexType_KEYS),
-			},
-			&cassandra.ColumnDef{
-				Name:            []byte("payments_caught_up_to"),
-				ValidationClass: "LongType",
-				IndexType:       mkindextypep(cassandra.IndexType_KEYS),
-			},
-			&cassandra.ColumnDef{
-				Name:            []byte("approval_ts"),
-				ValidationClass: "LongType",
-				IndexType:       mkindextypep(cassandra.IndexType_KEYS),
-			},
-			&cassandra.ColumnDef{
-				Name:            []byte("agreement_pdf"),
-				ValidationClass: "BytesType",
-			},
-			&cassandra.ColumnDef{
-				Name:            []byte("pb_data"),
-				ValidationClass: "BytesType",
-			},
-		},
-	},
-	// column family: member_agreements
-	&cassandra.CfDef{
-		Name:               "member_agreements",
-		ComparatorType:     "AsciiType",
-		Comment:            mkstringp("PDFs of membership agreements"),
-		KeyValidationClass: mkstringp("AsciiType"),
-		ColumnType:         "Standard",
-		Caching:            "keys_only",
-		SpeculativeRetry:   "100ms",
-		ColumnMetadata: []*cassandra.ColumnDef{
-			&cassandra.ColumnDef{
-				Name:            []byte("agreement_pdf"),
-				ValidationClass: "BytesType",
-			},
-			&cassandra.ColumnDef{
-				Name:            []byte("pb_data"),
-				ValidationClass: "BytesType",
-			},
-		},
-	},
-	// column family: membership_queue
-	&cassandra.CfDef{
-		Name:               "membership_queue",
-		ComparatorType:     "AsciiType",
-		Comment:            mkstringp("Queue of approved membership agreements"),
-		KeyValidationClass: mkstringp("BytesType"),
-		ColumnType:         "Standard",
-		Caching:            "keys_only",
-		SpeculativeRetry:   "100ms",
-		ColumnMetadata: []*cassandra.ColumnDef{
-			&cassandra.ColumnDef{
-				Name:            []byte("pb_data"),
-				ValidationClass: "BytesType",
-			},
-		},
-	},
-	// column family: membership_dequeue
-	&cassandra.CfDef{
-		Name:               "membership_dequeue",
-		ComparatorType:     "AsciiType",
-		Comment:            mkstringp("Queue of departing members for deletion"),
-		KeyValidationClass: mkstringp("BytesType"),
-		ColumnType:         "Standard",
-		Caching:            "keys_only",
-		SpeculativeRetry:   "100ms",
-		ColumnMetadata: []*cassandra.ColumnDef{
-			&cassandra.ColumnDef{
-				Name:            []byte("pb_data"),
-				ValidationClass: "BytesType",
-			},
-		},
-	},
-	// column family: membership_archive
-	&cassandra.CfDef{
-		Name:               "membership_archive",
-		ComparatorType:     "AsciiType",
-		Comment:            mkstringp("Recently departed former members"),
-		KeyValidationClass: mkstringp("BytesType"),
-		ColumnType:         "Standard",
-		Caching:            "keys_only",
-		SpeculativeRetry:   "100ms",
-		ColumnMetadata: []*cassandra.ColumnDef{
-			&cassandra.ColumnDef{
-				Name:            []byte("pb_data"),
-				ValidationClass: "BytesType",
-			},
-		},
-	},
+// Create the keyspace "dbname" if needed and apply all pending migrations.
+func up(sess *gocql.Session, dbname string) {
+	var err error
+
+	err = membersys.ApplySchemaMigrations(sess, dbname,
+		func(version int, migration *membersys.SchemaMigration) {
+			log.Print("Applying migration ", version, ": ", migration.Name)
+		})
+	if err != nil {
+		log.Fatal("Unable to migrate keyspace ", dbname, ": ", err)
+	}
+
+	log.Print("Keyspace ", dbname, " is at schema version ",
+		membersys.CurrentSchemaVersion)
 }
 
 func main() {
-	var existing_cfs []string = make([]string, 0)
-	var ks_def *cassandra.KsDef
-	var cf_def *cassandra.CfDef
-	var conn *cassandra.RetryCassandraClient
+	var cluster *gocql.ClusterConfig
+	var sess *gocql.Session
 	var err error
 
 	var dbserver, dbname string
+	var replication_factor int
 
-	flag.StringVar(&dbserver, "cassandra-server", "localhost:9160",
-		"Database server to set up")
+	flag.StringVar(&dbserver, "cassandra-server", "localhost:9042",
+		"Database server to set up (comma separated list)")
 	flag.StringVar(&dbname, "dbname", "sfmembersys",
 		"Database name to set up")
+	flag.IntVar(&replication_factor, "replication-factor", 1,
+		"Replication factor to use if the keyspace has to be created")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] up|status\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	conn, err = cassandra.NewRetryCassandraClient(dbserver)
-	if err != nil {
-		log.Fatal(err)
+	if flag.NArg() != 1 || (flag.Arg(0) != "up" && flag.Arg(0) != "status") {
+		flag.Usage()
+		os.Exit(2)
 	}
 
-	err = conn.SetKeyspace(dbname)
-	if err != nil {
-		log.Fatal(err)
-	}
+	cluster = gocql.NewCluster(strings.Split(dbserver, ",")...)
+	cluster.Consistency = gocql.Quorum
 
-	ks_def, err = conn.DescribeKeyspace(dbname)
-	if err != nil {
-		log.Fatal("Error describing keyspace ", dbname, ": ", err)
-	}
+	// The keyspace has to exist before we can connect to it.
+	if flag.Arg(0) == "up" {
+		sess, err = cluster.CreateSession()
+		if err != nil {
+			log.Fatal(err)
+		}
 
-	for _, cf_def = range ks_def.GetCfDefs() {
-		existing_cfs = append(existing_cfs, cf_def.Name)
-		log.Print("Found existing column family ", cf_def.Name)
+		err = sess.Query("CREATE KEYSPACE IF NOT EXISTS " + dbname +
+			" WITH replication = {'class': 'SimpleStrategy', " +
+			"'replication_factor': " + strconv.Itoa(replication_factor) +
+			"}").Exec()
+		sess.Close()
+		if err != nil {
+			log.Fatal("Unable to create keyspace ", dbname, ": ", err)
+		}
 	}
 
-	for _, cf_def = range desired_cf_defs {
-		cf_def.Keyspace = dbname
+	cluster.Keyspace = dbname
+	sess, err = cluster.CreateSession()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer sess.Close()
 
-		if contains(existing_cfs, cf_def.Name) {
-			var rv string
-			rv, err = conn.SystemUpdateColumnFamily(cf_def)
-			if err != nil {
-				log.Fatal("Unable to update column family ", cf_def.Name, ": ", err)
-			}
-			log.Print("Successfully updated column family ", cf_def.Name, ": ", rv)
-		} else {
-			var rv string
-			rv, err = conn.SystemAddColumnFamily(cf_def)
-			if err != nil {
-				log.Fatal("Unable to add column family ", cf_def.Name, ": ", err)
-			}
-			log.Print("Successfully added column family ", cf_def.Name, ": ", rv)
-		}
+	if flag.Arg(0) == "up" {
+		up(sess, dbname)
+	} else {
+		status(sess, dbname)
 	}
 }
@@ -0,0 +1,1976 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+package membersys
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/golang/protobuf/proto"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/starshipfactory/membersys/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Membership database kept in a relational database, such as SQLite or
+// PostgreSQL. Every lifecycle state has its own table, and records are
+// moved between them in transactions. The scanned agreements are kept in
+// "blobs", which defaults to the agreement_blobs table.
+type SQLMembershipDB struct {
+	db        *sql.DB
+	retention *config.DatabaseConfig_RetentionConfig
+	blobs     BlobStore
+}
+
+// Schema of the tables keyed by the UUID of the record. The blob type
+// differs between database systems and will be filled in.
+const sqlRecordTableDef = `CREATE TABLE IF NOT EXISTS %s (
+	id VARCHAR(36) PRIMARY KEY,
+	pb_data %s NOT NULL,
+	ts BIGINT NOT NULL,
+	expires BIGINT)`
+
+// Schema of the member records, keyed by membership number. Some data is
+// denormalised into individual columns so the member list can be produced
+// without decoding pb_data. The unique e-mail addresses are used to look
+// up members.
+const sqlMemberTableDef = `CREATE TABLE IF NOT EXISTS member_records (
+	id BIGINT PRIMARY KEY,
+	email VARCHAR(255) NOT NULL UNIQUE,
+	name TEXT NOT NULL,
+	city TEXT NOT NULL,
+	country TEXT NOT NULL,
+	phone TEXT,
+	username VARCHAR(255),
+	fee BIGINT NOT NULL,
+	fee_yearly BOOLEAN NOT NULL,
+	has_key BOOLEAN,
+	payments_caught_up_to BIGINT,
+	category TEXT,
+	approval_ts BIGINT,
+	pb_data %s NOT NULL,
+	ts BIGINT NOT NULL)`
+
+// Columns which have been added to member_records later on, with their
+// types. They are added to tables created by earlier versions.
+var sqlMemberAddedColumns = [][2]string{
+	{"category", "TEXT"},
+}
+
+const sqlMemberIndexDef = `CREATE INDEX IF NOT EXISTS member_records_username
+	ON member_records (username)`
+
+// Schema of the table holding the last membership number assigned.
+const sqlMemberNumberTableDef = `CREATE TABLE IF NOT EXISTS member_numbers (
+	name VARCHAR(32) PRIMARY KEY,
+	last_id BIGINT NOT NULL)`
+
+// Schema of the table holding previous states of member records, keyed by
+// membership number so they don't have to be touched when the e-mail
+// address of a member changes.
+const sqlMemberRevisionTableDef = `CREATE TABLE IF NOT EXISTS member_revisions (
+	id BIGINT NOT NULL,
+	version BIGINT NOT NULL,
+	pb_data %s NOT NULL,
+	PRIMARY KEY (id, version))`
+
+// Schema of the audit log. The primary key ensures that concurrent
+// changes can't both append the same entry to the log of a member.
+const sqlAuditLogTableDef = `CREATE TABLE IF NOT EXISTS audit_log (
+	subject VARCHAR(255) NOT NULL,
+	seq BIGINT NOT NULL,
+	pb_data %s NOT NULL,
+	PRIMARY KEY (subject, seq))`
+
+// Schema of the table holding the scanned membership agreements, keyed by
+// the hash of their contents.
+const sqlBlobTableDef = `CREATE TABLE IF NOT EXISTS agreement_blobs (
+	hash VARCHAR(64) PRIMARY KEY,
+	data %s NOT NULL)`
+
+// Common subset of sql.DB and sql.Tx used for queries.
+type sqlQueryer interface {
+	ExecContext(ctx context.Context, query string,
+		args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string,
+		args ...interface{}) *sql.Row
+}
+
+// Open the SQL database "dsn" using the database/sql driver "driver"
+// ("sqlite3" or "postgres") and create all tables which don't exist yet.
+func NewSQLMembershipDB(driver, dsn string) (*SQLMembershipDB, error) {
+	var blobType string = "BYTEA"
+	var table string
+	var column [2]string
+	var db *sql.DB
+	var err error
+
+	if db, err = sql.Open(driver, dsn); err != nil {
+		return nil, err
+	}
+
+	if driver == "sqlite3" {
+		// SQLite only supports a single writer at a time anyway.
+		db.SetMaxOpenConns(1)
+		blobType = "BLOB"
+	}
+
+	for _, table = range recordTables {
+		_, err = db.Exec(fmt.Sprintf(sqlRecordTableDef, table, blobType))
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("Error creating table %s: %s", table, err)
+		}
+	}
+
+	if _, err = db.Exec(fmt.Sprintf(sqlMemberTableDef, blobType)); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Error creating table member_records: %s",
+			err)
+	}
+	for _, column = range sqlMemberAddedColumns {
+		if err = sqlAddColumn(db, "member_records", column[0],
+			column[1]); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("Error adding column %s to "+
+				"member_records: %s", column[0], err)
+		}
+	}
+	if _, err = db.Exec(sqlMemberIndexDef); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Error creating member_records index: %s",
+			err)
+	}
+	if _, err = db.Exec(sqlMemberNumberTableDef); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Error creating table member_numbers: %s",
+			err)
+	}
+	if _, err = db.Exec(fmt.Sprintf(sqlAuditLogTableDef, blobType)); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Error creating table audit_log: %s", err)
+	}
+	_, err = db.Exec(fmt.Sprintf(sqlMemberRevisionTableDef, blobType))
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Error creating table member_revisions: %s",
+			err)
+	}
+	if _, err = db.Exec(fmt.Sprintf(sqlBlobTableDef, blobType)); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Error creating table agreement_blobs: %s",
+			err)
+	}
+	if err = sqlAddColumn(db, "agreement_blobs", "stored", "BIGINT"); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Error adding column stored to "+
+			"agreement_blobs: %s", err)
+	}
+
+	if err = sqlNumberMembers(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Error numbering existing members: %s", err)
+	}
+	if err = sqlNumberRevisions(db, blobType); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Error numbering existing revisions: %s",
+			err)
+	}
+
+	return &SQLMembershipDB{db: db, blobs: &sqlBlobStore{db: db}}, nil
+}
+
+// Add the column "column" of the type "coltype" to "table", unless it
+// exists already.
+func sqlAddColumn(db *sql.DB, table, column, coltype string) error {
+	var rows *sql.Rows
+	var err error
+
+	rows, err = db.Query("SELECT " + column + " FROM " + table +
+		" WHERE 1 = 0")
+	if err == nil {
+		return rows.Close()
+	}
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column +
+		" " + coltype)
+	return err
+}
+
+// Move the members from the e-mail keyed members table used by earlier
+// versions to member_records, numbering them in the order they have been
+// approved in. The old table is dropped afterwards.
+func sqlNumberMembers(db *sql.DB) error {
+	var ctx context.Context = context.Background()
+	var m *SQLMembershipDB = &SQLMembershipDB{db: db}
+	var agreements []*MembershipAgreement
+	var agreement *MembershipAgreement
+	var rows *sql.Rows
+	var number int64
+	var tx *sql.Tx
+	var err error
+
+	// Databases created by this version don't have the table.
+	rows, err = db.Query("SELECT pb_data FROM members")
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var value []byte
+
+		if err = rows.Scan(&value); err != nil {
+			return err
+		}
+
+		agreement = new(MembershipAgreement)
+		if err = proto.Unmarshal(value, agreement); err != nil {
+			return err
+		}
+		agreements = append(agreements, agreement)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	sortByApproval(agreements)
+
+	if tx, err = db.Begin(); err != nil {
+		return err
+	}
+
+	for _, agreement = range agreements {
+		if err == nil {
+			number, err = m.allocateMemberNumber(ctx, tx)
+		}
+		if err == nil {
+			agreement.MemberData.Id = proto.Uint64(uint64(number))
+			err = m.putMember(ctx, tx, agreement, nextVersion(0))
+		}
+	}
+	if err == nil {
+		_, err = tx.Exec("DROP TABLE members")
+	}
+
+	return sqlFinishTx(tx, err)
+}
+
+// Key the revisions in the e-mail keyed member_revisions table used by
+// earlier versions by the membership number of the member instead.
+// Revisions of members who have left are dropped.
+func sqlNumberRevisions(db *sql.DB, blobType string) error {
+	var rows *sql.Rows
+	var tx *sql.Tx
+	var err error
+
+	// Tables created by this version don't have the column.
+	rows, err = db.Query("SELECT email FROM member_revisions WHERE 1 = 0")
+	if err != nil {
+		return nil
+	}
+	rows.Close()
+
+	if tx, err = db.Begin(); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("ALTER TABLE member_revisions " +
+		"RENAME TO member_revisions_by_email")
+	if err == nil {
+		_, err = tx.Exec(fmt.Sprintf(sqlMemberRevisionTableDef, blobType))
+	}
+	if err == nil {
+		_, err = tx.Exec("INSERT INTO member_revisions " +
+			"(id, version, pb_data) SELECT m.id, r.version, r.pb_data " +
+			"FROM member_revisions_by_email r " +
+			"JOIN member_records m ON m.email = r.email")
+	}
+	if err == nil {
+		_, err = tx.Exec("DROP TABLE member_revisions_by_email")
+	}
+
+	return sqlFinishTx(tx, err)
+}
+
+// Convert the UUID "id" into the canonical form used as the record key.
+func sqlRecordKey(id string) (string, error) {
+	var uuid gocql.UUID
+	var err error
+
+	if uuid, err = gocql.ParseUUID(id); err != nil {
+		return "", err
+	}
+	return uuid.String(), nil
+}
+
+// Translate the lack of a result into a gRPC compatible error.
+func sqlError(err error) error {
+	if err == sql.ErrNoRows {
+		return grpc.Errorf(codes.NotFound, "Not found")
+	}
+	return err
+}
+
+// Commit "tx" if "err" is nil, roll it back otherwise.
+func sqlFinishTx(tx *sql.Tx, err error) error {
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Fetch and decode the record "key" from "table", along with its time
+// stamp. Expired records are treated as nonexistent.
+func (m *SQLMembershipDB) getRecord(ctx context.Context, q sqlQueryer, table,
+	key string) (*MembershipAgreement, int64, error) {
+	var agreement *MembershipAgreement = new(MembershipAgreement)
+	var value []byte
+	var ts int64
+	var err error
+
+	err = q.QueryRowContext(ctx, "SELECT pb_data, ts FROM "+table+
+		" WHERE id = $1 AND (expires IS NULL OR expires > $2)",
+		key, time.Now().Unix()).Scan(&value, &ts)
+	if err != nil {
+		return nil, 0, sqlError(err)
+	}
+
+	err = proto.Unmarshal(value, agreement)
+	return agreement, ts, err
+}
+
+// Encode "agreement" and add it to "table" under the given key. If "ttl"
+// is positive, the record will expire after "ttl" seconds.
+func (m *SQLMembershipDB) putRecord(ctx context.Context, q sqlQueryer, table,
+	key string, agreement *MembershipAgreement, now time.Time,
+	ttl int32) error {
+	var expires sql.NullInt64
+	var value []byte
+	var err error
+
+	if value, err = proto.Marshal(agreement); err != nil {
+		return err
+	}
+
+	if ttl > 0 {
+		expires.Int64 = now.Unix() + int64(ttl)
+		expires.Valid = true
+	}
+
+	_, err = q.ExecContext(ctx, "INSERT INTO "+table+
+		" (id, pb_data, ts, expires) VALUES ($1, $2, $3, $4)",
+		key, value, now.UnixNano(), expires)
+	return err
+}
+
+// Fetch and decode the member record of "email", along with its time
+// stamp, which serves as the version of the record. The membership number
+// is part of the member data.
+func (m *SQLMembershipDB) getMember(ctx context.Context, q sqlQueryer,
+	email string) (*MembershipAgreement, int64, error) {
+	var agreement *MembershipAgreement = new(MembershipAgreement)
+	var value []byte
+	var ts int64
+	var err error
+
+	err = q.QueryRowContext(ctx,
+		"SELECT pb_data, ts FROM member_records WHERE email = $1",
+		email).Scan(&value, &ts)
+	if err != nil {
+		return nil, 0, sqlError(err)
+	}
+
+	err = proto.Unmarshal(value, agreement)
+	return agreement, ts, err
+}
+
+// Write the member record "agreement", keyed by the membership number of
+// the member, along with all denormalised columns and the time stamp "ts".
+func (m *SQLMembershipDB) putMember(ctx context.Context, q sqlQueryer,
+	agreement *MembershipAgreement, ts int64) error {
+	var md *Member = agreement.GetMemberData()
+	var phone, username, category sql.NullString
+	var paymentsCaughtUpTo sql.NullInt64
+	var hasKey sql.NullBool
+	var value []byte
+	var err error
+
+	if value, err = proto.Marshal(agreement); err != nil {
+		return err
+	}
+
+	if md.Phone != nil {
+		phone = sql.NullString{String: md.GetPhone(), Valid: true}
+	}
+	if md.Username != nil {
+		username = sql.NullString{String: md.GetUsername(), Valid: true}
+	}
+	if md.HasKey != nil {
+		hasKey = sql.NullBool{Bool: md.GetHasKey(), Valid: true}
+	}
+	if md.PaymentsCaughtUpTo != nil {
+		paymentsCaughtUpTo = sql.NullInt64{
+			Int64: int64(md.GetPaymentsCaughtUpTo()), Valid: true}
+	}
+	if md.Category != nil {
+		category = sql.NullString{String: md.GetCategory(), Valid: true}
+	}
+
+	_, err = q.ExecContext(ctx, `INSERT INTO member_records (id, email,
+		name, city, country, phone, username, fee, fee_yearly, has_key,
+		payments_caught_up_to, category, approval_ts, pb_data, ts)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14,
+		$15)
+		ON CONFLICT (id) DO UPDATE SET email = excluded.email,
+		name = excluded.name,
+		city = excluded.city, country = excluded.country,
+		phone = excluded.phone, username = excluded.username,
+		fee = excluded.fee, fee_yearly = excluded.fee_yearly,
+		has_key = excluded.has_key,
+		payments_caught_up_to = excluded.payments_caught_up_to,
+		category = excluded.category,
+		approval_ts = excluded.approval_ts, pb_data = excluded.pb_data,
+		ts = excluded.ts`,
+		int64(md.GetId()), md.GetEmail(), md.GetName(), md.GetCity(),
+		md.GetCountry(), phone,
+		username, int64(md.GetFee()), md.GetFeeYearly(), hasKey,
+		paymentsCaughtUpTo, category,
+		int64(agreement.GetMetadata().GetApprovalTimestamp()), value, ts)
+	return err
+}
+
+// Assign the next membership number as part of the transaction "tx".
+// Numbers of members who have left are never reused.
+func (m *SQLMembershipDB) allocateMemberNumber(ctx context.Context,
+	tx *sql.Tx) (int64, error) {
+	var res sql.Result
+	var number, rows int64
+	var err error
+
+	res, err = tx.ExecContext(ctx, "UPDATE member_numbers "+
+		"SET last_id = last_id + 1 WHERE name = 'members'")
+	if err == nil {
+		rows, err = res.RowsAffected()
+	}
+	if err == nil && rows == 0 {
+		_, err = tx.ExecContext(ctx, "INSERT INTO member_numbers "+
+			"(name, last_id) VALUES ('members', 1)")
+	}
+	if err == nil {
+		err = tx.QueryRowContext(ctx, "SELECT last_id FROM member_numbers "+
+			"WHERE name = 'members'").Scan(&number)
+	}
+	return number, err
+}
+
+// Ensure no member is using the e-mail address "email" yet.
+func (m *SQLMembershipDB) checkEmailUnused(ctx context.Context, tx *sql.Tx,
+	email string) error {
+	var number int64
+	var err error
+
+	err = tx.QueryRowContext(ctx, "SELECT id FROM member_records "+
+		"WHERE email = $1", email).Scan(&number)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return grpc.Errorf(codes.AlreadyExists,
+		"The e-mail address %s is already in use", email)
+}
+
+// Chain "entries" to the audit log of their subject as part of the
+// transaction "tx".
+func (m *SQLMembershipDB) audit(ctx context.Context, tx *sql.Tx,
+	entries ...*AuditLogEntry) error {
+	var last *AuditLogEntry
+	var entry *AuditLogEntry
+	var value []byte
+	var err error
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	err = tx.QueryRowContext(ctx, "SELECT pb_data FROM audit_log "+
+		"WHERE subject = $1 ORDER BY seq DESC LIMIT 1",
+		entries[0].GetSubject()).Scan(&value)
+	if err == nil {
+		last = new(AuditLogEntry)
+		if err = proto.Unmarshal(value, last); err != nil {
+			return err
+		}
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+
+	if err = chainAuditEntries(last, entries); err != nil {
+		return err
+	}
+
+	for _, entry = range entries {
+		if value, err = proto.Marshal(entry); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO audit_log "+
+			"(subject, seq, pb_data) VALUES ($1, $2, $3)",
+			entry.GetSubject(), int64(entry.GetSequence()), value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Store the given membership request in the database.
+func (m *SQLMembershipDB) StoreMembershipRequest(ctx context.Context,
+	req *FormInputData) (key string, err error) {
+	var pb *MembershipAgreement = new(MembershipAgreement)
+	var now = time.Now()
+	var uuid gocql.UUID
+	var tx *sql.Tx
+
+	uuid = gocql.UUIDFromTime(now)
+
+	if req.Metadata.RequestTimestamp == nil {
+		req.Metadata.RequestTimestamp = proto.Uint64(uint64(now.Unix()))
+	}
+	pb.MemberData = req.MemberData
+	pb.Metadata = req.Metadata
+	pb.FeeReduction = req.FeeReduction
+
+	// The supporting document is stored before the transaction is
+	// started, since SQLite only allows a single connection.
+	if pb.FeeReduction != nil && len(req.FeeReductionDocument) > 0 {
+		var hash string = blobHash(req.FeeReductionDocument)
+		if err = m.blobs.PutBlob(ctx, hash, req.FeeReductionDocument); err != nil {
+			return "", err
+		}
+		pb.FeeReduction.DocumentHash = proto.String(hash)
+	}
+
+	if tx, err = m.db.BeginTx(ctx, nil); err != nil {
+		return "", err
+	}
+
+	err = m.putRecord(ctx, tx, "application", uuid.String(), pb, now, 0)
+	if err == nil {
+		err = m.audit(ctx, tx, newAuditMove(applicantActor(req), pb,
+			uuid.String(), AuditActionApply, "", "application", now))
+	}
+
+	if err = sqlFinishTx(tx, err); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(uuid[:]), nil
+}
+
+// Retrieve a specific members detailed membership data, but fetch it by the
+// user name of the member.
+func (m *SQLMembershipDB) GetMemberDetailByUsername(ctx context.Context,
+	username string) (*MembershipAgreement, error) {
+	var agreement *MembershipAgreement = new(MembershipAgreement)
+	var value []byte
+	var err error
+
+	err = m.db.QueryRowContext(ctx,
+		"SELECT pb_data FROM member_records WHERE username = $1",
+		username).Scan(&value)
+	if err != nil {
+		return nil, sqlError(err)
+	}
+
+	err = proto.Unmarshal(value, agreement)
+	return agreement, err
+}
+
+// Retrieve a specific members detailed membership data, along with the
+// version of the record.
+func (m *SQLMembershipDB) GetMemberDetail(ctx context.Context, id string) (
+	*MembershipAgreement, int64, error) {
+	return m.getMember(ctx, m.db, id)
+}
+
+// Apply "modify" to the membership data of the member "id" and write it
+// back to the members table, provided the record is still at "version".
+// The previous state is kept as a revision, and changes to any of
+// "fields" are recorded in the audit log.
+func (m *SQLMembershipDB) updateMember(ctx context.Context, id string,
+	version int64, fields []string, actor *Actor,
+	modify func(*MembershipAgreement) error) (int64, error) {
+	var before, member *MembershipAgreement
+	var entries []*AuditLogEntry
+	var next int64 = nextVersion(version)
+	var email string
+	var res sql.Result
+	var value []byte
+	var rows int64
+	var tx *sql.Tx
+	var err error
+
+	if tx, err = m.db.BeginTx(ctx, nil); err != nil {
+		return 0, err
+	}
+
+	// Claim the record first, so concurrent updates based on the same
+	// version will find no matching row.
+	res, err = tx.ExecContext(ctx, "UPDATE member_records SET ts = $1 "+
+		"WHERE email = $2 AND ts = $3", next, id, version)
+	if err == nil {
+		rows, err = res.RowsAffected()
+	}
+	if err == nil && rows == 0 {
+		if _, _, err = m.getMember(ctx, tx, id); err == nil {
+			err = versionConflict(id)
+		}
+	}
+
+	if err == nil {
+		before, _, err = m.getMember(ctx, tx, id)
+	}
+	if err == nil {
+		value, err = proto.Marshal(before)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, "INSERT INTO member_revisions "+
+			"(id, version, pb_data) VALUES ($1, $2, $3)",
+			int64(before.GetMemberData().GetId()), version, value)
+	}
+	if err == nil {
+		member = proto.Clone(before).(*MembershipAgreement)
+		err = modify(member)
+	}
+	if err == nil {
+		email = member.GetMemberData().GetEmail()
+		entries = newAuditEdits(actor, id, before.GetMemberData(),
+			member.GetMemberData(), fields, time.Now())
+	}
+	if err == nil && email != id {
+		err = m.checkEmailUnused(ctx, tx, email)
+		if err == nil {
+			err = m.audit(ctx, tx, auditEntriesFor(email, entries)...)
+		}
+	}
+	if err == nil {
+		err = m.putMember(ctx, tx, member, next)
+	}
+	if err == nil {
+		err = m.audit(ctx, tx, entries...)
+	}
+
+	if err = sqlFinishTx(tx, err); err != nil {
+		return 0, err
+	}
+	return next, nil
+}
+
+// Update the membership fee for the given member.
+func (m *SQLMembershipDB) SetMemberFee(ctx context.Context, id string,
+	fee uint64, yearly bool, version int64, actor *Actor) (int64, error) {
+	return m.updateMember(ctx, id, version, []string{"fee", "fee_yearly"}, actor,
+		func(member *MembershipAgreement) error {
+			member.MemberData.Fee = proto.Uint64(fee)
+			member.MemberData.FeeYearly = proto.Bool(yearly)
+			return nil
+		})
+}
+
+// Update the specified long field for the given member.
+func (m *SQLMembershipDB) SetLongValue(ctx context.Context, id string,
+	field string, value uint64, version int64, actor *Actor) (int64, error) {
+	return m.updateMember(ctx, id, version, []string{field}, actor,
+		func(member *MembershipAgreement) error {
+			return setMemberLongField(member, field, value)
+		})
+}
+
+// Update the specified boolean field for the given member.
+func (m *SQLMembershipDB) SetBoolValue(ctx context.Context, id string,
+	field string, value bool, version int64, actor *Actor) (int64, error) {
+	return m.updateMember(ctx, id, version, []string{field}, actor,
+		func(member *MembershipAgreement) error {
+			return setMemberBoolField(member, field, value)
+		})
+}
+
+// Update the specified text column on the membership data.
+func (m *SQLMembershipDB) SetTextValue(ctx context.Context, id string, field,
+	value string, version int64, actor *Actor) (int64, error) {
+	return m.updateMember(ctx, id, version, []string{field}, actor,
+		func(member *MembershipAgreement) error {
+			return setMemberTextField(member, field, value)
+		})
+}
+
+// Retrieve an individual applicants data.
+func (m *SQLMembershipDB) GetMembershipRequest(ctx context.Context, id, table,
+	prefix string) (*MembershipAgreement, int64, error) {
+	var key string
+	var err error
+
+	if err = checkRecordTable(table); err != nil {
+		return nil, 0, err
+	}
+	if key, err = sqlRecordKey(id); err != nil {
+		return nil, 0, err
+	}
+
+	return m.getRecord(ctx, m.db, table, key)
+}
+
+// Translate the conditions of "filter", except for the search criterion,
+// into SQL. Placeholders are numbered following the arguments "args".
+// Returns the conditions to add to the WHERE clause, along with the
+// arguments extended by the values of the conditions.
+func sqlMemberConditions(filter *MemberFilter, args []interface{}) (
+	string, []interface{}) {
+	var cond string
+	var add = func(expr string, value interface{}) {
+		args = append(args, value)
+		cond += " AND " + strings.Replace(expr, "?",
+			"$"+strconv.Itoa(len(args)), 1)
+	}
+
+	if filter == nil {
+		return cond, args
+	}
+	if filter.HasKey != nil {
+		add("COALESCE(has_key, FALSE) = ?", *filter.HasKey)
+	}
+	if filter.FeeYearly != nil {
+		add("fee_yearly = ?", *filter.FeeYearly)
+	}
+	if filter.MinFee != nil {
+		add("fee >= ?", int64(*filter.MinFee))
+	}
+	if filter.MaxFee != nil {
+		add("fee <= ?", int64(*filter.MaxFee))
+	}
+	if filter.ApprovedAfter != nil {
+		add("approval_ts >= ?", int64(*filter.ApprovedAfter))
+	}
+	if filter.ApprovedBefore != nil {
+		add("approval_ts < ?", int64(*filter.ApprovedBefore))
+	}
+	if len(filter.Country) > 0 {
+		add("country = ?", filter.Country)
+	}
+	if len(filter.Category) > 0 {
+		add("category = ?", filter.Category)
+	}
+	if filter.PaidBefore != nil {
+		add("(payments_caught_up_to IS NULL OR payments_caught_up_to < ?)",
+			int64(*filter.PaidBefore))
+	}
+	return cond, args
+}
+
+// Get a list of all members currently in the database. Returns a set of
+// "num" entries meeting "filter", beginning at "prev".
+func (m *SQLMembershipDB) EnumerateMembers(ctx context.Context,
+	filter *MemberFilter, prev string, num int32) ([]*Member, error) {
+	var op string = ">="
+	var query, cond string
+	var args []interface{}
+	var start int64
+	var rows *sql.Rows
+	var rv []*Member
+	var err error
+
+	// Callers page past the last entry by appending a NUL byte to it.
+	if strings.HasSuffix(prev, "\000") {
+		prev = strings.TrimRight(prev, "\000")
+		op = ">"
+	}
+	if len(prev) > 0 {
+		if start, err = strconv.ParseInt(prev, 10, 64); err != nil {
+			return nil, grpc.Errorf(codes.InvalidArgument,
+				"Invalid membership number %s", prev)
+		}
+	}
+
+	cond, args = sqlMemberConditions(filter, []interface{}{start})
+	query, args = sqlPageQuery(`SELECT id, email, name, city, country,
+		phone, username, fee, fee_yearly, has_key, payments_caught_up_to,
+		category FROM member_records WHERE id `+op+` $1`+cond+` ORDER BY id`,
+		filter.criterion(), num, args...)
+	rows, err = m.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return rv, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var member *Member = new(Member)
+		var email, name, city, country string
+		var phone, username, category sql.NullString
+		var number, fee int64
+		var feeYearly bool
+		var hasKey sql.NullBool
+		var paymentsCaughtUpTo sql.NullInt64
+
+		err = rows.Scan(&number, &email, &name, &city, &country, &phone,
+			&username, &fee, &feeYearly, &hasKey, &paymentsCaughtUpTo,
+			&category)
+		if err != nil {
+			return rv, err
+		}
+
+		member.Id = proto.Uint64(uint64(number))
+		member.Email = proto.String(email)
+		member.Name = proto.String(name)
+		member.City = proto.String(city)
+		member.Country = proto.String(country)
+		if phone.Valid {
+			member.Phone = proto.String(phone.String)
+		}
+		if username.Valid {
+			member.Username = proto.String(username.String)
+		}
+		member.Fee = proto.Uint64(uint64(fee))
+		member.FeeYearly = proto.Bool(feeYearly)
+		if hasKey.Valid {
+			member.HasKey = proto.Bool(hasKey.Bool)
+		}
+		if paymentsCaughtUpTo.Valid {
+			member.PaymentsCaughtUpTo = proto.Uint64(
+				uint64(paymentsCaughtUpTo.Int64))
+		}
+		if category.Valid {
+			member.Category = proto.String(category.String)
+		}
+
+		if !matchesCriterion(member, filter.criterion()) {
+			continue
+		}
+
+		rv = append(rv, member)
+		if int32(len(rv)) >= num {
+			break
+		}
+	}
+
+	return rv, rows.Err()
+}
+
+// Complete the listing "query" by the limit on the number of rows. Without
+// a search criterion, only "num" rows are needed. Otherwise the rows are
+// filtered as they are read, so all of them are requested and the caller
+// stops reading once it has found "num" matches. Returns the query along
+// with its arguments.
+func sqlPageQuery(query, criterion string, num int32, args ...interface{}) (
+	string, []interface{}) {
+	if len(criterion) == 0 {
+		args = append(args, num)
+		query += " LIMIT $" + strconv.Itoa(len(args))
+	}
+	return query, args
+}
+
+// List the decoded records of "table" matching "criterion", beginning at
+// the UUID "prev".
+func (m *SQLMembershipDB) enumerateRecordsIn(ctx context.Context, table,
+	criterion, prev string, num int32) ([]*MemberWithKey, error) {
+	var query string
+	var args []interface{}
+	var rows *sql.Rows
+	var rv []*MemberWithKey
+	var start string
+	var err error
+
+	if len(prev) > 0 {
+		if start, err = sqlRecordKey(prev); err != nil {
+			return rv, err
+		}
+	}
+
+	query, args = sqlPageQuery("SELECT id, pb_data FROM "+table+
+		" WHERE id >= $1 AND (expires IS NULL OR expires > $2)"+
+		" ORDER BY id", criterion, num, start, time.Now().Unix())
+	rows, err = m.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return rv, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var agreement = new(MembershipAgreement)
+		var member = new(MemberWithKey)
+		var value []byte
+
+		if err = rows.Scan(&member.Key, &value); err != nil {
+			return rv, err
+		}
+		if err = proto.Unmarshal(value, agreement); err != nil {
+			return rv, err
+		}
+
+		proto.Merge(&member.Member, agreement.GetMemberData())
+		if !matchesCriterion(&member.Member, criterion) {
+			continue
+		}
+
+		rv = append(rv, member)
+		if int32(len(rv)) >= num {
+			break
+		}
+	}
+
+	return rv, rows.Err()
+}
+
+// Get a list of all membership applications currently in the database.
+// Returns a set of "num" entries matching "criterion", beginning at "prev".
+func (m *SQLMembershipDB) EnumerateMembershipRequests(ctx context.Context,
+	criterion, prev string, num int32) ([]*MemberWithKey, error) {
+	var records, rv []*MemberWithKey
+	var record *MemberWithKey
+	var err error
+
+	records, err = m.enumerateRecordsIn(ctx, "application", criterion, prev,
+		num)
+	if err != nil {
+		return rv, err
+	}
+
+	// Only return the data the application list needs.
+	for _, record = range records {
+		var member *MemberWithKey = new(MemberWithKey)
+
+		member.Key = record.Key
+		member.Name = proto.String(record.GetName())
+		member.Street = proto.String(record.GetStreet())
+		member.City = proto.String(record.GetCity())
+		member.Email = proto.String(record.GetEmail())
+		member.Username = record.Username
+		member.Fee = proto.Uint64(record.GetFee())
+		member.FeeYearly = proto.Bool(record.GetFeeYearly())
+		member.Category = record.Category
+
+		rv = append(rv, member)
+	}
+
+	return rv, nil
+}
+
+// Get a list of all future members which are currently in the queue.
+func (m *SQLMembershipDB) EnumerateQueuedMembers(ctx context.Context,
+	criterion, prev string, num int32) ([]*MemberWithKey, error) {
+	return m.enumerateRecordsIn(ctx, "membership_queue", criterion, prev,
+		num)
+}
+
+// Get a list of all future members which are currently in the departing
+// queue.
+func (m *SQLMembershipDB) EnumerateDeQueuedMembers(ctx context.Context,
+	criterion, prev string, num int32) ([]*MemberWithKey, error) {
+	return m.enumerateRecordsIn(ctx, "membership_dequeue", criterion, prev,
+		num)
+}
+
+// Get a list of all members which are currently in the trash. Expired
+// records are purged on the way.
+func (m *SQLMembershipDB) EnumerateTrashedMembers(ctx context.Context,
+	criterion, prev string, num int32) ([]*MemberWithKey, error) {
+	var err error
+
+	_, err = m.db.ExecContext(ctx,
+		"DELETE FROM membership_archive WHERE expires <= $1",
+		time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	return m.enumerateRecordsIn(ctx, "membership_archive", criterion, prev,
+		num)
+}
+
+// Move a member record to the queue for getting their user account removed
+// (e.g. when they leave us).
+func (m *SQLMembershipDB) MoveMemberToTrash(ctx context.Context, id string,
+	actor *Actor, reason string) error {
+	var now time.Time = time.Now()
+	var member *MembershipAgreement
+	var entry *AuditLogEntry
+	var uuid gocql.UUID
+	var tx *sql.Tx
+	var err error
+
+	uuid = gocql.UUIDFromTime(now)
+
+	if tx, err = m.db.BeginTx(ctx, nil); err != nil {
+		return err
+	}
+
+	if member, _, err = m.getMember(ctx, tx, id); err != nil {
+		return sqlFinishTx(tx, err)
+	}
+
+	member.Metadata.GoodbyeInitiator = proto.String(actor.User)
+	member.Metadata.GoodbyeTimestamp = proto.Uint64(uint64(now.Unix()))
+	member.Metadata.GoodbyeReason = proto.String(reason)
+
+	entry = newAuditMove(actor, member, id, AuditActionGoodbye, "members",
+		"membership_dequeue", now)
+	entry.Comment = proto.String(reason)
+
+	err = m.putRecord(ctx, tx, "membership_dequeue", uuid.String(), member,
+		now, 0)
+	if err == nil {
+		_, err = tx.ExecContext(ctx,
+			"DELETE FROM member_records WHERE email = $1", id)
+	}
+	if err == nil {
+		err = m.audit(ctx, tx, entry)
+	}
+
+	return sqlFinishTx(tx, err)
+}
+
+// Move the record of the given applicant to the queue of new users to be
+// processed. The approver will be set to "initiator".
+func (m *SQLMembershipDB) MoveApplicantToNewMember(ctx context.Context,
+	id string, actor *Actor) error {
+	return m.moveRecordToTable(ctx, id, actor, AuditActionAccept, "application",
+		"membership_queue", 0)
+}
+
+// Move the record of the given applicant to a temporary archive of deleted
+// applications. The deleter will be set to "initiator".
+func (m *SQLMembershipDB) MoveApplicantToTrash(ctx context.Context, id string,
+	actor *Actor) error {
+	return m.moveRecordToTable(ctx, id, actor, AuditActionReject, "application",
+		"membership_archive",
+		retentionTTL(m.retention.GetRejectedApplicationDays()))
+}
+
+// Move a member from the queue to the trash (e.g. if they can't be
+// processed).
+func (m *SQLMembershipDB) MoveQueuedRecordToTrash(ctx context.Context,
+	id string, actor *Actor) error {
+	return m.moveRecordToTable(ctx, id, actor, AuditActionCancel,
+		"membership_queue", "membership_archive",
+		retentionTTL(m.retention.GetCancelledQueueDays()))
+}
+
+// Move the record of the given applicant to a different table.
+func (m *SQLMembershipDB) moveRecordToTable(ctx context.Context, id string,
+	actor *Actor, action, src_table, dst_table string, ttl int32) error {
+	var now time.Time = time.Now()
+	var member *MembershipAgreement
+	var key string
+	var tx *sql.Tx
+	var err error
+
+	if key, err = sqlRecordKey(id); err != nil {
+		return err
+	}
+
+	if tx, err = m.db.BeginTx(ctx, nil); err != nil {
+		return err
+	}
+
+	if member, _, err = m.getRecord(ctx, tx, src_table, key); err != nil {
+		return sqlFinishTx(tx, err)
+	}
+
+	if dst_table == "membership_queue" && agreementPdfHash(member) == "" {
+		return sqlFinishTx(tx,
+			errors.New("No membership agreement scan has been uploaded"))
+	}
+
+	// Fill in details concerning the approval.
+	member.Metadata.ApproverUid = proto.String(actor.User)
+	member.Metadata.ApprovalTimestamp = proto.Uint64(uint64(now.Unix()))
+
+	err = m.putRecord(ctx, tx, dst_table, key, member, now, ttl)
+	if err == nil {
+		_, err = tx.ExecContext(ctx,
+			"DELETE FROM "+src_table+" WHERE id = $1", key)
+	}
+	if err == nil {
+		err = m.audit(ctx, tx, newAuditMove(actor, member, key, action,
+			src_table, dst_table, now))
+	}
+
+	return sqlFinishTx(tx, err)
+}
+
+// Add the membership agreement form scan to the given membership request
+// record. The scan itself is kept in the blob store; it is stored before
+// the transaction is started, since SQLite only allows a single
+// connection.
+func (m *SQLMembershipDB) StoreMembershipAgreement(ctx context.Context,
+	id string, agreement_data []byte, actor *Actor) error {
+	var now time.Time = time.Now()
+	var agreement *MembershipAgreement
+	var entry *AuditLogEntry
+	var hash string = blobHash(agreement_data)
+	var key string
+	var value []byte
+	var tx *sql.Tx
+	var err error
+
+	if key, err = sqlRecordKey(id); err != nil {
+		return err
+	}
+
+	if err = m.blobs.PutBlob(ctx, hash, agreement_data); err != nil {
+		return err
+	}
+
+	if tx, err = m.db.BeginTx(ctx, nil); err != nil {
+		return err
+	}
+
+	if agreement, _, err = m.getRecord(ctx, tx, "application", key); err != nil {
+		return sqlFinishTx(tx, err)
+	}
+
+	entry = newAuditAgreementUpload(actor, agreement, key, agreement_data,
+		now)
+
+	agreement.AgreementPdf = nil
+	agreement.AgreementPdfHash = proto.String(hash)
+	if value, err = proto.Marshal(agreement); err != nil {
+		return sqlFinishTx(tx, err)
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE application "+
+		"SET pb_data = $1, ts = $2 WHERE id = $3", value, now.UnixNano(),
+		key)
+	if err == nil {
+		err = m.audit(ctx, tx, entry)
+	}
+	return sqlFinishTx(tx, err)
+}
+
+// Record the decision about the fee reduction requested along with the
+// application "id". Approved reductions apply until "valid_until", or
+// indefinitely if it is 0.
+func (m *SQLMembershipDB) DecideFeeReduction(ctx context.Context, id string,
+	approved bool, valid_until uint64, comment string, actor *Actor) error {
+	var now time.Time = time.Now()
+	var agreement *MembershipAgreement
+	var old_status string
+	var key string
+	var value []byte
+	var tx *sql.Tx
+	var err error
+
+	if key, err = sqlRecordKey(id); err != nil {
+		return err
+	}
+
+	if tx, err = m.db.BeginTx(ctx, nil); err != nil {
+		return err
+	}
+
+	if agreement, _, err = m.getRecord(ctx, tx, "application", key); err != nil {
+		return sqlFinishTx(tx, err)
+	}
+
+	old_status, err = decideFeeReduction(agreement, approved, valid_until,
+		comment, actor, now)
+	if err != nil {
+		return sqlFinishTx(tx, err)
+	}
+	if value, err = proto.Marshal(agreement); err != nil {
+		return sqlFinishTx(tx, err)
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE application "+
+		"SET pb_data = $1, ts = $2 WHERE id = $3", value, now.UnixNano(),
+		key)
+	if err == nil {
+		err = m.audit(ctx, tx, newAuditFeeReduction(actor, agreement, key,
+			old_status, now))
+	}
+	return sqlFinishTx(tx, err)
+}
+
+// Mark the e-mail address of the application "id" as verified, provided
+// it is still "email".
+func (m *SQLMembershipDB) VerifyApplicationEmail(ctx context.Context, id,
+	email string, actor *Actor) error {
+	var now time.Time = time.Now()
+	var agreement *MembershipAgreement
+	var key string
+	var value []byte
+	var tx *sql.Tx
+	var err error
+
+	if key, err = sqlRecordKey(id); err != nil {
+		return err
+	}
+
+	if tx, err = m.db.BeginTx(ctx, nil); err != nil {
+		return err
+	}
+
+	if agreement, _, err = m.getRecord(ctx, tx, "application", key); err != nil {
+		return sqlFinishTx(tx, err)
+	}
+
+	if err = verifyApplicationEmail(agreement, email, actor, now); err != nil {
+		return sqlFinishTx(tx, err)
+	}
+	if value, err = proto.Marshal(agreement); err != nil {
+		return sqlFinishTx(tx, err)
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE application "+
+		"SET pb_data = $1, ts = $2 WHERE id = $3", value, now.UnixNano(),
+		key)
+	if err == nil {
+		err = m.audit(ctx, tx, newAuditEntry(actor, email, key,
+			AuditActionVerifyEmail, now))
+	}
+	return sqlFinishTx(tx, err)
+}
+
+// Merge the application "duplicate" into the application "id". The
+// combined record is kept as "id", the duplicate is moved to the archive
+// like a rejected application.
+func (m *SQLMembershipDB) MergeApplications(ctx context.Context, id,
+	duplicate string, actor *Actor) error {
+	var now time.Time = time.Now()
+	var agreement, other *MembershipAgreement
+	var entry *AuditLogEntry
+	var key, other_key string
+	var value []byte
+	var tx *sql.Tx
+	var err error
+
+	if key, err = sqlRecordKey(id); err != nil {
+		return err
+	}
+	if other_key, err = sqlRecordKey(duplicate); err != nil {
+		return err
+	}
+	if key == other_key {
+		return grpc.Errorf(codes.InvalidArgument,
+			"Cannot merge application %s with itself", id)
+	}
+
+	if tx, err = m.db.BeginTx(ctx, nil); err != nil {
+		return err
+	}
+
+	if agreement, _, err = m.getRecord(ctx, tx, "application", key); err != nil {
+		return sqlFinishTx(tx, err)
+	}
+	other, _, err = m.getRecord(ctx, tx, "application", other_key)
+	if err != nil {
+		return sqlFinishTx(tx, err)
+	}
+
+	mergeAgreements(agreement, other, other_key)
+	other.Metadata.ApproverUid = proto.String(actor.User)
+	other.Metadata.ApprovalTimestamp = proto.Uint64(uint64(now.Unix()))
+
+	if value, err = proto.Marshal(agreement); err != nil {
+		return sqlFinishTx(tx, err)
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE application "+
+		"SET pb_data = $1, ts = $2 WHERE id = $3", value, now.UnixNano(),
+		key)
+	if err == nil {
+		_, err = tx.ExecContext(ctx,
+			"DELETE FROM application WHERE id = $1", other_key)
+	}
+	if err == nil {
+		err = m.putRecord(ctx, tx, "membership_archive", other_key, other,
+			now, retentionTTL(m.retention.GetRejectedApplicationDays()))
+	}
+	for _, entry = range newAuditMerge(actor, agreement, other, key,
+		other_key, now) {
+		if err == nil {
+			err = m.audit(ctx, tx, entry)
+		}
+	}
+
+	return sqlFinishTx(tx, err)
+}
+
+// Turn the queued record "id" into a member record holding "agreement",
+// once the account of the new member has been created.
+func (m *SQLMembershipDB) MoveQueuedRecordToMember(ctx context.Context,
+	id string, agreement *MembershipAgreement, actor *Actor) error {
+	var now time.Time = time.Now()
+	var number int64
+	var key string
+	var tx *sql.Tx
+	var err error
+
+	if key, err = sqlRecordKey(id); err != nil {
+		return err
+	}
+
+	if tx, err = m.db.BeginTx(ctx, nil); err != nil {
+		return err
+	}
+
+	if _, _, err = m.getRecord(ctx, tx, "membership_queue", key); err != nil {
+		return sqlFinishTx(tx, err)
+	}
+
+	err = m.checkEmailUnused(ctx, tx, agreement.GetMemberData().GetEmail())
+	if err == nil {
+		number, err = m.allocateMemberNumber(ctx, tx)
+	}
+	if err == nil {
+		agreement.MemberData.Id = proto.Uint64(uint64(number))
+		err = m.putMember(ctx, tx, agreement, now.UnixNano())
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx,
+			"DELETE FROM membership_queue WHERE id = $1", key)
+	}
+	if err == nil {
+		err = m.audit(ctx, tx, newAuditMove(actor, agreement, key,
+			AuditActionCreateAccount, "membership_queue", "members", now))
+	}
+
+	return sqlFinishTx(tx, err)
+}
+
+// Add "agreement", imported from another system, as a member record and
+// assign the next membership number to it.
+func (m *SQLMembershipDB) AddImportedMember(ctx context.Context,
+	agreement *MembershipAgreement, actor *Actor) error {
+	var now time.Time = time.Now()
+	var number int64
+	var tx *sql.Tx
+	var err error
+
+	if tx, err = m.db.BeginTx(ctx, nil); err != nil {
+		return err
+	}
+
+	err = m.checkEmailUnused(ctx, tx, agreement.GetMemberData().GetEmail())
+	if err == nil {
+		number, err = m.allocateMemberNumber(ctx, tx)
+	}
+	if err == nil {
+		agreement.MemberData.Id = proto.Uint64(uint64(number))
+		err = m.putMember(ctx, tx, agreement, now.UnixNano())
+	}
+	if err == nil {
+		err = m.audit(ctx, tx, newAuditMove(actor, agreement,
+			strconv.FormatInt(number, 10), AuditActionImport, "",
+			"members", now))
+	}
+
+	return sqlFinishTx(tx, err)
+}
+
+// Move the record "id" of a departed member from the departing queue to
+// the archive, once their account has been removed.
+func (m *SQLMembershipDB) MoveDeQueuedRecordToArchive(ctx context.Context,
+	id string, actor *Actor) error {
+	var now time.Time = time.Now()
+	var agreement *MembershipAgreement
+	var key string
+	var tx *sql.Tx
+	var err error
+
+	if key, err = sqlRecordKey(id); err != nil {
+		return err
+	}
+
+	if tx, err = m.db.BeginTx(ctx, nil); err != nil {
+		return err
+	}
+
+	agreement, _, err = m.getRecord(ctx, tx, "membership_dequeue", key)
+	if err != nil {
+		return sqlFinishTx(tx, err)
+	}
+
+	err = m.putRecord(ctx, tx, "membership_archive", key, agreement, now,
+		retentionTTL(m.retention.GetFormerMemberDays()))
+	if err == nil {
+		_, err = tx.ExecContext(ctx,
+			"DELETE FROM membership_dequeue WHERE id = $1", key)
+	}
+	if err == nil {
+		err = m.audit(ctx, tx, newAuditMove(actor, agreement, key,
+			AuditActionArchive, "membership_dequeue", "membership_archive",
+			now))
+	}
+
+	return sqlFinishTx(tx, err)
+}
+
+// Move the record "id" from the archive back to the application table, or
+// for former members, back to the members.
+func (m *SQLMembershipDB) RestoreArchivedRecord(ctx context.Context,
+	id string, actor *Actor) error {
+	var now time.Time = time.Now()
+	var agreement *MembershipAgreement
+	var dst_table string
+	var number int64
+	var key string
+	var tx *sql.Tx
+	var err error
+
+	if key, err = sqlRecordKey(id); err != nil {
+		return err
+	}
+
+	if tx, err = m.db.BeginTx(ctx, nil); err != nil {
+		return err
+	}
+
+	agreement, _, err = m.getRecord(ctx, tx, "membership_archive", key)
+	if err != nil {
+		return sqlFinishTx(tx, err)
+	}
+
+	dst_table = restoreArchivedAgreement(agreement)
+	if dst_table == "members" {
+		err = m.checkEmailUnused(ctx, tx,
+			agreement.GetMemberData().GetEmail())
+
+		// Members who left before membership numbers were introduced
+		// get a new one.
+		if err == nil && agreement.GetMemberData().GetId() == 0 {
+			number, err = m.allocateMemberNumber(ctx, tx)
+			agreement.MemberData.Id = proto.Uint64(uint64(number))
+		}
+		if err == nil {
+			err = m.putMember(ctx, tx, agreement, now.UnixNano())
+		}
+	} else {
+		err = m.putRecord(ctx, tx, dst_table, key, agreement, now, 0)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx,
+			"DELETE FROM membership_archive WHERE id = $1", key)
+	}
+	if err == nil {
+		err = m.audit(ctx, tx, newAuditMove(actor, agreement, key,
+			AuditActionRestore, "membership_archive", dst_table, now))
+	}
+
+	return sqlFinishTx(tx, err)
+}
+
+// Retrieve the audit log of the member with the e-mail address "subject",
+// oldest entry first.
+func (m *SQLMembershipDB) GetAuditLog(ctx context.Context, subject string) (
+	[]*AuditLogEntry, error) {
+	var rows *sql.Rows
+	var rv []*AuditLogEntry
+	var err error
+
+	rows, err = m.db.QueryContext(ctx, "SELECT pb_data FROM audit_log "+
+		"WHERE subject = $1 ORDER BY seq", subject)
+	if err != nil {
+		return rv, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry *AuditLogEntry = new(AuditLogEntry)
+		var value []byte
+
+		if err = rows.Scan(&value); err != nil {
+			return rv, err
+		}
+		if err = proto.Unmarshal(value, entry); err != nil {
+			return rv, err
+		}
+
+		rv = append(rv, entry)
+	}
+
+	return rv, rows.Err()
+}
+
+// Retrieve the previous states of the record of the member "id", newest
+// first.
+func (m *SQLMembershipDB) GetMemberRevisions(ctx context.Context, id string) (
+	[]*MemberRevision, error) {
+	var rows *sql.Rows
+	var rv []*MemberRevision
+	var err error
+
+	rows, err = m.db.QueryContext(ctx, "SELECT r.version, r.pb_data "+
+		"FROM member_revisions r JOIN member_records m ON m.id = r.id "+
+		"WHERE m.email = $1 ORDER BY r.version DESC", id)
+	if err != nil {
+		return rv, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var revision *MemberRevision = new(MemberRevision)
+		var value []byte
+
+		if err = rows.Scan(&revision.Version, &value); err != nil {
+			return rv, err
+		}
+		revision.Agreement = new(MembershipAgreement)
+		if err = proto.Unmarshal(value, revision.Agreement); err != nil {
+			return rv, err
+		}
+
+		rv = append(rv, revision)
+	}
+
+	return rv, rows.Err()
+}
+
+// List the records which will be deleted before "before" because their
+// retention period is over, the earliest first.
+func (m *SQLMembershipDB) EnumerateExpiringRecords(ctx context.Context,
+	before time.Time) ([]*ExpiringRecord, error) {
+	var rv []*ExpiringRecord
+	var table string
+	var err error
+
+	for _, table = range recordTables {
+		var rows *sql.Rows
+
+		rows, err = m.db.QueryContext(ctx, "SELECT id, pb_data, expires FROM "+
+			table+" WHERE expires IS NOT NULL AND expires > $1 "+
+			"AND expires < $2", time.Now().Unix(), before.Unix())
+		if err != nil {
+			return rv, err
+		}
+
+		for rows.Next() {
+			var record = &ExpiringRecord{
+				Table:     table,
+				Agreement: new(MembershipAgreement),
+			}
+			var value []byte
+			var expires int64
+
+			if err = rows.Scan(&record.Key, &value, &expires); err != nil {
+				rows.Close()
+				return rv, err
+			}
+			if err = proto.Unmarshal(value, record.Agreement); err != nil {
+				rows.Close()
+				return rv, err
+			}
+
+			record.Expires = time.Unix(expires, 0)
+			rv = append(rv, record)
+		}
+
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return rv, err
+		}
+	}
+
+	sortByExpiry(rv)
+	return rv, nil
+}
+
+// Delete the records whose retention period is over, along with the
+// blobs no record refers to any more.
+func (m *SQLMembershipDB) PurgeExpiredRecords(ctx context.Context) error {
+	var now int64 = time.Now().Unix()
+	var table string
+	var err error
+
+	for _, table = range recordTables {
+		_, err = m.db.ExecContext(ctx,
+			"DELETE FROM "+table+" WHERE expires <= $1", now)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = sweepBlobs(ctx, m.blobs, func(refs map[string]int) error {
+		return m.countBlobReferences(ctx, refs)
+	})
+	return err
+}
+
+// Count the references of all records to blobs in "refs". Revisions only
+// count as long as the member is still around.
+func (m *SQLMembershipDB) countBlobReferences(ctx context.Context,
+	refs map[string]int) error {
+	var queries []string
+	var query, table string
+	var err error
+
+	for _, table = range recordTables {
+		queries = append(queries, "SELECT pb_data FROM "+table)
+	}
+	queries = append(queries, "SELECT pb_data FROM member_records",
+		"SELECT r.pb_data FROM member_revisions r "+
+			"JOIN member_records m ON m.id = r.id")
+
+	for _, query = range queries {
+		var rows *sql.Rows
+
+		if rows, err = m.db.QueryContext(ctx, query); err != nil {
+			return err
+		}
+		for rows.Next() {
+			var agreement = new(MembershipAgreement)
+			var value []byte
+
+			if err = rows.Scan(&value); err != nil {
+				rows.Close()
+				return err
+			}
+			if err = proto.Unmarshal(value, agreement); err != nil {
+				rows.Close()
+				return err
+			}
+			countBlobReferences(refs, agreement)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Call "fn" for every record of every lifecycle state, and for the last
+// membership number assigned. Stops at the first error.
+func (m *SQLMembershipDB) ExportRecords(ctx context.Context,
+	fn func(*BackupRecord) error) error {
+	var now int64 = time.Now().Unix()
+	var rows *sql.Rows
+	var table string
+	var last int64
+	var err error
+
+	// Blobs come first, so they are there once the records referring to
+	// them have been restored.
+	if err = exportBlobs(ctx, m.blobs, nil, fn); err != nil {
+		return err
+	}
+
+	for _, table = range recordTables {
+		rows, err = m.db.QueryContext(ctx, "SELECT id, pb_data, expires "+
+			"FROM "+table+" WHERE expires IS NULL OR expires > $1 "+
+			"ORDER BY id", now)
+		if err != nil {
+			return err
+		}
+
+		for rows.Next() {
+			var record = &BackupRecord{
+				Table:     proto.String(table),
+				Key:       new(string),
+				Agreement: new(MembershipAgreement),
+			}
+			var expires sql.NullInt64
+			var value []byte
+
+			if err = rows.Scan(record.Key, &value, &expires); err != nil {
+				rows.Close()
+				return err
+			}
+			if expires.Valid {
+				record.Ttl = proto.Int32(int32(expires.Int64 - now))
+			}
+			if err = proto.Unmarshal(value, record.Agreement); err != nil {
+				rows.Close()
+				return err
+			}
+			if err = fn(record); err != nil {
+				rows.Close()
+				return err
+			}
+		}
+
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	rows, err = m.db.QueryContext(ctx,
+		"SELECT id, pb_data FROM member_records ORDER BY id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var record = &BackupRecord{
+			Table:     proto.String("members"),
+			Agreement: new(MembershipAgreement),
+		}
+		var number int64
+		var value []byte
+
+		if err = rows.Scan(&number, &value); err != nil {
+			return err
+		}
+		if err = proto.Unmarshal(value, record.Agreement); err != nil {
+			return err
+		}
+		record.Key = proto.String(strconv.FormatInt(number, 10))
+		if err = fn(record); err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	err = m.db.QueryRowContext(ctx, "SELECT last_id FROM member_numbers "+
+		"WHERE name = 'members'").Scan(&last)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return fn(&BackupRecord{
+		Table:            proto.String("member_numbers"),
+		Key:              proto.String("members"),
+		LastMemberNumber: proto.Uint64(uint64(last)),
+	})
+}
+
+// Ensure the last membership number assigned is at least "number" as part
+// of the transaction "tx", so numbers of imported members aren't handed
+// out again.
+func (m *SQLMembershipDB) raiseMemberNumber(ctx context.Context, tx *sql.Tx,
+	number int64) error {
+	var err error
+
+	_, err = tx.ExecContext(ctx, "UPDATE member_numbers SET last_id = $1 "+
+		"WHERE name = 'members' AND last_id < $1", number)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, "INSERT INTO member_numbers "+
+			"(name, last_id) VALUES ('members', $1) "+
+			"ON CONFLICT (name) DO NOTHING", number)
+	}
+	return err
+}
+
+// Write "record" as it has been exported from a database. Records with the
+// same key are replaced, so an import can be repeated.
+func (m *SQLMembershipDB) ImportRecord(ctx context.Context,
+	record *BackupRecord) error {
+	var agreement *MembershipAgreement = record.GetAgreement()
+	var number int64
+	var key string
+	var tx *sql.Tx
+	var err error
+
+	if err = checkBackupRecord(record); err != nil {
+		return err
+	}
+	if record.GetTable() == "agreement_blobs" {
+		return m.blobs.PutBlob(ctx, record.GetKey(), record.BlobData)
+	}
+
+	if tx, err = m.db.BeginTx(ctx, nil); err != nil {
+		return err
+	}
+
+	if record.GetTable() == "member_numbers" {
+		err = m.raiseMemberNumber(ctx, tx,
+			int64(record.GetLastMemberNumber()))
+		return sqlFinishTx(tx, err)
+	}
+
+	if record.GetTable() == "members" {
+		number, err = strconv.ParseInt(record.GetKey(), 10, 64)
+		if err == nil {
+			agreement.MemberData.Id = proto.Uint64(uint64(number))
+			err = m.raiseMemberNumber(ctx, tx, number)
+		}
+		if err == nil {
+			err = m.putMember(ctx, tx, agreement, nextVersion(0))
+		}
+		return sqlFinishTx(tx, err)
+	}
+
+	key, err = sqlRecordKey(record.GetKey())
+	if err == nil {
+		_, err = tx.ExecContext(ctx, "DELETE FROM "+record.GetTable()+
+			" WHERE id = $1", key)
+	}
+	if err == nil {
+		err = m.putRecord(ctx, tx, record.GetTable(), key, agreement,
+			time.Now(), record.GetTtl())
+	}
+	return sqlFinishTx(tx, err)
+}
+
+// Retrieve the scanned membership agreement of "agreement" from the blob
+// store.
+func (m *SQLMembershipDB) GetAgreementPdf(ctx context.Context,
+	agreement *MembershipAgreement) ([]byte, error) {
+	return readAgreementPdf(ctx, m.blobs, nil, agreement)
+}
+
+// Retrieve the document supporting the fee reduction request of
+// "agreement" from the blob store.
+func (m *SQLMembershipDB) GetFeeReductionDocument(ctx context.Context,
+	agreement *MembershipAgreement) ([]byte, error) {
+	return readFeeReductionDocument(ctx, m.blobs, nil, agreement)
+}
+
+// Tables holding MembershipAgreement records, along with their key
+// columns.
+var sqlAgreementTables = []struct {
+	table string
+	keys  []string
+}{
+	{"application", []string{"id"}},
+	{"membership_queue", []string{"id"}},
+	{"membership_dequeue", []string{"id"}},
+	{"membership_archive", []string{"id"}},
+	{"member_records", []string{"id"}},
+	{"member_revisions", []string{"id", "version"}},
+}
+
+// Move the agreements embedded in records written by earlier versions to
+// the blob store. The records to rewrite are collected first, since SQLite
+// only allows a single connection; records modified in the meantime are
+// skipped, so the migration may have to be run again. Returns the number
+// of records which have been rewritten.
+func (m *SQLMembershipDB) MoveAgreementsToBlobStore(ctx context.Context) (
+	int, error) {
+	var count int
+	var i int
+	var err error
+
+	for i = range sqlAgreementTables {
+		var table = &sqlAgreementTables[i]
+		var conds []string
+		var rowKeys [][]string
+		var values [][]byte
+		var rows *sql.Rows
+		var column string
+		var j int
+
+		for j, column = range table.keys {
+			conds = append(conds, fmt.Sprintf("%s = $%d", column, j+3))
+		}
+
+		rows, err = m.db.QueryContext(ctx, "SELECT "+
+			strings.Join(table.keys, ", ")+", pb_data FROM "+table.table)
+		if err != nil {
+			return count, err
+		}
+		for rows.Next() {
+			var keys = make([]string, len(table.keys))
+			var dest []interface{}
+			var value []byte
+
+			for j = range keys {
+				dest = append(dest, &keys[j])
+			}
+			if err = rows.Scan(append(dest, &value)...); err != nil {
+				rows.Close()
+				return count, err
+			}
+			rowKeys = append(rowKeys, keys)
+			values = append(values, value)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return count, err
+		}
+
+		for j = range values {
+			var agreement = new(MembershipAgreement)
+			var args []interface{}
+			var result sql.Result
+			var hash, key string
+			var value []byte
+			var n int64
+
+			if err = proto.Unmarshal(values[j], agreement); err != nil {
+				return count, err
+			}
+			if len(agreement.AgreementPdf) == 0 {
+				continue
+			}
+
+			hash = blobHash(agreement.AgreementPdf)
+			err = m.blobs.PutBlob(ctx, hash, agreement.AgreementPdf)
+			if err != nil {
+				return count, err
+			}
+			agreement.AgreementPdf = nil
+			agreement.AgreementPdfHash = proto.String(hash)
+			if value, err = proto.Marshal(agreement); err != nil {
+				return count, err
+			}
+
+			args = []interface{}{value, values[j]}
+			for _, key = range rowKeys[j] {
+				args = append(args, key)
+			}
+			result, err = m.db.ExecContext(ctx, "UPDATE "+table.table+
+				" SET pb_data = $1 WHERE pb_data = $2 AND "+
+				strings.Join(conds, " AND "), args...)
+			if err != nil {
+				return count, err
+			}
+			if n, err = result.RowsAffected(); err != nil {
+				return count, err
+			}
+			count += int(n)
+		}
+	}
+
+	return count, nil
+}
@@ -0,0 +1,73 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package membersys
+
+import (
+	"testing"
+)
+
+// Create an SQLite database in memory using the retention periods of the
+// tests. The tests are skipped if the SQLite driver isn't available, e.g.
+// when building without cgo.
+func newTestSQLDB(t *testing.T) MembershipStore {
+	var db *SQLMembershipDB
+	var err error
+
+	if db, err = NewSQLMembershipDB("sqlite3", ":memory:"); err != nil {
+		t.Skipf("SQLite is not available: %s", err)
+	}
+	db.retention = testRetention
+	t.Cleanup(func() {
+		db.db.Close()
+	})
+	return db
+}
+
+func TestSQLLifecycle(t *testing.T) {
+	testStoreLifecycle(t, newTestSQLDB)
+}
+
+func TestSQLMembers(t *testing.T) {
+	testStoreMembers(t, newTestSQLDB)
+}
+
+func TestSQLFilters(t *testing.T) {
+	testStoreFilters(t, newTestSQLDB)
+}
+
+func TestSQLAuditLog(t *testing.T) {
+	testStoreAuditLog(t, newTestSQLDB)
+}
+
+func TestSQLRevisions(t *testing.T) {
+	testStoreRevisions(t, newTestSQLDB)
+}
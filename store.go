@@ -0,0 +1,575 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package membersys
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/membersys/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Operations any storage backend of the membership database has to
+// support. Records move through a number of lifecycle states: applications
+// ("application"), approved applications waiting for their accounts to be
+// created ("membership_queue"), current members ("members"), departing
+// members waiting for their accounts to be removed ("membership_dequeue")
+// and rejected or former members ("membership_archive").
+//
+// All operations take a context. They give up and return its error once
+// it has been cancelled or its deadline has passed.
+type MembershipStore interface {
+	// Store the given membership request in the database.
+	StoreMembershipRequest(ctx context.Context, req *FormInputData) (
+		key string, err error)
+
+	// Retrieve a specific members detailed membership data, but fetch it
+	// by the user name of the member.
+	GetMemberDetailByUsername(ctx context.Context, username string) (
+		*MembershipAgreement, error)
+
+	// Retrieve a specific members detailed membership data, along with
+	// the version of the record. The version is an opaque number which
+	// changes whenever the record is modified.
+	GetMemberDetail(ctx context.Context, id string) (
+		*MembershipAgreement, int64, error)
+
+	// Update the membership fee for the given member. The change is only
+	// applied if the record is still at "version"; otherwise, an error
+	// for which IsVersionConflict returns true is returned. Returns the
+	// new version of the record.
+	//
+	// All modifying operations record the change, and the "actor" who
+	// made it, in the audit log of the member.
+	SetMemberFee(ctx context.Context, id string, fee uint64, yearly bool,
+		version int64, actor *Actor) (int64, error)
+
+	// Update the specified long field for the given member, provided
+	// the record is still at "version". Returns the new version.
+	SetLongValue(ctx context.Context, id string, field string,
+		value uint64, version int64, actor *Actor) (int64, error)
+
+	// Update the specified boolean field for the given member, provided
+	// the record is still at "version". Returns the new version.
+	SetBoolValue(ctx context.Context, id string, field string,
+		value bool, version int64, actor *Actor) (int64, error)
+
+	// Update the specified text column on the membership data, provided
+	// the record is still at "version". Returns the new version.
+	SetTextValue(ctx context.Context, id string, field, value string,
+		version int64, actor *Actor) (int64, error)
+
+	// Retrieve an individual record from the lifecycle state "table",
+	// along with the time stamp it was last written at.
+	GetMembershipRequest(ctx context.Context, id, table, prefix string) (
+		*MembershipAgreement, int64, error)
+
+	// Get a list of "num" members currently in the database, beginning
+	// at "prev". If "filter" is not nil, only members meeting its
+	// conditions are listed. Search criteria, here and below, are
+	// matched against the name, e-mail address, city, user name and
+	// membership number of the records, ignoring case and accents.
+	EnumerateMembers(ctx context.Context, filter *MemberFilter,
+		prev string, num int32) ([]*Member, error)
+
+	// Get a list of "num" membership applications currently in the
+	// database matching "criterion", beginning at "prev".
+	EnumerateMembershipRequests(ctx context.Context, criterion, prev string,
+		num int32) ([]*MemberWithKey, error)
+
+	// Get a list of all future members which are currently in the queue
+	// and match "criterion".
+	EnumerateQueuedMembers(ctx context.Context, criterion, prev string,
+		num int32) ([]*MemberWithKey, error)
+
+	// Get a list of all members which are currently in the departing
+	// queue and match "criterion".
+	EnumerateDeQueuedMembers(ctx context.Context, criterion, prev string,
+		num int32) ([]*MemberWithKey, error)
+
+	// Get a list of all members which are currently in the trash and
+	// match "criterion".
+	EnumerateTrashedMembers(ctx context.Context, criterion, prev string,
+		num int32) ([]*MemberWithKey, error)
+
+	// Move a member record to the queue for getting their user account
+	// removed.
+	MoveMemberToTrash(ctx context.Context, id string, actor *Actor,
+		reason string) error
+
+	// Move the record of the given applicant to the queue of new users to
+	// be processed. Fails if no membership agreement has been uploaded.
+	MoveApplicantToNewMember(ctx context.Context, id string,
+		actor *Actor) error
+
+	// Move the record of the given applicant to a temporary archive of
+	// deleted applications.
+	MoveApplicantToTrash(ctx context.Context, id string, actor *Actor) error
+
+	// Move a member from the queue to the trash.
+	MoveQueuedRecordToTrash(ctx context.Context, id string,
+		actor *Actor) error
+
+	// Combine the application "duplicate" into the application "id",
+	// which is kept. Details only known from the duplicate are filled in,
+	// and its agreement scan is kept if none was uploaded for "id". The
+	// duplicate is moved to the archive like a rejected application.
+	MergeApplications(ctx context.Context, id, duplicate string,
+		actor *Actor) error
+
+	// Record the decision of "actor" about the fee reduction requested
+	// along with the application "id": whether it has been "approved",
+	// and until when, as a timestamp, or 0 if it doesn't expire. The
+	// decision stays with the record once the applicant becomes a
+	// member.
+	DecideFeeReduction(ctx context.Context, id string, approved bool,
+		valid_until uint64, comment string, actor *Actor) error
+
+	// Mark the e-mail address of the application "id" as verified by
+	// "actor", who followed the link mailed to it, provided the address
+	// is still "email". Fails with AlreadyExists if it has been verified
+	// before.
+	VerifyApplicationEmail(ctx context.Context, id, email string,
+		actor *Actor) error
+
+	// Add the membership agreement form scan to the given membership
+	// request record.
+	StoreMembershipAgreement(ctx context.Context, id string,
+		agreement_data []byte, actor *Actor) error
+
+	// Turn the queued record "id" into a member record holding
+	// "agreement", once the account of the new member has been created.
+	MoveQueuedRecordToMember(ctx context.Context, id string,
+		agreement *MembershipAgreement, actor *Actor) error
+
+	// Add "agreement", imported from another system, as a member record
+	// and assign the next membership number to it. Fails if there
+	// already is a member with the same e-mail address.
+	AddImportedMember(ctx context.Context, agreement *MembershipAgreement,
+		actor *Actor) error
+
+	// Move the record "id" of a departed member from the departing queue
+	// to the archive, once their account has been removed.
+	MoveDeQueuedRecordToArchive(ctx context.Context, id string,
+		actor *Actor) error
+
+	// Move the record "id" from the archive back to where it came from.
+	// Rejected applications and cancelled queue entries become
+	// applications again, former members become members again under
+	// their previous membership number.
+	RestoreArchivedRecord(ctx context.Context, id string,
+		actor *Actor) error
+
+	// Retrieve the audit log of the member with the e-mail address
+	// "subject", oldest entry first.
+	GetAuditLog(ctx context.Context, subject string) ([]*AuditLogEntry, error)
+
+	// Retrieve the previous states of the record of the member "id",
+	// which are retained whenever the record is modified. Newest first.
+	GetMemberRevisions(ctx context.Context, id string) (
+		[]*MemberRevision, error)
+
+	// List the records which will be deleted before "before" because
+	// their retention period is over, the earliest first.
+	EnumerateExpiringRecords(ctx context.Context, before time.Time) (
+		[]*ExpiringRecord, error)
+
+	// Delete the records whose retention period is over, and the blobs
+	// which no record refers to any more. Backends which expire records
+	// by themselves only need to delete the blobs.
+	PurgeExpiredRecords(ctx context.Context) error
+
+	// Call "fn" for every agreement blob, every record of every
+	// lifecycle state, and for the last membership number assigned.
+	// Stops at the first error.
+	ExportRecords(ctx context.Context, fn func(*BackupRecord) error) error
+
+	// Write "record" as it has been exported from a database. Records
+	// with the same key are replaced, so an import can be repeated.
+	ImportRecord(ctx context.Context, record *BackupRecord) error
+
+	// Retrieve the scanned membership agreement of "agreement" from the
+	// blob store.
+	GetAgreementPdf(ctx context.Context, agreement *MembershipAgreement) (
+		[]byte, error)
+
+	// Retrieve the document supporting the fee reduction request of
+	// "agreement" from the blob store.
+	GetFeeReductionDocument(ctx context.Context,
+		agreement *MembershipAgreement) ([]byte, error)
+
+	// Move the agreements embedded in records written by earlier
+	// versions to the blob store. Returns the number of records which
+	// have been rewritten.
+	MoveAgreementsToBlobStore(ctx context.Context) (int, error)
+}
+
+// A record which is deleted once its retention period is over.
+type ExpiringRecord struct {
+	// Key and lifecycle state of the record.
+	Key   string
+	Table string
+
+	// Time the record will be deleted at.
+	Expires time.Time
+
+	// Contents of the record.
+	Agreement *MembershipAgreement
+}
+
+// Longest retention period which can be configured, in days. Cassandra
+// doesn't accept TTLs of more than 20 years.
+const maxRetentionDays = 7300
+
+// Ensure the retention periods of "retention" can be converted into TTLs.
+func checkRetention(retention *config.DatabaseConfig_RetentionConfig) error {
+	var periods = []struct {
+		name string
+		days uint32
+	}{
+		{"rejected_application_days",
+			retention.GetRejectedApplicationDays()},
+		{"cancelled_queue_days", retention.GetCancelledQueueDays()},
+		{"former_member_days", retention.GetFormerMemberDays()},
+	}
+	var i int
+
+	for i = range periods {
+		if periods[i].days > maxRetentionDays {
+			return fmt.Errorf("The retention period %s of %d days is "+
+				"longer than the maximum of %d days", periods[i].name,
+				periods[i].days, maxRetentionDays)
+		}
+	}
+	return nil
+}
+
+// Convert the retention period "days" from the configuration, which has
+// been checked by checkRetention, into a TTL in seconds. A TTL of 0 keeps
+// the record forever.
+func retentionTTL(days uint32) int32 {
+	return int32(int64(days) * 24 * 60 * 60)
+}
+
+// Sort "records" by the time they expire at, the earliest first.
+func sortByExpiry(records []*ExpiringRecord) {
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Expires.Before(records[j].Expires)
+	})
+}
+
+// Lifecycle states whose records are keyed by an UUID.
+var recordTables = []string{
+	"application", "membership_queue", "membership_dequeue",
+	"membership_archive",
+}
+
+// Ensure "table" is one of the UUID keyed tables, since table names can't
+// be passed as query parameters.
+func checkRecordTable(table string) error {
+	var t string
+
+	for _, t = range recordTables {
+		if t == table {
+			return nil
+		}
+	}
+	return grpc.Errorf(codes.InvalidArgument, "Unknown table "+table)
+}
+
+// Ensure "record" read from a backup belongs to a known table and carries
+// the data needed to import it.
+func checkBackupRecord(record *BackupRecord) error {
+	if record.GetTable() == "member_numbers" {
+		return nil
+	}
+	if record.GetTable() == "agreement_blobs" {
+		if blobHash(record.BlobData) != record.GetKey() {
+			return grpc.Errorf(codes.DataLoss,
+				"Blob %s doesn't match its hash", record.GetKey())
+		}
+		return nil
+	}
+	if record.GetAgreement().GetMemberData() == nil {
+		return grpc.Errorf(codes.InvalidArgument,
+			"Record %s of %s has no member data", record.GetKey(),
+			record.GetTable())
+	}
+	if record.GetTable() == "members" {
+		return nil
+	}
+	return checkRecordTable(record.GetTable())
+}
+
+// Remove the data recorded when "agreement" was moved to the archive, and
+// determine the lifecycle state it has to be restored to. Former members
+// go back to "members", all other records to "application", which
+// requires them to be approved again.
+func restoreArchivedAgreement(agreement *MembershipAgreement) string {
+	if agreement.Metadata == nil {
+		agreement.Metadata = new(MembershipMetadata)
+	}
+
+	if agreement.Metadata.GoodbyeTimestamp != nil {
+		agreement.Metadata.GoodbyeTimestamp = nil
+		agreement.Metadata.GoodbyeInitiator = nil
+		agreement.Metadata.GoodbyeReason = nil
+		return "members"
+	}
+
+	agreement.Metadata.ApprovalTimestamp = nil
+	agreement.Metadata.ApproverUid = nil
+	return "application"
+}
+
+// Determine the version to assign to a member record which is being
+// modified while it is at "version". Versions are based on the current
+// time, but always increase.
+func nextVersion(version int64) int64 {
+	var next int64 = time.Now().UnixNano()
+	if next <= version {
+		next = version + 1
+	}
+	return next
+}
+
+// Create the error returned when the member record "id" has been modified
+// since the version an update was based on.
+func versionConflict(id string) error {
+	return grpc.Errorf(codes.Aborted,
+		"The record of %s has been modified concurrently", id)
+}
+
+// Determine whether "err" indicates that an update was rejected because
+// the record has been modified concurrently. The update should be retried
+// based on the current version of the record.
+func IsVersionConflict(err error) bool {
+	return grpc.Code(err) == codes.Aborted
+}
+
+// Open the blob store configured in "dbconfig". Returns nil if the
+// agreements are to be kept in the database itself.
+func configuredBlobStore(dbconfig *config.DatabaseConfig) (BlobStore, error) {
+	var files *FileBlobStore
+	var err error
+
+	if dbconfig.BlobDirectory == nil {
+		return nil, nil
+	}
+	if files, err = NewFileBlobStore(dbconfig.GetBlobDirectory()); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// Connect to the membership database described by "dbconfig", using the
+// storage backend selected in the configuration. The deadlines configured
+// for the individual operations are applied to all calls.
+func NewMembershipStore(dbconfig *config.DatabaseConfig,
+	timeout time.Duration) (MembershipStore, error) {
+	var store MembershipStore
+	var blobs BlobStore
+	var db *MembershipDB
+	var sqldb *SQLMembershipDB
+	var err error
+
+	if err = checkRetention(dbconfig.Retention); err != nil {
+		return nil, err
+	}
+	if dbconfig.EncryptionKeyFile != nil &&
+		dbconfig.GetDatabaseType() != config.DatabaseConfig_CASSANDRA {
+		return nil, fmt.Errorf("Encryption is not supported with "+
+			"database type %v", dbconfig.GetDatabaseType())
+	}
+
+	if blobs, err = configuredBlobStore(dbconfig); err != nil {
+		return nil, err
+	}
+
+	switch dbconfig.GetDatabaseType() {
+	case config.DatabaseConfig_CASSANDRA:
+		if db, err = OpenMembershipDB(dbconfig, timeout); err != nil {
+			return nil, err
+		}
+		store = db
+	case config.DatabaseConfig_IN_MEMORY:
+		var memdb = NewInMemoryMembershipDB()
+		memdb.retention = dbconfig.Retention
+		if blobs != nil {
+			memdb.blobs = blobs
+		}
+		store = memdb
+	case config.DatabaseConfig_SQLITE:
+		var dsn string = dbconfig.GetDatabaseDsn()
+		if dsn == "" {
+			dsn = dbconfig.GetDatabaseName() + ".db"
+		}
+		sqldb, err = NewSQLMembershipDB("sqlite3", dsn)
+		if err != nil {
+			return nil, err
+		}
+		sqldb.retention = dbconfig.Retention
+		if blobs != nil {
+			sqldb.blobs = blobs
+		}
+		store = sqldb
+	case config.DatabaseConfig_POSTGRESQL:
+		sqldb, err = NewSQLMembershipDB("postgres",
+			dbconfig.GetDatabaseDsn())
+		if err != nil {
+			return nil, err
+		}
+		sqldb.retention = dbconfig.Retention
+		if blobs != nil {
+			sqldb.blobs = blobs
+		}
+		store = sqldb
+	default:
+		return nil, fmt.Errorf("Unsupported database type: %v",
+			dbconfig.GetDatabaseType())
+	}
+
+	return NewDeadlineStore(store, dbconfig), nil
+}
+
+// Sort "agreements" by the time the members have been approved, then by
+// the time they applied and finally by their e-mail address. This is the
+// order in which membership numbers are assigned to existing members.
+func sortByApproval(agreements []*MembershipAgreement) {
+	sort.SliceStable(agreements, func(i, j int) bool {
+		var a, b *MembershipAgreement = agreements[i], agreements[j]
+
+		if a.GetMetadata().GetApprovalTimestamp() !=
+			b.GetMetadata().GetApprovalTimestamp() {
+			return a.GetMetadata().GetApprovalTimestamp() <
+				b.GetMetadata().GetApprovalTimestamp()
+		} else if a.GetMetadata().GetRequestTimestamp() !=
+			b.GetMetadata().GetRequestTimestamp() {
+			return a.GetMetadata().GetRequestTimestamp() <
+				b.GetMetadata().GetRequestTimestamp()
+		}
+		return a.GetMemberData().GetEmail() < b.GetMemberData().GetEmail()
+	})
+}
+
+// Value of the denormalised members column "column" for the member "md".
+func memberColumnValue(md *Member, column string) interface{} {
+	if column == "fee" {
+		return int64(md.GetFee())
+	} else if column == "fee_yearly" {
+		return md.GetFeeYearly()
+	} else if column == "has_key" {
+		return md.GetHasKey()
+	} else if column == "payments_caught_up_to" {
+		return int64(md.GetPaymentsCaughtUpTo())
+	} else if column == "name" {
+		return md.GetName()
+	} else if column == "street" {
+		return md.GetStreet()
+	} else if column == "city" {
+		return md.GetCity()
+	} else if column == "zipcode" {
+		return md.GetZipcode()
+	} else if column == "country" {
+		return md.GetCountry()
+	} else if column == "phone" {
+		return md.GetPhone()
+	} else if column == "username" {
+		return md.GetUsername()
+	} else if column == "email" {
+		return md.GetEmail()
+	} else if column == "category" {
+		return md.GetCategory()
+	}
+	return nil
+}
+
+// Set the long field "field" of the member data to "value".
+func setMemberLongField(member *MembershipAgreement, field string,
+	value uint64) error {
+	if field == "payments_caught_up_to" {
+		member.MemberData.PaymentsCaughtUpTo = proto.Uint64(value)
+	} else {
+		return fmt.Errorf("Unknown field specified: %s", field)
+	}
+	return nil
+}
+
+// Set the boolean field "field" of the member data to "value".
+func setMemberBoolField(member *MembershipAgreement, field string,
+	value bool) error {
+	if field == "has_key" {
+		member.MemberData.HasKey = proto.Bool(value)
+	} else {
+		return fmt.Errorf("Unknown field specified: %s", field)
+	}
+	return nil
+}
+
+// Set the text field "field" of the member data to "value".
+func setMemberTextField(member *MembershipAgreement, field,
+	value string) error {
+	if field == "name" {
+		member.MemberData.Name = proto.String(value)
+	} else if field == "street" {
+		member.MemberData.Street = proto.String(value)
+	} else if field == "city" {
+		member.MemberData.City = proto.String(value)
+	} else if field == "zipcode" {
+		member.MemberData.Zipcode = proto.String(value)
+	} else if field == "country" {
+		member.MemberData.Country = proto.String(value)
+	} else if field == "phone" {
+		member.MemberData.Phone = proto.String(value)
+	} else if field == "email" {
+		if value == "" {
+			return errors.New("E-mail address must not be empty")
+		}
+		member.MemberData.Email = proto.String(value)
+	} else if field == "username" {
+		if member.MemberData.Username != nil && *member.MemberData.Username != "" {
+			return errors.New("Cannot modify user name")
+		}
+		member.MemberData.Username = proto.String(value)
+	} else if field == "category" {
+		member.MemberData.Category = proto.String(value)
+	} else {
+		return fmt.Errorf("Unknown field specified: %s", field)
+	}
+	return nil
+}
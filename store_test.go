@@ -0,0 +1,652 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package membersys
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/membersys/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Retention periods used by the tests, distinct so it's visible which one
+// has been applied.
+var testRetention = &config.DatabaseConfig_RetentionConfig{
+	RejectedApplicationDays: proto.Uint32(30),
+	CancelledQueueDays:      proto.Uint32(60),
+	FormerMemberDays:        proto.Uint32(365),
+}
+
+var testActor = &Actor{User: "admin", SourceIP: "192.0.2.1"}
+
+// Store an application of "name" with the e-mail address "email" in "db",
+// along with a scan of the membership agreement if "agreement" is set.
+// Returns the key of the application.
+func storeTestApplication(t *testing.T, db MembershipStore, name,
+	email string, agreement bool) string {
+	var ctx = context.Background()
+	var id string
+	var err error
+
+	id, err = db.StoreMembershipRequest(ctx, &FormInputData{
+		MemberData: &Member{
+			Name:      proto.String(name),
+			Street:    proto.String("Hauptstrasse 1"),
+			City:      proto.String("Zürich"),
+			Zipcode:   proto.String("8001"),
+			Country:   proto.String("CH"),
+			Email:     proto.String(email),
+			Fee:       proto.Uint64(20),
+			FeeYearly: proto.Bool(false),
+		},
+		Metadata: &MembershipMetadata{
+			RequestSourceIp: proto.String("192.0.2.2"),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error storing the application of %s: %s", email, err)
+	}
+
+	if agreement {
+		err = db.StoreMembershipAgreement(ctx, id,
+			[]byte("%PDF-1.4 agreement of "+email), testActor)
+		if err != nil {
+			t.Fatalf("Error storing the agreement of %s: %s", email, err)
+		}
+	}
+
+	return id
+}
+
+// Turn the queued record "id" into a member record.
+func createTestMember(t *testing.T, db MembershipStore, id string) {
+	var ctx = context.Background()
+	var agreement *MembershipAgreement
+	var err error
+
+	agreement, _, err = db.GetMembershipRequest(ctx, id, "membership_queue",
+		queuePrefix)
+	if err != nil {
+		t.Fatalf("Error fetching the queued record %s: %s", id, err)
+	}
+	agreement.MemberData.Username = proto.String("user" + id[:8])
+	if err = db.MoveQueuedRecordToMember(ctx, id, agreement,
+		testActor); err != nil {
+		t.Fatalf("Error creating the member %s: %s", id, err)
+	}
+}
+
+// Find the lifecycle state of the record "id" of "db". Fails if the
+// record is found in more than one of them.
+func findTestRecord(t *testing.T, db MembershipStore, id string) string {
+	var ctx = context.Background()
+	var found, table string
+	var err error
+
+	for _, table = range recordTables {
+		_, _, err = db.GetMembershipRequest(ctx, id, table,
+			recordPrefixes[table])
+		if err == nil {
+			if found != "" {
+				t.Errorf("Record %s is in both %s and %s", id, found,
+					table)
+			}
+			found = table
+		} else if grpc.Code(err) != codes.NotFound {
+			t.Errorf("Error looking for %s in %s: %s", id, table, err)
+		}
+	}
+
+	return found
+}
+
+// Find the time the record "id" of "db" expires at, or the zero time if it
+// never does.
+func findTestExpiry(t *testing.T, db MembershipStore, id string) time.Time {
+	var records []*ExpiringRecord
+	var record *ExpiringRecord
+	var uuid gocql.UUID
+	var err error
+
+	if uuid, err = gocql.ParseUUID(id); err != nil {
+		t.Fatalf("Invalid key %s: %s", id, err)
+	}
+
+	records, err = db.EnumerateExpiringRecords(context.Background(),
+		time.Now().Add(100*365*24*time.Hour))
+	if err != nil {
+		t.Fatalf("Error listing the expiring records: %s", err)
+	}
+
+	for _, record = range records {
+		if record.Key == uuid.String() {
+			return record.Expires
+		}
+	}
+	return time.Time{}
+}
+
+// Check that "expires" is "days" after "start", allowing for the time
+// the test took. Zero days means the record is kept forever.
+func checkTestExpiry(t *testing.T, name string, start, expires time.Time,
+	days uint32) {
+	var want time.Time
+
+	if days == 0 {
+		if !expires.IsZero() {
+			t.Errorf("%s: expected the record to be kept, but it expires "+
+				"at %s", name, expires)
+		}
+		return
+	}
+
+	want = start.Add(time.Duration(days) * 24 * time.Hour)
+	if expires.Before(want.Add(-time.Second)) ||
+		expires.After(want.Add(time.Minute)) {
+		t.Errorf("%s: expected the record to expire at %s, got %s", name,
+			want, expires)
+	}
+}
+
+// A step of moving a record of the database through its lifecycle.
+type lifecycleStep func(ctx context.Context, db MembershipStore,
+	id string) error
+
+func acceptStep(ctx context.Context, db MembershipStore, id string) error {
+	return db.MoveApplicantToNewMember(ctx, id, testActor)
+}
+
+func rejectStep(ctx context.Context, db MembershipStore, id string) error {
+	return db.MoveApplicantToTrash(ctx, id, testActor)
+}
+
+func cancelStep(ctx context.Context, db MembershipStore, id string) error {
+	return db.MoveQueuedRecordToTrash(ctx, id, testActor)
+}
+
+func restoreStep(ctx context.Context, db MembershipStore, id string) error {
+	return db.RestoreArchivedRecord(ctx, id, testActor)
+}
+
+var lifecycleTests = []struct {
+	name      string
+	agreement bool
+	steps     []lifecycleStep
+	// Whether the last step is expected to fail.
+	fails bool
+	// Lifecycle state the record is expected to end up in, and the
+	// days it is kept there.
+	table string
+	days  uint32
+}{
+	{"application", false, nil, false, "application", 0},
+	{"accept without agreement", false, []lifecycleStep{acceptStep}, true,
+		"application", 0},
+	{"accept", true, []lifecycleStep{acceptStep}, false,
+		"membership_queue", 0},
+	{"reject", false, []lifecycleStep{rejectStep}, false,
+		"membership_archive", 30},
+	{"reject with agreement", true, []lifecycleStep{rejectStep}, false,
+		"membership_archive", 30},
+	{"cancel", true, []lifecycleStep{acceptStep, cancelStep}, false,
+		"membership_archive", 60},
+	{"cancel application", false, []lifecycleStep{cancelStep}, true,
+		"application", 0},
+	{"reject twice", false, []lifecycleStep{rejectStep, rejectStep}, true,
+		"membership_archive", 30},
+	{"restore rejected", false, []lifecycleStep{rejectStep, restoreStep},
+		false, "application", 0},
+	{"restore cancelled", true, []lifecycleStep{acceptStep, cancelStep,
+		restoreStep}, false, "application", 0},
+	{"accept restored", true, []lifecycleStep{rejectStep, restoreStep,
+		acceptStep}, false, "membership_queue", 0},
+}
+
+// Move applications through the lifecycle states of a new store created
+// by "newStore", and check where they end up and how long they are kept.
+func testStoreLifecycle(t *testing.T, newStore func(t *testing.T) MembershipStore) {
+	var ctx = context.Background()
+	var db = newStore(t)
+	var i int
+
+	for i = range lifecycleTests {
+		var test = lifecycleTests[i]
+		var email string = "applicant" + string(rune('a'+i)) + "@example.com"
+		var id = storeTestApplication(t, db, "Test Applicant", email,
+			test.agreement)
+		var start time.Time = time.Now()
+		var step lifecycleStep
+		var table string
+		var j int
+		var err error
+
+		for j, step = range test.steps {
+			err = step(ctx, db, id)
+			if j < len(test.steps)-1 && err != nil {
+				t.Fatalf("%s: step %d failed: %s", test.name, j+1, err)
+			}
+		}
+		if test.fails && err == nil {
+			t.Errorf("%s: expected the last step to fail", test.name)
+		} else if !test.fails && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+
+		if table = findTestRecord(t, db, id); table != test.table {
+			t.Errorf("%s: expected the record in %s, found it in %q",
+				test.name, test.table, table)
+		}
+		checkTestExpiry(t, test.name, start, findTestExpiry(t, db, id),
+			test.days)
+	}
+}
+
+// Turn applications into members, see them leave and come back, and
+// check their membership numbers along the way.
+func testStoreMembers(t *testing.T, newStore func(t *testing.T) MembershipStore) {
+	var ctx = context.Background()
+	var db = newStore(t)
+	var first, second, other, id string
+	var members []*Member
+	var departed []*MemberWithKey
+	var agreement *MembershipAgreement
+	var start time.Time
+	var err error
+
+	first = storeTestApplication(t, db, "Ada Lovelace", "ada@example.com",
+		true)
+	second = storeTestApplication(t, db, "Grace Hopper",
+		"grace@example.com", true)
+	for _, id = range []string{first, second} {
+		if err = db.MoveApplicantToNewMember(ctx, id, testActor); err != nil {
+			t.Fatalf("Error accepting %s: %s", id, err)
+		}
+		createTestMember(t, db, id)
+	}
+
+	members, err = db.EnumerateMembers(ctx, &MemberFilter{}, "", 10)
+	if err != nil {
+		t.Fatalf("Error listing the members: %s", err)
+	}
+	if len(members) != 2 || members[0].GetId() != 1 ||
+		members[0].GetEmail() != "ada@example.com" ||
+		members[1].GetId() != 2 {
+		t.Errorf("Expected members 1 and 2, got %v", members)
+	}
+	if findTestRecord(t, db, first) != "" {
+		t.Errorf("The queued record of a new member has been kept")
+	}
+
+	// Members can only be created once for every e-mail address.
+	other = storeTestApplication(t, db, "Ada Lovelace", "ada@example.com",
+		true)
+	if err = db.MoveApplicantToNewMember(ctx, other, testActor); err != nil {
+		t.Fatalf("Error accepting %s: %s", other, err)
+	}
+	agreement, _, err = db.GetMembershipRequest(ctx, other,
+		"membership_queue", queuePrefix)
+	if err != nil {
+		t.Fatalf("Error fetching the queued record %s: %s", other, err)
+	}
+	err = db.MoveQueuedRecordToMember(ctx, other, agreement, testActor)
+	if grpc.Code(err) != codes.AlreadyExists {
+		t.Errorf("Expected a duplicate member to be refused, got %v", err)
+	}
+
+	if err = db.MoveMemberToTrash(ctx, "ada@example.com", testActor,
+		"moving away"); err != nil {
+		t.Fatalf("Error removing a member: %s", err)
+	}
+	if _, _, err = db.GetMemberDetail(ctx,
+		"ada@example.com"); grpc.Code(err) != codes.NotFound {
+		t.Errorf("Expected the departed member to be gone, got %v", err)
+	}
+
+	departed, err = db.EnumerateDeQueuedMembers(ctx, "", "", 10)
+	if err != nil {
+		t.Fatalf("Error listing the departing members: %s", err)
+	}
+	if len(departed) != 1 || departed[0].GetEmail() != "ada@example.com" {
+		t.Fatalf("Expected the departed member to be queued, got %v",
+			departed)
+	}
+	checkTestExpiry(t, "departing", time.Now(),
+		findTestExpiry(t, db, departed[0].Key), 0)
+
+	start = time.Now()
+	if err = db.MoveDeQueuedRecordToArchive(ctx, departed[0].Key,
+		testActor); err != nil {
+		t.Fatalf("Error archiving %s: %s", departed[0].Key, err)
+	}
+	checkTestExpiry(t, "archived", start,
+		findTestExpiry(t, db, departed[0].Key), 365)
+
+	if err = db.RestoreArchivedRecord(ctx, departed[0].Key,
+		testActor); err != nil {
+		t.Fatalf("Error restoring %s: %s", departed[0].Key, err)
+	}
+	agreement, _, err = db.GetMemberDetail(ctx, "ada@example.com")
+	if err != nil {
+		t.Fatalf("Error fetching the restored member: %s", err)
+	}
+	if agreement.GetMemberData().GetId() != 1 {
+		t.Errorf("Expected the restored member to keep number 1, got %d",
+			agreement.GetMemberData().GetId())
+	}
+	if agreement.GetMetadata().GoodbyeTimestamp != nil {
+		t.Errorf("The restored member still has a goodbye time stamp")
+	}
+}
+
+// Check the audit log written while a member is created.
+func testStoreAuditLog(t *testing.T, newStore func(t *testing.T) MembershipStore) {
+	var ctx = context.Background()
+	var db = newStore(t)
+	var entries []*AuditLogEntry
+	var entry *AuditLogEntry
+	var want = []string{AuditActionApply, AuditActionUploadAgreement,
+		AuditActionAccept, AuditActionCreateAccount}
+	var actions []string
+	var id string
+	var err error
+
+	id = storeTestApplication(t, db, "Ada Lovelace", "ada@example.com",
+		true)
+	if err = db.MoveApplicantToNewMember(ctx, id, testActor); err != nil {
+		t.Fatalf("Error accepting %s: %s", id, err)
+	}
+	createTestMember(t, db, id)
+
+	if entries, err = db.GetAuditLog(ctx, "ada@example.com"); err != nil {
+		t.Fatalf("Error fetching the audit log: %s", err)
+	}
+	if err = VerifyAuditLog(entries); err != nil {
+		t.Errorf("The audit log doesn't verify: %s", err)
+	}
+
+	for _, entry = range entries {
+		actions = append(actions, entry.GetAction())
+	}
+	if strings.Join(actions, " ") != strings.Join(want, " ") {
+		t.Errorf("Expected the actions %v, got %v", want, actions)
+	}
+}
+
+// Edit a member, and check that the previous states of the record are
+// kept, including across a change of the e-mail address, and that edits
+// based on an old version are refused.
+func testStoreRevisions(t *testing.T, newStore func(t *testing.T) MembershipStore) {
+	var ctx = context.Background()
+	var db = newStore(t)
+	var revisions []*MemberRevision
+	var version, next int64
+	var id string
+	var err error
+
+	id = storeTestApplication(t, db, "Ada Lovelace", "ada@example.com",
+		true)
+	if err = db.MoveApplicantToNewMember(ctx, id, testActor); err != nil {
+		t.Fatalf("Error accepting %s: %s", id, err)
+	}
+	createTestMember(t, db, id)
+
+	if _, version, err = db.GetMemberDetail(ctx,
+		"ada@example.com"); err != nil {
+		t.Fatalf("Error fetching the member: %s", err)
+	}
+	next, err = db.SetTextValue(ctx, "ada@example.com", "city", "Bern",
+		version, testActor)
+	if err != nil {
+		t.Fatalf("Error changing the city: %s", err)
+	}
+	_, err = db.SetTextValue(ctx, "ada@example.com", "city", "Basel",
+		version, testActor)
+	if !IsVersionConflict(err) {
+		t.Errorf("Expected an edit of an old version to conflict, got %v",
+			err)
+	}
+	_, err = db.SetTextValue(ctx, "ada@example.com", "email",
+		"ada@example.org", next, testActor)
+	if err != nil {
+		t.Fatalf("Error changing the e-mail address: %s", err)
+	}
+
+	revisions, err = db.GetMemberRevisions(ctx, "ada@example.org")
+	if err != nil {
+		t.Fatalf("Error fetching the revisions: %s", err)
+	}
+	if len(revisions) != 2 {
+		t.Fatalf("Expected 2 revisions, got %d", len(revisions))
+	}
+	if revisions[0].Version != next ||
+		revisions[0].Agreement.GetMemberData().GetCity() != "Bern" ||
+		revisions[0].Agreement.GetMemberData().GetEmail() !=
+			"ada@example.com" {
+		t.Errorf("Unexpected newest revision %d: %v", revisions[0].Version,
+			revisions[0].Agreement.GetMemberData())
+	}
+	if revisions[1].Version != version ||
+		revisions[1].Agreement.GetMemberData().GetCity() != "Zürich" {
+		t.Errorf("Unexpected oldest revision %d: %v", revisions[1].Version,
+			revisions[1].Agreement.GetMemberData())
+	}
+
+	revisions, err = db.GetMemberRevisions(ctx, "ada@example.com")
+	if err != nil {
+		t.Fatalf("Error fetching the revisions: %s", err)
+	}
+	if len(revisions) != 0 {
+		t.Errorf("Expected no revisions for the old address, got %d",
+			len(revisions))
+	}
+}
+
+// Members imported by testStoreFilters. Bob has never been recorded as
+// having paid, and his has_key is unset.
+var filterTestMembers = []*Member{
+	&Member{
+		Name:               proto.String("Ada Lovelace"),
+		Email:              proto.String("ada@example.com"),
+		City:               proto.String("Zürich"),
+		Country:            proto.String("CH"),
+		Fee:                proto.Uint64(20),
+		FeeYearly:          proto.Bool(false),
+		HasKey:             proto.Bool(true),
+		Category:           proto.String("regular"),
+		PaymentsCaughtUpTo: proto.Uint64(testDate(2030, 1, 1)),
+	},
+	&Member{
+		Name:      proto.String("Bob Builder"),
+		Email:     proto.String("bob@example.com"),
+		City:      proto.String("Berlin"),
+		Country:   proto.String("DE"),
+		Fee:       proto.Uint64(240),
+		FeeYearly: proto.Bool(true),
+		Category:  proto.String("student"),
+	},
+	&Member{
+		Name:               proto.String("Cleo Carter"),
+		Email:              proto.String("cleo@example.com"),
+		City:               proto.String("Bern"),
+		Country:            proto.String("CH"),
+		Fee:                proto.Uint64(50),
+		FeeYearly:          proto.Bool(false),
+		HasKey:             proto.Bool(false),
+		PaymentsCaughtUpTo: proto.Uint64(testDate(2020, 1, 1)),
+	},
+}
+
+// Times filterTestMembers have been approved at.
+var filterTestApprovals = []uint64{
+	testDate(2019, 1, 1), testDate(2020, 6, 1), testDate(2021, 1, 1),
+}
+
+// Time stamp of the start of the given day, UTC.
+func testDate(year int, month time.Month, day int) uint64 {
+	return uint64(time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Unix())
+}
+
+func testStoreFilters(t *testing.T, newStore func(t *testing.T) MembershipStore) {
+	var ctx = context.Background()
+	var db MembershipStore = newStore(t)
+	var tests = []struct {
+		name   string
+		filter *MemberFilter
+		names  []string
+	}{
+		{"none", nil, []string{"Ada Lovelace", "Bob Builder",
+			"Cleo Carter"}},
+		{"has key", &MemberFilter{HasKey: proto.Bool(true)},
+			[]string{"Ada Lovelace"}},
+		{"has no key", &MemberFilter{HasKey: proto.Bool(false)},
+			[]string{"Bob Builder", "Cleo Carter"}},
+		{"fee yearly", &MemberFilter{FeeYearly: proto.Bool(true)},
+			[]string{"Bob Builder"}},
+		{"fee monthly", &MemberFilter{FeeYearly: proto.Bool(false)},
+			[]string{"Ada Lovelace", "Cleo Carter"}},
+		{"fee range", &MemberFilter{MinFee: proto.Uint64(20),
+			MaxFee: proto.Uint64(50)},
+			[]string{"Ada Lovelace", "Cleo Carter"}},
+		{"minimum fee", &MemberFilter{MinFee: proto.Uint64(50)},
+			[]string{"Bob Builder", "Cleo Carter"}},
+		{"maximum fee", &MemberFilter{MaxFee: proto.Uint64(19)}, nil},
+		{"approval range", &MemberFilter{
+			ApprovedAfter:  proto.Uint64(testDate(2019, 1, 1)),
+			ApprovedBefore: proto.Uint64(testDate(2021, 1, 1))},
+			[]string{"Ada Lovelace", "Bob Builder"}},
+		{"approved after", &MemberFilter{
+			ApprovedAfter: proto.Uint64(testDate(2019, 1, 2))},
+			[]string{"Bob Builder", "Cleo Carter"}},
+		{"country", &MemberFilter{Country: "CH"},
+			[]string{"Ada Lovelace", "Cleo Carter"}},
+		{"category", &MemberFilter{Category: "student"},
+			[]string{"Bob Builder"}},
+		{"arrears", &MemberFilter{
+			PaidBefore: proto.Uint64(testDate(2025, 1, 1))},
+			[]string{"Bob Builder", "Cleo Carter"}},
+		{"arrears in CH", &MemberFilter{Country: "CH",
+			PaidBefore: proto.Uint64(testDate(2025, 1, 1))},
+			[]string{"Cleo Carter"}},
+		{"criterion", &MemberFilter{Criterion: "lovelace"},
+			[]string{"Ada Lovelace"}},
+	}
+	var members []*Member
+	var names []string
+	var i, j int
+	var err error
+
+	for i = range filterTestMembers {
+		err = db.AddImportedMember(ctx, &MembershipAgreement{
+			MemberData: proto.Clone(filterTestMembers[i]).(*Member),
+			Metadata: &MembershipMetadata{
+				RequestTimestamp:  proto.Uint64(filterTestApprovals[i]),
+				ApprovalTimestamp: proto.Uint64(filterTestApprovals[i]),
+			},
+		}, testActor)
+		if err != nil {
+			t.Fatalf("Error importing %s: %s",
+				filterTestMembers[i].GetName(), err)
+		}
+	}
+
+	for i = range tests {
+		var test = tests[i]
+
+		members, err = db.EnumerateMembers(ctx, test.filter, "", 10)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		names = nil
+		for j = range members {
+			names = append(names, members[j].GetName())
+		}
+		if strings.Join(names, ", ") != strings.Join(test.names, ", ") {
+			t.Errorf("%s: expected %v, got %v", test.name, test.names,
+				names)
+		}
+	}
+}
+
+func TestCheckRetention(t *testing.T) {
+	var tests = []struct {
+		name      string
+		retention *config.DatabaseConfig_RetentionConfig
+		ttl       int32
+		err       string
+	}{
+		{"defaults", nil, 180 * 24 * 60 * 60, ""},
+		{"forever", &config.DatabaseConfig_RetentionConfig{
+			RejectedApplicationDays: proto.Uint32(0),
+		}, 0, ""},
+		{"longest", &config.DatabaseConfig_RetentionConfig{
+			RejectedApplicationDays: proto.Uint32(maxRetentionDays),
+		}, maxRetentionDays * 24 * 60 * 60, ""},
+		{"too long", &config.DatabaseConfig_RetentionConfig{
+			FormerMemberDays: proto.Uint32(maxRetentionDays + 1),
+		}, 0, "former_member_days"},
+		{"overflowing", &config.DatabaseConfig_RetentionConfig{
+			CancelledQueueDays: proto.Uint32(30000),
+		}, 0, "cancelled_queue_days"},
+	}
+	var ttl int32
+	var i int
+	var err error
+
+	for i = range tests {
+		var test = tests[i]
+
+		err = checkRetention(test.retention)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected an error containing %q, got %v",
+					test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		ttl = retentionTTL(test.retention.GetRejectedApplicationDays())
+		if ttl != test.ttl {
+			t.Errorf("%s: expected a TTL of %d, got %d", test.name,
+				test.ttl, ttl)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"database/cassandra"
+	"encoding/binary"
+	"flag"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/starshipfactory/membersys"
+)
+
+// A column family of the Thrift schema and the CQL table its rows are
+// copied to. Rows of the column family are keyed by "prefix", followed by
+// the value of the "key" column of the table.
+type migration struct {
+	cf     string
+	prefix string
+	end    string
+	table  string
+	key    string
+}
+
+var migrations = []migration{
+	{"application", "applicant:", "applicant;", "application", "id"},
+	{"membership_queue", "queue:", "queue;", "membership_queue", "id"},
+	{"membership_dequeue", "dequeue:", "dequeue;", "membership_dequeue", "id"},
+	{"membership_archive", "archive:", "archive;", "membership_archive", "id"},
+	{"members", "member:", "member;", "members", "email"},
+	{"member_agreements", "member:", "member;", "member_agreements", "email"},
+}
+
+// CQL types of the columns which are copied to each table.
+var table_columns = map[string]map[string]string{
+	"application": {
+		"name": "text", "street": "text", "city": "text",
+		"email": "text", "username": "text", "fee": "bigint",
+		"fee_yearly": "boolean", "pb_data": "blob",
+	},
+	"membership_queue":   {"pb_data": "blob"},
+	"membership_dequeue": {"pb_data": "blob"},
+	"membership_archive": {"pb_data": "blob"},
+	"members": {
+		"name": "text", "street": "text", "city": "text",
+		"zipcode": "text", "country": "text", "phone": "text",
+		"username": "text", "fee": "bigint", "fee_yearly": "boolean",
+		"has_key": "boolean", "payments_caught_up_to": "bigint",
+		"approval_ts": "bigint", "agreement_pdf": "blob",
+		"pb_data": "blob",
+	},
+	"member_agreements": {"agreement_pdf": "blob", "pb_data": "blob"},
+}
+
+// Columns of the Thrift schema which are no longer kept outside of pb_data,
+// and are skipped silently.
+var dropped_columns = map[string]map[string]bool{
+	"application": {
+		"zipcode": true, "country": true, "email_verified": true,
+		"phone": true, "sourceip": true, "useragent": true, "pwhash": true,
+		"application_pdf": true,
+	},
+}
+
+// Decode the Thrift column value "value" into a Go value which can be
+// bound to a CQL column of type "cqltype".
+func decodeValue(cqltype string, value []byte) interface{} {
+	if cqltype == "bigint" && len(value) == 8 {
+		return int64(binary.BigEndian.Uint64(value))
+	} else if cqltype == "boolean" && len(value) == 1 {
+		return value[0] == 1
+	} else if cqltype == "text" {
+		return string(value)
+	} else if cqltype == "blob" {
+		return value
+	}
+	return nil
+}
+
+// Copy the Thrift row "ks" to the CQL table described by "m". Columns
+// with a TTL are copied with the time they have left to live; the Thrift
+// code of membersys always wrote time stamps in nanoseconds. Returns
+// false if the row had nothing left to copy.
+func copyRow(sess *gocql.Session, m migration, ks *cassandra.KeySlice,
+	now time.Time, noop bool) (bool, error) {
+	var types map[string]string = table_columns[m.table]
+	var columns []string = []string{m.key}
+	var values []interface{}
+	var cos *cassandra.ColumnOrSuperColumn
+	var ttl int32
+	var query string
+	var err error
+
+	if m.key == "id" {
+		var uuid gocql.UUID
+		if uuid, err = gocql.UUIDFromBytes(ks.Key[len(m.prefix):]); err != nil {
+			return false, err
+		}
+		values = append(values, uuid)
+	} else {
+		values = append(values, string(ks.Key[len(m.prefix):]))
+	}
+
+	for _, cos = range ks.Columns {
+		var col *cassandra.Column = cos.Column
+		var cqltype string
+		var value interface{}
+		var ok bool
+
+		if dropped_columns[m.table][string(col.Name)] {
+			continue
+		}
+		if cqltype, ok = types[string(col.Name)]; !ok {
+			log.Print("Skipping unknown column ", string(col.Name), " of ",
+				m.cf, " row ", string(ks.Key))
+			continue
+		}
+
+		if col.TTL != nil && *col.TTL > 0 && col.Timestamp != nil {
+			var written time.Time = time.Unix(0, *col.Timestamp)
+			var remaining int32 = *col.TTL -
+				int32(now.Sub(written)/time.Second)
+
+			if remaining <= 0 {
+				continue
+			}
+			if ttl == 0 || remaining < ttl {
+				ttl = remaining
+			}
+		}
+
+		if value = decodeValue(cqltype, col.Value); value == nil {
+			log.Print("Skipping malformed column ", string(col.Name),
+				" of ", m.cf, " row ", string(ks.Key))
+			continue
+		}
+
+		columns = append(columns, string(col.Name))
+		values = append(values, value)
+	}
+
+	if len(columns) == 1 {
+		return false, nil
+	}
+
+	query = "INSERT INTO " + m.table + " (" + strings.Join(columns, ", ") +
+		") VALUES (?" + strings.Repeat(", ?", len(columns)-1) + ")"
+	if ttl > 0 {
+		query += " USING TTL ?"
+		values = append(values, ttl)
+	}
+
+	if noop {
+		return true, nil
+	}
+
+	return true, sess.Query(query, values...).Exec()
+}
+
+// Copy all rows of the column family described by "m" to the new table.
+func migrate(conn *cassandra.RetryCassandraClient, sess *gocql.Session,
+	m migration, page_size int32, noop bool) (int, error) {
+	var cp *cassandra.ColumnParent = cassandra.NewColumnParent()
+	var pred *cassandra.SlicePredicate = cassandra.NewSlicePredicate()
+	var start []byte = []byte(m.prefix)
+	var now time.Time = time.Now()
+	var copied int
+
+	cp.ColumnFamily = m.cf
+	pred.SliceRange = cassandra.NewSliceRange()
+	pred.SliceRange.Start = []byte{}
+	pred.SliceRange.Finish = []byte{}
+	pred.SliceRange.Count = 1000
+
+	for {
+		var kr *cassandra.KeyRange = cassandra.NewKeyRange()
+		var kss []*cassandra.KeySlice
+		var ks *cassandra.KeySlice
+		var err error
+
+		kr.StartKey = start
+		kr.EndKey = []byte(m.end)
+		kr.Count = page_size
+
+		kss, err = conn.GetRangeSlices(cp, pred, kr,
+			cassandra.ConsistencyLevel_QUORUM)
+		if err != nil {
+			return copied, err
+		}
+
+		for _, ks = range kss {
+			var ok bool
+
+			// The start key is inclusive, so the last row of the
+			// previous page shows up again.
+			if string(ks.Key) == string(start) {
+				continue
+			}
+
+			if ok, err = copyRow(sess, m, ks, now, noop); err != nil {
+				return copied, err
+			}
+			if ok {
+				copied++
+			}
+		}
+
+		if int32(len(kss)) < page_size {
+			return copied, nil
+		}
+		start = kss[len(kss)-1].Key
+	}
+}
+
+func main() {
+	var conn *cassandra.RetryCassandraClient
+	var cluster *gocql.ClusterConfig
+	var sess *gocql.Session
+	var m migration
+	var err error
+
+	var thrift_server, thrift_dbname, dbserver, dbname string
+	var page_size int
+	var noop bool
+
+	flag.StringVar(&thrift_server, "thrift-server", "localhost:9160",
+		"Thrift server of the Cassandra database to copy from")
+	flag.StringVar(&thrift_dbname, "thrift-dbname", "sfmembersys",
+		"Name of the Cassandra keyspace to copy from")
+	flag.StringVar(&dbserver, "cassandra-server", "localhost:9042",
+		"CQL server of the Cassandra database to copy to (comma separated list)")
+	flag.StringVar(&dbname, "dbname", "",
+		"Name of the Cassandra keyspace to copy to; must have been set up using setup_cassandra")
+	flag.IntVar(&page_size, "page-size", 100,
+		"Number of rows to fetch at once")
+	flag.BoolVar(&noop, "dry-run", false,
+		"Only count the rows which would be copied")
+	flag.Parse()
+
+	if dbname == "" || dbname == thrift_dbname {
+		log.Fatal("Please specify a new keyspace to copy to using --dbname")
+	}
+
+	conn, err = cassandra.NewRetryCassandraClient(thrift_server)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = conn.SetKeyspace(thrift_dbname)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cluster = gocql.NewCluster(strings.Split(dbserver, ",")...)
+	cluster.Keyspace = dbname
+	cluster.Consistency = gocql.Quorum
+
+	sess, err = cluster.CreateSession()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer sess.Close()
+
+	for _, m = range migrations {
+		var copied int
+
+		copied, err = migrate(conn, sess, m, int32(page_size), noop)
+		if err != nil {
+			log.Fatal("Error copying ", m.cf, " after ", copied, " rows: ",
+				err)
+		}
+		log.Print("Copied ", copied, " rows from ", m.cf, " to ", m.table)
+	}
+
+	if !noop {
+		// The members have been copied into the e-mail keyed table, so
+		// they still need to be assigned their membership numbers.
+		if err = membersys.NumberMembers(sess); err != nil {
+			log.Fatal("Error numbering members: ", err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package membersys
+
+import (
+	"regexp"
+
+	"github.com/starshipfactory/membersys/config"
+)
+
+// Regular expressions for verification of the email and phone number fields.
+var EmailRe *regexp.Regexp = regexp.MustCompile(
+	`^[A-Za-z0-9-_\.]+@[A-Za-z0-9-_\.]+$`)
+var PhoneRe *regexp.Regexp = regexp.MustCompile(`^\+?[0-9 -\.]+$`)
+
+// Problem found with a field of the member data, given as the code of
+// the message describing it and the arguments of the message.
+type ValidationError struct {
+	Code string
+	Args []interface{}
+}
+
+// Describe the problem "e" in "lang".
+func (e *ValidationError) Message(lang string) string {
+	return Message(lang, e.Code, e.Args...)
+}
+
+// Check the member data "md" against the rules of the membership form of
+// an organisation charging "fees". Returns the problems found, keyed by
+// the name of the form field. "reduction" permits fees below the one of
+// the membership category, as if a reduction had been requested, if the
+// category allows for reductions.
+func ValidateMember(md *Member, fees *config.FeeConfig,
+	reduction bool) map[string]*ValidationError {
+	var errs = make(map[string]*ValidationError)
+	var category *config.FeeCategory = FindFeeCategory(fees, md.GetCategory())
+
+	if len(md.GetName()) <= 0 {
+		errs["name"] = &ValidationError{Code: "no-name"}
+	}
+	if len(md.GetStreet()) <= 0 {
+		errs["address"] = &ValidationError{Code: "no-street"}
+	}
+	if len(md.GetCity()) <= 0 {
+		errs["city"] = &ValidationError{Code: "no-city"}
+	}
+	if len(md.GetZipcode()) <= 0 {
+		errs["zip"] = &ValidationError{Code: "no-zip"}
+	}
+	if len(md.GetCountry()) <= 0 {
+		errs["country"] = &ValidationError{Code: "no-country"}
+	}
+
+	if len(md.GetEmail()) <= 0 {
+		errs["email"] = &ValidationError{Code: "no-email"}
+	} else if !EmailRe.MatchString(md.GetEmail()) {
+		errs["email"] = &ValidationError{Code: "bad-email-format"}
+	}
+
+	if len(md.GetPhone()) > 0 && !PhoneRe.MatchString(md.GetPhone()) {
+		errs["telephone"] = &ValidationError{Code: "bad-phone-format"}
+	}
+
+	if category == nil {
+		errs["category"] = &ValidationError{Code: "unknown-fee-category"}
+	}
+
+	if md.Fee == nil {
+		errs["customFee"] = &ValidationError{Code: "no-fee"}
+	} else if category != nil &&
+		md.GetFee() < CategoryFee(category, md.GetFeeYearly()) {
+		if !reduction {
+			errs["customFee"] = &ValidationError{
+				Code: "low-fee-without-reduction",
+				Args: []interface{}{
+					CategoryFee(category, md.GetFeeYearly()),
+					fees.GetCurrency(),
+				},
+			}
+		} else if !category.GetReductionAllowed() {
+			errs["customFee"] = &ValidationError{
+				Code: "reduction-not-allowed",
+				Args: []interface{}{CategoryDescription(category)},
+			}
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,229 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package membersys
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/starshipfactory/membersys/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Sends mails asking applicants to verify their e-mail address, and
+// checks the links contained in them. The links are signed, so they can't
+// be made up for other applications or addresses, and expire.
+type EmailVerifier struct {
+	tmpls          map[string]*template.Template
+	auth           smtp.Auth
+	smtpserveraddr string
+	from           string
+	replyto        string
+	subject        string
+	organisation   string
+	baseURL        string
+	secret         []byte
+	validity       time.Duration
+}
+
+type verificationTemplateData struct {
+	Member       *Member
+	From         string
+	ReplyTo      string
+	Subject      string
+	Organisation string
+	Date         string
+	Link         string
+	Expires      string
+}
+
+// Set up sending the verification mails of the organisation
+// "organisation" as configured in "cfg".
+func NewEmailVerifier(cfg *config.VerificationMailConfig,
+	organisation string) (*EmailVerifier, error) {
+	var tmpls = make(map[string]*template.Template)
+	var auth smtp.Auth
+	var secret []byte
+	var lang string
+	var host string
+	var err error
+
+	host, _, err = net.SplitHostPort(cfg.GetSmtpServerAddress())
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Username != nil && cfg.Password != nil {
+		auth = smtp.PlainAuth(cfg.GetIdentity(), cfg.GetUsername(),
+			cfg.GetPassword(), host)
+	}
+
+	if secret, err = ioutil.ReadFile(cfg.GetSecretFile()); err != nil {
+		return nil, err
+	}
+	secret = bytes.TrimSpace(secret)
+	if len(secret) < 16 {
+		return nil, fmt.Errorf("The secret in %s is too short, at least "+
+			"16 bytes are needed", cfg.GetSecretFile())
+	}
+
+	for _, lang = range TranslatedLanguages(cfg.GetMailTemplatePath()) {
+		tmpls[lang], err = template.ParseFiles(
+			LocalizedFileName(cfg.GetMailTemplatePath(), lang))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &EmailVerifier{
+		tmpls:          tmpls,
+		auth:           auth,
+		smtpserveraddr: cfg.GetSmtpServerAddress(),
+		from:           cfg.GetFrom(),
+		replyto:        cfg.GetReplyTo(),
+		subject:        cfg.GetSubject(),
+		organisation:   organisation,
+		baseURL:        strings.TrimSuffix(cfg.GetBaseUrl(), "/"),
+		secret:         secret,
+		validity: time.Duration(cfg.GetLinkValidityHours()) *
+			time.Hour,
+	}, nil
+}
+
+// Compute the signature of a link verifying the address "email" of the
+// application "id", which expires at "expires".
+func (v *EmailVerifier) sign(id, email string, expires int64) string {
+	var mac = hmac.New(sha256.New, v.secret)
+
+	mac.Write([]byte(id + "\x00" + email + "\x00" +
+		strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Create the link verifying the address "email" of the application "id".
+// It can be followed until the configured validity has passed after
+// "now".
+func (v *EmailVerifier) Link(id, email string, now time.Time) string {
+	var expires int64 = now.Add(v.validity).Unix()
+	var params = url.Values{}
+
+	params.Set("id", id)
+	params.Set("expires", strconv.FormatInt(expires, 10))
+	params.Set("token", v.sign(id, email, expires))
+	return v.baseURL + "/verify?" + params.Encode()
+}
+
+// Check the "token" of a link verifying the address "email" of the
+// application "id", which expires at "expires". Links for other
+// applications or addresses are rejected with PermissionDenied, expired
+// ones with DeadlineExceeded.
+func (v *EmailVerifier) CheckToken(id, email string, expires int64,
+	token string, now time.Time) error {
+	if !hmac.Equal([]byte(token), []byte(v.sign(id, email, expires))) {
+		return grpc.Errorf(codes.PermissionDenied,
+			"The verification link is not valid")
+	}
+	if now.Unix() > expires {
+		return grpc.Errorf(codes.DeadlineExceeded,
+			"The verification link has expired")
+	}
+	return nil
+}
+
+// Send the mail asking the applicant "member" of the application "id" to
+// verify their e-mail address, in the language "lang" if the template has
+// been translated into it.
+func (v *EmailVerifier) SendMail(id string, member *Member, lang string) error {
+	var tmpl *template.Template
+	var now time.Time = time.Now()
+	var messagebuffer = new(bytes.Buffer)
+	var ok bool
+	var err error
+
+	if tmpl, ok = v.tmpls[lang]; !ok {
+		tmpl = v.tmpls[DefaultLanguage]
+	}
+	err = tmpl.Execute(messagebuffer, &verificationTemplateData{
+		Member:       member,
+		From:         v.from,
+		ReplyTo:      v.replyto,
+		Subject:      v.subject,
+		Organisation: v.organisation,
+		Date:         now.Format(time.RFC1123Z),
+		Link:         v.Link(id, member.GetEmail(), now),
+		Expires:      now.Add(v.validity).Format("2006-01-02 15:04"),
+	})
+	if err != nil {
+		return err
+	}
+
+	return smtp.SendMail(v.smtpserveraddr, v.auth, v.from,
+		[]string{member.GetEmail()}, messagebuffer.Bytes())
+}
+
+// Mark the e-mail address of the application "agreement" as verified by
+// "actor", provided it is still "email". Fails with AlreadyExists if it
+// has been verified before.
+func verifyApplicationEmail(agreement *MembershipAgreement, email string,
+	actor *Actor, now time.Time) error {
+	if agreement.GetMemberData().GetEmail() != email {
+		return grpc.Errorf(codes.FailedPrecondition,
+			"The e-mail address of the application has changed")
+	}
+	if agreement.GetMemberData().GetEmailVerified() {
+		return grpc.Errorf(codes.AlreadyExists,
+			"The e-mail address has already been verified")
+	}
+
+	agreement.MemberData.EmailVerified = proto.Bool(true)
+	if agreement.Metadata == nil {
+		agreement.Metadata = new(MembershipMetadata)
+	}
+	agreement.Metadata.VerificationTimestamp = proto.Uint64(uint64(now.Unix()))
+	if actor != nil && len(actor.SourceIP) > 0 {
+		agreement.Metadata.VerificationSourceIp = proto.String(actor.SourceIP)
+	}
+	return nil
+}
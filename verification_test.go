@@ -0,0 +1,116 @@
+/*
+ * (c) 2014, Tonnerre Lombard <tonnerre@ancient-solutions.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package membersys
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestCheckToken(t *testing.T) {
+	var verifier = &EmailVerifier{
+		baseURL:  "https://members.example.com",
+		secret:   []byte("0123456789abcdef"),
+		validity: 48 * time.Hour,
+	}
+	var now = time.Unix(1500000000, 0)
+	var link *url.URL
+	var expires int64
+	var token string
+	var i int
+	var err error
+
+	link, err = url.Parse(verifier.Link("0123", "ada@example.com", now))
+	if err != nil {
+		t.Fatalf("Invalid link: %s", err)
+	}
+	if !strings.HasPrefix(link.String(),
+		"https://members.example.com/verify?") {
+		t.Errorf("Unexpected link %s", link)
+	}
+	if link.Query().Get("id") != "0123" {
+		t.Errorf("Expected the link to refer to 0123, got %s", link)
+	}
+	expires, err = strconv.ParseInt(link.Query().Get("expires"), 10, 64)
+	if err != nil {
+		t.Fatalf("Invalid expiry in %s: %s", link, err)
+	}
+	if expires != now.Add(48*time.Hour).Unix() {
+		t.Errorf("Expected the link to expire after 48 hours, got %s",
+			time.Unix(expires, 0).Sub(now))
+	}
+	token = link.Query().Get("token")
+
+	var tests = []struct {
+		name    string
+		id      string
+		email   string
+		expires int64
+		token   string
+		now     time.Time
+		code    codes.Code
+	}{
+		{"valid", "0123", "ada@example.com", expires, token, now, codes.OK},
+		{"last second", "0123", "ada@example.com", expires, token,
+			time.Unix(expires, 0), codes.OK},
+		{"expired", "0123", "ada@example.com", expires, token,
+			time.Unix(expires+1, 0), codes.DeadlineExceeded},
+		{"other application", "4567", "ada@example.com", expires, token,
+			now, codes.PermissionDenied},
+		{"other address", "0123", "mallory@example.com", expires, token,
+			now, codes.PermissionDenied},
+		{"extended", "0123", "ada@example.com", expires + 86400, token,
+			now, codes.PermissionDenied},
+		{"no token", "0123", "ada@example.com", expires, "", now,
+			codes.PermissionDenied},
+		{"other secret", "0123", "ada@example.com", expires,
+			(&EmailVerifier{secret: []byte("fedcba9876543210")}).sign(
+				"0123", "ada@example.com", expires), now,
+			codes.PermissionDenied},
+	}
+
+	for i = range tests {
+		var test = tests[i]
+
+		err = verifier.CheckToken(test.id, test.email, test.expires,
+			test.token, test.now)
+		if grpc.Code(err) != test.code {
+			t.Errorf("%s: expected %v, got %v", test.name, test.code, err)
+		}
+	}
+}
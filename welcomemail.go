@@ -11,12 +11,14 @@ import (
 )
 
 type WelcomeMail struct {
-	tmpl           *template.Template
+	// Mail templates by language.
+	tmpls          map[string]*template.Template
 	auth           smtp.Auth
 	smtpserveraddr string
 	from           string
         replyto        string
         subject        string
+        organisation   string
 }
 
 type welcomeTemplateData struct {
@@ -25,11 +27,13 @@ type welcomeTemplateData struct {
         ReplyTo         string
         Subject         string
         Date            string
+        Organisation    string
 }
 
 func NewWelcomeMail(config *config.WelcomeMailConfig) (*WelcomeMail, error) {
-	var tmpl *template.Template
+	var tmpls = make(map[string]*template.Template)
 	var auth smtp.Auth
+	var lang string
 	var err error
         var host string
 
@@ -42,33 +46,46 @@ func NewWelcomeMail(config *config.WelcomeMailConfig) (*WelcomeMail, error) {
                 auth = smtp.PlainAuth(config.GetIdentity(), config.GetUsername(),
                         config.GetPassword(), host)
         }
-	tmpl, err = template.ParseFiles(config.GetMailTemplatePath())
-	if err != nil {
-		return nil, err
+	// Translations of the template are named like form templates, e.g.
+	// welcomemail.en.txt.
+	for _, lang = range TranslatedLanguages(config.GetMailTemplatePath()) {
+		tmpls[lang], err = template.ParseFiles(
+			LocalizedFileName(config.GetMailTemplatePath(), lang))
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return &WelcomeMail{
-		tmpl:           tmpl,
+		tmpls:          tmpls,
 		auth:           auth,
 		smtpserveraddr: config.GetSmtpServerAddress(),
 		from:           config.GetFrom(),
                 replyto:        config.GetReplyTo(),
                 subject:        config.GetSubject(),
+                organisation:   config.GetOrganisationName(),
 	}, nil
 }
 
-// Sends a welcome  e-mail to the new member.
-func (w *WelcomeMail) SendMail(member *Member) error {
+// Sends a welcome  e-mail to the new member, in the language "lang" if
+// the template has been translated into it.
+func (w *WelcomeMail) SendMail(member *Member, lang string) error {
+	var tmpl *template.Template
+	var ok bool
 	var err error
 	var recepients []string
 	var messagebuffer = new(bytes.Buffer)
 
 	// Save message in messagebuffer
-        err = w.tmpl.Execute(messagebuffer, &welcomeTemplateData{
+	if tmpl, ok = w.tmpls[lang]; !ok {
+		tmpl = w.tmpls[DefaultLanguage]
+	}
+        err = tmpl.Execute(messagebuffer, &welcomeTemplateData{
                 Member: member,
                 From: w.from,
                 ReplyTo: w.replyto,
                 Subject: w.subject,
+                Organisation: w.organisation,
                 Date: time.Now().Format(time.RFC1123Z), // "Mon, 02 Jan 2006 15:04:05 -0700" // RFC1123 with numeric zone
         })
 	if err != nil {